@@ -1,28 +1,89 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"math"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/luma/pharos/protocol"
 	"go.uber.org/zap"
 )
 
+const (
+	// unixPrefix marks an address as the path of a Unix socket
+	unixPrefix = "unix:"
+)
+
+var (
+	// ErrServerUnresponsive is returned once we haven't heard from the server
+	// within the heartbeat timeout
+	ErrServerUnresponsive = errors.New("Server unresponsive")
+
+	// ErrDisconnected is returned once the connection to the server is closed
+	ErrDisconnected = errors.New("Disconnected from the server")
+)
+
 type Update struct {
 	Key   string
 	Value []byte
 }
 
+// Message is a message that was published to a channel that we've subscribed
+// to.
+type Message struct {
+	Channel string
+	Payload []byte
+}
+
 type Conn struct {
 	ctx context.Context
 
-	conn *net.TCPConn
+	// addr is what we last connected to, for Reconnect
+	addr string
+
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// readDone is closed when the read loop exits
+	readDone chan struct{}
+
+	// tlsConfig is used to connect over TLS if it's set
+	tlsConfig *tls.Config
+
+	// heartbeatTimeout is how long we'll wait to hear from the server before we
+	// consider it unresponsive, zero waits forever
+	heartbeatTimeout time.Duration
+
+	// token is sent with AUTH whenever we connect, if it's set
+	token string
+
+	// namespace is selected whenever we connect, if it's set
+	namespace string
 
 	updateChan chan *Update
 
+	// messageChan receives the messages published to our subscriptions
+	messageChan chan *Message
+
+	// goAway is closed when the server tells us it's shutting down
+	goAway     chan struct{}
+	goAwayOnce sync.Once
+
+	// done is closed when the connection fails, err says why
+	done     chan struct{}
+	err      error
+	failOnce sync.Once
+
 	respMu    sync.RWMutex
 	respChans map[protocol.RequestID]chan *protocol.Response
 
@@ -32,27 +93,137 @@ type Conn struct {
 	log *zap.Logger
 }
 
-func New(log *zap.Logger) *Conn {
-	return &Conn{
-		log:        log,
-		updateChan: make(chan *Update, 255),
-		respChans:  make(map[protocol.RequestID]chan *protocol.Response),
+// Option configures a Conn.
+type Option func(c *Conn)
+
+// WithTLSConfig connects to the server over TLS using config. To authenticate
+// with a client certificate, for mutual TLS, include it in config.Certificates.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Conn) {
+		c.tlsConfig = config
+	}
+}
+
+// WithHeartbeatTimeout fails the connection with ErrServerUnresponsive if we
+// don't receive anything from the server for timeout. Servers that send
+// heartbeats should use a timeout of a few heartbeat intervals.
+func WithHeartbeatTimeout(timeout time.Duration) Option {
+	return func(c *Conn) {
+		c.heartbeatTimeout = timeout
+	}
+}
+
+// WithToken authenticates with token whenever the connection is established,
+// by Connect or Reconnect.
+func WithToken(token string) Option {
+	return func(c *Conn) {
+		c.token = token
+	}
+}
+
+// WithNamespace selects namespace whenever the connection is established, by
+// Connect or Reconnect.
+func WithNamespace(namespace string) Option {
+	return func(c *Conn) {
+		c.namespace = namespace
+	}
+}
+
+func New(log *zap.Logger, opts ...Option) *Conn {
+	c := &Conn{
+		log:         log,
+		updateChan:  make(chan *Update, 255),
+		messageChan: make(chan *Message, 255),
+		goAway:      make(chan struct{}),
+		done:        make(chan struct{}),
+		respChans:   make(map[protocol.RequestID]chan *protocol.Response),
+	}
+
+	for _, opt := range opts {
+		opt(c)
 	}
+
+	return c
 }
 
+// Connect connects to the server at addr, which is either a TCP host:port or
+// the path of a Unix socket prefixed with "unix:".
+//
+// If the connection has a token it authenticates before returning, and fails
+// if the server doesn't accept it. Likewise for selecting its namespace.
 func (c *Conn) Connect(ctx context.Context, addr string) error {
 	c.ctx = ctx
+	c.addr = addr
+
+	dialer := &net.Dialer{}
+	network := "tcp"
+
+	if strings.HasPrefix(addr, unixPrefix) {
+		network = "unix"
+		addr = strings.TrimPrefix(addr, unixPrefix)
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+
+	if c.tlsConfig != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.tlsConfig}).DialContext(ctx, network, addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, addr)
+	}
 
-	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	c.conn = conn.(*net.TCPConn)
+	c.conn = conn
+	c.reader = bufio.NewReader(c.conn)
+	c.readDone = make(chan struct{})
+
+	go c.readLoop()
+
+	if c.token != "" {
+		if err := c.Auth(ctx, c.token); err != nil {
+			c.fail(ErrDisconnected)
+			<-c.readDone
+
+			return fmt.Errorf("Failed to authenticate %w", err)
+		}
+	}
+
+	if c.namespace != "" {
+		if err := c.Select(ctx, c.namespace); err != nil {
+			c.fail(ErrDisconnected)
+			<-c.readDone
+
+			return fmt.Errorf("Failed to select namespace %w", err)
+		}
+	}
 
 	return nil
 }
 
+// Reconnect closes the connection, if it's still open, and connects to the same
+// address again. It's used to recover once Done or GoAway are closed, which are
+// replaced by new channels for the new connection. It must not be called while
+// other requests are in flight.
+func (c *Conn) Reconnect(ctx context.Context) error {
+	if c.conn != nil {
+		c.fail(ErrDisconnected)
+		<-c.readDone
+	}
+
+	c.goAway = make(chan struct{})
+	c.goAwayOnce = sync.Once{}
+	c.done = make(chan struct{})
+	c.err = nil
+	c.failOnce = sync.Once{}
+
+	return c.Connect(ctx, c.addr)
+}
+
 func (c *Conn) Disconnect() error {
 	// TODO(rolly) mark us as disconnected and have all methods that make command requests return disconnected errors
 	// TODO(rolly) tell the read loop to terminate and wait until it does
@@ -64,6 +235,38 @@ func (c *Conn) UpdateChan() <-chan *Update {
 	return c.updateChan
 }
 
+// MessageChan returns the channel that messages published to the channels
+// we've subscribed to are delivered on. It must be read from once we've
+// subscribed, or the connection stops reading responses.
+func (c *Conn) MessageChan() <-chan *Message {
+	return c.messageChan
+}
+
+// GoAway returns a channel that is closed when the server announces that it's
+// shutting down. The server finishes responding to the requests it has already
+// received, but won't read any more, so clients should reconnect.
+func (c *Conn) GoAway() <-chan struct{} {
+	return c.goAway
+}
+
+// Done returns a channel that is closed when the connection fails, either
+// because it was closed or because the server stopped responding. Err returns
+// the reason.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection failed, or nil if it hasn't.
+func (c *Conn) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+
+	default:
+		return nil
+	}
+}
+
 func (c *Conn) Quit(ctx context.Context) error {
 	reqID, respChan := c.createResponseChan()
 	defer c.destroyResponseChan(reqID)
@@ -73,13 +276,22 @@ func (c *Conn) Quit(ctx context.Context) error {
 		return err
 	}
 
-	select {
-	case resp := <-respChan:
-		return resp.ErrorOrNil()
+	return c.await(ctx, respChan)
+}
 
-	case <-ctx.Done():
-		return ctx.Err()
+// Auth authenticates the connection with token. Servers that require
+// authentication refuse every other request, with protocol.ErrNoAuth, until
+// it's succeeded.
+func (c *Conn) Auth(ctx context.Context, token string) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, "AUTH "+token)
+	if err != nil {
+		return err
 	}
+
+	return c.await(ctx, respChan)
 }
 
 func (c *Conn) Ping(ctx context.Context) error {
@@ -91,35 +303,196 @@ func (c *Conn) Ping(ctx context.Context) error {
 		return err
 	}
 
-	select {
-	case resp := <-respChan:
-		return resp.ErrorOrNil()
+	return c.await(ctx, respChan)
+}
 
-	case <-ctx.Done():
-		return ctx.Err()
+func (c *Conn) Set(ctx context.Context, key string, value []byte) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteLines(c.conn, reqID, []byte("SET "+key), value)
+	if err != nil {
+		return err
 	}
+
+	return c.await(ctx, respChan)
 }
 
-func (c *Conn) Set(ctx context.Context, key string, value []byte) error {
+// Get returns the encoded value of key, which is empty if it isn't set.
+func (c *Conn) Get(ctx context.Context, key string) ([]byte, error) {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, "GET "+key)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.awaitResponse(ctx, respChan)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Value, nil
+}
+
+// SetEphemeral sets key, which is deleted by the server when this connection
+// closes. Setting it again with Set stops it from being deleted.
+func (c *Conn) SetEphemeral(ctx context.Context, key string, value []byte) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteLines(c.conn, reqID, []byte("SET "+key+" EPHEMERAL"), value)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// Select switches the connection to namespace. Servers respond with
+// protocol.ErrNoNamespace if it doesn't exist.
+func (c *Conn) Select(ctx context.Context, namespace string) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, "SELECT "+namespace)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// Delete deletes key, and everything nested beneath it.
+func (c *Conn) Delete(ctx context.Context, key string) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, "DEL "+key)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// Publish sends message to the subscribers of channel, without storing it.
+// message can't contain a newline.
+func (c *Conn) Publish(ctx context.Context, channel string, message []byte) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteLines(c.conn, reqID, []byte("PUBLISH "+channel), message)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// Subscribe asks the server to send us the messages that are published to
+// channel, which are delivered on MessageChan. Subscriptions don't survive
+// reconnecting.
+func (c *Conn) Subscribe(ctx context.Context, channel string) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, "SUBSCRIBE "+channel)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// Unsubscribe stops the server from sending us the messages that are published
+// to channel.
+func (c *Conn) Unsubscribe(ctx context.Context, channel string) error {
 	reqID, respChan := c.createResponseChan()
 	defer c.destroyResponseChan(reqID)
 
-	err := protocol.WriteLines(c.conn, reqID, protocol.PrefixSet, []byte(key), value)
+	err := protocol.WriteString(c.conn, reqID, "UNSUBSCRIBE "+channel)
 	if err != nil {
 		return err
 	}
 
+	return c.await(ctx, respChan)
+}
+
+// Watch asks the server to only send us the updates of path, rather than every
+// update. A write to path, beneath it or to one of its ancestors is delivered
+// on UpdateChan as an update of path. Watches don't survive reconnecting, or
+// selecting another namespace.
+func (c *Conn) Watch(ctx context.Context, path string) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, "WATCH "+path)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// Unwatch stops watching path. Once nothing is watched the server sends us
+// every update again.
+func (c *Conn) Unwatch(ctx context.Context, path string) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, "UNWATCH "+path)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// Coalesce asks the server to buffer updates for window before sending them,
+// collapsing multiple updates to the same key into the latest value. A zero
+// window disables coalescing.
+func (c *Conn) Coalesce(ctx context.Context, window time.Duration) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteString(c.conn, reqID, fmt.Sprintf("COALESCE %d", window.Milliseconds()))
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// await waits for the response to a request
+func (c *Conn) await(ctx context.Context, respChan <-chan *protocol.Response) error {
+	_, err := c.awaitResponse(ctx, respChan)
+	return err
+}
+
+// awaitResponse waits for the response to a request, for requests that respond
+// with more than OK
+func (c *Conn) awaitResponse(ctx context.Context, respChan <-chan *protocol.Response) (*protocol.Response, error) {
 	select {
 	case resp := <-respChan:
-		return resp.ErrorOrNil()
+		if err := resp.ErrorOrNil(); err != nil {
+			return nil, err
+		}
+
+		return resp, nil
+
+	case <-c.done:
+		return nil, c.err
 
 	case <-ctx.Done():
-		return ctx.Err()
+		return nil, ctx.Err()
 	}
 }
 
 func (c *Conn) readLoop() {
 	log := c.log.Named("readLoop")
+	defer close(c.readDone)
 
 	for {
 		select {
@@ -128,20 +501,60 @@ func (c *Conn) readLoop() {
 			return
 
 		default:
-			// TODO(rolly) probably want to SetDeadline on the reads...
+			if c.heartbeatTimeout > 0 {
+				if err := c.conn.SetReadDeadline(time.Now().Add(c.heartbeatTimeout)); err != nil {
+					log.Warn("Failed to set read deadline", zap.Error(err))
+				}
+			}
 
 			// Parse command responses and
-			resp, err := protocol.ReadResponse(c.conn)
+			resp, err := protocol.ReadResponse(c.reader)
 			if err != nil {
+				if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+					log.Info("Connection closed, exiting...")
+					c.fail(ErrDisconnected)
+					return
+				}
+
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					log.Warn("Server unresponsive, closing connection",
+						zap.Duration("heartbeatTimeout", c.heartbeatTimeout))
+					c.fail(ErrServerUnresponsive)
+					return
+				}
+
 				log.Warn("Failed to read server response", zap.Error(err))
 				continue
 			}
 
-			if resp.Type == protocol.RespUpdate {
+			switch resp.Type {
+			case protocol.RespUpdate:
 				// Handle responses that indicate keys were updated
-				c.updateChan <- &Update{
-					Key:   string(resp.Args[0].([]byte)),
-					Value: resp.Value,
+				c.sendUpdate(resp)
+				continue
+
+			case protocol.RespUpdateBatch:
+				for _, update := range resp.Args {
+					c.sendUpdate(update.(*protocol.Response))
+				}
+				continue
+
+			case protocol.RespMessage:
+				c.messageChan <- &Message{
+					Channel: string(resp.Args[0].([]byte)),
+					Payload: resp.Value,
+				}
+				continue
+
+			case protocol.RespGoAway:
+				log.Info("Server is going away")
+				c.goAwayOnce.Do(func() { close(c.goAway) })
+				continue
+
+			case protocol.RespHeartbeat:
+				if err := protocol.WriteString(c.conn, c.getNextRequestID(), string(protocol.HEARTBEAT)); err != nil {
+					log.Warn("Failed to answer heartbeat", zap.Error(err))
 				}
 				continue
 			}
@@ -152,6 +565,23 @@ func (c *Conn) readLoop() {
 	}
 }
 
+// fail records why the connection failed, wakes anything waiting on a response,
+// and closes the connection
+func (c *Conn) fail(err error) {
+	c.failOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *Conn) sendUpdate(resp *protocol.Response) {
+	c.updateChan <- &Update{
+		Key:   string(resp.Args[0].([]byte)),
+		Value: resp.Value,
+	}
+}
+
 func (c *Conn) createResponseChan() (protocol.RequestID, <-chan *protocol.Response) {
 	reqID := c.getNextRequestID()
 	respChan := make(chan *protocol.Response, 1)
@@ -163,44 +593,53 @@ func (c *Conn) createResponseChan() (protocol.RequestID, <-chan *protocol.Respon
 	return reqID, respChan
 }
 
+// sendToResponseChan delivers resp to whoever is waiting for the response to
+// reqID, if they still are. Response channels are never closed, a requester
+// that has given up just stops reading its channel, so the send is made under
+// respMu, and never blocks, rather than racing with destroyResponseChan.
 func (c *Conn) sendToResponseChan(reqID protocol.RequestID, resp *protocol.Response) {
 	c.respMu.Lock()
-	respChan, ok := c.respChans[reqID]
-	c.respMu.Unlock()
+	defer c.respMu.Unlock()
 
+	respChan, ok := c.respChans[reqID]
 	if !ok {
 		return
 	}
 
-	respChan <- resp
-	c.destroyResponseChan(reqID)
+	delete(c.respChans, reqID)
+
+	select {
+	case respChan <- resp:
+	default:
+	}
 }
 
 func (c *Conn) destroyResponseChan(reqID protocol.RequestID) {
 	c.respMu.Lock()
-	respChan, ok := c.respChans[reqID]
-	if ok {
-		close(respChan)
-		delete(c.respChans, reqID)
-	}
+	delete(c.respChans, reqID)
 	c.respMu.Unlock()
 }
 
 func (c *Conn) getNextRequestID() protocol.RequestID {
-	var requestID uint32
+	var reqID protocol.RequestID
 
 	c.idMu.Lock()
-	if c.requestId < math.MaxUint32-1 {
-		c.requestId += 1
-	} else {
-		// Wrap around instead of overflowing
-		c.requestId = 0
-	}
+	defer c.idMu.Unlock()
 
-	requestID = c.requestId
-	c.idMu.Unlock()
+	for {
+		if c.requestId < math.MaxUint32-1 {
+			c.requestId += 1
+		} else {
+			// Wrap around instead of overflowing
+			c.requestId = 0
+		}
 
-	var reqID protocol.RequestID
-	binary.LittleEndian.PutUint32(reqID[:], requestID)
-	return reqID
+		binary.LittleEndian.PutUint32(reqID[:], c.requestId)
+
+		// Responses that start with these would be mistaken for server pushes,
+		// and the server reads requests up to the first newline
+		if !protocol.IsPushPrefix(reqID[0]) && bytes.IndexByte(reqID[:], '\n') < 0 {
+			return reqID
+		}
+	}
 }
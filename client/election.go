@@ -0,0 +1,407 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/protocol"
+)
+
+const (
+	// MinElectionTTL is the shortest TTL that an Election can be held for
+	MinElectionTTL = 10 * time.Millisecond
+
+	// minReconnectBackoff is how long an Election waits before reconnecting
+	// the first time, it doubles with each attempt up to the election's TTL
+	minReconnectBackoff = 100 * time.Millisecond
+)
+
+// ErrElectionTTL is returned by NewElection when the TTL is shorter than
+// MinElectionTTL
+var ErrElectionTTL = errors.New("Election TTL is too short")
+
+// Leader is the candidate that's leading an election.
+type Leader struct {
+	// ID is what the leader campaigned as, it's empty while there's no leader
+	ID string
+
+	// Token is the fencing token of the leader's term, it's greater than the
+	// token of every term before it
+	Token uint64
+}
+
+// Election elects one leader from the candidates that campaign on the same
+// name. Being elected is holding the lock called name, so the server ensures
+// that there's only one leader at a time and that it stops being the leader
+// once its connection is lost.
+//
+// An Election needs a Conn of its own. It watches the leader through the
+// updates that the Conn receives, which it reads all of, and it reconnects the
+// Conn whenever it fails.
+type Election struct {
+	conn *Conn
+	name string
+	key  string
+	ttl  time.Duration
+	log  *zap.Logger
+
+	// connMu is held for reading while making requests, and for writing while
+	// reconnecting
+	connMu sync.RWMutex
+
+	mu sync.Mutex
+
+	// session is the current connection to the server
+	session *electionSession
+
+	// leader is the current leader, rank orders the states of the lock that
+	// it's from so that stale ones are ignored
+	leader Leader
+	rank   uint64
+
+	observers map[chan Leader]struct{}
+}
+
+// electionSession is a connection to the server, which is replaced when it
+// fails
+type electionSession struct {
+	// done is closed when the connection fails
+	done <-chan struct{}
+
+	// replaced is closed once the connection has been reconnected
+	replaced chan struct{}
+}
+
+// electionState is the state of an election's lock, as the server stores it
+type electionState struct {
+	Token   uint64 `json:"token"`
+	Expires int64  `json:"expires"`
+	Owner   string `json:"owner"`
+}
+
+// NewElection returns an election, for the candidates that campaign on name,
+// that's observed until ctx is done. conn must be connected and mustn't be used
+// for anything else. Leaders hold the election for ttl after each renewal, so
+// that's how long it takes for another candidate to be elected if a leader
+// stops responding. ttl must be at least MinElectionTTL.
+func NewElection(ctx context.Context, conn *Conn, name string, ttl time.Duration) (*Election, error) {
+	if ttl < MinElectionTTL {
+		return nil, ErrElectionTTL
+	}
+
+	e := &Election{
+		conn:      conn,
+		name:      name,
+		key:       protocol.LockPrefix + name,
+		ttl:       ttl,
+		log:       conn.log.Named("election"),
+		session:   &electionSession{done: conn.Done(), replaced: make(chan struct{})},
+		observers: make(map[chan Leader]struct{}),
+	}
+
+	go e.run(ctx)
+
+	return e, nil
+}
+
+// Campaign waits until the candidate called id is elected, and returns its
+// term. id can't contain whitespace. The term ends when ctx is done, in which
+// case the candidate resigns.
+//
+// If the connection is lost while campaigning the candidate carries on once
+// it's been reconnected.
+func (e *Election) Campaign(ctx context.Context, id string) (*Term, error) {
+	for {
+		session := e.currentSession()
+
+		var lock *Lock
+		err := e.withConn(func() (err error) {
+			lock, err = e.conn.LockAs(ctx, e.name, id, e.ttl, e.ttl)
+			return err
+		})
+
+		var respErr *protocol.Error
+
+		switch {
+		case err == nil:
+			return e.lead(ctx, lock, session), nil
+
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+
+		case errors.Is(err, protocol.ErrLocked):
+			// Someone else is still the leader
+			continue
+
+		case errors.As(err, &respErr):
+			return nil, fmt.Errorf("Failed to campaign %w", err)
+		}
+
+		// The connection was lost, campaign again once it's been replaced
+		select {
+		case <-session.replaced:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Leader returns the current leader.
+func (e *Election) Leader() Leader {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader
+}
+
+// Observe returns a channel that receives the current leader, and then each new
+// one. Receivers that fall behind only receive the latest leader. The channel is
+// closed once ctx is done.
+func (e *Election) Observe(ctx context.Context) <-chan Leader {
+	observer := make(chan Leader, 1)
+
+	e.mu.Lock()
+	e.observers[observer] = struct{}{}
+	observer <- e.leader
+	e.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		e.mu.Lock()
+		delete(e.observers, observer)
+		close(observer)
+		e.mu.Unlock()
+	}()
+
+	return observer
+}
+
+// run watches the leader, and reconnects whenever the connection fails
+func (e *Election) run(ctx context.Context) {
+	e.refresh(ctx)
+
+	for {
+		session := e.currentSession()
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case update := <-e.conn.UpdateChan():
+			if update.Key == e.key {
+				e.setLeader(update.Value, false)
+			}
+
+		case <-session.done:
+			if !e.reconnect(ctx, session) {
+				return
+			}
+
+			e.refresh(ctx)
+		}
+	}
+}
+
+// refresh reads the current leader, which is used as is rather than ordered
+// after the previous one as the server may have restarted
+func (e *Election) refresh(ctx context.Context) {
+	var value []byte
+	err := e.withConn(func() (err error) {
+		value, err = e.conn.Get(ctx, e.key)
+		return err
+	})
+
+	if err != nil {
+		e.log.Warn("Failed to read leader", zap.String("election", e.name), zap.Error(err))
+		return
+	}
+
+	e.setLeader(value, true)
+}
+
+// reconnect reconnects until it succeeds or ctx is done, in which case it
+// returns false
+func (e *Election) reconnect(ctx context.Context, session *electionSession) bool {
+	backoff := minReconnectBackoff
+
+	for {
+		e.connMu.Lock()
+		err := e.conn.Reconnect(ctx)
+		done := e.conn.Done()
+		e.connMu.Unlock()
+
+		if err == nil {
+			e.mu.Lock()
+			e.session = &electionSession{done: done, replaced: make(chan struct{})}
+			e.mu.Unlock()
+
+			close(session.replaced)
+			return true
+		}
+
+		e.log.Warn("Failed to reconnect", zap.String("election", e.name), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return false
+
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > e.ttl {
+			backoff = e.ttl
+		}
+	}
+}
+
+// setLeader changes the leader to the one in value, which is the state of the
+// election's lock. Unless force is set, states that are older than the current
+// one are ignored.
+func (e *Election) setLeader(value []byte, force bool) {
+	var state electionState
+	if len(value) > 0 {
+		if err := json.Unmarshal(value, &state); err != nil {
+			e.log.Warn("Failed to parse leader", zap.String("election", e.name), zap.Error(err))
+			return
+		}
+	}
+
+	// A lock is acquired, and then released, with each token
+	rank := state.Token * 2
+	if state.Expires == 0 {
+		rank++
+	}
+
+	leader := Leader{ID: state.Owner, Token: state.Token}
+	if state.Expires == 0 {
+		leader = Leader{}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !force && rank < e.rank {
+		return
+	}
+
+	e.rank = rank
+
+	if leader == e.leader {
+		return
+	}
+
+	e.leader = leader
+
+	for observer := range e.observers {
+		// Replace anything that hasn't been received yet
+		select {
+		case <-observer:
+		default:
+		}
+
+		observer <- leader
+	}
+}
+
+// lead keeps the election's lock until ctx is done, or it can't be renewed
+func (e *Election) lead(ctx context.Context, lock *Lock, session *electionSession) *Term {
+	ctx, cancel := context.WithCancel(ctx)
+
+	term := &Term{
+		Leader: Leader{ID: lock.Owner, Token: lock.Token},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(term.done)
+
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-session.done:
+				// The server releases the lock once it notices that the connection
+				// has gone
+				return
+
+			case <-ctx.Done():
+				e.resign(lock)
+				return
+
+			case <-ticker.C:
+				err := e.withConn(func() error { return lock.Renew(ctx) })
+				if err != nil && ctx.Err() == nil {
+					e.log.Warn("Lost leadership", zap.String("election", e.name), zap.Error(err))
+					return
+				}
+			}
+		}
+	}()
+
+	return term
+}
+
+// resign releases the election's lock, so that another candidate can be elected
+// without waiting for it to expire
+func (e *Election) resign(lock *Lock) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl)
+	defer cancel()
+
+	err := e.withConn(func() error { return lock.Unlock(ctx) })
+	if err != nil && !errors.Is(err, protocol.ErrNotLocked) {
+		e.log.Warn("Failed to resign", zap.String("election", e.name), zap.Error(err))
+	}
+}
+
+func (e *Election) currentSession() *electionSession {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.session
+}
+
+// withConn makes requests with f, once the connection isn't being replaced
+func (e *Election) withConn(f func() error) error {
+	e.connMu.RLock()
+	defer e.connMu.RUnlock()
+
+	return f()
+}
+
+// Term is a candidate's time as the leader of an election. It ends when the
+// candidate resigns, or when its leadership is lost because the election
+// couldn't be renewed, e.g. as the connection failed.
+type Term struct {
+	Leader
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Done returns a channel that's closed once the term has ended.
+func (t *Term) Done() <-chan struct{} {
+	return t.done
+}
+
+// Resign ends the term, so that another candidate can be elected straight away.
+// It waits until the term has ended, or ctx is done.
+func (t *Term) Resign(ctx context.Context) error {
+	t.cancel()
+
+	select {
+	case <-t.done:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
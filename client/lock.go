@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/luma/pharos/protocol"
+)
+
+// Lock is a lock that's held by a Conn. It's held until it's unlocked, its TTL
+// passes without it being renewed, or the Conn disconnects.
+type Lock struct {
+	Name string
+
+	// Owner is who the lock was acquired for, if anyone
+	Owner string
+
+	// Token is the fencing token that the lock was acquired with, it's greater
+	// than any token that the lock was acquired with before. Pass it along with
+	// the writes that the lock protects so that they can be refused once the
+	// lock has been lost.
+	Token uint64
+
+	// TTL is how long the lock is held for after it's acquired or renewed
+	TTL time.Duration
+
+	conn *Conn
+}
+
+// Lock acquires the lock called name for ttl. If it's held by someone else the
+// server waits up to wait for it to be released, once that's passed, or
+// straight away if wait is zero, it fails with protocol.ErrLocked.
+func (c *Conn) Lock(ctx context.Context, name string, ttl, wait time.Duration) (*Lock, error) {
+	return c.LockAs(ctx, name, "", ttl, wait)
+}
+
+// LockAs acquires the lock called name for owner, which is stored with the lock
+// while it's held so that anyone watching it can tell who holds it. It can't
+// contain whitespace. Otherwise it's the same as Lock.
+func (c *Conn) LockAs(ctx context.Context, name, owner string, ttl, wait time.Duration) (*Lock, error) {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	req := "LOCK " + name + " TTL " + formatSeconds(ttl)
+	if wait > 0 {
+		req += " WAIT " + formatSeconds(wait)
+	}
+
+	if owner != "" {
+		req += " OWNER " + owner
+	}
+
+	if err := protocol.WriteString(c.conn, reqID, req); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.awaitResponse(ctx, respChan)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Type != protocol.RespLock {
+		return nil, fmt.Errorf("Unexpected response to LOCK: %s", resp.Type)
+	}
+
+	return &Lock{Name: name, Owner: owner, Token: resp.Args[0].(uint64), TTL: ttl, conn: c}, nil
+}
+
+// Renew extends the lock by its TTL. It fails with protocol.ErrNotLocked if the
+// lock has already expired.
+func (l *Lock) Renew(ctx context.Context) error {
+	return l.send(ctx, "RENEW")
+}
+
+// Unlock releases the lock. It fails with protocol.ErrNotLocked if the lock has
+// already expired.
+func (l *Lock) Unlock(ctx context.Context) error {
+	return l.send(ctx, "UNLOCK")
+}
+
+// KeepAlive renews the lock a few times per TTL until ctx is done, so that it's
+// held for as long as the caller needs it. It returns nil once ctx is done, or
+// the error that a renewal failed with, in which case the lock may have been
+// lost.
+func (l *Lock) KeepAlive(ctx context.Context) error {
+	ticker := time.NewTicker(l.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			if err := l.Renew(ctx); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				return fmt.Errorf("Failed to renew lock %w", err)
+			}
+		}
+	}
+}
+
+func (l *Lock) send(ctx context.Context, command string) error {
+	reqID, respChan := l.conn.createResponseChan()
+	defer l.conn.destroyResponseChan(reqID)
+
+	req := command + " " + l.Name + " " + strconv.FormatUint(l.Token, 10)
+	if err := protocol.WriteString(l.conn.conn, reqID, req); err != nil {
+		return err
+	}
+
+	return l.conn.await(ctx, respChan)
+}
+
+// formatSeconds formats d as a number of seconds, as the lock commands expect
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
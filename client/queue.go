@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/luma/pharos/protocol"
+)
+
+// Item is an item that was taken from a queue. It's hidden from everyone else
+// until it's acknowledged, or its visibility timeout passes, in which case it's
+// returned to the front of the queue.
+type Item struct {
+	Queue string
+
+	// ID is what the item is acknowledged with, it changes each time the item
+	// is returned to the queue
+	ID uint64
+
+	Value []byte
+
+	conn *Conn
+}
+
+// LPush adds item to the front of queue. item can't contain a newline.
+func (c *Conn) LPush(ctx context.Context, queue string, item []byte) error {
+	return c.push(ctx, "LPUSH", queue, item)
+}
+
+// RPush adds item to the back of queue. item can't contain a newline.
+func (c *Conn) RPush(ctx context.Context, queue string, item []byte) error {
+	return c.push(ctx, "RPUSH", queue, item)
+}
+
+func (c *Conn) push(ctx context.Context, command, queue string, item []byte) error {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	err := protocol.WriteLines(c.conn, reqID, []byte(command+" "+queue), item)
+	if err != nil {
+		return err
+	}
+
+	return c.await(ctx, respChan)
+}
+
+// BLPop takes the item at the front of queue. If the queue is empty the server
+// waits up to timeout for an item, or until there is one if timeout is zero,
+// and then fails with protocol.ErrEmpty. The item is hidden for visibility, or
+// protocol.DefaultVisibility if it's zero, and should be acknowledged with Ack
+// before then.
+//
+// If ctx is done first an item may still be taken, it's returned to the queue
+// once its visibility timeout passes.
+func (c *Conn) BLPop(ctx context.Context, queue string, timeout, visibility time.Duration) (*Item, error) {
+	reqID, respChan := c.createResponseChan()
+	defer c.destroyResponseChan(reqID)
+
+	req := "BLPOP " + queue + " " + formatSeconds(timeout)
+	if visibility > 0 {
+		req += " VISIBILITY " + formatSeconds(visibility)
+	}
+
+	if err := protocol.WriteString(c.conn, reqID, req); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.awaitResponse(ctx, respChan)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Type != protocol.RespPop {
+		return nil, fmt.Errorf("Unexpected response to BLPOP: %s", resp.Type)
+	}
+
+	return &Item{Queue: queue, ID: resp.Args[0].(uint64), Value: resp.Value, conn: c}, nil
+}
+
+// Ack acknowledges the item, so that it's removed from the queue for good. It
+// fails with protocol.ErrNotPending if the item's visibility timeout has
+// already passed.
+func (i *Item) Ack(ctx context.Context) error {
+	reqID, respChan := i.conn.createResponseChan()
+	defer i.conn.destroyResponseChan(reqID)
+
+	req := "ACK " + i.Queue + " " + strconv.FormatUint(i.ID, 10)
+	if err := protocol.WriteString(i.conn.conn, reqID, req); err != nil {
+		return err
+	}
+
+	return i.conn.await(ctx, respChan)
+}
@@ -30,4 +30,5 @@ func Execute() {
 func init() {
 	rootCmd.AddCommand(gen.RootCmd)
 	rootCmd.AddCommand(StartCmd)
+	rootCmd.AddCommand(UpgradeCmd)
 }
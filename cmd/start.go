@@ -3,10 +3,13 @@ package cmd
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,6 +19,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/luma/pharos/internal/env"
+	"github.com/luma/pharos/internal/upgrade"
 	"github.com/luma/pharos/storage"
 	"github.com/luma/pharos/transport"
 )
@@ -29,6 +33,54 @@ var (
 
 	// The port to listen for tcp clients on
 	port int
+
+	// Whether to serve clients from epoll event loops rather than goroutines
+	eventLoop bool
+
+	// Where to write our process ID, for `pharos upgrade`
+	pidFile string
+
+	// TLS certificate, key, and client CA bundle for client connections
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	// Unix sockets to serve clients on, and their permissions
+	unixSockets     []string
+	unixSocketMode  string
+	unixSocketUser  string
+	unixSocketGroup string
+
+	// How often to send clients heartbeats, and how long they can be silent for
+	heartbeatInterval time.Duration
+	idleTimeout       time.Duration
+
+	// Connection caps, and per connection rate limits
+	maxConns      int
+	maxConnsPerIP int
+	requestRate   float64
+	writeRate     float64
+
+	// Whether client connections start with a PROXY protocol header: off,
+	// optional, or strict
+	proxyProtocol string
+
+	// How long a request can take, how many a connection can run at once, and
+	// how many goroutines each event loop runs them on
+	requestTimeout        time.Duration
+	maxConcurrentRequests int
+	eventLoopWorkers      int
+
+	// Files of the tokens that clients can AUTH with, in plain text or as
+	// SHA-256 digests
+	authTokenFile       string
+	authHashedTokenFile string
+	aclFile             string
+
+	// Namespaces to create in addition to the default one, and how many writes
+	// per second each of them can take
+	namespaces         []string
+	namespaceWriteRate float64
 )
 
 func init() {
@@ -37,6 +89,30 @@ func init() {
 	flags.IntVarP(&port, "port", "p", 7363, "The port to listen client connections on")
 	flags.StringVar(&httpPort, "http-port", "7362", "The port to listen to HTTP requests on")
 	flags.StringVarP(&host, "host", "a", "0.0.0.0", "The host to listen on")
+	flags.BoolVar(&eventLoop, "event-loop", false, "Serve client connections from epoll event loops instead of a goroutine per connection")
+	flags.StringVar(&pidFile, "pid-file", "", "Where to write the process ID, required to upgrade with `pharos upgrade`")
+	flags.StringVar(&tlsCert, "tls-cert", "", "PEM encoded certificate to serve client connections over TLS with")
+	flags.StringVar(&tlsKey, "tls-key", "", "PEM encoded private key for --tls-cert")
+	flags.StringVar(&tlsClientCA, "tls-client-ca", "", "PEM encoded CA bundle, clients must present a certificate signed by one of them")
+	flags.StringSliceVar(&unixSockets, "unix-socket", nil, "Also serve client connections on this unix socket, can be repeated")
+	flags.StringVar(&unixSocketMode, "unix-socket-mode", "0660", "File mode of the unix sockets, in octal")
+	flags.StringVar(&unixSocketUser, "unix-socket-user", "", "User, name or ID, that owns the unix sockets")
+	flags.StringVar(&unixSocketGroup, "unix-socket-group", "", "Group, name or ID, that owns the unix sockets")
+	flags.DurationVar(&heartbeatInterval, "heartbeat-interval", 0, "How often to send clients heartbeats, which they must answer. 0 disables heartbeats")
+	flags.IntVar(&maxConns, "max-conns", 0, "Most client connections that can be open at once. 0 is unlimited")
+	flags.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "Most client connections that can be open from a single IP. 0 is unlimited")
+	flags.Float64Var(&requestRate, "request-rate", 0, "Most requests per second for each client connection. 0 is unlimited")
+	flags.Float64Var(&writeRate, "write-rate", 0, "Most SETs per second for each client connection. 0 is unlimited")
+	flags.StringVar(&proxyProtocol, "proxy-protocol", "off", "Whether client connections start with a PROXY protocol header from a load balancer: off, optional, or strict")
+	flags.DurationVar(&idleTimeout, "idle-timeout", 0, "Close client connections that are silent for this long. Defaults to 3 heartbeat intervals when heartbeats are enabled")
+	flags.DurationVar(&requestTimeout, "request-timeout", transport.DefaultRequestTimeout, "How long a GET or SET can take before it fails")
+	flags.StringVar(&authTokenFile, "auth-token-file", "", "File of tokens that clients can AUTH with, one per line optionally preceded by a name. Setting it requires clients to authenticate")
+	flags.StringVar(&authHashedTokenFile, "auth-hashed-token-file", "", "Like --auth-token-file, but each token is a hex encoded SHA-256 digest")
+	flags.StringVar(&aclFile, "acl-file", "", "JSON policy of the paths that each token's principal can read, write and subscribe to. Requires auth tokens")
+	flags.StringSliceVar(&namespaces, "namespace", nil, "Create a namespace, that clients can SELECT, in addition to the default one. Can be repeated")
+	flags.Float64Var(&namespaceWriteRate, "namespace-write-rate", 0, "Most SETs per second for each namespace, across all client connections. 0 is unlimited")
+	flags.IntVar(&maxConcurrentRequests, "max-concurrent-requests", transport.DefaultMaxConcurrentRequests, "Most requests for different keys that a client connection can run at once")
+	flags.IntVar(&eventLoopWorkers, "event-loop-workers", transport.DefaultEventLoopWorkers, "How many goroutines each event loop runs requests on, with --event-loop")
 }
 
 var StartCmd = &cobra.Command{
@@ -47,6 +123,15 @@ var StartCmd = &cobra.Command{
 Usage
 	pharos start
 
+Sending the process SIGUSR2, or running 'pharos upgrade', starts a new copy of
+the binary which takes over the listening sockets. Once the new process is
+ready the old one drains its connections and exits.
+
+Sending the process SIGHUP reloads the TLS certificates and the ACL policy.
+
+Each --namespace is a separate document, with its own keys and updates, that
+clients can switch to with SELECT. Clients start in the default namespace.
+
 `,
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		ctx, signalStop := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
@@ -69,6 +154,76 @@ Usage
 			return err
 		}
 
+		upgrader, err := upgrade.New(upgrade.Options{PIDFile: pidFile}, log.Named("upgrade"))
+		if err != nil {
+			return err
+		}
+
+		defer upgrader.Close()
+
+		var tlsOptions *transport.TLSOptions
+		if tlsCert != "" || tlsKey != "" {
+			tlsOptions = &transport.TLSOptions{
+				CertFile:     tlsCert,
+				KeyFile:      tlsKey,
+				ClientCAFile: tlsClientCA,
+			}
+		}
+
+		sockets, err := unixSocketOptions()
+		if err != nil {
+			return err
+		}
+
+		proxyMode, err := proxyProtocolMode()
+		if err != nil {
+			return err
+		}
+
+		auth, err := authTokens(conf)
+		if err != nil {
+			return err
+		}
+
+		var acl *transport.ACL
+		if aclFile != "" {
+			if acl, err = transport.LoadACL(aclFile); err != nil {
+				return err
+			}
+		}
+
+		stores := storage.NewNamespaces(storage.NewInmemoryStore())
+		for _, name := range namespaces {
+			if _, err := stores.Create(name); err != nil {
+				return err
+			}
+		}
+
+		tcp := transport.NewTCP(transport.Options{
+			Host:                  host,
+			Port:                  port,
+			Reuseport:             true,
+			UseStdlib:             !eventLoop,
+			ListenFunc:            upgrader.Listen,
+			TLS:                   tlsOptions,
+			UnixSockets:           sockets,
+			HeartbeatInterval:     heartbeatInterval,
+			IdleTimeout:           idleTimeout,
+			MaxConns:              maxConns,
+			MaxConnsPerIP:         maxConnsPerIP,
+			RequestRate:           requestRate,
+			WriteRate:             writeRate,
+			ProxyProtocol:         proxyMode,
+			Auth:                  auth,
+			ACL:                   acl,
+			RequestTimeout:        requestTimeout,
+			MaxConcurrentRequests: maxConcurrentRequests,
+			EventLoopWorkers:      eventLoopWorkers,
+			Namespaces:            stores,
+			NamespaceWriteRate:    namespaceWriteRate,
+			Log:                   log.Named("transport"),
+		})
+
 		router := setupRouter(conf.DebugHTTP, log)
 
 		// Ping test
@@ -76,28 +231,40 @@ Usage
 			c.String(http.StatusOK, "pong")
 		})
 
+		// Reports how many of the TCP listeners are serving, it fails if any of them
+		// have failed and haven't been restarted yet
+		router.GET("/health", func(c *gin.Context) {
+			health := tcp.Health()
+
+			status := http.StatusOK
+			if !health.Healthy() {
+				status = http.StatusServiceUnavailable
+			}
+
+			c.JSON(status, health)
+		})
+
 		s := &http.Server{
 			Addr:    net.JoinHostPort(host, httpPort),
 			Handler: router,
 		}
 
+		httpListener, err := upgrader.Listen("tcp", s.Addr)
+		if err != nil {
+			return err
+		}
+
 		// Initializing the server in a goroutine so that
 		// it won't block the graceful shutdown handling below
 		go func() {
-			if err := s.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if err := s.Serve(httpListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				log.Error("Http server errored", zap.Error(err))
 			}
 		}()
 
-		tcp := transport.NewTCP(transport.Options{
-			Host:      host,
-			Port:      port,
-			Reuseport: true,
-			Store:     storage.NewInmemoryStore(),
-			Log:       log.Named("transport"),
-		})
-
-		if err := tcp.Start(ctx); err != nil {
+		// The TCP server isn't started with the signal context, cancelling that would
+		// close every connection immediately. It's shutdown gracefully below instead.
+		if err := tcp.Start(context.Background()); err != nil {
 			return err
 		}
 
@@ -107,15 +274,62 @@ Usage
 			zap.Int("port", port),
 			zap.String("httpPort", httpPort))
 
-		// Listen for the interrupt signal.
-		<-ctx.Done()
+		// Let the process that we're replacing know that it can exit, if there is one
+		if err := upgrader.Ready(); err != nil {
+			return err
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR2, syscall.SIGHUP)
+
+		defer func() {
+			signal.Stop(signals)
+			close(signals)
+		}()
+
+		go func() {
+			for sig := range signals {
+				switch sig {
+				case syscall.SIGUSR2:
+					log.Info("Upgrading")
+
+					if err := upgrader.Upgrade(); err != nil {
+						log.Error("Upgrade failed", zap.Error(err))
+					}
+
+				case syscall.SIGHUP:
+					if tlsOptions != nil {
+						log.Info("Reloading TLS certificates")
+
+						if err := tcp.ReloadTLS(); err != nil {
+							log.Error("Failed to reload TLS certificates", zap.Error(err))
+						}
+					}
+
+					if acl != nil {
+						log.Info("Reloading ACL policy")
+
+						if err := acl.Reload(); err != nil {
+							log.Error("Failed to reload ACL policy, keeping the current one", zap.Error(err))
+						}
+					}
+				}
+			}
+		}()
+
+		// Listen for the interrupt signal, or for a new process to take over
+		select {
+		case <-ctx.Done():
+		case <-upgrader.Exit():
+			log.Info("Upgraded, the new process has taken over our listeners")
+		}
 
 		// Restore default behavior on the interrupt signal and notify user of shutdown.
 		signalStop()
 		log.Info("Shutting down gracefully, press Ctrl+C again to force")
 
-		// The context is used to inform the server it has 5 seconds to finish
-		// the request it is currently handling
+		// The context is used to inform the servers they have 5 seconds to finish
+		// the requests they are currently handling, and to drain their connections
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
@@ -125,7 +339,7 @@ Usage
 			log.Error("Http server forced to shutdown", zap.Error(err))
 		}
 
-		if err := tcp.Close(); err != nil {
+		if err := tcp.Shutdown(ctx); err != nil {
 			log.Error("TCP server forced to shutdown", zap.Error(err))
 		}
 
@@ -134,6 +348,73 @@ Usage
 	},
 }
 
+// unixSocketOptions returns the unix sockets from our flags
+func unixSocketOptions() ([]transport.UnixSocket, error) {
+	mode, err := strconv.ParseUint(unixSocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid unix socket mode %w", err)
+	}
+
+	sockets := make([]transport.UnixSocket, 0, len(unixSockets))
+
+	for _, path := range unixSockets {
+		sockets = append(sockets, transport.UnixSocket{
+			Path:  strings.TrimPrefix(path, "unix:"),
+			Mode:  os.FileMode(mode),
+			User:  unixSocketUser,
+			Group: unixSocketGroup,
+		})
+	}
+
+	return sockets, nil
+}
+
+// proxyProtocolMode returns the PROXY protocol mode from our flags
+func proxyProtocolMode() (transport.ProxyProtocolMode, error) {
+	switch proxyProtocol {
+	case "", "off":
+		return transport.ProxyProtocolDisabled, nil
+
+	case "optional":
+		return transport.ProxyProtocolOptional, nil
+
+	case "strict":
+		return transport.ProxyProtocolStrict, nil
+
+	default:
+		return transport.ProxyProtocolDisabled, fmt.Errorf("Invalid PROXY protocol mode %s, it must be off, optional, or strict", proxyProtocol)
+	}
+}
+
+// authTokens returns the tokens that clients can AUTH with, from our flags and
+// PHAROS_AUTH_TOKEN. It returns nil if there aren't any, so that clients don't
+// have to authenticate.
+func authTokens(conf *env.Config) (transport.TokenSource, error) {
+	tokens := transport.NewTokens()
+
+	if conf.AuthToken != "" {
+		tokens.Add(transport.DefaultPrincipal, conf.AuthToken)
+	}
+
+	if authTokenFile != "" {
+		if err := tokens.LoadFile(authTokenFile, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if authHashedTokenFile != "" {
+		if err := tokens.LoadFile(authHashedTokenFile, true); err != nil {
+			return nil, err
+		}
+	}
+
+	if tokens.Len() == 0 {
+		return nil, nil
+	}
+
+	return tokens, nil
+}
+
 func setupRouter(debugHTTP bool, log *zap.Logger) *gin.Engine {
 	gin.DisableConsoleColor()
 	if !debugHTTP {
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/luma/pharos/internal/upgrade"
+)
+
+var (
+	// The PID file of the process to upgrade
+	upgradePIDFile string
+)
+
+func init() {
+	flags := UpgradeCmd.PersistentFlags()
+
+	flags.StringVar(&upgradePIDFile, "pid-file", "", "The PID file of the process to upgrade, as passed to `pharos start --pid-file`")
+	UpgradeCmd.MarkPersistentFlagRequired("pid-file")
+}
+
+var UpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Replace a running Pharos API service with the current binary",
+	Long: `Replace a running Pharos API service with the current binary
+
+The running process is sent SIGUSR2, which causes it to start a new copy of its
+executable and hand over its listening sockets. Replace the binary on disk
+before upgrading.
+
+Usage
+	pharos upgrade --pid-file /var/run/pharos.pid
+
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pid, err := upgrade.ReadPIDFile(upgradePIDFile)
+		if err != nil {
+			return err
+		}
+
+		if err := syscall.Kill(pid, syscall.SIGUSR2); err != nil {
+			return fmt.Errorf("Failed to signal process %d %w", pid, err)
+		}
+
+		fmt.Printf("Asked process %d to upgrade\n", pid)
+		return nil
+	},
+}
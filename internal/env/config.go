@@ -11,6 +11,10 @@ import (
 type Config struct {
 	Region    string `env:"PHAROS_REGION"`
 	DebugHTTP bool   `env:"PHAROS_DEBUG_HTTP"`
+
+	// AuthToken is a token that clients can AUTH with, setting it requires
+	// clients to authenticate
+	AuthToken string `env:"PHAROS_AUTH_TOKEN"`
 }
 
 func LoadConfig(ctx context.Context) (*Config, error) {
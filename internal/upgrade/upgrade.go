@@ -0,0 +1,468 @@
+// Package upgrade allows a running process to be replaced by a new binary
+// without refusing any connections, by handing its listening sockets to the
+// new process.
+//
+// An upgrade goes like this:
+//
+//  1. The running process (the parent) calls Upgrade, usually on SIGUSR2.
+//  2. The parent execs its own executable with the same arguments, passing its
+//     listening sockets and the write end of a readiness pipe as extra files.
+//  3. The new process (the child) calls Listen as usual, but instead of binding
+//     new sockets it's handed the ones it inherited. Once it's serving it calls
+//     Ready.
+//  4. Exit is closed in the parent, which should then gracefully drain its own
+//     connections and exit. Connections that arrive in the meantime are queued
+//     on the shared sockets for the child to accept.
+//
+// See https://blog.cloudflare.com/graceful-upgrades-in-go/
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	reuseport "github.com/kavu/go_reuseport"
+	"go.uber.org/zap"
+)
+
+const (
+	// envListeners lists the network and address of each socket the child
+	// inherited, in the order of their file descriptors
+	envListeners = "PHAROS_UPGRADE_LISTENERS"
+
+	// envReadyFd is the file descriptor of the readiness pipe
+	envReadyFd = "PHAROS_UPGRADE_READY_FD"
+
+	// firstInheritedFd is the file descriptor of the first of exec.Cmd.ExtraFiles
+	firstInheritedFd = 3
+
+	// DefaultReadyTimeout is the default for Options.ReadyTimeout
+	DefaultReadyTimeout = time.Minute
+)
+
+var (
+	ErrUpgradeInProgress = errors.New("An upgrade is already in progress")
+	ErrUpgradeComplete   = errors.New("This process has already been upgraded")
+	ErrNotReady          = errors.New("This process can't be upgraded until it is ready")
+	ErrReadyTimeout      = errors.New("Timed out waiting for the new process to be ready")
+)
+
+type Options struct {
+	// PIDFile is where the process ID is written once the process is ready, so
+	// that the process to signal for the next upgrade can be found. No file is
+	// written if it's empty.
+	PIDFile string
+
+	// ReadyTimeout is how long to wait for the new process to call Ready before
+	// killing it. Defaults to DefaultReadyTimeout.
+	ReadyTimeout time.Duration
+}
+
+// Upgrader creates listening sockets, and hands them over to a new process
+// when asked to upgrade.
+type Upgrader struct {
+	options Options
+
+	// mu guards the fields below
+	mu sync.Mutex
+
+	// inherited holds the sockets that we were handed by our parent that
+	// haven't been claimed by Listen yet, keyed by network and address
+	inherited map[string][]*os.File
+
+	// listeners are the sockets we'd hand to a child if we were upgraded
+	listeners []*listener
+
+	// readyFile is the write end of our parent's readiness pipe, it's nil once
+	// we're ready or if we weren't started by an upgrade.
+	readyFile *os.File
+
+	upgrading bool
+	exit      chan struct{}
+	exitOnce  sync.Once
+
+	log *zap.Logger
+}
+
+// New returns an Upgrader. If the process was started by an upgrade then it
+// claims the sockets that were inherited from the parent process.
+func New(options Options, log *zap.Logger) (*Upgrader, error) {
+	if options.ReadyTimeout <= 0 {
+		options.ReadyTimeout = DefaultReadyTimeout
+	}
+
+	u := &Upgrader{
+		options:   options,
+		inherited: make(map[string][]*os.File),
+		exit:      make(chan struct{}),
+		log:       log,
+	}
+
+	if err := u.inherit(); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Listen returns a listener for addr. If a socket for addr was inherited from
+// our parent process then it's used, otherwise a new socket is bound. TCP
+// sockets are bound with SO_REUSEPORT. It has the signature of
+// transport.Options.ListenFunc.
+func (u *Upgrader) Listen(network, addr string) (net.Listener, error) {
+	key := listenerKey(network, addr)
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var (
+		ln   net.Listener
+		file *os.File
+		err  error
+	)
+
+	if files := u.inherited[key]; len(files) > 0 {
+		file = files[0]
+		u.inherited[key] = files[1:]
+
+		if ln, err = net.FileListener(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Failed to use inherited listener for %s %w", key, err)
+		}
+
+		u.log.Info("Using inherited listener", zap.String("addr", key))
+	} else {
+		if ln, err = bind(network, addr); err != nil {
+			return nil, err
+		}
+
+		if file, err = listenerFile(ln); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	l := &listener{Listener: ln, key: key, file: file, upgrader: u}
+	u.listeners = append(u.listeners, l)
+
+	return l, nil
+}
+
+// Ready tells our parent process, if we have one, that we're serving and that
+// it can exit. The PID file is updated to point to this process.
+func (u *Upgrader) Ready() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.options.PIDFile != "" {
+		if err := writePIDFile(u.options.PIDFile); err != nil {
+			return err
+		}
+	}
+
+	if u.readyFile == nil {
+		return nil
+	}
+
+	_, err := u.readyFile.Write([]byte{1})
+	u.readyFile.Close()
+	u.readyFile = nil
+
+	if err != nil {
+		return fmt.Errorf("Failed to notify parent process %w", err)
+	}
+
+	return nil
+}
+
+// Upgrade starts a new copy of the current executable and hands it our
+// listening sockets. It returns once the new process is ready, at which point
+// Exit is closed and the caller should drain its connections and exit.
+//
+// If the new process fails to become ready within Options.ReadyTimeout, or
+// exits first, then an error is returned and this process carries on as it
+// was.
+func (u *Upgrader) Upgrade() error {
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Failed to create readiness pipe %w", err)
+	}
+
+	defer readyR.Close()
+
+	cmd, err := u.start(readyW)
+	readyW.Close()
+
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		u.mu.Lock()
+		u.upgrading = false
+		u.mu.Unlock()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := readyR.Read(b[:])
+		ready <- err
+	}()
+
+	timer := time.NewTimer(u.options.ReadyTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			// The child closed the pipe without telling us it was ready, which
+			// normally means that it exited
+			cmd.Process.Kill()
+			cmd.Wait()
+			return fmt.Errorf("New process exited before it was ready %w", err)
+		}
+
+	case <-timer.C:
+		cmd.Process.Kill()
+		cmd.Wait()
+		return ErrReadyTimeout
+	}
+
+	u.log.Info("Upgrade complete", zap.Int("pid", cmd.Process.Pid))
+
+	// Reap the child if it exits before we do
+	go cmd.Wait()
+
+	u.exitOnce.Do(func() { close(u.exit) })
+	return nil
+}
+
+// Exit is closed once an upgrade has completed and this process should exit.
+func (u *Upgrader) Exit() <-chan struct{} {
+	return u.exit
+}
+
+// Close releases any inherited sockets that were never claimed by Listen, and
+// our copies of the sockets that Listen returned. Listeners that are still
+// open are unaffected.
+func (u *Upgrader) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, files := range u.inherited {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+
+	u.inherited = make(map[string][]*os.File)
+
+	for _, l := range u.listeners {
+		l.file.Close()
+	}
+
+	u.listeners = nil
+
+	return nil
+}
+
+// inherit claims the sockets and readiness pipe passed to us by our parent
+func (u *Upgrader) inherit() error {
+	if fd := os.Getenv(envReadyFd); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return fmt.Errorf("Invalid %s %w", envReadyFd, err)
+		}
+
+		u.readyFile = os.NewFile(uintptr(n), "ready")
+	}
+
+	if keys := os.Getenv(envListeners); keys != "" {
+		for n, key := range strings.Split(keys, ",") {
+			file := os.NewFile(uintptr(firstInheritedFd+n), key)
+			u.inherited[key] = append(u.inherited[key], file)
+		}
+	}
+
+	// These are only meant for us, not any processes that we start
+	os.Unsetenv(envReadyFd)
+	os.Unsetenv(envListeners)
+
+	return nil
+}
+
+// start execs the child process, handing it our listeners and readyW
+func (u *Upgrader) start(readyW *os.File) (*exec.Cmd, error) {
+	// The lock is held until the child has started, so that none of our
+	// listeners can be closed while they're being handed over
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	select {
+	case <-u.exit:
+		return nil, ErrUpgradeComplete
+
+	default:
+	}
+
+	if u.upgrading {
+		return nil, ErrUpgradeInProgress
+	}
+
+	if u.readyFile != nil {
+		return nil, ErrNotReady
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find our executable %w", err)
+	}
+
+	keys := make([]string, 0, len(u.listeners))
+	files := make([]*os.File, 0, len(u.listeners)+1)
+
+	for _, l := range u.listeners {
+		keys = append(keys, l.key)
+		files = append(files, l.file)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		envListeners+"="+strings.Join(keys, ","),
+		envReadyFd+"="+strconv.Itoa(firstInheritedFd+len(files)),
+	)
+
+	u.log.Info("Starting new process", zap.String("executable", executable), zap.Strings("listeners", keys))
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start new process %w", err)
+	}
+
+	u.upgrading = true
+	return cmd, nil
+}
+
+func (u *Upgrader) removeListener(l *listener) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for n, other := range u.listeners {
+		if other == l {
+			u.listeners = append(u.listeners[:n], u.listeners[n+1:]...)
+			break
+		}
+	}
+}
+
+// listener is a listening socket that can be handed over to a child process.
+type listener struct {
+	net.Listener
+
+	key      string
+	file     *os.File
+	upgrader *Upgrader
+
+	closeOnce sync.Once
+}
+
+// Close closes the listener. Once closed it won't be handed to a child.
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+
+	l.closeOnce.Do(func() {
+		l.upgrader.removeListener(l)
+		l.file.Close()
+	})
+
+	return err
+}
+
+// File returns a copy of the underlying socket, see net.TCPListener.File
+func (l *listener) File() (*os.File, error) {
+	return listenerFile(l.Listener)
+}
+
+// bind creates a new listening socket
+func bind(network, addr string) (net.Listener, error) {
+	if network != "unix" {
+		return reuseport.Listen(network, addr)
+	}
+
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// A child that inherits the socket will still be using the socket file after
+	// we close our listener, so it must be left in place.
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	return ln, nil
+}
+
+func listenerFile(ln net.Listener) (*os.File, error) {
+	filer, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("Listeners of type %T can't be handed over", ln)
+	}
+
+	return filer.File()
+}
+
+func listenerKey(network, addr string) string {
+	return network + ":" + addr
+}
+
+// writePIDFile atomically replaces path with our process ID
+func writePIDFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("Failed to write PID file %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.Itoa(os.Getpid())); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to write PID file %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to write PID file %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Failed to write PID file %w", err)
+	}
+
+	return nil
+}
+
+// ReadPIDFile returns the process ID in the PID file at path.
+func ReadPIDFile(path string) (int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid PID file %s %w", path, err)
+	}
+
+	return pid, nil
+}
@@ -0,0 +1,148 @@
+package upgrade_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/internal/upgrade"
+)
+
+const (
+	childModeEnv    = "PHAROS_UPGRADE_TEST_CHILD"
+	childAddrEnv    = "PHAROS_UPGRADE_TEST_ADDR"
+	childPIDFileEnv = "PHAROS_UPGRADE_TEST_PID_FILE"
+
+	listenAddr = "127.0.0.1:0"
+)
+
+var _ = Describe("Upgrader", func() {
+	var (
+		pidFile  string
+		upgrader *upgrade.Upgrader
+		ln       net.Listener
+	)
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir("", "pharos-upgrade")
+		Expect(err).To(Succeed())
+		pidFile = filepath.Join(dir, "pharos.pid")
+
+		upgrader, err = upgrade.New(upgrade.Options{
+			PIDFile:      pidFile,
+			ReadyTimeout: 5 * time.Second,
+		}, zap.NewNop())
+		Expect(err).To(Succeed())
+
+		ln, err = upgrader.Listen("tcp", listenAddr)
+		Expect(err).To(Succeed())
+
+		os.Setenv(childAddrEnv, listenAddr)
+		os.Setenv(childPIDFileEnv, pidFile)
+	})
+
+	AfterEach(func() {
+		os.Unsetenv(childModeEnv)
+		os.Unsetenv(childAddrEnv)
+		os.Unsetenv(childPIDFileEnv)
+
+		ln.Close()
+		upgrader.Close()
+		os.RemoveAll(filepath.Dir(pidFile))
+	})
+
+	It("writes our PID file once we're ready", func() {
+		Expect(upgrader.Ready()).To(Succeed())
+
+		pid, err := upgrade.ReadPIDFile(pidFile)
+		Expect(err).To(Succeed())
+		Expect(pid).To(Equal(os.Getpid()))
+	})
+
+	It("hands its listeners to the new process", func() {
+		os.Setenv(childModeEnv, "serve")
+
+		Expect(upgrader.Upgrade()).To(Succeed())
+		Expect(upgrader.Exit()).To(BeClosed())
+
+		// We stop accepting, the new process accepts on the same socket
+		addr := ln.Addr().String()
+		Expect(ln.Close()).To(Succeed())
+
+		conn, err := net.Dial("tcp", addr)
+		Expect(err).To(Succeed())
+		defer conn.Close()
+
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		Expect(err).To(Succeed())
+		Expect(line).To(Equal("child\n"))
+
+		pid, err := upgrade.ReadPIDFile(pidFile)
+		Expect(err).To(Succeed())
+		Expect(pid).NotTo(Equal(os.Getpid()))
+	})
+
+	It("returns an error if the new process exits before it's ready", func() {
+		os.Setenv(childModeEnv, "fail")
+
+		Expect(upgrader.Upgrade()).NotTo(Succeed())
+		Expect(upgrader.Exit()).NotTo(BeClosed())
+	})
+
+	It("returns an error if the new process isn't ready in time", func() {
+		var err error
+
+		upgrader.Close()
+		upgrader, err = upgrade.New(upgrade.Options{ReadyTimeout: 100 * time.Millisecond}, zap.NewNop())
+		Expect(err).To(Succeed())
+
+		os.Setenv(childModeEnv, "hang")
+
+		Expect(upgrader.Upgrade()).To(MatchError(upgrade.ErrReadyTimeout))
+		Expect(upgrader.Exit()).NotTo(BeClosed())
+	})
+})
+
+// runChild is run by the new process that an upgrade starts
+func runChild(mode string) int {
+	switch mode {
+	case "fail":
+		return 1
+
+	case "hang":
+		time.Sleep(time.Minute)
+		return 1
+	}
+
+	upgrader, err := upgrade.New(upgrade.Options{PIDFile: os.Getenv(childPIDFileEnv)}, zap.NewNop())
+	if err != nil {
+		return 1
+	}
+
+	ln, err := upgrader.Listen("tcp", os.Getenv(childAddrEnv))
+	if err != nil {
+		return 1
+	}
+
+	if err := upgrader.Ready(); err != nil {
+		return 1
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		return 1
+	}
+
+	conn.Write([]byte("child\n"))
+	conn.Close()
+
+	return 0
+}
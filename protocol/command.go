@@ -1,5 +1,12 @@
 package protocol
 
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"time"
+)
+
 type Command string
 
 const (
@@ -7,8 +14,651 @@ const (
 	PING Command = "PING"
 	SET  Command = "SET"
 	GET  Command = "GET"
+
+	COALESCE  Command = "COALESCE"
+	HEARTBEAT Command = "HEARTBEAT"
+	HELP      Command = "HELP"
+	AUTH      Command = "AUTH"
+	DEL       Command = "DEL"
+	SELECT    Command = "SELECT"
+	LOCK      Command = "LOCK"
+	UNLOCK    Command = "UNLOCK"
+	RENEW     Command = "RENEW"
+	PUBLISH   Command = "PUBLISH"
+	SUBSCRIBE Command = "SUBSCRIBE"
+	LPUSH     Command = "LPUSH"
+	RPUSH     Command = "RPUSH"
+	BLPOP     Command = "BLPOP"
+	ACK       Command = "ACK"
+	WATCH     Command = "WATCH"
+	UNWATCH   Command = "UNWATCH"
+
+	UNSUBSCRIBE Command = "UNSUBSCRIBE"
+)
+
+// ephemeralOption follows the key of a SET that's ephemeral
+var ephemeralOption = []byte(" EPHEMERAL")
+
+// The options of a LOCK, TTL and WAIT are followed by a number of seconds and
+// OWNER by who is acquiring the lock
+var (
+	ttlOption   = []byte("TTL")
+	waitOption  = []byte("WAIT")
+	ownerOption = []byte("OWNER")
 )
 
+// visibilityOption is followed by how many seconds an item that BLPOP takes
+// from a queue is hidden for
+var visibilityOption = []byte("VISIBILITY")
+
+// DefaultVisibility is how long an item that BLPOP takes from a queue is hidden
+// for when the request doesn't say
+const DefaultVisibility = 30 * time.Second
+
+// LockPrefix is the path beneath which the state of each lock is stored
+const LockPrefix = "_locks."
+
+// ChannelPrefix is the path that access to each channel is controlled by,
+// channels aren't stored
+const ChannelPrefix = "_channels."
+
+// QueuePrefix is the path beneath which the contents of each queue are stored
+const QueuePrefix = "_queues."
+
+// ParseFunc parses the arguments of a request. args is everything on the
+// request's first line after the command name and the space that follows it,
+// without the line ending. Commands that span several lines read the rest of
+// them from r.
+//
+// Errors are wrapped with the request that failed to parse by the Registry.
+type ParseFunc func(requestID RequestID, args []byte, r LineReader) (Request, error)
+
+// ResponseFunc parses the arguments of a response, in the same way as
+// ParseFunc does for requests.
+type ResponseFunc func(requestID RequestID, args []byte, r LineReader) (*Response, error)
+
+// CommandSpec describes how a command is sent over the wire.
+type CommandSpec struct {
+	// Name is what requests for the command start with, it must be uppercase
+	Name Command
+
+	// Usage and Summary describe the command in the HELP output, e.g.
+	// "COALESCE <milliseconds>" and "Batches updates over a time window"
+	Usage   string
+	Summary string
+
+	// Parse parses requests for the command
+	Parse ParseFunc
+
+	// ReadResponse parses responses that start with the command's name. It's
+	// only needed for commands that respond with something other than OK, PONG
+	// or an error.
+	ReadResponse ResponseFunc
+}
+
+// builtinCommands are the commands that every Registry starts with
+func builtinCommands() []CommandSpec {
+	return []CommandSpec{
+		{
+			Name:    QUIT,
+			Usage:   "QUIT",
+			Summary: "Closes the connection once everything before it has been responded to",
+			Parse: func(requestID RequestID, _ []byte, _ LineReader) (Request, error) {
+				return &QuitRequest{requestID: requestID}, nil
+			},
+		},
+		{
+			Name:    PING,
+			Usage:   "PING",
+			Summary: "Responds with PONG",
+			Parse: func(requestID RequestID, _ []byte, _ LineReader) (Request, error) {
+				return &PingRequest{requestID: requestID}, nil
+			},
+		},
+		{
+			Name:    SET,
+			Usage:   "SET <key> [EPHEMERAL]",
+			Summary: "Sets key to the value on the following line, ephemeral keys are deleted when the connection closes",
+			Parse:   parseSet,
+		},
+		{
+			Name:         GET,
+			Usage:        "GET <key>",
+			Summary:      "Responds with the value of key",
+			Parse:        parseGet,
+			ReadResponse: readGetResponse,
+		},
+		{
+			Name:    COALESCE,
+			Usage:   "COALESCE <milliseconds>",
+			Summary: "Batches updates over a time window, 0 disables batching",
+			Parse:   parseCoalesce,
+		},
+		{
+			Name:    HEARTBEAT,
+			Usage:   "HEARTBEAT",
+			Summary: "Answers a HEARTBEAT notice from the server",
+			Parse: func(requestID RequestID, _ []byte, _ LineReader) (Request, error) {
+				return &HeartbeatRequest{requestID: requestID}, nil
+			},
+		},
+		{
+			Name:    HELP,
+			Usage:   "HELP",
+			Summary: "Lists the commands that the server understands",
+			Parse: func(requestID RequestID, _ []byte, _ LineReader) (Request, error) {
+				return &HelpRequest{requestID: requestID}, nil
+			},
+			ReadResponse: readHelpResponse,
+		},
+		{
+			Name:    AUTH,
+			Usage:   "AUTH <token>",
+			Summary: "Authenticates the connection, servers that require it refuse other commands until then",
+			Parse:   parseAuth,
+		},
+		{
+			Name:    DEL,
+			Usage:   "DEL <key>",
+			Summary: "Deletes key, and everything nested beneath it",
+			Parse:   parseDel,
+		},
+		{
+			Name:    SELECT,
+			Usage:   "SELECT <namespace>",
+			Summary: "Switches the connection to another namespace, each has its own keys and updates",
+			Parse:   parseSelect,
+		},
+		{
+			Name:         LOCK,
+			Usage:        "LOCK <name> TTL <seconds> [WAIT <seconds>] [OWNER <id>]",
+			Summary:      "Acquires a lock until it's unlocked or expires, responds with a fencing token",
+			Parse:        parseLock,
+			ReadResponse: readLockResponse,
+		},
+		{
+			Name:    UNLOCK,
+			Usage:   "UNLOCK <name> <token>",
+			Summary: "Releases a lock that was acquired with token",
+			Parse:   parseUnlock,
+		},
+		{
+			Name:    RENEW,
+			Usage:   "RENEW <name> <token>",
+			Summary: "Extends a lock that was acquired with token by its TTL",
+			Parse:   parseRenew,
+		},
+		{
+			Name:    PUBLISH,
+			Usage:   "PUBLISH <channel>",
+			Summary: "Sends the message on the following line to the channel's subscribers, without storing it",
+			Parse:   parsePublish,
+		},
+		{
+			Name:    SUBSCRIBE,
+			Usage:   "SUBSCRIBE <channel>",
+			Summary: "Receives the messages that are published to channel",
+			Parse:   parseSubscribe,
+		},
+		{
+			Name:    UNSUBSCRIBE,
+			Usage:   "UNSUBSCRIBE <channel>",
+			Summary: "Stops receiving the messages that are published to channel",
+			Parse:   parseUnsubscribe,
+		},
+		{
+			Name:    LPUSH,
+			Usage:   "LPUSH <queue>",
+			Summary: "Adds the item on the following line to the front of queue",
+			Parse:   parseLPush,
+		},
+		{
+			Name:    RPUSH,
+			Usage:   "RPUSH <queue>",
+			Summary: "Adds the item on the following line to the back of queue",
+			Parse:   parseRPush,
+		},
+		{
+			Name:         BLPOP,
+			Usage:        "BLPOP <queue> <timeout> [VISIBILITY <seconds>]",
+			Summary:      "Takes the item at the front of queue, waiting up to timeout seconds for one, 0 waits forever",
+			Parse:        parseBLPop,
+			ReadResponse: readPopResponse,
+		},
+		{
+			Name:    ACK,
+			Usage:   "ACK <queue> <id>",
+			Summary: "Acknowledges an item that BLPOP took, so that it isn't returned to queue",
+			Parse:   parseAck,
+		},
+		{
+			Name:    WATCH,
+			Usage:   "WATCH <path>",
+			Summary: "Only sends updates to path, and to the paths nested beneath it or above it, rather than every update",
+			Parse:   parseWatch,
+		},
+		{
+			Name:    UNWATCH,
+			Usage:   "UNWATCH <path>",
+			Summary: "Stops watching path, every update is sent again once nothing is watched",
+			Parse:   parseUnwatch,
+		},
+	}
+}
+
+func parseSet(requestID RequestID, args []byte, r LineReader) (Request, error) {
+	req := &SetRequest{requestID: requestID, Key: args}
+
+	if bytes.HasSuffix(args, ephemeralOption) {
+		req.Key = args[:len(args)-len(ephemeralOption)]
+		req.Ephemeral = true
+	}
+
+	// Ready key value
+	value, err := r.ReadBytes('\n')
+
+	if err != nil {
+		// TODO(rolly)
+		// This could be handled better. It's possible that we don't have a '\n'
+		// yet as we haven't received enough from the client. In this case we
+		// would accumulate more until we have a '\n' or we reach should safe
+		// limit on buffer size.
+		//
+		// We should handle the above case and only return for other cases or
+		// if we hit our buffer limit
+		return nil, err
+	}
+
+	req.Value = RemoveTrailingCR(value[:len(value)-1])
+
+	return req, nil
+}
+
+func parseGet(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	return &GetRequest{requestID: requestID, Key: args}, nil
+}
+
+func parseCoalesce(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	millis, err := strconv.ParseUint(string(args), 10, 32)
+	if err != nil {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &CoalesceRequest{
+		requestID: requestID,
+		Window:    time.Duration(millis) * time.Millisecond,
+	}, nil
+}
+
+func parseDel(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	return &DelRequest{requestID: requestID, Key: args}, nil
+}
+
+func parseWatch(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	if len(args) == 0 {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &WatchRequest{requestID: requestID, Path: args}, nil
+}
+
+func parseUnwatch(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	if len(args) == 0 {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &UnwatchRequest{requestID: requestID, Path: args}, nil
+}
+
+func parseSelect(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	if len(args) == 0 {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &SelectRequest{requestID: requestID, Namespace: args}, nil
+}
+
+func parseAuth(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	if len(args) == 0 {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &AuthRequest{requestID: requestID, Token: args}, nil
+}
+
+func parseLock(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	fields := bytes.Fields(args)
+	if len(fields) < 3 || len(fields)%2 == 0 || !IsLockName(fields[0]) {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	req := &LockRequest{requestID: requestID, Name: fields[0]}
+
+	// The options are pairs of a name and a value, in any order
+	for i := 1; i < len(fields); i += 2 {
+		var ok bool
+
+		switch option, value := fields[i], fields[i+1]; {
+		case bytes.Equal(option, ttlOption):
+			req.TTL, ok = parseSeconds(value)
+			ok = ok && req.TTL > 0
+
+		case bytes.Equal(option, waitOption):
+			req.Wait, ok = parseSeconds(value)
+
+		case bytes.Equal(option, ownerOption):
+			req.Owner, ok = value, true
+		}
+
+		if !ok {
+			return nil, ErrRequestInvalidArgument
+		}
+	}
+
+	if req.TTL == 0 {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return req, nil
+}
+
+func parseUnlock(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	name, token, err := parseLockToken(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnlockRequest{requestID: requestID, Name: name, Token: token}, nil
+}
+
+func parseRenew(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	name, token, err := parseLockToken(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RenewRequest{requestID: requestID, Name: name, Token: token}, nil
+}
+
+// parseLockToken parses the name of a lock followed by a fencing token
+func parseLockToken(args []byte) ([]byte, uint64, error) {
+	fields := bytes.Fields(args)
+	if len(fields) != 2 || !IsLockName(fields[0]) {
+		return nil, 0, ErrRequestInvalidArgument
+	}
+
+	token, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return nil, 0, ErrRequestInvalidArgument
+	}
+
+	return fields[0], token, nil
+}
+
+// parseSeconds parses a non-negative, and possibly fractional, number of
+// seconds
+func parseSeconds(b []byte) (time.Duration, bool) {
+	seconds, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || seconds < 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return 0, false
+	}
+
+	if seconds > math.MaxInt64/float64(time.Second) {
+		return 0, false
+	}
+
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// IsLockName returns true if name can be used as the name of a lock, which is
+// one or more letters, digits, '-' or '_'.
+func IsLockName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for _, c := range name {
+		if !isNameByte(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isNameByte returns true for the letters, digits, '-' and '_' that names can
+// be made of
+func isNameByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// LockKey returns the path that the state of the lock called name is stored at
+func LockKey(name []byte) []byte {
+	return append([]byte(LockPrefix), name...)
+}
+
+func parsePublish(requestID RequestID, args []byte, r LineReader) (Request, error) {
+	if !IsChannelName(args) {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	message, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	return &PublishRequest{
+		requestID: requestID,
+		Channel:   args,
+		Message:   RemoveTrailingCR(message[:len(message)-1]),
+	}, nil
+}
+
+func parseSubscribe(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	if !IsChannelName(args) {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &SubscribeRequest{requestID: requestID, Channel: args}, nil
+}
+
+func parseUnsubscribe(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	if !IsChannelName(args) {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &UnsubscribeRequest{requestID: requestID, Channel: args}, nil
+}
+
+// IsChannelName returns true if name can be used as the name of a channel,
+// which is one or more letters, digits, '-', '_' or '.'.
+func IsChannelName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for _, c := range name {
+		if c != '.' && !isNameByte(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ChannelKey returns the path that access to the channel called name is
+// controlled by
+func ChannelKey(name []byte) []byte {
+	return append([]byte(ChannelPrefix), name...)
+}
+
+func parseLPush(requestID RequestID, args []byte, r LineReader) (Request, error) {
+	return parsePush(requestID, args, r, true)
+}
+
+func parseRPush(requestID RequestID, args []byte, r LineReader) (Request, error) {
+	return parsePush(requestID, args, r, false)
+}
+
+// parsePush parses an LPUSH, which adds to the front of a queue, or an RPUSH
+func parsePush(requestID RequestID, args []byte, r LineReader, front bool) (Request, error) {
+	if !IsQueueName(args) {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	item, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	return &PushRequest{
+		requestID: requestID,
+		Queue:     args,
+		Item:      RemoveTrailingCR(item[:len(item)-1]),
+		Front:     front,
+	}, nil
+}
+
+func parseBLPop(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	fields := bytes.Fields(args)
+	if (len(fields) != 2 && len(fields) != 4) || !IsQueueName(fields[0]) {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	timeout, ok := parseSeconds(fields[1])
+	if !ok {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	req := &PopRequest{
+		requestID:  requestID,
+		Queue:      fields[0],
+		Timeout:    timeout,
+		Visibility: DefaultVisibility,
+	}
+
+	if len(fields) == 4 {
+		if !bytes.Equal(fields[2], visibilityOption) {
+			return nil, ErrRequestInvalidArgument
+		}
+
+		req.Visibility, ok = parseSeconds(fields[3])
+		if !ok || req.Visibility == 0 {
+			return nil, ErrRequestInvalidArgument
+		}
+	}
+
+	return req, nil
+}
+
+func parseAck(requestID RequestID, args []byte, _ LineReader) (Request, error) {
+	fields := bytes.Fields(args)
+	if len(fields) != 2 || !IsQueueName(fields[0]) {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	id, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &AckRequest{requestID: requestID, Queue: fields[0], ID: id}, nil
+}
+
+// IsQueueName returns true if name can be used as the name of a queue, which,
+// like the name of a lock, is one or more letters, digits, '-' or '_'.
+func IsQueueName(name []byte) bool {
+	return IsLockName(name)
+}
+
+// QueueKey returns the path that the contents of the queue called name are
+// stored at
+func QueueKey(name []byte) []byte {
+	return append([]byte(QueuePrefix), name...)
+}
+
+// readPopResponse reads the ID that follows BLPOP, and the item on the line after
+// it
+func readPopResponse(requestID RequestID, args []byte, r LineReader) (*Response, error) {
+	id, err := strconv.ParseUint(string(args), 10, 64)
+	if err != nil {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	item, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		Type:      RespPop,
+		RequestID: requestID,
+		Args:      []interface{}{id},
+		Value:     RemoveTrailingCR(item[:len(item)-1]),
+	}, nil
+}
+
+// readLockResponse reads the fencing token that follows LOCK
+func readLockResponse(requestID RequestID, args []byte, _ LineReader) (*Response, error) {
+	token, err := strconv.ParseUint(string(args), 10, 64)
+	if err != nil {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	return &Response{Type: RespLock, RequestID: requestID, Args: []interface{}{token}}, nil
+}
+
+// readGetResponse reads the value line of a GET response
+func readGetResponse(requestID RequestID, _ []byte, r LineReader) (*Response, error) {
+	value, err := r.ReadBytes('\n')
+
+	if err != nil {
+		// TODO(rolly)
+		// This could be handled better. It's possible that we don't have a '\n'
+		// yet as we haven't received enough from the client. In this case we
+		// would accumulate more until we have a '\n' or we reach should safe
+		// limit on buffer size.
+		//
+		// We should handle the above case and only return for other cases or
+		// if we hit our buffer limit
+		return nil, err
+	}
+
+	resp := &Response{
+		Type:      RespGet,
+		RequestID: requestID,
+		Value:     RemoveTrailingCR(value[:len(value)-1]),
+	}
+
+	return resp, nil
+}
+
+// readHelpResponse reads the line describing each command, the number of lines
+// follows the HELP
+func readHelpResponse(requestID RequestID, args []byte, r LineReader) (*Response, error) {
+	count, err := strconv.ParseUint(string(args), 10, 16)
+	if err != nil {
+		return nil, ErrRequestInvalidArgument
+	}
+
+	resp := &Response{
+		Type:      RespHelp,
+		RequestID: requestID,
+		Args:      make([]interface{}, 0, count),
+	}
+
+	for n := uint64(0); n < count; n++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Args = append(resp.Args, string(RemoveTrailingCR(line[:len(line)-1])))
+	}
+
+	return resp, nil
+}
+
 type ResponseType string
 
 const (
@@ -16,5 +666,13 @@ const (
 	RespOk     ResponseType = "OK"
 	RespGet    ResponseType = "GET"
 	RespErr    ResponseType = "ERR"
+	RespHelp   ResponseType = "HELP"
+	RespLock   ResponseType = "LOCK"
+	RespPop    ResponseType = "BLPOP"
 	RespUpdate ResponseType = "UPDATE"
+
+	RespUpdateBatch ResponseType = "UPDATE_BATCH"
+	RespGoAway      ResponseType = "GOAWAY"
+	RespHeartbeat   ResponseType = "HEARTBEAT"
+	RespMessage     ResponseType = "MESSAGE"
 )
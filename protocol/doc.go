@@ -24,6 +24,28 @@ package protocol
 //					  close the connection
 // - `PING` - PING! Server will respond with pong
 // - `SET`  - The client wishes to update a key to the provided value
+// - `GET`  - The client wishes to read the value of a key
+// - `DEL`  - The client wishes to delete a key
+// - `COALESCE` - The client would like updates batched over a time window
+// - `HEARTBEAT` - The client is answering a HEARTBEAT notice from the server
+// - `HELP` - Lists the commands that the server understands
+// - `AUTH` - The client is authenticating with a token
+// - `SELECT` - The client wishes to use another namespace
+// - `LOCK` - The client wishes to acquire a lock
+// - `UNLOCK` - The client wishes to release a lock it holds
+// - `RENEW` - The client wishes to extend a lock it holds
+// - `PUBLISH` - The client wishes to send a message to a channel
+// - `SUBSCRIBE` - The client wishes to receive the messages sent to a channel
+// - `UNSUBSCRIBE` - The client no longer wishes to receive a channel's messages
+// - `LPUSH` - The client wishes to add an item to the front of a queue
+// - `RPUSH` - The client wishes to add an item to the back of a queue
+// - `BLPOP` - The client wishes to take the item at the front of a queue
+// - `ACK` - The client has finished with an item it took from a queue
+// - `WATCH` - The client only wishes to receive updates related to a path
+// - `UNWATCH` - The client no longer wishes to watch a path
+//
+// Servers can register commands of their own in addition to these, see
+// Registry. HELP always reflects the commands that a server has registered.
 //
 // === General Syntax
 //
@@ -61,7 +83,29 @@ package protocol
 //     <reqID>ERR <errMessage>\r\n
 //   ```
 //
-// Where `<errMessage>` is a human readable string
+// Where `<errMessage>` is a human readable string. Errors that clients may want
+// to handle are classified by a code, which is the first word of the message
+// and is always uppercase.
+//
+//   ```
+//     <reqID>ERR <CODE> <errMessage>\r\n
+//   ```
+//
+// - `RATELIMITED` - The client has exceeded a rate limit, the request was not
+//                   executed and should be retried later
+// - `NOAUTH` - The server requires the client to AUTH first
+// - `AUTHFAILED` - The token the client tried to AUTH with is not valid
+// - `FORBIDDEN` - The client is not allowed to access the key, or the key is
+//                 reserved for the server's own state
+// - `NONAMESPACE` - The namespace the client tried to SELECT does not exist
+// - `LOCKED` - The lock the client tried to acquire is held by someone else
+// - `NOTLOCKED` - The client does not hold the lock it tried to UNLOCK or RENEW
+// - `EMPTY` - The queue the client tried to BLPOP from stayed empty until the
+//             timeout
+// - `NOTPENDING` - The item the client tried to ACK is not waiting to be
+//                  acknowledged
+// - `TOOMANY` - The connection already has as many watches, or waiting
+//               requests, as the server allows
 //
 // === QUIT
 //
@@ -86,6 +130,173 @@ package protocol
 //    < <reqID>OK\r\n
 //  ```
 //
+// A SET can be made ephemeral, by following the key with `EPHEMERAL`. The key
+// is owned by the connection that set it, and is deleted when that connection
+// closes for any reason. A later SET or DEL of the key, or one of its ancestors,
+// that isn't ephemeral stops the key from being deleted.
+//
+//  ```
+//    > <reqID>SET <key> EPHEMERAL\r\n
+//    > <value>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// === AUTH
+//
+//  ```
+//    > <reqID>AUTH <token>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// Servers can require clients to authenticate with a token. Until they have,
+// every command other than AUTH, HEARTBEAT, and QUIT is refused with a NOAUTH
+// error and the client isn't sent any updates.
+//
+// === HELP
+//
+//  ```
+//    > <reqID>HELP\r\n
+//    < <reqID>HELP <count>\r\n
+//    < <usage> - <summary>\r\n
+//    < ...
+//  ```
+//
+// The response is followed by a line describing each command, count is the
+// number of lines.
+//
+// === DEL
+//
+//  ```
+//    > <reqID>DEL <key>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// Deleting a key sends an update with a `null` value.
+//
+// === SELECT
+//
+//  ```
+//    > <reqID>SELECT <namespace>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// A server can hold several namespaces, each is a separate document with its
+// own keys and updates. Clients start in the `default` namespace. Once a client
+// has selected a namespace its requests operate on that namespace's keys, and
+// it's only sent updates of them.
+//
+// === LOCK, UNLOCK and RENEW
+//
+//  ```
+//    > <reqID>LOCK <name> TTL <seconds> [WAIT <seconds>] [OWNER <id>]\r\n
+//    < <reqID>LOCK <token>\r\n
+//    > <reqID>RENEW <name> <token>\r\n
+//    < <reqID>OK\r\n
+//    > <reqID>UNLOCK <name> <token>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// A lock is held by one client at a time, until it's unlocked, its TTL passes
+// without it being renewed, or the client's connection closes. Lock names are
+// letters, digits, `-` and `_`, and each namespace has its own locks.
+//
+// Acquiring a lock responds with a fencing token, which is greater than every
+// token the lock has been acquired with before. Clients should pass it along
+// with any writes that the lock protects, so that writes from a holder whose
+// lock has since expired can be recognised and refused.
+//
+// If the lock is held, LOCK fails with a LOCKED error unless it has a WAIT, in
+// which case the client waits up to that many seconds for the lock to be
+// released. Each connection can only have so many requests waiting at once,
+// past that LOCK fails with a TOOMANY error rather than waiting.
+//
+// The state of each lock is stored at `_locks.<name>`, so clients can
+// subscribe to it, but only the server can write to it. A SET or DEL of
+// `_locks`, or anything beneath it, fails with a FORBIDDEN error. While the
+// lock is held its state includes the OWNER that it was acquired with, if any,
+// which is how clients can tell who holds it, e.g. to follow the leader of an
+// election.
+//
+//   ```
+//   {"token":<token>,"expires":<unix nanoseconds>,"owner":"<id>"}
+//   ```
+//
+// === PUBLISH, SUBSCRIBE and UNSUBSCRIBE
+//
+//  ```
+//    > <reqID>SUBSCRIBE <channel>\r\n
+//    < <reqID>OK\r\n
+//    > <reqID>PUBLISH <channel>\r\n
+//    > <message>\r\n
+//    < <reqID>OK\r\n
+//    > <reqID>UNSUBSCRIBE <channel>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// Channels broadcast messages to the clients that have subscribed to them, in
+// the same namespace, without storing them. Unlike updates messages are never
+// coalesced, and clients that aren't connected when a message is published
+// never receive it. Channel names are letters, digits, `-`, `_` and `.`.
+//
+// Messages are pushed like updates, but are prefixed with `>` and the name of
+// the channel.
+//
+//   ```
+//   ><channel>\r\n
+//   <message>\r\n
+//   ```
+//
+// Access to a channel is controlled by the path `_channels.<channel>`, which
+// clients need to be allowed to write to to PUBLISH, and to subscribe to to
+// SUBSCRIBE.
+//
+// === LPUSH, RPUSH, BLPOP and ACK
+//
+//  ```
+//    > <reqID>RPUSH <queue>\r\n
+//    > <item>\r\n
+//    < <reqID>OK\r\n
+//    > <reqID>BLPOP <queue> <timeout> [VISIBILITY <seconds>]\r\n
+//    < <reqID>BLPOP <id>\r\n
+//    < <item>\r\n
+//    > <reqID>ACK <queue> <id>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// Queues hold items for workers to take one at a time. LPUSH adds an item to
+// the front of a queue and RPUSH to the back. Queue names are letters, digits,
+// `-` and `_`, and each namespace has its own queues.
+//
+// BLPOP takes the item at the front of the queue. If the queue is empty the
+// client waits up to timeout seconds for an item, or until there is one if the
+// timeout is 0, and then fails with an EMPTY error. Each item is only given to
+// one client at a time. As with LOCK's WAIT, each connection can only have so
+// many requests waiting at once, past that BLPOP fails with a TOOMANY error.
+//
+// An item that's been taken is hidden for the VISIBILITY, which is 30 seconds
+// by default, and the client should ACK it with its ID once it has been
+// handled. If it isn't acknowledged in time it's returned to the front of the
+// queue to be taken again.
+//
+// The contents of each queue are stored at `_queues.<queue>`, so they're
+// included in backups and clients can subscribe to them, but only the server
+// can write to them. A SET or DEL of `_queues`, or anything beneath it, fails
+// with a FORBIDDEN error. Each item is stored at `_queues.<queue>.items.<id>`
+// until it's acknowledged, items are ordered by their position, and the ones
+// that have been taken have the time they'll be visible again.
+//
+//   ```
+//   {"next":<id>,"items":{"<id>":{"item":"<item>","position":<position>,"visible":<unix nanoseconds>}}}
+//   ```
+//
+// === Access control
+//
+// Servers can restrict which keys each authenticated client can read, write,
+// and receive updates for. Requests for keys outside of the client's grants
+// are refused with a FORBIDDEN error. Clients are only sent updates within
+// their grants, a write to an ancestor of a grant is sent as an update of the
+// granted path alone.
+//
 // === Key updates
 //
 // Whenever keys are updated by clients the servers will push the updated keys
@@ -99,13 +310,90 @@ package protocol
 // The syntax of a full update is as follows
 //
 //   ```
-//   $<key>\n\n
-//   <update>\n\n
+//   *<key>\r\n
+//   <update>\r\n
 //   ```
 //
 // The first line says that "this is a update of key <key>". The second line is the
 // encoded value of the key.
 //
+// === WATCH and UNWATCH
+//
+//  ```
+//    > <reqID>WATCH <path>\r\n
+//    < <reqID>OK\r\n
+//    > <reqID>UNWATCH <path>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// Clients that only care about part of the keyspace can WATCH the paths they're
+// interested in. Once a client watches anything it's only sent updates for the
+// paths it watches, rather than every update. A write to a watched path, to a
+// path nested beneath it or to one of its ancestors is sent as an update of the
+// watched path with its new value, so a client watching `services` is sent the
+// whole of `services` when `services.api.port` changes.
+//
+// Watching a path needs access to subscribe to it. Watches belong to the
+// namespace that was selected when they were made, SELECT removes them.
+//
+// === COALESCE
+//
+// By default every update is sent as soon as it happens. Clients that would
+// rather receive fewer, larger, frames can ask the server to buffer updates
+// for a window of time (in milliseconds). Multiple updates to the same key
+// within the window collapse to the latest value. A window of 0 disables
+// coalescing.
+//
+//  ```
+//    > <reqID>COALESCE <milliseconds>\r\n
+//    < <reqID>OK\r\n
+//  ```
+//
+// When a window ends with a single pending update it is sent as a normal
+// update, otherwise the pending updates are sent as a batch. Batches are
+// prefixed with `&` and the number of updates in the batch, followed by a
+// key and value line for each update.
+//
+//   ```
+//   &<count>\r\n
+//   <key>\r\n
+//   <update>\r\n
+//   ...
+//   ```
+//
+// === Notices
+//
+// The server can also push notices about the connection itself. Like updates
+// they don't include a request ID. They are prefixed with `!`, followed by the
+// name of the notice.
+//
+// ==== GOAWAY
+//
+//   ```
+//   !GOAWAY\r\n
+//   ```
+//
+// The server is shutting down. It will not read any further requests from the
+// connection, but it will finish responding to requests that it has already
+// received and flush any pending updates before closing the connection. Clients
+// should reconnect, to another server if there is one.
+//
+// ==== HEARTBEAT
+//
+//   ```
+//   < !HEARTBEAT\r\n
+//   > <reqID>HEARTBEAT\r\n
+//   ```
+//
+// The server sends heartbeats periodically, when it's configured to. Clients
+// must answer each one with a HEARTBEAT command, which the server does not
+// respond to. Any request counts as activity though, so a busy client can't be
+// mistaken for an unresponsive one.
+//
+// The server closes connections that it hasn't received anything from within
+// its idle timeout. Clients can likewise assume the server is unresponsive if
+// they haven't received anything from it for a few heartbeat intervals.
+//
 // ==== Update Value encoding
 //
 // TODO(rolly) but JSON for now...
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"errors"
+	"unicode"
+)
+
+// ErrorCode classifies an error response, so that clients can handle it
+// without matching on the message.
+type ErrorCode string
+
+const (
+	// CodeRateLimited means the client has exceeded a rate limit, the request was
+	// rejected and it should slow down
+	CodeRateLimited ErrorCode = "RATELIMITED"
+
+	// CodeNoAuth means the server requires the client to AUTH before it can make
+	// the request
+	CodeNoAuth ErrorCode = "NOAUTH"
+
+	// CodeAuthFailed means the token that the client tried to AUTH with isn't
+	// valid
+	CodeAuthFailed ErrorCode = "AUTHFAILED"
+
+	// CodeForbidden means the client isn't allowed to access the key that it
+	// made the request for, or that the key is reserved for the server
+	CodeForbidden ErrorCode = "FORBIDDEN"
+
+	// CodeNoNamespace means the namespace that the client tried to SELECT
+	// doesn't exist
+	CodeNoNamespace ErrorCode = "NONAMESPACE"
+
+	// CodeLocked means the lock that the client tried to acquire is held by
+	// someone else
+	CodeLocked ErrorCode = "LOCKED"
+
+	// CodeNotLocked means the client doesn't hold the lock that it tried to
+	// unlock or renew, either the token is wrong or the lock has expired
+	CodeNotLocked ErrorCode = "NOTLOCKED"
+
+	// CodeEmpty means the queue that the client tried to BLPOP from stayed empty
+	// for the whole of the timeout
+	CodeEmpty ErrorCode = "EMPTY"
+
+	// CodeNotPending means the item that the client tried to ACK isn't waiting
+	// to be acknowledged, either it already has been or its visibility timeout
+	// passed and it was returned to the queue
+	CodeNotPending ErrorCode = "NOTPENDING"
+
+	// CodeTooMany means the connection already has as many of something, e.g.
+	// watches or waiting requests, as the server allows each connection
+	CodeTooMany ErrorCode = "TOOMANY"
+)
+
+var (
+	// ErrRateLimited matches any RATELIMITED error response with errors.Is
+	ErrRateLimited = &Error{Code: CodeRateLimited}
+
+	// ErrNoAuth matches any NOAUTH error response with errors.Is
+	ErrNoAuth = &Error{Code: CodeNoAuth}
+
+	// ErrAuthFailed matches any AUTHFAILED error response with errors.Is
+	ErrAuthFailed = &Error{Code: CodeAuthFailed}
+
+	// ErrForbidden matches any FORBIDDEN error response with errors.Is
+	ErrForbidden = &Error{Code: CodeForbidden}
+
+	// ErrNoNamespace matches any NONAMESPACE error response with errors.Is
+	ErrNoNamespace = &Error{Code: CodeNoNamespace}
+
+	// ErrLocked matches any LOCKED error response with errors.Is
+	ErrLocked = &Error{Code: CodeLocked}
+
+	// ErrNotLocked matches any NOTLOCKED error response with errors.Is
+	ErrNotLocked = &Error{Code: CodeNotLocked}
+
+	// ErrEmpty matches any EMPTY error response with errors.Is
+	ErrEmpty = &Error{Code: CodeEmpty}
+
+	// ErrNotPending matches any NOTPENDING error response with errors.Is
+	ErrNotPending = &Error{Code: CodeNotPending}
+
+	// ErrTooMany matches any TOOMANY error response with errors.Is
+	ErrTooMany = &Error{Code: CodeTooMany}
+)
+
+// Error is an error response from the server. Code is empty for errors that
+// aren't classified.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+
+	return string(e.Code) + " " + e.Message
+}
+
+// Is reports whether target is an *Error with the same code, so that errors
+// can be compared with sentinels like ErrRateLimited.
+func (e *Error) Is(target error) bool {
+	var other *Error
+	if !errors.As(target, &other) {
+		return false
+	}
+
+	return e.Code != "" && e.Code == other.Code
+}
+
+// parseError splits an error message into its code and the rest of the
+// message. The code is the first word, if it's entirely uppercase letters.
+func parseError(msg string) *Error {
+	for i, r := range msg {
+		if r == ' ' && i > 0 {
+			return &Error{Code: ErrorCode(msg[:i]), Message: msg[i+1:]}
+		}
+
+		if r > unicode.MaxASCII || !unicode.IsUpper(r) {
+			break
+		}
+	}
+
+	return &Error{Message: msg}
+}
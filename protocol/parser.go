@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 )
 
 var (
@@ -14,6 +15,8 @@ var (
 	ErrRequestUnexpectedEOF    = errors.New("Request is malformed, received EOF before parsing a full command")
 	ErrRequestMissingSetSpace  = errors.New("Set command is malformed, it appears to be missing a space between SET and the key")
 	ErrResponseMissingErrSpace = errors.New("Err command response is malformed, it appears to be missing a space between ERR and the error messsage")
+	ErrRequestInvalidArgument  = errors.New("Request is malformed, it has an invalid argument")
+	ErrResponseInvalidBatch    = errors.New("Update batch is malformed, it does not have a valid update count")
 
 	PrefixQuit = []byte("QUIT")
 	PrefixPing = []byte("PING")
@@ -23,227 +26,190 @@ var (
 	PrefixOk   = []byte("OK")
 	PrefixErr  = []byte("ERR")
 
+	PrefixCoalesce  = []byte("COALESCE")
+	PrefixHeartbeat = []byte("HEARTBEAT")
+	PrefixHelp      = []byte("HELP")
+
 	// PrefixUpdate starts the first line of every update from the server
 	PrefixUpdate = []byte("*")
-)
-
-// ReadRequest reads bytes from the provided Reader and attempts to parse them
-// as a Pharos request command.
-//
-// To avoid denial of service attacks, the provided bufio.Reader
-// should be reading from an io.LimitReader or similar Reader to bound
-// the size of responses.
-func ReadRequest(data io.Reader) (req Request, err error) {
-	r := bufio.NewReader(data)
-
-	// Read the Command
-	rawReq, err := r.ReadBytes('\n')
-	if err != nil {
-		// TODO(rolly)
-		// This could be handled better. It's possible that we don't have a '\n'
-		// yet as we haven't received enough from the client. In this case we
-		// would accumulate more until we have a '\n' or we reach should safe
-		// limit on buffer size.
-		//
-		// We should handle the above case and only return for other cases or
-		// if we hit our buffer limit
-		return nil, err
-	}
 
-	if len(rawReq) < 9 {
-		return nil, ErrRequestTooShort
-	}
-
-	var requestID RequestID
-	copy(requestID[:], rawReq[:4])
+	// PrefixUpdateBatch starts the first line of every batch of updates from the server
+	PrefixUpdateBatch = []byte("&")
 
-	// Strip off the request id and the final '\n'
-	rawCommand := rawReq[4 : len(rawReq)-1]
-
-	// Parse the command
-	switch {
-	case bytes.HasPrefix(rawCommand, PrefixQuit):
-		req := &QuitRequest{requestID: requestID}
-		return req, nil
+	// PrefixNotice starts every notice from the server, such as GOAWAY
+	PrefixNotice = []byte("!")
 
-	case bytes.HasPrefix(rawCommand, PrefixPing):
-		req := &PingRequest{requestID: requestID}
-		return req, nil
-
-	case bytes.HasPrefix(rawCommand, PrefixGet):
-		req := &GetRequest{requestID: requestID}
-
-		if rawCommand[3] != ' ' {
-			// There should be a space delimiting the SET from it's key
-			return nil, fmt.Errorf("Failed to parse '%s': %w",
-				string(rawCommand), ErrRequestMissingSetSpace)
-		}
+	// PrefixMessage starts the first line of every message that's published to
+	// a channel that the client has subscribed to
+	PrefixMessage = []byte(">")
 
-		// Read key to get
-		req.Key = RemoveTrailingCR(rawCommand[4:])
-
-		return req, nil
-
-	case bytes.HasPrefix(rawCommand, PrefixSet):
-		req := &SetRequest{requestID: requestID}
-
-		if rawCommand[3] != ' ' {
-			// There should be a space delimiting the SET from it's key
-			return nil, fmt.Errorf("Failed to parse '%s': %w",
-				string(rawCommand), ErrRequestMissingSetSpace)
-		}
+	NoticeGoAway    = []byte("GOAWAY")
+	NoticeHeartbeat = []byte("HEARTBEAT")
+)
 
-		// Read key to set
-		req.Key = RemoveTrailingCR(rawCommand[4:])
+const (
+	// minResponseLength is the length of the shortest valid response, `<reqID>OK\n`
+	minResponseLength = 7
+)
 
-		// Ready key value
-		value, err := r.ReadBytes('\n')
+// LineReader is the subset of bufio.Reader that the parsers need.
+//
+// Readers that already implement LineReader are used as-is, which allows
+// callers to reuse a single buffered reader across many requests without
+// losing buffered data between calls.
+type LineReader interface {
+	ReadBytes(delim byte) ([]byte, error)
+}
 
-		if err != nil {
-			// TODO(rolly)
-			// This could be handled better. It's possible that we don't have a '\n'
-			// yet as we haven't received enough from the client. In this case we
-			// would accumulate more until we have a '\n' or we reach should safe
-			// limit on buffer size.
-			//
-			// We should handle the above case and only return for other cases or
-			// if we hit our buffer limit
-			return nil, err
-		}
+// IsPushPrefix returns true if b starts a frame that the server pushes without a
+// client request. Clients must not use request IDs that start with these bytes.
+func IsPushPrefix(b byte) bool {
+	return b == PrefixUpdate[0] || b == PrefixUpdateBatch[0] || b == PrefixNotice[0] || b == PrefixMessage[0]
+}
 
-		req.Value = RemoveTrailingCR(value[:len(value)-1])
+func asLineReader(data io.Reader) LineReader {
+	if r, ok := data.(LineReader); ok {
+		return r
+	}
 
-		return req, nil
+	return bufio.NewReader(data)
+}
 
-	default:
-		return nil, fmt.Errorf("Failed to parse '%s': %w",
-			string(rawCommand), ErrUnknownCommand)
-	}
+// ReadRequest reads bytes from the provided Reader and attempts to parse them
+// as a request for one of the builtin commands.
+//
+// To avoid denial of service attacks, the provided bufio.Reader
+// should be reading from an io.LimitReader or similar Reader to bound
+// the size of responses.
+func ReadRequest(data io.Reader) (req Request, err error) {
+	return defaultRegistry.ReadRequest(data)
 }
 
 // ReadResponse reads bytes from the provided Reader and attempts to parse them
-// as a Pharos response.
+// as a Pharos response to one of the builtin commands.
 //
 // To avoid denial of service attacks, the provided bufio.Reader
 // should be reading from an io.LimitReader or similar Reader to bound
 // the size of responses.
 func ReadResponse(data io.Reader) (resp *Response, err error) {
-	r := bufio.NewReader(data)
-
-	// Read the Command
-	rawResp, err := r.ReadBytes('\n')
-	if err != nil {
-		// TODO(rolly)
-		// This could be handled better. It's possible that we don't have a '\n'
-		// yet as we haven't received enough from the client. In this case we
-		// would accumulate more until we have a '\n' or we reach should safe
-		// limit on buffer size.
-		//
-		// We should handle the above case and only return for other cases or
-		// if we hit our buffer limit
-		return nil, err
-	}
-
-	if len(rawResp) < 9 {
-		return nil, ErrRequestTooShort
-	}
+	return defaultRegistry.ReadResponse(data)
+}
 
+// readPush parses a frame that the server pushed without a request, rawResp is
+// its first line
+func readPush(r LineReader, rawResp []byte) (*Response, error) {
 	if rawResp[0] == PrefixUpdate[0] {
 		// This is a update pushed from the server, not a response to
 		// a client request.
-		key := rawResp[1 : len(rawResp)-1]
-
-		// Ready Get response value
-		value, err := r.ReadBytes('\n')
+		return readUpdate(r, RemoveTrailingCR(rawResp[1:len(rawResp)-1]))
+	}
 
+	if rawResp[0] == PrefixUpdateBatch[0] {
+		// This is a batch of updates pushed from the server
+		count, err := strconv.ParseUint(string(RemoveTrailingCR(rawResp[1:len(rawResp)-1])), 10, 32)
 		if err != nil {
-			// TODO(rolly)
-			// This could be handled better. It's possible that we don't have a '\n'
-			// yet as we haven't received enough from the client. In this case we
-			// would accumulate more until we have a '\n' or we reach should safe
-			// limit on buffer size.
-			//
-			// We should handle the above case and only return for other cases or
-			// if we hit our buffer limit
-			return nil, err
+			return nil, fmt.Errorf("Failed to parse '%s': %w", string(rawResp), ErrResponseInvalidBatch)
 		}
 
 		resp := &Response{
-			Type:  RespUpdate,
-			Args:  []interface{}{key},
-			Value: RemoveTrailingCR(value[:len(value)-1]),
+			Type: RespUpdateBatch,
+			Args: make([]interface{}, 0, count),
 		}
 
-		return resp, nil
-	}
-
-	var requestID RequestID
-	copy(requestID[:], rawResp[:4])
+		for n := uint64(0); n < count; n++ {
+			key, err := r.ReadBytes('\n')
+			if err != nil {
+				return nil, err
+			}
 
-	// Strip off the request id and the final '\n'
-	rawCommand := rawResp[4 : len(rawResp)-1]
+			update, err := readUpdate(r, RemoveTrailingCR(key[:len(key)-1]))
+			if err != nil {
+				return nil, err
+			}
 
-	// Parse the command
-	switch {
-	case bytes.HasPrefix(rawCommand, PrefixPong):
-		resp := &Response{Type: RespPong, RequestID: requestID}
-		return resp, nil
+			resp.Args = append(resp.Args, update)
+		}
 
-	case bytes.HasPrefix(rawCommand, PrefixOk):
-		resp := &Response{Type: RespOk, RequestID: requestID}
 		return resp, nil
+	}
 
-	case bytes.HasPrefix(rawCommand, PrefixGet):
-		// Ready Get response value
-		value, err := r.ReadBytes('\n')
-
+	if rawResp[0] == PrefixMessage[0] {
+		// This is a message published to a channel
+		resp, err := readUpdate(r, RemoveTrailingCR(rawResp[1:len(rawResp)-1]))
 		if err != nil {
-			// TODO(rolly)
-			// This could be handled better. It's possible that we don't have a '\n'
-			// yet as we haven't received enough from the client. In this case we
-			// would accumulate more until we have a '\n' or we reach should safe
-			// limit on buffer size.
-			//
-			// We should handle the above case and only return for other cases or
-			// if we hit our buffer limit
 			return nil, err
 		}
 
-		resp := &Response{
-			Type:      RespGet,
-			RequestID: requestID,
-			Value:     RemoveTrailingCR(value[:len(value)-1]),
-		}
-
+		resp.Type = RespMessage
 		return resp, nil
+	}
 
-	case bytes.HasPrefix(rawCommand, PrefixErr):
-		// <reqID>ERR <errMessage>\r\n
+	// This is a notice pushed from the server
+	return readNotice(RemoveTrailingCR(rawResp[1 : len(rawResp)-1]))
+}
 
-		if rawCommand[3] != ' ' {
-			// There should be a space delimiting the ERR from it's message
-			return nil, fmt.Errorf("Failed to parse '%s': %w",
-				string(rawCommand), ErrResponseMissingErrSpace)
-		}
+// readErrorResponse parses the message of an error response
+//
+//	<reqID>ERR <errMessage>\r\n
+func readErrorResponse(requestID RequestID, args []byte, _ LineReader) (*Response, error) {
+	if len(args) == 0 {
+		// There should be a space delimiting the ERR from it's message
+		return nil, ErrResponseMissingErrSpace
+	}
 
-		resp := &Response{
-			Type:      RespErr,
-			RequestID: requestID,
-			Args: []interface{}{
-				errors.New(string(rawCommand[4:])),
-			},
-		}
+	resp := &Response{
+		Type:      RespErr,
+		RequestID: requestID,
+		Args: []interface{}{
+			parseError(string(args)),
+		},
+	}
 
-		return resp, nil
+	return resp, nil
+}
+
+// readNotice parses the body of a server notice
+func readNotice(notice []byte) (*Response, error) {
+	switch {
+	case bytes.Equal(notice, NoticeGoAway):
+		return &Response{Type: RespGoAway}, nil
+
+	case bytes.Equal(notice, NoticeHeartbeat):
+		return &Response{Type: RespHeartbeat}, nil
 
 	default:
-		return nil, fmt.Errorf("Failed to parse '%s': %w",
-			string(rawCommand), ErrUnknownCommand)
+		return nil, fmt.Errorf("Failed to parse notice '%s': %w",
+			string(notice), ErrUnknownCommand)
 	}
 }
 
+// readUpdate reads the value line of an update to key
+func readUpdate(r LineReader, key []byte) (*Response, error) {
+	value, err := r.ReadBytes('\n')
+
+	if err != nil {
+		// TODO(rolly)
+		// This could be handled better. It's possible that we don't have a '\n'
+		// yet as we haven't received enough from the client. In this case we
+		// would accumulate more until we have a '\n' or we reach should safe
+		// limit on buffer size.
+		//
+		// We should handle the above case and only return for other cases or
+		// if we hit our buffer limit
+		return nil, err
+	}
+
+	resp := &Response{
+		Type:  RespUpdate,
+		Args:  []interface{}{key},
+		Value: RemoveTrailingCR(value[:len(value)-1]),
+	}
+
+	return resp, nil
+}
+
 func RemoveTrailingCR(data []byte) []byte {
-	if data[len(data)-1] == '\r' {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
 		// Remove the optional trailing \r
 		return data[:len(data)-1]
 	}
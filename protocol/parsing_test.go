@@ -1,9 +1,11 @@
 package protocol_test
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"io"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -67,6 +69,17 @@ var _ = Describe("Parsing", func() {
 
 				Expect(setReq.Key).To(Equal([]byte("key")))
 				Expect(setReq.Value).To(Equal([]byte("value")))
+				Expect(setReq.Ephemeral).To(BeFalse())
+			})
+
+			It("parses an EPHEMERAL SET command", func() {
+				data := bytes.NewReader([]byte("1234SET services.api EPHEMERAL\nvalue\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+
+				setReq := req.(*protocol.SetRequest)
+				Expect(setReq.Key).To(Equal([]byte("services.api")))
+				Expect(setReq.Ephemeral).To(BeTrue())
 			})
 
 			It("returns an error if there is not a space between the SET command and it's key", func() {
@@ -102,6 +115,403 @@ var _ = Describe("Parsing", func() {
 				Expect(errors.Is(err, protocol.ErrRequestMissingSetSpace)).To(BeTrue())
 			})
 		})
+
+		Describe("COALESCE", func() {
+			It("parses a valid COALESCE command", func() {
+				data := bytes.NewReader([]byte("1234COALESCE 250\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetRequestID()).To(Equal(expectedRequestID))
+				Expect(req.GetCommand()).To(Equal(protocol.COALESCE))
+
+				coalesceReq, ok := req.(*protocol.CoalesceRequest)
+				Expect(ok).To(BeTrue())
+				Expect(coalesceReq.Window).To(Equal(250 * time.Millisecond))
+			})
+
+			It("returns an error if the window is not a number", func() {
+				data := bytes.NewReader([]byte("1234COALESCE soon\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("DEL", func() {
+			It("parses a valid DEL command", func() {
+				data := bytes.NewReader([]byte("1234DEL key\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.DEL))
+				Expect(req.(*protocol.DelRequest).Key).To(Equal([]byte("key")))
+			})
+		})
+
+		Describe("SELECT", func() {
+			It("parses a valid SELECT command", func() {
+				data := bytes.NewReader([]byte("1234SELECT staging\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.SELECT))
+				Expect(req.(*protocol.SelectRequest).Namespace).To(Equal([]byte("staging")))
+			})
+
+			It("returns an error if there is no namespace", func() {
+				data := bytes.NewReader([]byte("1234SELECT\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("LOCK", func() {
+			It("parses a valid LOCK command", func() {
+				data := bytes.NewReader([]byte("1234LOCK nightly-report TTL 30\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.LOCK))
+
+				lock := req.(*protocol.LockRequest)
+				Expect(lock.Name).To(Equal([]byte("nightly-report")))
+				Expect(lock.TTL).To(Equal(30 * time.Second))
+				Expect(lock.Wait).To(BeZero())
+				Expect(lock.GetKey()).To(Equal([]byte("_locks.nightly-report")))
+			})
+
+			It("parses a LOCK command that waits", func() {
+				data := bytes.NewReader([]byte("1234LOCK nightly-report TTL 30 WAIT 0.5\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.(*protocol.LockRequest).Wait).To(Equal(500 * time.Millisecond))
+			})
+
+			It("parses a LOCK command with an owner, in any order", func() {
+				data := bytes.NewReader([]byte("1234LOCK nightly-report OWNER worker-1:8080 WAIT 1 TTL 30\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+
+				lock := req.(*protocol.LockRequest)
+				Expect(lock.Owner).To(Equal([]byte("worker-1:8080")))
+				Expect(lock.Wait).To(Equal(time.Second))
+				Expect(lock.TTL).To(Equal(30 * time.Second))
+			})
+
+			It("returns an error if the TTL is missing or invalid", func() {
+				for _, raw := range []string{
+					"1234LOCK nightly-report\n",
+					"1234LOCK nightly-report TTL 0\n",
+					"1234LOCK nightly-report TTL -1\n",
+					"1234LOCK nightly-report TTL soon\n",
+					"1234LOCK nightly-report WAIT 30\n",
+					"1234LOCK nightly-report TTL 30 WAIT\n",
+					"1234LOCK nightly-report TTL 30 SOON 1\n",
+				} {
+					_, err := protocol.ReadRequest(bytes.NewReader([]byte(raw)))
+					Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue(), raw)
+				}
+			})
+
+			It("returns an error if the name isn't valid", func() {
+				data := bytes.NewReader([]byte("1234LOCK reports.nightly TTL 30\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("UNLOCK", func() {
+			It("parses a valid UNLOCK command", func() {
+				data := bytes.NewReader([]byte("1234UNLOCK nightly-report 42\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.UNLOCK))
+				Expect(req.(*protocol.UnlockRequest).Name).To(Equal([]byte("nightly-report")))
+				Expect(req.(*protocol.UnlockRequest).Token).To(Equal(uint64(42)))
+			})
+
+			It("returns an error if there is no token", func() {
+				data := bytes.NewReader([]byte("1234UNLOCK nightly-report\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("RENEW", func() {
+			It("parses a valid RENEW command", func() {
+				data := bytes.NewReader([]byte("1234RENEW nightly-report 42\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.RENEW))
+				Expect(req.(*protocol.RenewRequest).Token).To(Equal(uint64(42)))
+			})
+		})
+
+		Describe("PUBLISH", func() {
+			It("parses a valid PUBLISH command", func() {
+				data := bytes.NewReader([]byte("1234PUBLISH cache.invalidate\r\nusers\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.PUBLISH))
+
+				publish := req.(*protocol.PublishRequest)
+				Expect(publish.Channel).To(Equal([]byte("cache.invalidate")))
+				Expect(publish.Message).To(Equal([]byte("users")))
+				Expect(publish.GetKey()).To(Equal([]byte("_channels.cache.invalidate")))
+			})
+
+			It("returns an error if the channel isn't valid", func() {
+				data := bytes.NewReader([]byte("1234PUBLISH cache invalidate\nusers\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("SUBSCRIBE", func() {
+			It("parses valid SUBSCRIBE and UNSUBSCRIBE commands", func() {
+				req, err := protocol.ReadRequest(bytes.NewReader([]byte("1234SUBSCRIBE cache.invalidate\r\n")))
+				Expect(err).To(Succeed())
+				Expect(req.(*protocol.SubscribeRequest).Channel).To(Equal([]byte("cache.invalidate")))
+
+				req, err = protocol.ReadRequest(bytes.NewReader([]byte("1234UNSUBSCRIBE cache.invalidate\r\n")))
+				Expect(err).To(Succeed())
+				Expect(req.(*protocol.UnsubscribeRequest).Channel).To(Equal([]byte("cache.invalidate")))
+			})
+
+			It("returns an error if there is no channel", func() {
+				_, err := protocol.ReadRequest(bytes.NewReader([]byte("1234SUBSCRIBE\n")))
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("WATCH", func() {
+			It("parses valid WATCH and UNWATCH commands", func() {
+				req, err := protocol.ReadRequest(bytes.NewReader([]byte("1234WATCH services.api\r\n")))
+				Expect(err).To(Succeed())
+				Expect(req.(*protocol.WatchRequest).Path).To(Equal([]byte("services.api")))
+
+				req, err = protocol.ReadRequest(bytes.NewReader([]byte("1234UNWATCH services.api\r\n")))
+				Expect(err).To(Succeed())
+				Expect(req.(*protocol.UnwatchRequest).Path).To(Equal([]byte("services.api")))
+			})
+
+			It("returns an error if there is no path", func() {
+				_, err := protocol.ReadRequest(bytes.NewReader([]byte("1234WATCH\n")))
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("LPUSH and RPUSH", func() {
+			It("parses valid LPUSH and RPUSH commands", func() {
+				req, err := protocol.ReadRequest(bytes.NewReader([]byte("1234LPUSH emails\r\n{\"to\":\"rolly\"}\r\n")))
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.LPUSH))
+
+				push := req.(*protocol.PushRequest)
+				Expect(push.Queue).To(Equal([]byte("emails")))
+				Expect(push.Item).To(Equal([]byte(`{"to":"rolly"}`)))
+				Expect(push.Front).To(BeTrue())
+				Expect(push.GetKey()).To(Equal([]byte("_queues.emails")))
+
+				req, err = protocol.ReadRequest(bytes.NewReader([]byte("1234RPUSH emails\nhello\n")))
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.RPUSH))
+				Expect(req.(*protocol.PushRequest).Front).To(BeFalse())
+			})
+
+			It("returns an error if the queue isn't valid", func() {
+				data := bytes.NewReader([]byte("1234RPUSH emails.outbox\nhello\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("BLPOP", func() {
+			It("parses a valid BLPOP command", func() {
+				data := bytes.NewReader([]byte("1234BLPOP emails 0.5\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.BLPOP))
+
+				pop := req.(*protocol.PopRequest)
+				Expect(pop.Queue).To(Equal([]byte("emails")))
+				Expect(pop.Timeout).To(Equal(500 * time.Millisecond))
+				Expect(pop.Visibility).To(Equal(protocol.DefaultVisibility))
+				Expect(pop.GetKey()).To(Equal([]byte("_queues.emails")))
+			})
+
+			It("parses a BLPOP command with a visibility timeout", func() {
+				data := bytes.NewReader([]byte("1234BLPOP emails 0 VISIBILITY 60\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.(*protocol.PopRequest).Timeout).To(BeZero())
+				Expect(req.(*protocol.PopRequest).Visibility).To(Equal(time.Minute))
+			})
+
+			It("returns an error if the timeout or visibility timeout is missing or invalid", func() {
+				for _, raw := range []string{
+					"1234BLPOP emails\n",
+					"1234BLPOP emails soon\n",
+					"1234BLPOP emails -1\n",
+					"1234BLPOP emails 1 VISIBILITY\n",
+					"1234BLPOP emails 1 VISIBILITY 0\n",
+					"1234BLPOP emails 1 TTL 30\n",
+				} {
+					_, err := protocol.ReadRequest(bytes.NewReader([]byte(raw)))
+					Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue(), raw)
+				}
+			})
+		})
+
+		Describe("ACK", func() {
+			It("parses a valid ACK command", func() {
+				data := bytes.NewReader([]byte("1234ACK emails 42\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.ACK))
+				Expect(req.(*protocol.AckRequest).Queue).To(Equal([]byte("emails")))
+				Expect(req.(*protocol.AckRequest).ID).To(Equal(uint64(42)))
+			})
+
+			It("returns an error if there is no ID", func() {
+				data := bytes.NewReader([]byte("1234ACK emails\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("AUTH", func() {
+			It("parses a valid AUTH command", func() {
+				data := bytes.NewReader([]byte("1234AUTH s3cret\r\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetCommand()).To(Equal(protocol.AUTH))
+				Expect(req.(*protocol.AuthRequest).Token).To(Equal([]byte("s3cret")))
+			})
+
+			It("returns an error if there is no token", func() {
+				data := bytes.NewReader([]byte("1234AUTH\n"))
+				_, err := protocol.ReadRequest(data)
+				Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+			})
+		})
+
+		Describe("HEARTBEAT", func() {
+			It("parses a valid HEARTBEAT command", func() {
+				data := bytes.NewReader([]byte("1234HEARTBEAT\n"))
+				req, err := protocol.ReadRequest(data)
+				Expect(err).To(Succeed())
+				Expect(req.GetRequestID()).To(Equal(expectedRequestID))
+				Expect(req.GetCommand()).To(Equal(protocol.HEARTBEAT))
+			})
+		})
+	})
+
+	Describe("ReadResponse()", func() {
+		It("parses an ERR response", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader([]byte("1234ERR Unknown command\r\n")))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespErr))
+			Expect(resp.ErrorOrNil()).To(MatchError("Unknown command"))
+			Expect(errors.Is(resp.ErrorOrNil(), protocol.ErrRateLimited)).To(BeFalse())
+		})
+
+		It("parses the code of a coded ERR response", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader([]byte("1234ERR RATELIMITED Too many requests\r\n")))
+			Expect(err).To(Succeed())
+
+			var respErr *protocol.Error
+			Expect(errors.As(resp.ErrorOrNil(), &respErr)).To(BeTrue())
+			Expect(respErr.Code).To(Equal(protocol.CodeRateLimited))
+			Expect(respErr.Message).To(Equal("Too many requests"))
+			Expect(errors.Is(respErr, protocol.ErrRateLimited)).To(BeTrue())
+		})
+
+		It("parses a LOCK response", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader([]byte("1234LOCK 42\r\n")))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespLock))
+			Expect(resp.Args).To(Equal([]interface{}{uint64(42)}))
+		})
+
+		It("parses a BLPOP response", func() {
+			var buf bytes.Buffer
+			Expect(protocol.WritePop(&buf, protocol.RequestID{'1', '2', '3', '4'}, 42, []byte("hello"))).To(Succeed())
+
+			resp, err := protocol.ReadResponse(&buf)
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespPop))
+			Expect(resp.Args).To(Equal([]interface{}{uint64(42)}))
+			Expect(resp.Value).To(Equal([]byte("hello")))
+		})
+
+		It("parses an OK response", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader([]byte("1234OK\r\n")))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespOk))
+		})
+
+		It("parses an update", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader([]byte("*a\r\n1\r\n")))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespUpdate))
+			Expect(resp.Args).To(Equal([]interface{}{[]byte("a")}))
+			Expect(resp.Value).To(Equal([]byte("1")))
+		})
+
+		It("parses a batch of updates", func() {
+			data := bytes.NewReader([]byte("&2\r\nfoo\r\n\"bar\"\r\nbaz\r\n1\r\n"))
+			resp, err := protocol.ReadResponse(data)
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespUpdateBatch))
+			Expect(resp.Args).To(HaveLen(2))
+
+			first := resp.Args[0].(*protocol.Response)
+			Expect(first.Args).To(Equal([]interface{}{[]byte("foo")}))
+			Expect(first.Value).To(Equal([]byte(`"bar"`)))
+
+			second := resp.Args[1].(*protocol.Response)
+			Expect(second.Args).To(Equal([]interface{}{[]byte("baz")}))
+			Expect(second.Value).To(Equal([]byte(`1`)))
+		})
+
+		It("parses a message", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader(protocol.AppendMessage(nil, []byte("cache.invalidate"), []byte("users"))))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespMessage))
+			Expect(resp.Args).To(Equal([]interface{}{[]byte("cache.invalidate")}))
+			Expect(resp.Value).To(Equal([]byte("users")))
+		})
+
+		It("parses a GOAWAY notice", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader([]byte("!GOAWAY\r\n")))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespGoAway))
+		})
+
+		It("parses a HEARTBEAT notice", func() {
+			resp, err := protocol.ReadResponse(bytes.NewReader([]byte("!HEARTBEAT\r\n")))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespHeartbeat))
+		})
+
+		It("returns an error if the notice is unknown", func() {
+			_, err := protocol.ReadResponse(bytes.NewReader([]byte("!WHATEVER\r\n")))
+			Expect(errors.Is(err, protocol.ErrUnknownCommand)).To(BeTrue())
+		})
+
+		It("returns an error if the batch count is invalid", func() {
+			_, err := protocol.ReadResponse(bytes.NewReader([]byte("&lots\r\n")))
+			Expect(errors.Is(err, protocol.ErrResponseInvalidBatch)).To(BeTrue())
+		})
+
+		It("does not lose buffered data between reads from the same reader", func() {
+			r := bufio.NewReader(bytes.NewReader([]byte("1234OK\r\n*a\r\n1\r\n")))
+
+			resp, err := protocol.ReadResponse(r)
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespOk))
+
+			resp, err = protocol.ReadResponse(r)
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespUpdate))
+		})
 	})
 
 	Describe("RemoveTrailingCR()", func() {
@@ -0,0 +1,257 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	ErrCommandRegistered  = errors.New("Command is already registered")
+	ErrInvalidCommandName = errors.New("Command name must be one or more uppercase letters")
+	ErrCommandMissingFunc = errors.New("Command must have a Parse function")
+
+	// defaultRegistry is used by ReadRequest and ReadResponse
+	defaultRegistry = NewRegistry()
+)
+
+// Registry holds the commands that can be parsed, so that commands can be
+// added without changing the parser. It's safe for concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	commands map[Command]CommandSpec
+
+	// names is every command name in the order they were registered
+	names []Command
+
+	// responses parses responses by their first word
+	responses map[string]ResponseFunc
+}
+
+// NewRegistry returns a registry that holds the builtin commands.
+func NewRegistry() *Registry {
+	r := &Registry{
+		commands: make(map[Command]CommandSpec),
+		responses: map[string]ResponseFunc{
+			string(PrefixPong): func(requestID RequestID, _ []byte, _ LineReader) (*Response, error) {
+				return &Response{Type: RespPong, RequestID: requestID}, nil
+			},
+			string(PrefixOk): func(requestID RequestID, _ []byte, _ LineReader) (*Response, error) {
+				return &Response{Type: RespOk, RequestID: requestID}, nil
+			},
+			string(PrefixErr): readErrorResponse,
+		},
+	}
+
+	for _, spec := range builtinCommands() {
+		if err := r.Register(spec); err != nil {
+			panic(err)
+		}
+	}
+
+	return r
+}
+
+// Register adds a command to the registry. It fails if a command with the same
+// name has already been registered.
+func (r *Registry) Register(spec CommandSpec) error {
+	if !isCommandName([]byte(spec.Name)) {
+		return fmt.Errorf("Failed to register '%s': %w", spec.Name, ErrInvalidCommandName)
+	}
+
+	if spec.Parse == nil {
+		return fmt.Errorf("Failed to register '%s': %w", spec.Name, ErrCommandMissingFunc)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.commands[spec.Name]; ok {
+		return fmt.Errorf("Failed to register '%s': %w", spec.Name, ErrCommandRegistered)
+	}
+
+	if _, ok := r.responses[string(spec.Name)]; ok && spec.ReadResponse != nil {
+		return fmt.Errorf("Failed to register '%s' response: %w", spec.Name, ErrCommandRegistered)
+	}
+
+	r.commands[spec.Name] = spec
+	r.names = append(r.names, spec.Name)
+
+	if spec.ReadResponse != nil {
+		r.responses[string(spec.Name)] = spec.ReadResponse
+	}
+
+	return nil
+}
+
+// Lookup returns the command called name, if it's registered.
+func (r *Registry) Lookup(name Command) (CommandSpec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	spec, ok := r.commands[name]
+	return spec, ok
+}
+
+// Commands returns every registered command, in the order they were registered.
+func (r *Registry) Commands() []CommandSpec {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	specs := make([]CommandSpec, 0, len(r.names))
+	for _, name := range r.names {
+		specs = append(specs, r.commands[name])
+	}
+
+	return specs
+}
+
+// ReadRequest reads bytes from the provided Reader and attempts to parse them
+// as a request for one of the registered commands.
+//
+// To avoid denial of service attacks, the provided bufio.Reader
+// should be reading from an io.LimitReader or similar Reader to bound
+// the size of responses.
+func (r *Registry) ReadRequest(data io.Reader) (Request, error) {
+	lr := asLineReader(data)
+
+	// Read the Command
+	rawReq, err := lr.ReadBytes('\n')
+	if err != nil {
+		// TODO(rolly)
+		// This could be handled better. It's possible that we don't have a '\n'
+		// yet as we haven't received enough from the client. In this case we
+		// would accumulate more until we have a '\n' or we reach should safe
+		// limit on buffer size.
+		//
+		// We should handle the above case and only return for other cases or
+		// if we hit our buffer limit
+		return nil, err
+	}
+
+	if len(rawReq) < 9 {
+		return nil, ErrRequestTooShort
+	}
+
+	var requestID RequestID
+	copy(requestID[:], rawReq[:4])
+
+	// Strip off the request id and the final '\n'
+	rawCommand := RemoveTrailingCR(rawReq[4 : len(rawReq)-1])
+	name, args := splitCommand(rawCommand)
+
+	spec, ok := r.Lookup(Command(name))
+	if !ok {
+		if r.isMissingSpace(rawCommand) {
+			return nil, fmt.Errorf("Failed to parse '%s': %w",
+				string(rawCommand), ErrRequestMissingSetSpace)
+		}
+
+		return nil, fmt.Errorf("Failed to parse '%s': %w",
+			string(rawCommand), ErrUnknownCommand)
+	}
+
+	req, err := spec.Parse(requestID, args, lr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse '%s': %w", string(rawCommand), err)
+	}
+
+	return req, nil
+}
+
+// ReadResponse reads bytes from the provided Reader and attempts to parse them
+// as a Pharos response, or an update or notice pushed by the server.
+//
+// To avoid denial of service attacks, the provided bufio.Reader
+// should be reading from an io.LimitReader or similar Reader to bound
+// the size of responses.
+func (r *Registry) ReadResponse(data io.Reader) (*Response, error) {
+	lr := asLineReader(data)
+
+	// Read the Command
+	rawResp, err := lr.ReadBytes('\n')
+	if err != nil {
+		// TODO(rolly)
+		// This could be handled better. It's possible that we don't have a '\n'
+		// yet as we haven't received enough from the client. In this case we
+		// would accumulate more until we have a '\n' or we reach should safe
+		// limit on buffer size.
+		//
+		// We should handle the above case and only return for other cases or
+		// if we hit our buffer limit
+		return nil, err
+	}
+
+	if len(rawResp) > 1 && IsPushPrefix(rawResp[0]) {
+		return readPush(lr, rawResp)
+	}
+
+	if len(rawResp) < minResponseLength {
+		return nil, ErrRequestTooShort
+	}
+
+	var requestID RequestID
+	copy(requestID[:], rawResp[:4])
+
+	// Strip off the request id and the final '\n'
+	rawCommand := RemoveTrailingCR(rawResp[4 : len(rawResp)-1])
+	name, args := splitCommand(rawCommand)
+
+	r.mu.RLock()
+	read, ok := r.responses[string(name)]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Failed to parse '%s': %w",
+			string(rawCommand), ErrUnknownCommand)
+	}
+
+	resp, err := read(requestID, args, lr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse '%s': %w", string(rawCommand), err)
+	}
+
+	return resp, nil
+}
+
+// isMissingSpace returns true if raw starts with a registered command name but
+// doesn't have a space after it, e.g. `SETkey`
+func (r *Registry) isMissingSpace(raw []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for name := range r.commands {
+		if bytes.HasPrefix(raw, []byte(name)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitCommand splits the first line of a request or response into the command
+// name and its arguments
+func splitCommand(raw []byte) ([]byte, []byte) {
+	i := bytes.IndexByte(raw, ' ')
+	if i < 0 {
+		return raw, nil
+	}
+
+	return raw[:i], raw[i+1:]
+}
+
+func isCommandName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+
+	for _, c := range name {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,150 @@
+package protocol_test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+)
+
+// echoRequest is a custom command, which the server responds to with its
+// argument
+type echoRequest struct {
+	requestID protocol.RequestID
+	message   []byte
+}
+
+func (q *echoRequest) GetRequestID() protocol.RequestID {
+	return q.requestID
+}
+
+func (q *echoRequest) GetCommand() protocol.Command {
+	return "ECHO"
+}
+
+var echoSpec = protocol.CommandSpec{
+	Name:    "ECHO",
+	Usage:   "ECHO <message>",
+	Summary: "Responds with message",
+	Parse: func(requestID protocol.RequestID, args []byte, _ protocol.LineReader) (protocol.Request, error) {
+		if len(args) == 0 {
+			return nil, protocol.ErrRequestInvalidArgument
+		}
+
+		return &echoRequest{requestID: requestID, message: args}, nil
+	},
+	ReadResponse: func(requestID protocol.RequestID, args []byte, _ protocol.LineReader) (*protocol.Response, error) {
+		return &protocol.Response{Type: "ECHO", RequestID: requestID, Value: args}, nil
+	},
+}
+
+var _ = Describe("Registry", func() {
+	var registry *protocol.Registry
+
+	BeforeEach(func() {
+		registry = protocol.NewRegistry()
+	})
+
+	It("starts with the builtin commands", func() {
+		var names []protocol.Command
+		for _, spec := range registry.Commands() {
+			names = append(names, spec.Name)
+		}
+
+		Expect(names).To(Equal([]protocol.Command{
+			protocol.QUIT,
+			protocol.PING,
+			protocol.SET,
+			protocol.GET,
+			protocol.COALESCE,
+			protocol.HEARTBEAT,
+			protocol.HELP,
+			protocol.AUTH,
+			protocol.DEL,
+			protocol.SELECT,
+			protocol.LOCK,
+			protocol.UNLOCK,
+			protocol.RENEW,
+			protocol.PUBLISH,
+			protocol.SUBSCRIBE,
+			protocol.UNSUBSCRIBE,
+			protocol.LPUSH,
+			protocol.RPUSH,
+			protocol.BLPOP,
+			protocol.ACK,
+			protocol.WATCH,
+			protocol.UNWATCH,
+		}))
+	})
+
+	It("parses requests and responses for registered commands", func() {
+		Expect(registry.Register(echoSpec)).To(Succeed())
+
+		req, err := registry.ReadRequest(bytes.NewReader([]byte("1234ECHO hello\r\n")))
+		Expect(err).To(Succeed())
+		Expect(req.GetCommand()).To(Equal(protocol.Command("ECHO")))
+		Expect(req.(*echoRequest).message).To(Equal([]byte("hello")))
+
+		resp, err := registry.ReadResponse(bytes.NewReader([]byte("1234ECHO hello\r\n")))
+		Expect(err).To(Succeed())
+		Expect(resp.Type).To(Equal(protocol.ResponseType("ECHO")))
+		Expect(resp.Value).To(Equal([]byte("hello")))
+	})
+
+	It("wraps parse errors with the request", func() {
+		Expect(registry.Register(echoSpec)).To(Succeed())
+
+		_, err := registry.ReadRequest(bytes.NewReader([]byte("1234ECHO\r\n")))
+		Expect(errors.Is(err, protocol.ErrRequestInvalidArgument)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("'ECHO'"))
+	})
+
+	It("doesn't add commands to other registries", func() {
+		Expect(registry.Register(echoSpec)).To(Succeed())
+
+		_, err := protocol.ReadRequest(bytes.NewReader([]byte("1234ECHO hello\n")))
+		Expect(errors.Is(err, protocol.ErrUnknownCommand)).To(BeTrue())
+	})
+
+	It("rejects commands that are already registered", func() {
+		Expect(registry.Register(echoSpec)).To(Succeed())
+
+		err := registry.Register(echoSpec)
+		Expect(errors.Is(err, protocol.ErrCommandRegistered)).To(BeTrue())
+
+		spec := echoSpec
+		spec.Name = protocol.SET
+		err = registry.Register(spec)
+		Expect(errors.Is(err, protocol.ErrCommandRegistered)).To(BeTrue())
+	})
+
+	It("rejects invalid commands", func() {
+		spec := echoSpec
+		spec.Name = "echo"
+		Expect(errors.Is(registry.Register(spec), protocol.ErrInvalidCommandName)).To(BeTrue())
+
+		spec = echoSpec
+		spec.Parse = nil
+		Expect(errors.Is(registry.Register(spec), protocol.ErrCommandMissingFunc)).To(BeTrue())
+	})
+
+	Describe("HELP", func() {
+		It("round trips the description of each command", func() {
+			Expect(registry.Register(echoSpec)).To(Succeed())
+
+			var buf bytes.Buffer
+			Expect(protocol.WriteHelp(&buf, protocol.RequestID{'1', '2', '3', '4'}, registry.Commands())).To(Succeed())
+
+			resp, err := registry.ReadResponse(bufio.NewReader(&buf))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespHelp))
+			Expect(resp.Args).To(HaveLen(23))
+			Expect(resp.Args[0]).To(Equal("QUIT - Closes the connection once everything before it has been responded to"))
+			Expect(resp.Args[22]).To(Equal("ECHO <message> - Responds with message"))
+		})
+	})
+})
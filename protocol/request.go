@@ -1,5 +1,7 @@
 package protocol
 
+import "time"
+
 type RequestID [4]byte
 
 func (r RequestID) String() string {
@@ -39,6 +41,9 @@ type SetRequest struct {
 	requestID RequestID
 	Key       []byte
 	Value     []byte
+
+	// Ephemeral keys are deleted when the connection that set them closes
+	Ephemeral bool
 }
 
 func (q *SetRequest) GetRequestID() RequestID {
@@ -62,7 +67,367 @@ func (q *GetRequest) GetCommand() Command {
 	return GET
 }
 
+type CoalesceRequest struct {
+	requestID RequestID
+
+	// Window is how long the server should buffer updates for before sending them.
+	// A zero Window disables coalescing.
+	Window time.Duration
+}
+
+func (q *CoalesceRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *CoalesceRequest) GetCommand() Command {
+	return COALESCE
+}
+
 var _ Request = (*QuitRequest)(nil)
 var _ Request = (*PingRequest)(nil)
 var _ Request = (*SetRequest)(nil)
 var _ Request = (*GetRequest)(nil)
+var _ Request = (*CoalesceRequest)(nil)
+
+// HeartbeatRequest answers a HEARTBEAT notice from the server. The server
+// doesn't respond to it.
+type HeartbeatRequest struct {
+	requestID RequestID
+}
+
+func (q *HeartbeatRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *HeartbeatRequest) GetCommand() Command {
+	return HEARTBEAT
+}
+
+// HelpRequest asks the server to describe the commands that it understands.
+type HelpRequest struct {
+	requestID RequestID
+}
+
+func (q *HelpRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *HelpRequest) GetCommand() Command {
+	return HELP
+}
+
+// AuthRequest authenticates the connection with a token.
+type AuthRequest struct {
+	requestID RequestID
+	Token     []byte
+}
+
+func (q *AuthRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *AuthRequest) GetCommand() Command {
+	return AUTH
+}
+
+// DelRequest deletes a key.
+type DelRequest struct {
+	requestID RequestID
+	Key       []byte
+}
+
+func (q *DelRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *DelRequest) GetCommand() Command {
+	return DEL
+}
+
+// SelectRequest switches the connection to another namespace.
+type SelectRequest struct {
+	requestID RequestID
+	Namespace []byte
+}
+
+func (q *SelectRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *SelectRequest) GetCommand() Command {
+	return SELECT
+}
+
+// LockRequest acquires a lock.
+type LockRequest struct {
+	requestID RequestID
+	Name      []byte
+
+	// TTL is how long the lock is held for, unless it's renewed
+	TTL time.Duration
+
+	// Wait is how long to wait for the lock if it's held by someone else, zero
+	// fails straight away
+	Wait time.Duration
+
+	// Owner identifies who holds the lock to anyone watching it, it's optional
+	Owner []byte
+}
+
+func (q *LockRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *LockRequest) GetCommand() Command {
+	return LOCK
+}
+
+// UnlockRequest releases a lock.
+type UnlockRequest struct {
+	requestID RequestID
+	Name      []byte
+
+	// Token is the fencing token that the lock was acquired with
+	Token uint64
+}
+
+func (q *UnlockRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *UnlockRequest) GetCommand() Command {
+	return UNLOCK
+}
+
+// RenewRequest extends a lock by its TTL.
+type RenewRequest struct {
+	requestID RequestID
+	Name      []byte
+
+	// Token is the fencing token that the lock was acquired with
+	Token uint64
+}
+
+func (q *RenewRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *RenewRequest) GetCommand() Command {
+	return RENEW
+}
+
+// PublishRequest sends a message to a channel's subscribers.
+type PublishRequest struct {
+	requestID RequestID
+	Channel   []byte
+	Message   []byte
+}
+
+func (q *PublishRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *PublishRequest) GetCommand() Command {
+	return PUBLISH
+}
+
+// SubscribeRequest subscribes the connection to a channel.
+type SubscribeRequest struct {
+	requestID RequestID
+	Channel   []byte
+}
+
+func (q *SubscribeRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *SubscribeRequest) GetCommand() Command {
+	return SUBSCRIBE
+}
+
+// UnsubscribeRequest unsubscribes the connection from a channel.
+type UnsubscribeRequest struct {
+	requestID RequestID
+	Channel   []byte
+}
+
+func (q *UnsubscribeRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *UnsubscribeRequest) GetCommand() Command {
+	return UNSUBSCRIBE
+}
+
+// WatchRequest limits the updates that the connection is sent to those related
+// to a path.
+type WatchRequest struct {
+	requestID RequestID
+	Path      []byte
+}
+
+func (q *WatchRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *WatchRequest) GetCommand() Command {
+	return WATCH
+}
+
+// UnwatchRequest stops the connection watching a path.
+type UnwatchRequest struct {
+	requestID RequestID
+	Path      []byte
+}
+
+func (q *UnwatchRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *UnwatchRequest) GetCommand() Command {
+	return UNWATCH
+}
+
+// PushRequest adds an item to a queue, LPUSH adds it to the front and RPUSH to
+// the back.
+type PushRequest struct {
+	requestID RequestID
+	Queue     []byte
+	Item      []byte
+	Front     bool
+}
+
+func (q *PushRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *PushRequest) GetCommand() Command {
+	if q.Front {
+		return LPUSH
+	}
+
+	return RPUSH
+}
+
+// PopRequest takes the item at the front of a queue.
+type PopRequest struct {
+	requestID RequestID
+	Queue     []byte
+
+	// Timeout is how long to wait for an item if the queue is empty, zero waits
+	// until there is one
+	Timeout time.Duration
+
+	// Visibility is how long the item is hidden from other requests for, once
+	// it's passed without the item being acknowledged it's returned to the
+	// front of the queue
+	Visibility time.Duration
+}
+
+func (q *PopRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *PopRequest) GetCommand() Command {
+	return BLPOP
+}
+
+// AckRequest acknowledges an item that was taken from a queue.
+type AckRequest struct {
+	requestID RequestID
+	Queue     []byte
+
+	// ID is the ID that the item was taken with
+	ID uint64
+}
+
+func (q *AckRequest) GetRequestID() RequestID {
+	return q.requestID
+}
+
+func (q *AckRequest) GetCommand() Command {
+	return ACK
+}
+
+// KeyedRequest is implemented by requests that operate on a single key.
+// Servers execute requests for the same key in the order they were received,
+// and may execute other requests concurrently with them.
+type KeyedRequest interface {
+	Request
+	GetKey() []byte
+}
+
+func (q *SetRequest) GetKey() []byte {
+	return q.Key
+}
+
+func (q *GetRequest) GetKey() []byte {
+	return q.Key
+}
+
+func (q *DelRequest) GetKey() []byte {
+	return q.Key
+}
+
+// The lock requests operate on the key that the lock's state is stored at
+func (q *LockRequest) GetKey() []byte {
+	return LockKey(q.Name)
+}
+
+func (q *UnlockRequest) GetKey() []byte {
+	return LockKey(q.Name)
+}
+
+func (q *RenewRequest) GetKey() []byte {
+	return LockKey(q.Name)
+}
+
+// The channel requests operate on the key that controls access to the channel,
+// so that a connection's messages to a channel are published in order
+func (q *PublishRequest) GetKey() []byte {
+	return ChannelKey(q.Channel)
+}
+
+func (q *SubscribeRequest) GetKey() []byte {
+	return ChannelKey(q.Channel)
+}
+
+func (q *UnsubscribeRequest) GetKey() []byte {
+	return ChannelKey(q.Channel)
+}
+
+func (q *WatchRequest) GetKey() []byte {
+	return q.Path
+}
+
+func (q *UnwatchRequest) GetKey() []byte {
+	return q.Path
+}
+
+// The queue requests operate on the key that the queue's contents are stored at
+func (q *PushRequest) GetKey() []byte {
+	return QueueKey(q.Queue)
+}
+
+func (q *PopRequest) GetKey() []byte {
+	return QueueKey(q.Queue)
+}
+
+func (q *AckRequest) GetKey() []byte {
+	return QueueKey(q.Queue)
+}
+
+var _ KeyedRequest = (*SetRequest)(nil)
+var _ KeyedRequest = (*GetRequest)(nil)
+var _ KeyedRequest = (*DelRequest)(nil)
+var _ KeyedRequest = (*LockRequest)(nil)
+var _ KeyedRequest = (*UnlockRequest)(nil)
+var _ KeyedRequest = (*RenewRequest)(nil)
+var _ KeyedRequest = (*PublishRequest)(nil)
+var _ KeyedRequest = (*SubscribeRequest)(nil)
+var _ KeyedRequest = (*UnsubscribeRequest)(nil)
+var _ KeyedRequest = (*PushRequest)(nil)
+var _ KeyedRequest = (*PopRequest)(nil)
+var _ KeyedRequest = (*AckRequest)(nil)
+var _ KeyedRequest = (*WatchRequest)(nil)
+var _ KeyedRequest = (*UnwatchRequest)(nil)
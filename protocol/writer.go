@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
 )
 
 var (
@@ -44,6 +45,115 @@ func WriteError(w io.Writer, requestID RequestID, errMsg string) error {
 	return err
 }
 
+// WriteCodedError writes an error response that's classified by code.
+func WriteCodedError(w io.Writer, requestID RequestID, code ErrorCode, errMsg string) error {
+	return WriteError(w, requestID, string(code)+" "+errMsg)
+}
+
 func PrependRequestID(data []byte, requestID RequestID) []byte {
 	return append(requestID[:], data...)
 }
+
+// WriteUpdate writes a single update of key to value.
+func WriteUpdate(w io.Writer, key, value []byte) error {
+	_, err := w.Write(AppendUpdate(nil, key, value))
+	return err
+}
+
+// AppendUpdate appends the encoding of a single update of key to value to dst
+// and returns the extended buffer.
+//
+//	*<key>\r\n
+//	<value>\r\n
+func AppendUpdate(dst []byte, key, value []byte) []byte {
+	dst = append(dst, PrefixUpdate...)
+	return appendKeyValue(dst, key, value)
+}
+
+// AppendMessage appends the encoding of a message published to channel to dst
+// and returns the extended buffer.
+//
+//	><channel>\r\n
+//	<message>\r\n
+func AppendMessage(dst []byte, channel, message []byte) []byte {
+	dst = append(dst, PrefixMessage...)
+	return appendKeyValue(dst, channel, message)
+}
+
+// AppendUpdateBatch appends the encoding of a batch of updates to dst and
+// returns the extended buffer. keys and values must be the same length.
+//
+//	&<count>\r\n
+//	<key>\r\n
+//	<value>\r\n
+//	...
+func AppendUpdateBatch(dst []byte, keys, values [][]byte) []byte {
+	dst = append(dst, PrefixUpdateBatch...)
+	dst = strconv.AppendInt(dst, int64(len(keys)), 10)
+	dst = append(dst, Terminal...)
+
+	for n := range keys {
+		dst = appendKeyValue(dst, keys[n], values[n])
+	}
+
+	return dst
+}
+
+func appendKeyValue(dst []byte, key, value []byte) []byte {
+	dst = append(dst, key...)
+	dst = append(dst, Terminal...)
+	dst = append(dst, value...)
+	return append(dst, Terminal...)
+}
+
+// AppendGoAway appends a GOAWAY notice to dst and returns the extended buffer.
+//
+//	!GOAWAY\r\n
+func AppendGoAway(dst []byte) []byte {
+	dst = append(dst, PrefixNotice...)
+	dst = append(dst, NoticeGoAway...)
+	return append(dst, Terminal...)
+}
+
+// AppendHeartbeat appends a HEARTBEAT notice to dst and returns the extended
+// buffer.
+//
+//	!HEARTBEAT\r\n
+func AppendHeartbeat(dst []byte) []byte {
+	dst = append(dst, PrefixNotice...)
+	dst = append(dst, NoticeHeartbeat...)
+	return append(dst, Terminal...)
+}
+
+// WriteLock writes the response to a LOCK, which is the fencing token that the
+// lock was acquired with.
+//
+//	<reqID>LOCK <token>\r\n
+func WriteLock(w io.Writer, requestID RequestID, token uint64) error {
+	return WriteString(w, requestID, "LOCK "+strconv.FormatUint(token, 10))
+}
+
+// WritePop writes the response to a BLPOP, which is the item that was taken
+// from the queue and the ID to ACK it with.
+//
+//	<reqID>BLPOP <id>\r\n
+//	<item>\r\n
+func WritePop(w io.Writer, requestID RequestID, id uint64, item []byte) error {
+	return WriteLines(w, requestID, []byte("BLPOP "+strconv.FormatUint(id, 10)), item)
+}
+
+// WriteHelp writes a HELP response, which is a line describing each command.
+//
+//	<reqID>HELP <count>\r\n
+//	<usage> - <summary>\r\n
+//	...
+func WriteHelp(w io.Writer, requestID RequestID, specs []CommandSpec) error {
+	lines := make([][]byte, 0, len(specs)+1)
+	lines = append(lines, []byte(fmt.Sprintf("HELP %d", len(specs))))
+
+	for _, spec := range specs {
+		lines = append(lines, []byte(spec.Usage+" - "+spec.Summary))
+	}
+
+	return WriteLines(w, requestID, lines...)
+}
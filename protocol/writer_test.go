@@ -104,4 +104,45 @@ var _ = Describe("Parsing/ Writer", func() {
 			Expect(w.String()).To(Equal("1234ERR errMessage\r\n"))
 		})
 	})
+
+	Describe("AppendUpdate", func() {
+		It("encodes the key and value of the update", func() {
+			Expect(string(protocol.AppendUpdate(nil, []byte("foo"), []byte(`"bar"`)))).To(Equal("*foo\r\n\"bar\"\r\n"))
+		})
+
+		It("does not modify the shared update prefix", func() {
+			protocol.AppendUpdate(nil, []byte("foo"), []byte("1"))
+			Expect(protocol.PrefixUpdate).To(Equal([]byte("*")))
+		})
+	})
+
+	Describe("AppendUpdateBatch", func() {
+		It("encodes the count and each update in the batch", func() {
+			keys := [][]byte{[]byte("foo"), []byte("baz")}
+			values := [][]byte{[]byte(`"bar"`), []byte(`1`)}
+
+			Expect(string(protocol.AppendUpdateBatch(nil, keys, values))).To(Equal("&2\r\nfoo\r\n\"bar\"\r\nbaz\r\n1\r\n"))
+		})
+	})
+
+	Describe("WriteCodedError", func() {
+		It("includes the code before the message", func() {
+			w := bytes.NewBuffer([]byte{})
+
+			Expect(protocol.WriteCodedError(w, reqID, protocol.CodeRateLimited, "Too many requests")).To(Succeed())
+			Expect(w.String()).To(Equal("1234ERR RATELIMITED Too many requests\r\n"))
+		})
+	})
+
+	Describe("AppendGoAway", func() {
+		It("encodes a GOAWAY notice", func() {
+			Expect(string(protocol.AppendGoAway(nil))).To(Equal("!GOAWAY\r\n"))
+		})
+	})
+
+	Describe("AppendHeartbeat", func() {
+		It("encodes a HEARTBEAT notice", func() {
+			Expect(string(protocol.AppendHeartbeat(nil))).To(Equal("!HEARTBEAT\r\n"))
+		})
+	})
 })
@@ -2,7 +2,6 @@ package storage
 
 import (
 	"context"
-	"fmt"
 	"sync"
 
 	"github.com/tidwall/gjson"
@@ -10,10 +9,12 @@ import (
 )
 
 type InmemoryStore struct {
-	values []byte
+	valuesMu sync.RWMutex
+	values   []byte
 
-	mu          sync.Mutex
-	updateChans []chan *Update
+	// mu guards subscriptions. When both are needed valuesMu must be acquired first
+	mu            sync.Mutex
+	subscriptions map[*Subscription]struct{}
 
 	// stop willl be closed when Close() is called
 	stop chan struct{}
@@ -21,9 +22,9 @@ type InmemoryStore struct {
 
 func NewInmemoryStore() *InmemoryStore {
 	return &InmemoryStore{
-		values:      []byte(""),
-		stop:        make(chan struct{}),
-		updateChans: make([]chan *Update, 0),
+		values:        []byte(""),
+		stop:          make(chan struct{}),
+		subscriptions: make(map[*Subscription]struct{}),
 	}
 }
 
@@ -33,40 +34,49 @@ func (i *InmemoryStore) Close() error {
 	}
 
 	i.mu.Lock()
-	defer i.mu.Unlock()
+	subscriptions := i.subscriptions
+	i.subscriptions = make(map[*Subscription]struct{})
+	i.mu.Unlock()
 
-	for _, updateChan := range i.updateChans {
-		close(updateChan)
+	for sub := range subscriptions {
+		sub.Cancel()
 	}
 
 	return nil
 }
 
 func (i *InmemoryStore) Set(ctx context.Context, key []byte, value interface{}) (err error) {
+	i.valuesMu.Lock()
+
 	i.values, err = sjson.SetBytes(i.values, string(key), value)
 	if err != nil {
+		i.valuesMu.Unlock()
 		return err
 	}
 
-	if i.isRunning() {
-		i.mu.Lock()
+	i.publish(key)
 
-		for _, updateChan := range i.updateChans {
-			updateChan <- &Update{
-				Key:   key,
-				Value: []byte(gjson.GetBytes(i.values, string(key)).Raw),
-			}
-		}
+	return nil
+}
+
+func (i *InmemoryStore) Delete(ctx context.Context, key []byte) (err error) {
+	i.valuesMu.Lock()
 
-		i.mu.Unlock()
+	i.values, err = sjson.DeleteBytes(i.values, string(key))
+	if err != nil {
+		i.valuesMu.Unlock()
+		return err
 	}
 
-	fmt.Printf("WUT %s = %v\n%s\n", string(key), value, string(i.values))
+	i.publish(key)
 
 	return nil
 }
 
 func (i *InmemoryStore) Get(ctx context.Context, key []byte) ([]byte, error) {
+	i.valuesMu.RLock()
+	defer i.valuesMu.RUnlock()
+
 	result := gjson.GetBytes(i.values, string(key))
 
 	if result.Index == 0 {
@@ -76,22 +86,90 @@ func (i *InmemoryStore) Get(ctx context.Context, key []byte) ([]byte, error) {
 	return i.values[result.Index : result.Index+len(result.Raw)], nil
 }
 
-func (i *InmemoryStore) ListenToUpdates() <-chan *Update {
+// publish sends the updates caused by a write to key to every affected
+// subscriber. Subscribers to key's ancestors or descendants receive the new
+// value of their own path, rather than the value of key.
+//
+// publish must be called with valuesMu held, it releases it once the new values
+// have been read. The updates are queued on each subscription while the
+// subscriptions lock is held, so that subscribers observe writes in the order
+// they were made, and delivered by the subscriptions once it's released, so
+// that a slow subscriber doesn't hold up writes or other subscribers.
+func (i *InmemoryStore) publish(key []byte) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	updateChan := make(chan *Update, 255)
-	i.updateChans = append(i.updateChans, updateChan)
+	if !i.isRunning() || len(i.subscriptions) == 0 {
+		i.valuesMu.Unlock()
+		return
+	}
+
+	values := make(map[string][]byte)
+	valueAt := func(path []byte) []byte {
+		if value, ok := values[string(path)]; ok {
+			return value
+		}
+
+		value := []byte("null")
+		if result := gjson.GetBytes(i.values, string(path)); result.Exists() {
+			value = []byte(result.Raw)
+		}
 
-	return updateChan
+		values[string(path)] = value
+		return value
+	}
+
+	pending := make(map[*Subscription][]*Update, len(i.subscriptions))
+	for sub := range i.subscriptions {
+		if sub.Matches(key) {
+			pending[sub] = sub.updatesFor(key, valueAt)
+		}
+	}
+
+	i.valuesMu.Unlock()
+
+	for sub, updates := range pending {
+		sub.queue(updates)
+	}
+}
+
+func (i *InmemoryStore) ListenToUpdates(ctx context.Context, filters ...[]byte) *Subscription {
+	sub := newSubscription(ctx, filters, i.unsubscribe)
+
+	i.mu.Lock()
+	running := i.isRunning()
+	if running {
+		i.subscriptions[sub] = struct{}{}
+	}
+	i.mu.Unlock()
+
+	if !running {
+		// We're closed, no updates will ever be delivered
+		sub.Cancel()
+	}
+
+	return sub
+}
+
+func (i *InmemoryStore) unsubscribe(sub *Subscription) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	delete(i.subscriptions, sub)
 }
 
 func (i *InmemoryStore) Restore(values []byte) error {
+	i.valuesMu.Lock()
+	defer i.valuesMu.Unlock()
+
 	i.values = values
 	return nil
 }
 
 func (i *InmemoryStore) Backup() ([]byte, error) {
+	i.valuesMu.RLock()
+	defer i.valuesMu.RUnlock()
+
 	if len(i.values) == 0 {
 		return []byte("{}"), nil
 	}
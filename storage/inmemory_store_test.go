@@ -2,6 +2,7 @@ package storage_test
 
 import (
 	"context"
+	"strconv"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -48,11 +49,13 @@ var _ = Describe("storage / InmemoryStore", func() {
 			store := storage.NewInmemoryStore()
 			defer store.Close()
 
-			updateChan := store.ListenToUpdates()
+			sub := store.ListenToUpdates(context.Background())
+			defer sub.Cancel()
+
 			err := store.Set(context.Background(), []byte("foo"), "bar")
 			Expect(err).To(Succeed())
 
-			update, ok := <-updateChan
+			update, ok := <-sub.Updates()
 			Expect(ok).To(BeTrue())
 			Expect(update).To(Equal(&storage.Update{
 				Key:   []byte("foo"),
@@ -60,4 +63,290 @@ var _ = Describe("storage / InmemoryStore", func() {
 			}))
 		})
 	})
+
+	Describe("Delete()", func() {
+		It("removes the key and publishes null for it", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"foo":"bar","baz":1}`))).To(Succeed())
+
+			sub := store.ListenToUpdates(context.Background())
+			defer sub.Cancel()
+
+			Expect(store.Delete(context.Background(), []byte("foo"))).To(Succeed())
+
+			var update *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&update))
+			Expect(string(update.Key)).To(Equal("foo"))
+			Expect(string(update.Value)).To(Equal(`null`))
+
+			value, err := store.Backup()
+			Expect(err).To(Succeed())
+			Expect(string(value)).To(Equal(`{"baz":1}`))
+		})
+
+		It("removes a nested key, leaving its siblings", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"services":{"api":{"port":80,"host":"a"}}}`))).To(Succeed())
+
+			Expect(store.Delete(context.Background(), []byte("services.api.port"))).To(Succeed())
+
+			Expect(store.Get(context.Background(), []byte("services.api.port"))).To(BeEmpty())
+
+			value, err := store.Backup()
+			Expect(err).To(Succeed())
+			Expect(string(value)).To(Equal(`{"services":{"api":{"host":"a"}}}`))
+		})
+
+		It("removes everything nested beneath the key", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"services":{"api":{"port":80}},"baz":1}`))).To(Succeed())
+
+			Expect(store.Delete(context.Background(), []byte("services"))).To(Succeed())
+
+			Expect(store.Get(context.Background(), []byte("services.api.port"))).To(BeEmpty())
+
+			value, err := store.Backup()
+			Expect(err).To(Succeed())
+			Expect(string(value)).To(Equal(`{"baz":1}`))
+		})
+
+		It("succeeds when the key doesn't exist", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"baz":1}`))).To(Succeed())
+
+			Expect(store.Delete(context.Background(), []byte("foo"))).To(Succeed())
+
+			value, err := store.Backup()
+			Expect(err).To(Succeed())
+			Expect(string(value)).To(Equal(`{"baz":1}`))
+		})
+
+		It("notifies subscribers of an ancestor path with the ancestor's new value", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"services":{"api":{"port":80,"host":"a"}}}`))).To(Succeed())
+
+			sub := store.ListenToUpdates(context.Background(), []byte("services.api"))
+			defer sub.Cancel()
+
+			Expect(store.Delete(context.Background(), []byte("services.api.port"))).To(Succeed())
+
+			var update *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&update))
+			Expect(string(update.Key)).To(Equal("services.api"))
+			Expect(string(update.Value)).To(Equal(`{"host":"a"}`))
+		})
+
+		It("sends null to subscribers of a descendant path", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"services":{"api":{"port":80}}}`))).To(Succeed())
+
+			sub := store.ListenToUpdates(context.Background(), []byte("services.api.port"))
+			defer sub.Cancel()
+
+			Expect(store.Delete(context.Background(), []byte("services"))).To(Succeed())
+
+			var update *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&update))
+			Expect(string(update.Key)).To(Equal("services.api.port"))
+			Expect(string(update.Value)).To(Equal(`null`))
+		})
+	})
+
+	Describe("HasPathPrefix()", func() {
+		It("matches the prefix and paths nested beneath it", func() {
+			Expect(storage.HasPathPrefix([]byte("teams.a"), []byte("teams.a"))).To(BeTrue())
+			Expect(storage.HasPathPrefix([]byte("teams.a.b"), []byte("teams.a"))).To(BeTrue())
+			Expect(storage.HasPathPrefix([]byte("teams.a"), []byte(""))).To(BeTrue())
+
+			Expect(storage.HasPathPrefix([]byte("teams.ab"), []byte("teams.a"))).To(BeFalse())
+			Expect(storage.HasPathPrefix([]byte("teams"), []byte("teams.a"))).To(BeFalse())
+			Expect(storage.HasPathPrefix([]byte(`teams\.a.b`), []byte(`teams\`))).To(BeFalse())
+		})
+	})
+
+	Describe("ListenToUpdates()", func() {
+		It("closes the update channel when the subscription is cancelled", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			sub := store.ListenToUpdates(context.Background())
+			sub.Cancel()
+
+			Eventually(sub.Updates()).Should(BeClosed())
+			Expect(func() { sub.Cancel() }).NotTo(Panic())
+		})
+
+		It("stops delivering updates once cancelled", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			sub := store.ListenToUpdates(context.Background())
+			sub.Cancel()
+
+			for n := 0; n < storage.SubscriptionBufferSize+1; n++ {
+				Expect(store.Set(context.Background(), []byte("foo"), "bar")).To(Succeed())
+			}
+
+			Eventually(sub.Updates()).Should(BeClosed())
+		})
+
+		It("doesn't hold up writes or other subscribers behind a slow subscriber", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			slow := store.ListenToUpdates(context.Background())
+			defer slow.Cancel()
+
+			sub := store.ListenToUpdates(context.Background())
+			defer sub.Cancel()
+
+			count := storage.SubscriptionBufferSize * 3
+
+			received := make(chan []string)
+			go func() {
+				var values []string
+				for update := range sub.Updates() {
+					values = append(values, string(update.Value))
+					if len(values) == count {
+						break
+					}
+				}
+
+				received <- values
+			}()
+
+			var expected []string
+			for n := 0; n < count; n++ {
+				Expect(store.Set(context.Background(), []byte("foo"), n)).To(Succeed())
+				expected = append(expected, strconv.Itoa(n))
+			}
+
+			Eventually(received).Should(Receive(Equal(expected)))
+		})
+
+		It("cancels the subscription when its context is done", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			sub := store.ListenToUpdates(ctx)
+			cancel()
+
+			Eventually(sub.Done()).Should(BeClosed())
+			Eventually(sub.Updates()).Should(BeClosed())
+		})
+
+		It("cancels subscriptions when the store is closed", func() {
+			store := storage.NewInmemoryStore()
+
+			sub := store.ListenToUpdates(context.Background())
+			Expect(store.Close()).To(Succeed())
+
+			Eventually(sub.Updates()).Should(BeClosed())
+		})
+
+		It("only delivers updates that match the subscription filters", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			sub := store.ListenToUpdates(context.Background(), []byte("services"))
+			defer sub.Cancel()
+
+			Expect(store.Set(context.Background(), []byte("servicesOld"), "nope")).To(Succeed())
+			Expect(store.Set(context.Background(), []byte("other"), "nope")).To(Succeed())
+			Expect(store.Set(context.Background(), []byte("services.api"), "yep")).To(Succeed())
+
+			var update *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&update))
+			Expect(string(update.Key)).To(Equal("services"))
+			Expect(string(update.Value)).To(Equal(`{"api":"yep"}`))
+			Consistently(sub.Updates()).ShouldNot(Receive())
+		})
+	})
+
+	Describe("hierarchical updates", func() {
+		It("notifies subscribers of an ancestor path with the ancestor's new value", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"services":{"api":{"port":80}}}`))).To(Succeed())
+
+			sub := store.ListenToUpdates(context.Background(), []byte("services.api"))
+			defer sub.Cancel()
+
+			Expect(store.Set(context.Background(), []byte("services.api.port"), 8080)).To(Succeed())
+
+			var update *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&update))
+			Expect(string(update.Key)).To(Equal("services.api"))
+			Expect(string(update.Value)).To(Equal(`{"port":8080}`))
+		})
+
+		It("notifies subscribers of a descendant path with the descendant's new value", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"services":{"api":{"port":80}}}`))).To(Succeed())
+
+			sub := store.ListenToUpdates(context.Background(), []byte("services.api.port"))
+			defer sub.Cancel()
+
+			Expect(store.Set(context.Background(), []byte("services"), map[string]interface{}{
+				"api": map[string]interface{}{"port": 9090},
+			})).To(Succeed())
+
+			var update *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&update))
+			Expect(string(update.Key)).To(Equal("services.api.port"))
+			Expect(string(update.Value)).To(Equal(`9090`))
+		})
+
+		It("sends null to descendant subscribers when their path is removed", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			Expect(store.Restore([]byte(`{"services":{"api":{"port":80}}}`))).To(Succeed())
+
+			sub := store.ListenToUpdates(context.Background(), []byte("services.api.port"))
+			defer sub.Cancel()
+
+			Expect(store.Set(context.Background(), []byte("services"), "gone")).To(Succeed())
+
+			var update *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&update))
+			Expect(string(update.Key)).To(Equal("services.api.port"))
+			Expect(string(update.Value)).To(Equal(`null`))
+		})
+
+		It("sends one update per affected filter", func() {
+			store := storage.NewInmemoryStore()
+			defer store.Close()
+
+			sub := store.ListenToUpdates(context.Background(), []byte("a"), []byte("a.b.c"), []byte("z"))
+			defer sub.Cancel()
+
+			Expect(store.Set(context.Background(), []byte("a.b"), map[string]interface{}{"c": 1})).To(Succeed())
+
+			var first, second *storage.Update
+			Eventually(sub.Updates()).Should(Receive(&first))
+			Eventually(sub.Updates()).Should(Receive(&second))
+			Expect(string(first.Key)).To(Equal("a"))
+			Expect(string(first.Value)).To(Equal(`{"b":{"c":1}}`))
+			Expect(string(second.Key)).To(Equal("a.b.c"))
+			Expect(string(second.Value)).To(Equal(`1`))
+			Consistently(sub.Updates()).ShouldNot(Receive())
+		})
+	})
 })
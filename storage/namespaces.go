@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.uber.org/multierr"
+)
+
+const (
+	// DefaultNamespace is the namespace that clients use until they SELECT another
+	DefaultNamespace = "default"
+)
+
+var (
+	ErrNamespaceExists   = errors.New("Namespace already exists")
+	ErrNamespaceNotFound = errors.New("Namespace does not exist")
+	ErrInvalidNamespace  = errors.New("Namespace names must be letters, digits, '-' or '_'")
+)
+
+// Namespaces holds a separate Store for each namespace, so that unrelated
+// documents can be served by one process without sharing keys, updates or
+// backups. It's safe for concurrent use.
+type Namespaces struct {
+	mu     sync.RWMutex
+	stores map[string]Store
+
+	// names is every namespace in the order they were added
+	names []string
+}
+
+// NewNamespaces returns namespaces that only hold DefaultNamespace, which is
+// backed by store.
+func NewNamespaces(store Store) *Namespaces {
+	return &Namespaces{
+		stores: map[string]Store{DefaultNamespace: store},
+		names:  []string{DefaultNamespace},
+	}
+}
+
+// Add adds a namespace that's backed by store.
+func (n *Namespaces) Add(name string, store Store) error {
+	if !ValidNamespace(name) {
+		return fmt.Errorf("Failed to add namespace '%s' %w", name, ErrInvalidNamespace)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.stores[name]; ok {
+		return fmt.Errorf("Failed to add namespace '%s' %w", name, ErrNamespaceExists)
+	}
+
+	n.stores[name] = store
+	n.names = append(n.names, name)
+
+	return nil
+}
+
+// Create adds a namespace that's backed by a new, empty, InmemoryStore.
+func (n *Namespaces) Create(name string) (Store, error) {
+	store := NewInmemoryStore()
+
+	if err := n.Add(name, store); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Get returns the store of the namespace called name, if there is one.
+func (n *Namespaces) Get(name string) (Store, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	store, ok := n.stores[name]
+	return store, ok
+}
+
+// Names returns the name of every namespace, in the order they were added.
+func (n *Namespaces) Names() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	names := make([]string, len(n.names))
+	copy(names, n.names)
+
+	return names
+}
+
+// Backup backs up each namespace separately, keyed by the namespace's name.
+func (n *Namespaces) Backup() (map[string][]byte, error) {
+	backups := make(map[string][]byte)
+
+	for _, name := range n.Names() {
+		store, _ := n.Get(name)
+
+		backup, err := store.Backup()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to backup namespace '%s' %w", name, err)
+		}
+
+		backups[name] = backup
+	}
+
+	return backups, nil
+}
+
+// Restore restores each namespace in backups from its backup, namespaces that
+// aren't in backups are left as they are. It fails if a namespace in backups
+// doesn't exist.
+func (n *Namespaces) Restore(backups map[string][]byte) error {
+	for name, backup := range backups {
+		store, ok := n.Get(name)
+		if !ok {
+			return fmt.Errorf("Failed to restore namespace '%s' %w", name, ErrNamespaceNotFound)
+		}
+
+		if err := store.Restore(backup); err != nil {
+			return fmt.Errorf("Failed to restore namespace '%s' %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes every namespace's store.
+func (n *Namespaces) Close() (err error) {
+	for _, name := range n.Names() {
+		store, _ := n.Get(name)
+		err = multierr.Append(err, store.Close())
+	}
+
+	return err
+}
+
+// ValidNamespace returns true if name can be used as the name of a namespace.
+func ValidNamespace(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+
+		default:
+			return false
+		}
+	}
+
+	return true
+}
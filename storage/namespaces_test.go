@@ -0,0 +1,73 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/storage"
+)
+
+var _ = Describe("storage / Namespaces", func() {
+	var namespaces *storage.Namespaces
+
+	BeforeEach(func() {
+		namespaces = storage.NewNamespaces(storage.NewInmemoryStore())
+	})
+
+	AfterEach(func() {
+		Expect(namespaces.Close()).To(Succeed())
+	})
+
+	It("starts with the default namespace", func() {
+		Expect(namespaces.Names()).To(Equal([]string{storage.DefaultNamespace}))
+
+		_, ok := namespaces.Get(storage.DefaultNamespace)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("keeps each namespace's keys separate", func() {
+		staging, err := namespaces.Create("staging")
+		Expect(err).To(Succeed())
+
+		production, ok := namespaces.Get(storage.DefaultNamespace)
+		Expect(ok).To(BeTrue())
+
+		Expect(staging.Set(context.Background(), []byte("foo"), "staging")).To(Succeed())
+		Expect(production.Set(context.Background(), []byte("foo"), "production")).To(Succeed())
+
+		Expect(staging.Get(context.Background(), []byte("foo"))).To(Equal([]byte(`"staging"`)))
+		Expect(production.Get(context.Background(), []byte("foo"))).To(Equal([]byte(`"production"`)))
+	})
+
+	It("rejects duplicate and invalid names", func() {
+		_, err := namespaces.Create(storage.DefaultNamespace)
+		Expect(errors.Is(err, storage.ErrNamespaceExists)).To(BeTrue())
+
+		_, err = namespaces.Create("not valid")
+		Expect(errors.Is(err, storage.ErrInvalidNamespace)).To(BeTrue())
+
+		_, err = namespaces.Create("")
+		Expect(errors.Is(err, storage.ErrInvalidNamespace)).To(BeTrue())
+	})
+
+	It("backs up and restores each namespace separately", func() {
+		staging, err := namespaces.Create("staging")
+		Expect(err).To(Succeed())
+		Expect(staging.Set(context.Background(), []byte("foo"), "bar")).To(Succeed())
+
+		backups, err := namespaces.Backup()
+		Expect(err).To(Succeed())
+		Expect(backups).To(HaveLen(2))
+		Expect(backups["staging"]).To(MatchJSON(`{"foo": "bar"}`))
+		Expect(backups[storage.DefaultNamespace]).To(MatchJSON(`{}`))
+
+		Expect(namespaces.Restore(map[string][]byte{"staging": []byte(`{"foo": "baz"}`)})).To(Succeed())
+		Expect(staging.Get(context.Background(), []byte("foo"))).To(Equal([]byte(`"baz"`)))
+
+		err = namespaces.Restore(map[string][]byte{"missing": []byte(`{}`)})
+		Expect(errors.Is(err, storage.ErrNamespaceNotFound)).To(BeTrue())
+	})
+})
@@ -0,0 +1,32 @@
+package storage
+
+import "bytes"
+
+// Paths are gjson style, '.' separated, paths into the document. A '.' that is
+// escaped with a '\' is part of a key rather than a separator.
+
+// HasPathPrefix returns true if path is prefix, or is nested somewhere beneath
+// it. An empty prefix is the whole document, so it's a prefix of every path.
+func HasPathPrefix(path, prefix []byte) bool {
+	return len(prefix) == 0 || bytes.Equal(path, prefix) || isAncestorPath(prefix, path)
+}
+
+// isAncestorPath returns true if path is nested somewhere beneath ancestor.
+func isAncestorPath(ancestor, path []byte) bool {
+	if len(path) <= len(ancestor) || !bytes.HasPrefix(path, ancestor) {
+		return false
+	}
+
+	if len(ancestor) > 0 && ancestor[len(ancestor)-1] == '\\' {
+		// The separator is escaped, so it's part of the key rather than a path separator
+		return false
+	}
+
+	return path[len(ancestor)] == '.'
+}
+
+// isRelatedPath returns true if a and b are the same path, or if one is nested
+// beneath the other. A write to either path changes the value of the other.
+func isRelatedPath(a, b []byte) bool {
+	return bytes.Equal(a, b) || isAncestorPath(a, b) || isAncestorPath(b, a)
+}
@@ -6,10 +6,19 @@ type Store interface {
 	Set(ctx context.Context, key []byte, value interface{}) error
 	Get(ctx context.Context, key []byte) ([]byte, error)
 
+	// Delete removes key, and everything nested beneath it. Subscribers are sent
+	// a null value for it.
+	Delete(ctx context.Context, key []byte) error
+
 	Restore(values []byte) error
 	Backup() ([]byte, error)
 
-	ListenToUpdates() <-chan *Update
+	// ListenToUpdates subscribes to updates of keys in the store. If any filters
+	// are provided, only updates to those paths (or paths nested beneath them) are
+	// delivered.
+	//
+	// The subscription ends when it is cancelled, ctx is done, or the store is closed.
+	ListenToUpdates(ctx context.Context, filters ...[]byte) *Subscription
 
 	Close() error
 }
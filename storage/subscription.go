@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	// SubscriptionBufferSize is the number of updates that can be buffered in a
+	// subscription's Updates() channel. Updates beyond that are queued by the
+	// subscription until the subscriber catches up.
+	SubscriptionBufferSize = 255
+)
+
+// Subscription is a handle to a stream of updates from a Store.
+//
+// A Subscription remains active until either Cancel() is called, the context
+// it was created with is cancelled, or the Store is closed. In all cases the
+// Updates() channel is closed once the Store will no longer write to it.
+type Subscription struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// filters are the paths this subscription is interested in. If there are
+	// no filters then the subscription receives every update.
+	filters [][]byte
+
+	updates chan *Update
+
+	// mu guards the updates that are waiting to be delivered. delivering is set
+	// while a goroutine is delivering them, and closed once the subscription has
+	// been cancelled, whichever of the two finishes last closes updates.
+	mu         sync.Mutex
+	pending    []*Update
+	delivering bool
+	closed     bool
+
+	once        sync.Once
+	unsubscribe func(*Subscription)
+}
+
+func newSubscription(
+	parentCtx context.Context,
+	filters [][]byte,
+	unsubscribe func(*Subscription),
+) *Subscription {
+	ctx, cancel := context.WithCancel(parentCtx)
+
+	sub := &Subscription{
+		ctx:         ctx,
+		cancel:      cancel,
+		filters:     filters,
+		updates:     make(chan *Update, SubscriptionBufferSize),
+		unsubscribe: unsubscribe,
+	}
+
+	go func() {
+		<-ctx.Done()
+		sub.Cancel()
+	}()
+
+	return sub
+}
+
+// Updates returns the channel that updates will be delivered on. It is closed
+// when the subscription ends.
+func (s *Subscription) Updates() <-chan *Update {
+	return s.updates
+}
+
+// Done returns a channel that is closed when the subscription has been cancelled.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Filters returns the paths this subscription is filtered to. An empty result
+// means the subscription receives every update.
+func (s *Subscription) Filters() [][]byte {
+	return s.filters
+}
+
+// Cancel ends the subscription, removing it from the Store and closing the
+// Updates() channel. It is safe to call Cancel more than once.
+func (s *Subscription) Cancel() {
+	s.cancel()
+
+	s.once.Do(func() {
+		if s.unsubscribe != nil {
+			s.unsubscribe(s)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.closed = true
+		if !s.delivering {
+			close(s.updates)
+		}
+	})
+}
+
+// Matches returns true if a write to key affects any of the paths this
+// subscription is filtered to.
+//
+// A write affects a filter if it is to the filter itself, to a path nested
+// beneath it, or to one of its ancestors. So a filter of `services.api` matches
+// writes to `services.api`, `services.api.port` and `services`, but not
+// `services.apiOld`.
+func (s *Subscription) Matches(key []byte) bool {
+	if len(s.filters) == 0 {
+		return true
+	}
+
+	for _, filter := range s.filters {
+		if isRelatedPath(filter, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updatesFor returns the updates this subscription should receive for a write
+// to key. Unfiltered subscriptions receive the write as-is, filtered
+// subscriptions receive the new value of each of their affected filter paths.
+func (s *Subscription) updatesFor(key []byte, valueAt func(path []byte) []byte) []*Update {
+	if len(s.filters) == 0 {
+		return []*Update{{Key: key, Value: valueAt(key)}}
+	}
+
+	var updates []*Update
+
+	for _, filter := range s.filters {
+		if isRelatedPath(filter, key) {
+			updates = append(updates, &Update{Key: filter, Value: valueAt(filter)})
+		}
+	}
+
+	return updates
+}
+
+// queue queues updates to be delivered to the subscriber after any that were
+// queued before them. It never waits for the subscriber, the updates are
+// delivered on a goroutine that's started when there are updates to deliver
+// and exits once there are none left.
+func (s *Subscription) queue(updates []*Update) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.ctx.Err() != nil {
+		return
+	}
+
+	s.pending = append(s.pending, updates...)
+
+	if !s.delivering {
+		s.delivering = true
+		go s.deliver()
+	}
+}
+
+// deliver sends the pending updates to the subscriber until there are none
+// left, or the subscription is cancelled
+func (s *Subscription) deliver() {
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 || s.ctx.Err() != nil {
+			s.pending = nil
+			s.delivering = false
+
+			// Cancel left closing updates to us
+			if s.closed {
+				close(s.updates)
+			}
+
+			s.mu.Unlock()
+			return
+		}
+
+		update := s.pending[0]
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.updates <- update:
+		case <-s.ctx.Done():
+		}
+	}
+}
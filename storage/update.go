@@ -1,5 +1,9 @@
 package storage
 
+// Update describes the new value of a single path after a write to the store.
+//
+// Value is the raw JSON encoding of the path's new value, or `null` if the path
+// no longer exists.
 type Update struct {
 	Key   []byte
 	Value []byte
@@ -0,0 +1,288 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+var (
+	ErrACLRequiresAuth  = errors.New("Access control requires clients to authenticate, set Options.Auth")
+	ErrACLNotReloadable = errors.New("ACL wasn't loaded from a file, so it can't be reloaded")
+)
+
+// Access is something that a principal can do to a path.
+type Access int
+
+const (
+	// AccessRead allows GETs
+	AccessRead Access = iota
+
+	// AccessWrite allows SETs and DELs
+	AccessWrite
+
+	// AccessSubscribe allows the client to be sent updates
+	AccessSubscribe
+)
+
+// ACLPolicy is what each principal is allowed to access, it's the contents of a
+// policy file. For example
+//
+//	{
+//	  "principals": {
+//	    "payments": {
+//	      "read": ["teams.payments", "shared"],
+//	      "write": ["teams.payments"],
+//	      "subscribe": ["teams.payments"]
+//	    },
+//	    "admin": {"read": [""], "write": [""], "subscribe": [""]}
+//	  }
+//	}
+//
+// Principals are the names of tokens, see Tokens. Each grant is a path prefix,
+// which allows access to the path and everything nested beneath it. The empty
+// path is the whole document. Principals that aren't in the policy can't access
+// anything.
+type ACLPolicy struct {
+	Principals map[string]ACLGrants `json:"principals"`
+}
+
+// ACLGrants are the path prefixes that a principal can access.
+type ACLGrants struct {
+	Read      []string `json:"read"`
+	Write     []string `json:"write"`
+	Subscribe []string `json:"subscribe"`
+}
+
+func (g ACLGrants) prefixes(access Access) []string {
+	switch access {
+	case AccessRead:
+		return g.Read
+
+	case AccessWrite:
+		return g.Write
+
+	default:
+		return g.Subscribe
+	}
+}
+
+// ACL holds the policy that requests are checked against. The policy can be
+// replaced while the server is running, requests and updates use the new
+// policy as soon as it has loaded. It's safe for concurrent use.
+type ACL struct {
+	// path is where the policy was loaded from, if it was
+	path string
+
+	// policy holds the current *ACLPolicy
+	policy atomic.Value
+}
+
+// NewACL returns an ACL for policy.
+func NewACL(policy *ACLPolicy) *ACL {
+	acl := &ACL{}
+	acl.policy.Store(policy)
+
+	return acl
+}
+
+// LoadACL returns an ACL for the policy in the JSON file at path, which can be
+// reloaded with Reload.
+func LoadACL(path string) (*ACL, error) {
+	acl := &ACL{path: path}
+
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// Reload reads the policy file again. If it fails to load then the current
+// policy remains in use.
+func (a *ACL) Reload() error {
+	if a.path == "" {
+		return ErrACLNotReloadable
+	}
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		return fmt.Errorf("Failed to open ACL policy %w", err)
+	}
+	defer file.Close()
+
+	// Unknown fields are most likely typos, which would otherwise silently deny
+	// access
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	var policy ACLPolicy
+	if err := decoder.Decode(&policy); err != nil {
+		return fmt.Errorf("Failed to parse ACL policy %s %w", a.path, err)
+	}
+
+	a.policy.Store(&policy)
+	return nil
+}
+
+// Policy returns the current policy.
+func (a *ACL) Policy() *ACLPolicy {
+	return a.policy.Load().(*ACLPolicy)
+}
+
+// Allowed returns true if principal has access to key.
+func (a *ACL) Allowed(principal string, access Access, key []byte) bool {
+	grants, ok := a.Policy().Principals[principal]
+	if !ok {
+		return false
+	}
+
+	for _, prefix := range grants.prefixes(access) {
+		if storage.HasPathPrefix(key, []byte(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scope returns the parts of update that principal can subscribe to. That's
+// the update itself if it's within one of their grants. If it's a write to an
+// ancestor of their grants then it's an update of each granted path, with its
+// value taken from the ancestor's.
+func (a *ACL) scope(principal string, update *storage.Update) []*storage.Update {
+	grants, ok := a.Policy().Principals[principal]
+	if !ok {
+		return nil
+	}
+
+	var scoped []*storage.Update
+
+	for _, prefix := range grants.Subscribe {
+		if storage.HasPathPrefix(update.Key, []byte(prefix)) {
+			return []*storage.Update{update}
+		}
+
+		if !storage.HasPathPrefix([]byte(prefix), update.Key) {
+			continue
+		}
+
+		value := []byte("null")
+
+		rel := bytes.TrimPrefix([]byte(prefix), update.Key)
+		rel = bytes.TrimPrefix(rel, []byte("."))
+
+		if result := gjson.GetBytes(update.Value, string(rel)); result.Exists() {
+			value = []byte(result.Raw)
+		}
+
+		scoped = append(scoped, &storage.Update{Key: []byte(prefix), Value: value})
+	}
+
+	return scoped
+}
+
+// checkAccess writes a FORBIDDEN error to s if the client that made req can't
+// access key, in which case it returns false
+func (h *requestHandler) checkAccess(ctx context.Context, s Session, access Access, req protocol.Request, key []byte) (bool, error) {
+	if h.options.ACL == nil {
+		return true, nil
+	}
+
+	if principal, ok := Principal(ctx); ok && h.options.ACL.Allowed(principal, access, key) {
+		return true, nil
+	}
+
+	if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeForbidden, "Access denied"); err != nil {
+		return false, fmt.Errorf("Failed to reject %s %w", req.GetCommand(), err)
+	}
+
+	return false, nil
+}
+
+// updateFanout encodes an update for each connection that it's sent to. When
+// there's an ACL the update is scoped to what each connection's principal can
+// see, and encoded once per principal.
+type updateFanout struct {
+	acl    *ACL
+	update *storage.Update
+	frame  *Frame
+
+	// scoped holds the updates, and their frames, for each principal
+	scoped map[string][]scopedUpdate
+}
+
+type scopedUpdate struct {
+	update *storage.Update
+	frame  *Frame
+}
+
+// newUpdateFanout returns a fanout of update, which is encoded in frame.
+// release must be called once it has been sent.
+func newUpdateFanout(acl *ACL, update *storage.Update, frame *Frame) *updateFanout {
+	return &updateFanout{
+		acl:    acl,
+		update: update,
+		frame:  frame,
+	}
+}
+
+// updatesFor returns the updates to send to a connection, connections that
+// haven't authenticated when they're required to aren't sent anything.
+func (f *updateFanout) updatesFor(auth *authState) []scopedUpdate {
+	if !auth.allowed() {
+		return nil
+	}
+
+	if f.acl == nil {
+		return []scopedUpdate{{update: f.update, frame: f.frame}}
+	}
+
+	principal, _ := auth.principalName()
+
+	if scoped, ok := f.scoped[principal]; ok {
+		return scoped
+	}
+
+	var scoped []scopedUpdate
+
+	for _, update := range f.acl.scope(principal, f.update) {
+		if update == f.update {
+			scoped = append(scoped, scopedUpdate{update: update, frame: f.frame})
+			continue
+		}
+
+		frame := newFrame()
+		frame.buf = protocol.AppendUpdate(frame.buf, update.Key, update.Value)
+
+		scoped = append(scoped, scopedUpdate{update: update, frame: frame})
+	}
+
+	if f.scoped == nil {
+		f.scoped = make(map[string][]scopedUpdate)
+	}
+
+	f.scoped[principal] = scoped
+	return scoped
+}
+
+// release releases the frames that the fanout encoded, but not the frame it
+// was given
+func (f *updateFanout) release() {
+	for _, scoped := range f.scoped {
+		for _, s := range scoped {
+			if s.frame != f.frame {
+				s.frame.Release()
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("ACL", func() {
+		policy := &transport.ACLPolicy{
+			Principals: map[string]transport.ACLGrants{
+				"alice": {
+					Read:      []string{"teams.a", "shared"},
+					Write:     []string{"teams.a"},
+					Subscribe: []string{"teams.a"},
+				},
+				"admin": {
+					Read:      []string{""},
+					Write:     []string{""},
+					Subscribe: []string{""},
+				},
+			},
+		}
+
+		It("allows paths beneath a grant", func() {
+			acl := transport.NewACL(policy)
+
+			Expect(acl.Allowed("alice", transport.AccessRead, []byte("teams.a"))).To(BeTrue())
+			Expect(acl.Allowed("alice", transport.AccessRead, []byte("teams.a.x"))).To(BeTrue())
+			Expect(acl.Allowed("alice", transport.AccessRead, []byte("shared"))).To(BeTrue())
+			Expect(acl.Allowed("admin", transport.AccessWrite, []byte("anything.at.all"))).To(BeTrue())
+
+			Expect(acl.Allowed("alice", transport.AccessRead, []byte("teams"))).To(BeFalse())
+			Expect(acl.Allowed("alice", transport.AccessRead, []byte("teams.ab"))).To(BeFalse())
+			Expect(acl.Allowed("alice", transport.AccessWrite, []byte("shared"))).To(BeFalse())
+			Expect(acl.Allowed("mallory", transport.AccessRead, []byte("teams.a"))).To(BeFalse())
+		})
+
+		Describe("LoadACL", func() {
+			var (
+				dir  string
+				path string
+			)
+
+			BeforeEach(func() {
+				var err error
+				dir, err = ioutil.TempDir("", "pharos-acl")
+				Expect(err).To(Succeed())
+
+				path = filepath.Join(dir, "acl.json")
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(dir)
+			})
+
+			It("reloads the policy from the file", func() {
+				Expect(ioutil.WriteFile(path, []byte(`{"principals": {"alice": {"read": ["a"]}}}`), 0600)).To(Succeed())
+
+				acl, err := transport.LoadACL(path)
+				Expect(err).To(Succeed())
+				Expect(acl.Allowed("alice", transport.AccessRead, []byte("a"))).To(BeTrue())
+
+				Expect(ioutil.WriteFile(path, []byte(`{"principals": {"alice": {"read": ["b"]}}}`), 0600)).To(Succeed())
+				Expect(acl.Reload()).To(Succeed())
+
+				Expect(acl.Allowed("alice", transport.AccessRead, []byte("a"))).To(BeFalse())
+				Expect(acl.Allowed("alice", transport.AccessRead, []byte("b"))).To(BeTrue())
+			})
+
+			It("keeps the current policy if the file is invalid", func() {
+				Expect(ioutil.WriteFile(path, []byte(`{"principals": {"alice": {"read": ["a"]}}}`), 0600)).To(Succeed())
+
+				acl, err := transport.LoadACL(path)
+				Expect(err).To(Succeed())
+
+				Expect(ioutil.WriteFile(path, []byte(`{"principals": {"alice": {"reed": ["b"]}}}`), 0600)).To(Succeed())
+				Expect(acl.Reload()).NotTo(Succeed())
+
+				Expect(acl.Allowed("alice", transport.AccessRead, []byte("a"))).To(BeTrue())
+			})
+
+			It("can't reload policies that weren't loaded from a file", func() {
+				err := transport.NewACL(policy).Reload()
+				Expect(errors.Is(err, transport.ErrACLNotReloadable)).To(BeTrue())
+			})
+		})
+
+		It("requires auth", func() {
+			tcp := transport.NewTCP(transport.Options{
+				Port: 6682,
+				ACL:  transport.NewACL(policy),
+				Log:  zap.NewNop(),
+			})
+
+			err := tcp.Start(context.Background())
+			Expect(errors.Is(err, transport.ErrACLRequiresAuth)).To(BeTrue())
+		})
+
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var tcp *transport.TCP
+
+				BeforeEach(func() {
+					tokens := transport.NewTokens()
+					tokens.Add("alice", "alice-token")
+					tokens.Add("admin", "admin-token")
+
+					tcp = makeServer(`{"teams": {"a": {"x": 1}, "b": {"y": 2}}, "shared": "s"}`, transport.Options{
+						UseStdlib: useStdlib,
+						Auth:      tokens,
+						ACL:       transport.NewACL(policy),
+					})
+				})
+
+				AfterEach(func() {
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				It("forbids reads outside the principal's grants", func() {
+					conn, err := net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					defer conn.Close()
+
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+					r := bufio.NewReader(conn)
+
+					_, err = conn.Write([]byte("0001AUTH alice-token\n0002GET teams.a.x\n0003GET teams.b.y\n0004GET teams\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespOk))
+
+					// GETs for different keys can be responded to in any order
+					responses := make(map[string]*protocol.Response)
+					for n := 0; n < 3; n++ {
+						resp, err = protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+
+						responses[string(resp.RequestID[:])] = resp
+					}
+
+					Expect(responses["0002"].Type).To(Equal(protocol.RespGet))
+					Expect(string(responses["0002"].Value)).To(Equal("1"))
+
+					Expect(errors.Is(responses["0003"].ErrorOrNil(), protocol.ErrForbidden)).To(BeTrue())
+					Expect(errors.Is(responses["0004"].ErrorOrNil(), protocol.ErrForbidden)).To(BeTrue())
+				})
+
+				It("forbids writes outside the principal's grants", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+
+					conn := client.New(zap.NewNop(), client.WithToken("alice-token"))
+					Expect(conn.Connect(ctx, "127.0.0.1:6682")).To(Succeed())
+					defer conn.Disconnect()
+
+					err := conn.Set(ctx, "shared", []byte(`"t"`))
+					Expect(errors.Is(err, protocol.ErrForbidden)).To(BeTrue())
+
+					err = conn.Delete(ctx, "teams.b")
+					Expect(errors.Is(err, protocol.ErrForbidden)).To(BeTrue())
+
+					Expect(conn.Set(ctx, "teams.a.x", []byte("2"))).To(Succeed())
+					Expect(conn.Delete(ctx, "teams.a.x")).To(Succeed())
+
+					value, err := tcp.Store().Get(ctx, []byte("teams"))
+					Expect(err).To(Succeed())
+					Expect(value).To(MatchJSON(`{"a": {}, "b": {"y": 2}}`))
+				})
+
+				It("only sends updates within the principal's grants", func() {
+					conn, err := net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					defer conn.Close()
+
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+					r := bufio.NewReader(conn)
+
+					_, err = conn.Write([]byte("0001AUTH alice-token\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespOk))
+
+					ctx := context.Background()
+
+					// Outside of the grant, alice isn't sent this
+					Expect(tcp.Store().Set(ctx, []byte("teams.b.y"), 3)).To(Succeed())
+
+					// An ancestor of the grant, alice is sent the part she can see
+					Expect(tcp.Store().Set(ctx, []byte("teams"), map[string]interface{}{
+						"a": map[string]interface{}{"x": 4},
+						"b": map[string]interface{}{"y": 5},
+					})).To(Succeed())
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespUpdate))
+					Expect(resp.Args[0]).To(BeEquivalentTo("teams.a"))
+					Expect(resp.Value).To(MatchJSON(`{"x": 4}`))
+
+					Expect(tcp.Store().Delete(ctx, []byte("teams"))).To(Succeed())
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Args[0]).To(BeEquivalentTo("teams.a"))
+					Expect(string(resp.Value)).To(Equal("null"))
+
+					Expect(tcp.Store().Set(ctx, []byte("teams.a.x"), 6)).To(Succeed())
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Args[0]).To(BeEquivalentTo("teams.a.x"))
+					Expect(string(resp.Value)).To(Equal("6"))
+				})
+			})
+		}
+	})
+})
@@ -0,0 +1,195 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultPrincipal names the tokens that aren't given a name of their own
+	DefaultPrincipal = "default"
+)
+
+var (
+	ErrInvalidTokenHash = errors.New("Token hash must be a hex encoded SHA-256 digest")
+	ErrInvalidTokenLine = errors.New("Token line must be a token, or a principal and a token")
+)
+
+// TokenSource decides which tokens clients can AUTH with.
+type TokenSource interface {
+	// Authenticate returns the name of the principal that token belongs to, or
+	// false if it isn't valid.
+	Authenticate(token []byte) (string, bool)
+}
+
+// Tokens is a TokenSource that holds the SHA-256 digest of each valid token,
+// so that tokens can be configured without storing them in plain text. It's
+// safe for concurrent use once the tokens have been added.
+type Tokens struct {
+	tokens []namedDigest
+}
+
+type namedDigest struct {
+	principal string
+	digest    [sha256.Size]byte
+}
+
+// NewTokens returns an empty set of tokens, which doesn't authenticate anything.
+func NewTokens() *Tokens {
+	return &Tokens{}
+}
+
+// Add adds a token that authenticates as principal.
+func (t *Tokens) Add(principal, token string) {
+	t.tokens = append(t.tokens, namedDigest{
+		principal: principal,
+		digest:    sha256.Sum256([]byte(token)),
+	})
+}
+
+// AddHashed adds a token by its hex encoded SHA-256 digest, such as the output
+// of `sha256sum`.
+func (t *Tokens) AddHashed(principal, digest string) error {
+	raw, err := hex.DecodeString(digest)
+	if err != nil || len(raw) != sha256.Size {
+		return fmt.Errorf("Failed to add token for %s %w", principal, ErrInvalidTokenHash)
+	}
+
+	token := namedDigest{principal: principal}
+	copy(token.digest[:], raw)
+
+	t.tokens = append(t.tokens, token)
+	return nil
+}
+
+// LoadFile adds every token in the file at path. Each line is a token, which
+// can be preceded by the name of its principal and a space, otherwise it's
+// DefaultPrincipal. Blank lines, and lines that start with #, are ignored, and
+// lines with anything more are rejected. If hashed is true then the tokens are
+// hex encoded SHA-256 digests.
+func (t *Tokens) LoadFile(path string, hashed bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Failed to open token file %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		principal, token := DefaultPrincipal, line
+		switch fields := strings.Fields(line); len(fields) {
+		case 1:
+		case 2:
+			principal, token = fields[0], fields[1]
+
+		default:
+			return fmt.Errorf("Failed to load %s line %d %w", path, n, ErrInvalidTokenLine)
+		}
+
+		if !hashed {
+			t.Add(principal, token)
+			continue
+		}
+
+		if err := t.AddHashed(principal, token); err != nil {
+			return fmt.Errorf("Failed to load %s line %d %w", path, n, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Failed to read token file %w", err)
+	}
+
+	return nil
+}
+
+// Len returns how many tokens there are.
+func (t *Tokens) Len() int {
+	return len(t.tokens)
+}
+
+// Authenticate compares the digest of token with every token's, in constant
+// time so that how long it takes doesn't reveal anything about them.
+func (t *Tokens) Authenticate(token []byte) (string, bool) {
+	digest := sha256.Sum256(token)
+
+	principal, ok := "", false
+	for _, candidate := range t.tokens {
+		if subtle.ConstantTimeCompare(digest[:], candidate.digest[:]) == 1 && !ok {
+			principal, ok = candidate.principal, true
+		}
+	}
+
+	return principal, ok
+}
+
+var _ TokenSource = (*Tokens)(nil)
+
+// authState is whether a connection has authenticated. It's safe for concurrent
+// use, as requests can be executed by workers.
+type authState struct {
+	// required is false if the server doesn't require authentication
+	required bool
+
+	mu            sync.RWMutex
+	authenticated bool
+	principal     string
+}
+
+func newAuthState(options Options) *authState {
+	return &authState{required: options.Auth != nil}
+}
+
+// allowed returns true if the connection can make any request, and be sent
+// updates
+func (a *authState) allowed() bool {
+	if !a.required {
+		return true
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.authenticated
+}
+
+func (a *authState) authenticate(principal string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.authenticated = true
+	a.principal = principal
+}
+
+// principalName returns the principal that the connection authenticated as, or
+// false if it hasn't
+func (a *authState) principalName() (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.principal, a.authenticated
+}
+
+// Principal returns the name of the principal that the client making the
+// request authenticated as, or false if it hasn't authenticated.
+func Principal(ctx context.Context) (string, bool) {
+	s, ok := ctx.Value(sessionKey{}).(session)
+	if !ok {
+		return "", false
+	}
+
+	return s.auth().principalName()
+}
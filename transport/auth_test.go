@@ -0,0 +1,234 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("auth", func() {
+		Describe("Tokens", func() {
+			It("authenticates tokens as their principal", func() {
+				digest := sha256.Sum256([]byte("hashed"))
+
+				tokens := transport.NewTokens()
+				tokens.Add("alice", "plain")
+				Expect(tokens.AddHashed("bob", hex.EncodeToString(digest[:]))).To(Succeed())
+
+				principal, ok := tokens.Authenticate([]byte("plain"))
+				Expect(ok).To(BeTrue())
+				Expect(principal).To(Equal("alice"))
+
+				principal, ok = tokens.Authenticate([]byte("hashed"))
+				Expect(ok).To(BeTrue())
+				Expect(principal).To(Equal("bob"))
+
+				_, ok = tokens.Authenticate([]byte("wrong"))
+				Expect(ok).To(BeFalse())
+			})
+
+			It("rejects invalid hashes", func() {
+				err := transport.NewTokens().AddHashed("bob", "not hex")
+				Expect(errors.Is(err, transport.ErrInvalidTokenHash)).To(BeTrue())
+			})
+
+			It("loads tokens from a file", func() {
+				dir, err := ioutil.TempDir("", "pharos-auth")
+				Expect(err).To(Succeed())
+				defer os.RemoveAll(dir)
+
+				path := filepath.Join(dir, "tokens")
+				Expect(ioutil.WriteFile(path, []byte("# Tokens\n\nfirst\nalice second\n"), 0600)).To(Succeed())
+
+				tokens := transport.NewTokens()
+				Expect(tokens.LoadFile(path, false)).To(Succeed())
+				Expect(tokens.Len()).To(Equal(2))
+
+				principal, ok := tokens.Authenticate([]byte("first"))
+				Expect(ok).To(BeTrue())
+				Expect(principal).To(Equal(transport.DefaultPrincipal))
+
+				principal, ok = tokens.Authenticate([]byte("second"))
+				Expect(ok).To(BeTrue())
+				Expect(principal).To(Equal("alice"))
+
+				Expect(errors.Is(tokens.LoadFile(path, true), transport.ErrInvalidTokenHash)).To(BeTrue())
+			})
+
+			It("rejects lines with more than a principal and a token", func() {
+				dir, err := ioutil.TempDir("", "pharos-auth")
+				Expect(err).To(Succeed())
+				defer os.RemoveAll(dir)
+
+				path := filepath.Join(dir, "tokens")
+				Expect(ioutil.WriteFile(path, []byte("first\nalice second\nbob my secret\n"), 0600)).To(Succeed())
+
+				err = transport.NewTokens().LoadFile(path, false)
+				Expect(errors.Is(err, transport.ErrInvalidTokenLine)).To(BeTrue())
+				Expect(err.Error()).To(ContainSubstring("line 3"))
+			})
+		})
+
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var (
+					tcp        *transport.TCP
+					principals *requestLog
+				)
+
+				BeforeEach(func() {
+					tokens := transport.NewTokens()
+					tokens.Add("alice", "s3cret")
+
+					principals = &requestLog{}
+
+					tcp = makeServer("", transport.Options{
+						UseStdlib: useStdlib,
+						Auth:      tokens,
+						Middleware: []transport.Middleware{
+							func(next transport.HandlerFunc) transport.HandlerFunc {
+								return func(ctx context.Context, s transport.Session, req protocol.Request) error {
+									if principal, ok := transport.Principal(ctx); ok {
+										principals.add(principal)
+									}
+
+									return next(ctx, s, req)
+								}
+							},
+						},
+					})
+				})
+
+				AfterEach(func() {
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				dial := func() (net.Conn, *bufio.Reader) {
+					conn, err := net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					return conn, bufio.NewReader(conn)
+				}
+
+				It("refuses requests until the client has authenticated", func() {
+					conn, r := dial()
+					defer conn.Close()
+
+					_, err := conn.Write([]byte("0001GET foo\n0002AUTH wrong\n0003AUTH s3cret\n0004PING\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(errors.Is(resp.ErrorOrNil(), protocol.ErrNoAuth)).To(BeTrue())
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(errors.Is(resp.ErrorOrNil(), protocol.ErrAuthFailed)).To(BeTrue())
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespOk))
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespPong))
+
+					Expect(principals.get()).To(ContainElement("alice"))
+				})
+
+				It("doesn't send updates to clients that haven't authenticated", func() {
+					unauthed, unauthedReader := dial()
+					defer unauthed.Close()
+
+					authed, authedReader := dial()
+					defer authed.Close()
+
+					_, err := authed.Write([]byte("0001AUTH s3cret\n0002SET foo\n\"bar\"\n"))
+					Expect(err).To(Succeed())
+
+					// The writer sees the update once it's been sent to every connection
+					for {
+						resp, err := protocol.ReadResponse(authedReader)
+						Expect(err).To(Succeed())
+
+						if resp.Type == protocol.RespUpdate {
+							break
+						}
+					}
+
+					Expect(unauthed.SetReadDeadline(time.Now().Add(100 * time.Millisecond))).To(Succeed())
+
+					_, err = unauthedReader.ReadByte()
+					var netErr net.Error
+					Expect(errors.As(err, &netErr)).To(BeTrue())
+					Expect(netErr.Timeout()).To(BeTrue())
+				})
+
+				Describe("client", func() {
+					It("authenticates on connect and reconnect", func() {
+						ctx, cancel := context.WithCancel(context.Background())
+						defer cancel()
+
+						conn := client.New(zap.NewNop(), client.WithToken("s3cret"))
+						Expect(conn.Connect(ctx, "127.0.0.1:6682")).To(Succeed())
+						Expect(conn.Set(ctx, "foo", []byte(`"bar"`))).To(Succeed())
+
+						Expect(conn.Reconnect(ctx)).To(Succeed())
+						Expect(conn.Set(ctx, "foo", []byte(`"baz"`))).To(Succeed())
+
+						Expect(conn.Disconnect()).To(Succeed())
+					})
+
+					It("fails to connect with an invalid token", func() {
+						ctx, cancel := context.WithCancel(context.Background())
+						defer cancel()
+
+						conn := client.New(zap.NewNop(), client.WithToken("wrong"))
+						err := conn.Connect(ctx, "127.0.0.1:6682")
+						Expect(errors.Is(err, protocol.ErrAuthFailed)).To(BeTrue())
+					})
+				})
+			})
+		}
+
+		It("rejects AUTH when it isn't enabled", func() {
+			tcp := makeServer("", transport.Options{UseStdlib: true})
+			defer tcp.Close()
+
+			conn, err := net.Dial("tcp", "127.0.0.1:6682")
+			Expect(err).To(Succeed())
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("0001AUTH s3cret\n"))
+			Expect(err).To(Succeed())
+
+			resp, err := protocol.ReadResponse(conn)
+			Expect(err).To(Succeed())
+			Expect(resp.ErrorOrNil()).To(MatchError("Authentication is not enabled"))
+		})
+	})
+})
@@ -0,0 +1,167 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+// message is a message that was published to a channel
+type message struct {
+	channel []byte
+	payload []byte
+}
+
+// channelHub hands the messages that are published to a namespace's channels to
+// each of the server's listeners, which send them on to their subscribers.
+// Messages never touch the namespace's store. It's safe for concurrent use.
+type channelHub struct {
+	mu        sync.RWMutex
+	listeners map[*messageListener]struct{}
+}
+
+// messageListener receives every message that's published until ctx is done
+type messageListener struct {
+	ctx      context.Context
+	messages chan *message
+}
+
+func newChannelHub() *channelHub {
+	return &channelHub{listeners: make(map[*messageListener]struct{})}
+}
+
+// listen returns a channel that receives every message that's published, until
+// ctx is done. Publishing blocks while it's full.
+func (c *channelHub) listen(ctx context.Context) <-chan *message {
+	listener := &messageListener{
+		ctx:      ctx,
+		messages: make(chan *message, storage.SubscriptionBufferSize),
+	}
+
+	c.mu.Lock()
+	c.listeners[listener] = struct{}{}
+	c.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		c.mu.Lock()
+		delete(c.listeners, listener)
+		close(listener.messages)
+		c.mu.Unlock()
+	}()
+
+	return listener.messages
+}
+
+// publish hands msg to every listener
+func (c *channelHub) publish(msg *message) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for listener := range c.listeners {
+		select {
+		case listener.messages <- msg:
+		case <-listener.ctx.Done():
+		}
+	}
+}
+
+// channelSubscriptions are the channels that a connection has subscribed to.
+// They apply to whichever namespace the connection has selected. It's safe for
+// concurrent use.
+type channelSubscriptions struct {
+	mu       sync.RWMutex
+	channels map[string]struct{}
+}
+
+func newChannelSubscriptions() *channelSubscriptions {
+	return &channelSubscriptions{channels: make(map[string]struct{})}
+}
+
+func (c *channelSubscriptions) subscribe(channel []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.channels[string(channel)] = struct{}{}
+}
+
+func (c *channelSubscriptions) unsubscribe(channel []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.channels, string(channel))
+}
+
+func (c *channelSubscriptions) subscribed(channel []byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.channels[string(channel)]
+	return ok
+}
+
+// receives returns true if a connection should be sent msg. The ACL is checked
+// again as it may have been reloaded since the connection subscribed.
+func receives(acl *ACL, auth *authState, subscriptions *channelSubscriptions, msg *message) bool {
+	if !auth.allowed() || !subscriptions.subscribed(msg.channel) {
+		return false
+	}
+
+	if acl == nil {
+		return true
+	}
+
+	principal, _ := auth.principalName()
+	return acl.Allowed(principal, AccessSubscribe, protocol.ChannelKey(msg.channel))
+}
+
+func (h *requestHandler) handlePublish(ctx context.Context, s Session, req protocol.Request) error {
+	publish := req.(*protocol.PublishRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, publish.GetKey()); !ok {
+		return err
+	}
+
+	namespaceFor(ctx).channels.publish(&message{
+		channel: retain(publish.Channel),
+		payload: retain(publish.Message),
+	})
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack PUBLISH %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleSubscribe(ctx context.Context, s Session, req protocol.Request) error {
+	subscribe := req.(*protocol.SubscribeRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessSubscribe, req, subscribe.GetKey()); !ok {
+		return err
+	}
+
+	ctx.Value(sessionKey{}).(session).subscriptions().subscribe(subscribe.Channel)
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack SUBSCRIBE %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleUnsubscribe(ctx context.Context, s Session, req protocol.Request) error {
+	unsubscribe := req.(*protocol.UnsubscribeRequest)
+
+	ctx.Value(sessionKey{}).(session).subscriptions().unsubscribe(unsubscribe.Channel)
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack UNSUBSCRIBE %w", err)
+	}
+
+	return nil
+}
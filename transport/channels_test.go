@@ -0,0 +1,70 @@
+package transport_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("channels", func() {
+		forEachServer(transport.Options{}, func(f *serverFixture) {
+			var publisher, subscriber *client.Conn
+
+			BeforeEach(func() {
+				publisher = f.connect()
+				subscriber = f.connect()
+			})
+
+			It("sends published messages to subscribers, without storing them", func() {
+				Expect(subscriber.Subscribe(f.ctx, "cache.invalidate")).To(Succeed())
+
+				Expect(publisher.Publish(f.ctx, "cache.invalidate", []byte("users"))).To(Succeed())
+
+				var msg *client.Message
+				Eventually(subscriber.MessageChan()).Should(Receive(&msg))
+				Expect(msg.Channel).To(Equal("cache.invalidate"))
+				Expect(msg.Payload).To(Equal([]byte("users")))
+
+				Expect(f.tcp.Store().Backup()).To(Equal([]byte("{}")))
+				Consistently(subscriber.UpdateChan(), 100*time.Millisecond).ShouldNot(Receive())
+			})
+
+			It("only sends messages to the channel's subscribers", func() {
+				Expect(subscriber.Subscribe(f.ctx, "cache.invalidate")).To(Succeed())
+
+				Expect(publisher.Publish(f.ctx, "cache.warm", []byte("users"))).To(Succeed())
+				Consistently(subscriber.MessageChan(), 100*time.Millisecond).ShouldNot(Receive())
+				Consistently(publisher.MessageChan(), 100*time.Millisecond).ShouldNot(Receive())
+
+				Expect(subscriber.Unsubscribe(f.ctx, "cache.invalidate")).To(Succeed())
+
+				Expect(publisher.Publish(f.ctx, "cache.invalidate", []byte("users"))).To(Succeed())
+				Consistently(subscriber.MessageChan(), 100*time.Millisecond).ShouldNot(Receive())
+			})
+
+			It("doesn't coalesce messages", func() {
+				Expect(subscriber.Coalesce(f.ctx, 100*time.Millisecond)).To(Succeed())
+				Expect(subscriber.Subscribe(f.ctx, "cache.invalidate")).To(Succeed())
+
+				for _, payload := range []string{"users", "teams", "users"} {
+					Expect(publisher.Publish(f.ctx, "cache.invalidate", []byte(payload))).To(Succeed())
+				}
+
+				var payloads []string
+				for len(payloads) < 3 {
+					var msg *client.Message
+					Eventually(subscriber.MessageChan()).Should(Receive(&msg))
+
+					payloads = append(payloads, string(msg.Payload))
+				}
+
+				Expect(payloads).To(Equal([]string{"users", "teams", "users"}))
+			})
+		})
+	})
+})
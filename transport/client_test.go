@@ -0,0 +1,65 @@
+package transport_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("client", func() {
+	forEachServer(transport.Options{}, func(f *serverFixture) {
+		var conn *client.Conn
+
+		BeforeEach(func() {
+			conn = f.connect()
+		})
+
+		It("reads responses as soon as it's connected", func() {
+			pingCtx, cancel := context.WithTimeout(f.ctx, time.Second)
+			defer cancel()
+
+			Expect(conn.Ping(pingCtx)).To(Succeed())
+		})
+
+		It("sets keys", func() {
+			Expect(conn.Set(f.ctx, "services.api.port", []byte("8080"))).To(Succeed())
+
+			backup, err := f.tcp.Store().Backup()
+			Expect(err).To(Succeed())
+			Expect(gjson.GetBytes(backup, "services.api.port").String()).To(Equal("8080"))
+		})
+
+		It("drops responses that arrive after their request gave up", func() {
+			// Timeouts around the time a PING takes, so that some responses
+			// arrive just as their requests give up
+			for n := 0; n < 2000; n++ {
+				pingCtx, cancel := context.WithTimeout(f.ctx, time.Duration(n%100)*time.Microsecond)
+				_ = conn.Ping(pingCtx)
+				cancel()
+			}
+
+			pingCtx, cancel := context.WithTimeout(f.ctx, time.Second)
+			defer cancel()
+
+			Expect(conn.Ping(pingCtx)).To(Succeed())
+			Consistently(conn.Done(), 100*time.Millisecond).ShouldNot(BeClosed())
+		})
+
+		It("never uses request IDs that could be mistaken for pushes", func() {
+			// Request IDs are little endian, so the first byte of the first 256
+			// covers every value, including '\n' and the bytes that pushes
+			// start with
+			for n := 0; n < 300; n++ {
+				pingCtx, cancel := context.WithTimeout(f.ctx, time.Second)
+				Expect(conn.Ping(pingCtx)).To(Succeed())
+				cancel()
+			}
+		})
+	})
+})
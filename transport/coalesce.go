@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+const (
+	// DefaultMaxCoalesceWindow is the longest coalescing window a client may ask
+	// for when Options.MaxCoalesceWindow is not set.
+	DefaultMaxCoalesceWindow = time.Second
+)
+
+// coalescer buffers updates for a connection over a window of time. Multiple
+// updates to the same key within a window collapse to the latest value, and
+// everything pending when the window ends is flushed as a single frame.
+type coalescer struct {
+	mu      sync.Mutex
+	window  time.Duration
+	timer   *time.Timer
+	stopped bool
+
+	// keys preserves the order that keys were first updated in the window
+	keys   [][]byte
+	values map[string][]byte
+
+	// write is handed the frame for each window, it takes ownership of the
+	// frame's reference
+	write func(frame *Frame)
+}
+
+func newCoalescer(write func(frame *Frame)) *coalescer {
+	return &coalescer{
+		values: make(map[string][]byte),
+		write:  write,
+	}
+}
+
+// SetWindow changes the coalescing window. A zero window disables coalescing,
+// anything pending when coalescing is disabled is flushed immediately.
+func (c *coalescer) SetWindow(window time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.window = window
+
+	if window == 0 {
+		c.flushLocked()
+	}
+}
+
+// Add buffers update until the end of the current window. It returns false
+// without buffering the update if coalescing is disabled.
+func (c *coalescer) Add(update *storage.Update) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.window == 0 || c.stopped {
+		return false
+	}
+
+	if _, ok := c.values[string(update.Key)]; !ok {
+		c.keys = append(c.keys, update.Key)
+	}
+
+	c.values[string(update.Key)] = update.Value
+
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flush)
+	}
+
+	return true
+}
+
+// Stop discards anything pending and stops any further flushes.
+func (c *coalescer) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = true
+	c.reset()
+}
+
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushLocked()
+}
+
+// flushLocked writes everything pending. The lock is held while writing so
+// that consecutive windows can't be written out of order.
+func (c *coalescer) flushLocked() {
+	if c.stopped || len(c.keys) == 0 {
+		c.reset()
+		return
+	}
+
+	frame := newFrame()
+
+	if len(c.keys) == 1 {
+		frame.buf = protocol.AppendUpdate(frame.buf, c.keys[0], c.values[string(c.keys[0])])
+	} else {
+		values := make([][]byte, 0, len(c.keys))
+		for _, key := range c.keys {
+			values = append(values, c.values[string(key)])
+		}
+
+		frame.buf = protocol.AppendUpdateBatch(frame.buf, c.keys, values)
+	}
+
+	c.reset()
+	c.write(frame)
+}
+
+func (c *coalescer) reset() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+
+	c.keys = nil
+	c.values = make(map[string][]byte)
+}
@@ -0,0 +1,415 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+const (
+	// DefaultRequestTimeout is the default for Options.RequestTimeout
+	DefaultRequestTimeout = 3 * time.Second
+)
+
+var (
+	// errQuit is returned by requestHandler.execute when the client has asked to QUIT
+	errQuit = errors.New("Client quit")
+
+	// reservedPaths are where the server stores the state of locks and queues.
+	// Clients can read and subscribe to them, but only the server writes to them.
+	reservedPaths = [][]byte{
+		bytes.TrimSuffix([]byte(protocol.LockPrefix), []byte(".")),
+		bytes.TrimSuffix([]byte(protocol.QueuePrefix), []byte(".")),
+	}
+)
+
+// Session is a client connection, as seen by command handlers. Each transport
+// has its own connection type that implements it.
+type Session interface {
+	// Write queues a response to be written to the client
+	io.Writer
+
+	// Context is cancelled when the connection closes
+	Context() context.Context
+
+	// SetCoalesceWindow changes how long updates are buffered for before being
+	// written to the client
+	SetCoalesceWindow(window time.Duration)
+
+	// Identity is the client's verified TLS certificate, or nil
+	Identity() *Identity
+
+	// RemoteAddr is the client's address
+	RemoteAddr() net.Addr
+}
+
+// session is the parts of a connection that only builtin commands need
+type session interface {
+	Session
+
+	// limiter limits how fast the client can make requests
+	limiter() *rateLimiter
+
+	// auth is whether the client has authenticated
+	auth() *authState
+
+	// namespace is the namespace that the client has selected
+	namespace() *namespaceState
+
+	// subscriptions are the channels that the client has subscribed to
+	subscriptions() *channelSubscriptions
+
+	// watches are the paths that the client has watched
+	watches() *watchSet
+
+	// waits counts the client's requests that are waiting, like a LOCK for
+	// its lock to be released
+	waits() *waitCounter
+}
+
+// sessionKey is the context key of the session that a request was made on, so
+// that builtin commands can reach it even if middleware has wrapped it
+type sessionKey struct{}
+
+// requestHandler executes client requests. It's shared between transports so
+// a request behaves the same way regardless of how the client is connected.
+type requestHandler struct {
+	registry *Registry
+	options  Options
+
+	// dispatch executes requests through the middleware
+	dispatch HandlerFunc
+}
+
+func newRequestHandler(options Options) *requestHandler {
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = DefaultRequestTimeout
+	}
+
+	if options.Registry == nil {
+		options.Registry = defaultRegistry
+	}
+
+	h := &requestHandler{
+		registry: options.Registry,
+		options:  options,
+	}
+
+	h.dispatch = chainMiddleware(options.Middleware, h.dispatchCommand)
+
+	return h
+}
+
+// readRequest reads a request for any of the registered commands from r
+func (h *requestHandler) readRequest(r io.Reader) (protocol.Request, error) {
+	return h.registry.commands.ReadRequest(r)
+}
+
+// requestKey returns the key that req operates on, if it operates on one.
+// Requests for the same key must be executed in the order they were received,
+// others can be executed concurrently.
+func requestKey(req protocol.Request) ([]byte, bool) {
+	if keyed, ok := req.(protocol.KeyedRequest); ok {
+		return keyed.GetKey(), true
+	}
+
+	return nil, false
+}
+
+// waitsForOthers returns true for the requests that everything before them is
+// responded to before they're executed. Requests before a SELECT use the
+// namespace that was selected when they were made.
+func waitsForOthers(req protocol.Request) bool {
+	switch req.(type) {
+	case *protocol.QuitRequest, *protocol.SelectRequest:
+		return true
+	}
+
+	return false
+}
+
+// admit rejects req if it exceeds the client's rate limits, or if the client
+// has to AUTH first, in which case it returns true. It must be called in the
+// order that requests are received.
+//
+// Authentication is checked before the namespace's write limit, which is shared
+// by every connection in the namespace, so that clients that haven't
+// authenticated can't use it up.
+func (h *requestHandler) admit(s session, req protocol.Request) (bool, error) {
+	if errMsg, ok := s.limiter().allow(req); !ok {
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeRateLimited, errMsg); err != nil {
+			return true, fmt.Errorf("Failed to reject rate limited request %w", err)
+		}
+
+		return true, nil
+	}
+
+	if !s.auth().allowed() && !allowedBeforeAuth(req) {
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeNoAuth, "Authentication required"); err != nil {
+			return true, fmt.Errorf("Failed to reject unauthenticated request %w", err)
+		}
+
+		return true, nil
+	}
+
+	if isWrite(req) && !s.namespace().current().writes.allow(time.Now()) {
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeRateLimited, "Too many writes to namespace"); err != nil {
+			return true, fmt.Errorf("Failed to reject rate limited request %w", err)
+		}
+
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// allowedBeforeAuth returns true for the commands that clients can make before
+// they've authenticated
+func allowedBeforeAuth(req protocol.Request) bool {
+	switch req.GetCommand() {
+	case protocol.AUTH, protocol.HEARTBEAT, protocol.QUIT:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// execute executes req and writes the response to s. It returns errQuit once
+// the client has been told that it's QUIT was successful.
+func (h *requestHandler) execute(s session, req protocol.Request) error {
+	ctx, cancel := context.WithTimeout(s.Context(), h.options.RequestTimeout)
+	defer cancel()
+
+	ctx = context.WithValue(ctx, sessionKey{}, s)
+
+	return h.dispatch(ctx, s, req)
+}
+
+// dispatchCommand executes req with the handler for its command, it's the
+// innermost HandlerFunc of the middleware chain.
+func (h *requestHandler) dispatchCommand(ctx context.Context, s Session, req protocol.Request) error {
+	handler, ok := h.registry.handler(req.GetCommand())
+	if !ok {
+		if err := protocol.WriteError(s, req.GetRequestID(), "Unknown command"); err != nil {
+			return fmt.Errorf("Failed to reject unknown command %w", err)
+		}
+
+		return nil
+	}
+
+	return handler(h, ctx, s, req)
+}
+
+func (h *requestHandler) handlePing(_ context.Context, s Session, req protocol.Request) error {
+	if err := protocol.WriteString(s, req.GetRequestID(), "PONG"); err != nil {
+		return fmt.Errorf("Failed to respond to PING %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleQuit(_ context.Context, s Session, req protocol.Request) error {
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to acknowledge QUIT %w", err)
+	}
+
+	return errQuit
+}
+
+func (h *requestHandler) handleSet(ctx context.Context, s Session, req protocol.Request) error {
+	set := req.(*protocol.SetRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, set.Key); !ok {
+		return err
+	}
+
+	if ok, err := checkWritable(s, req, set.Key); !ok {
+		return err
+	}
+
+	// Ephemeral keys are owned by the connection, rather than any middleware
+	// that wraps it
+	var owner session
+	if set.Ephemeral {
+		owner = ctx.Value(sessionKey{}).(session)
+	}
+
+	ns := namespaceFor(ctx)
+
+	if err := ns.store.Set(ctx, set.Key, set.Value); err != nil {
+		return fmt.Errorf("Failed to set %w", err)
+	}
+
+	ns.ephemeral.wrote(set.Key, owner)
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack set %w", err)
+	}
+
+	return nil
+}
+
+// checkWritable rejects req if key is one of the reservedPaths, or is nested
+// beneath one. It returns false if req was rejected.
+func checkWritable(s Session, req protocol.Request, key []byte) (bool, error) {
+	for _, path := range reservedPaths {
+		if !storage.HasPathPrefix(key, path) {
+			continue
+		}
+
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeForbidden, "Key is reserved"); err != nil {
+			return false, fmt.Errorf("Failed to reject %s %w", req.GetCommand(), err)
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (h *requestHandler) handleGet(ctx context.Context, s Session, req protocol.Request) error {
+	get := req.(*protocol.GetRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessRead, req, get.Key); !ok {
+		return err
+	}
+
+	value, err := namespaceFor(ctx).store.Get(ctx, get.Key)
+	if err != nil {
+		return fmt.Errorf("Failed to get %w", err)
+	}
+
+	if err := protocol.WriteLines(s, req.GetRequestID(), protocol.PrefixGet, value); err != nil {
+		return fmt.Errorf("Failed to reply to get %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleDel(ctx context.Context, s Session, req protocol.Request) error {
+	del := req.(*protocol.DelRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, del.Key); !ok {
+		return err
+	}
+
+	if ok, err := checkWritable(s, req, del.Key); !ok {
+		return err
+	}
+
+	ns := namespaceFor(ctx)
+
+	if err := ns.store.Delete(ctx, del.Key); err != nil {
+		return fmt.Errorf("Failed to delete %w", err)
+	}
+
+	ns.ephemeral.wrote(del.Key, nil)
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack delete %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleCoalesce(_ context.Context, s Session, req protocol.Request) error {
+	coalesce := req.(*protocol.CoalesceRequest)
+
+	if coalesce.Window > h.options.MaxCoalesceWindow {
+		errMsg := fmt.Sprintf("Coalesce window must be at most %dms", h.options.MaxCoalesceWindow.Milliseconds())
+		if err := protocol.WriteError(s, req.GetRequestID(), errMsg); err != nil {
+			return fmt.Errorf("Failed to reject coalesce %w", err)
+		}
+
+		return nil
+	}
+
+	s.SetCoalesceWindow(coalesce.Window)
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack coalesce %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleHeartbeat(_ context.Context, _ Session, _ protocol.Request) error {
+	// Heartbeats aren't responded to. Receiving it is enough to show that the
+	// client is alive, which the transport has already noted.
+	return nil
+}
+
+func (h *requestHandler) handleAuth(ctx context.Context, s Session, req protocol.Request) error {
+	auth := req.(*protocol.AuthRequest)
+
+	if h.options.Auth == nil {
+		if err := protocol.WriteError(s, req.GetRequestID(), "Authentication is not enabled"); err != nil {
+			return fmt.Errorf("Failed to reject AUTH %w", err)
+		}
+
+		return nil
+	}
+
+	principal, ok := h.options.Auth.Authenticate(auth.Token)
+	if !ok {
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeAuthFailed, "Invalid token"); err != nil {
+			return fmt.Errorf("Failed to reject AUTH %w", err)
+		}
+
+		return nil
+	}
+
+	ctx.Value(sessionKey{}).(session).auth().authenticate(principal)
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack AUTH %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleSelect(ctx context.Context, s Session, req protocol.Request) error {
+	sel := req.(*protocol.SelectRequest)
+
+	holder := ctx.Value(sessionKey{}).(session)
+
+	if !holder.namespace().selectNamespace(string(sel.Namespace)) {
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeNoNamespace, "Unknown namespace"); err != nil {
+			return fmt.Errorf("Failed to reject SELECT %w", err)
+		}
+
+		return nil
+	}
+
+	// Watches belong to the namespace they were made in
+	holder.watches().clear()
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack SELECT %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleHelp(_ context.Context, s Session, req protocol.Request) error {
+	if err := protocol.WriteHelp(s, req.GetRequestID(), h.registry.Commands()); err != nil {
+		return fmt.Errorf("Failed to respond to HELP %w", err)
+	}
+
+	return nil
+}
+
+// retain returns a copy of b, which is part of a request. A request's buffer is
+// reused once it has been executed, so anything that's kept after that needs a
+// copy of its own.
+func retain(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
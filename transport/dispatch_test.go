@@ -0,0 +1,194 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+	"github.com/luma/pharos/transport"
+)
+
+// slowStore delays every Set of the key "slow", and reports the deadline that
+// each Set was given
+type slowStore struct {
+	storage.Store
+
+	delay     time.Duration
+	deadlines chan time.Duration
+}
+
+func (s *slowStore) Set(ctx context.Context, key []byte, value interface{}) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		select {
+		case s.deadlines <- time.Until(deadline):
+		default:
+		}
+	}
+
+	if string(key) == "slow" {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return s.Store.Set(ctx, key, value)
+}
+
+var _ = Describe("transport", func() {
+	Describe("request dispatch", func() {
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var (
+					tcp   *transport.TCP
+					store *slowStore
+					conn  net.Conn
+					r     *bufio.Reader
+				)
+
+				start := func(options transport.Options) {
+					log, err := zap.NewDevelopment()
+					Expect(err).To(Succeed())
+
+					store = &slowStore{
+						Store:     storage.NewInmemoryStore(),
+						delay:     300 * time.Millisecond,
+						deadlines: make(chan time.Duration, 1),
+					}
+
+					options.Log = log
+					options.Port = 6682
+					options.NumListeners = 1
+					options.Reuseport = true
+					options.UseStdlib = useStdlib
+					options.Store = store
+
+					tcp = transport.NewTCP(options)
+					Expect(tcp.Start(context.Background())).To(Succeed())
+
+					conn, err = net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					r = bufio.NewReader(conn)
+				}
+
+				AfterEach(func() {
+					conn.Close()
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				// responses reads the responses to n requests, skipping any updates
+				responses := func(n int) []*protocol.Response {
+					var resps []*protocol.Response
+
+					for len(resps) < n {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+
+						if resp.Type != protocol.RespUpdate {
+							resps = append(resps, resp)
+						}
+					}
+
+					return resps
+				}
+
+				It("doesn't hold up other requests behind a slow one", func() {
+					start(transport.Options{})
+
+					_, err := conn.Write([]byte("0001SET slow\n1\n0002SET fast\n2\n0003PING\n"))
+					Expect(err).To(Succeed())
+
+					resps := responses(3)
+					Expect(string(resps[2].RequestID[:])).To(Equal("0001"))
+				})
+
+				It("doesn't hold up other connections behind a slow request", func() {
+					start(transport.Options{})
+
+					_, err := conn.Write([]byte("0001SET slow\n1\n"))
+					Expect(err).To(Succeed())
+
+					other, err := net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					defer other.Close()
+
+					began := time.Now()
+
+					_, err = other.Write([]byte("0002PING\n"))
+					Expect(err).To(Succeed())
+
+					Expect(other.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+					resp, err := protocol.ReadResponse(bufio.NewReader(other))
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespPong))
+					Expect(time.Since(began)).To(BeNumerically("<", store.delay))
+				})
+
+				It("executes requests for the same key in order", func() {
+					start(transport.Options{})
+
+					_, err := conn.Write([]byte("0001SET slow\n1\n0002SET slow\n2\n0003GET slow\n"))
+					Expect(err).To(Succeed())
+
+					resps := responses(3)
+					for i, id := range []string{"0001", "0002", "0003"} {
+						Expect(string(resps[i].RequestID[:])).To(Equal(id))
+					}
+
+					Expect(string(resps[2].Value)).To(Equal(`"2"`))
+				})
+
+				It("executes requests for overlapping paths in order", func() {
+					start(transport.Options{})
+
+					_, err := conn.Write([]byte("0001SET slow\n1\n0002GET slow.port\n"))
+					Expect(err).To(Succeed())
+
+					resps := responses(2)
+					Expect(string(resps[0].RequestID[:])).To(Equal("0001"))
+					Expect(string(resps[1].RequestID[:])).To(Equal("0002"))
+				})
+
+				It("responds to everything before a QUIT first", func() {
+					start(transport.Options{})
+
+					_, err := conn.Write([]byte("0001SET slow\n1\n0002QUIT\n"))
+					Expect(err).To(Succeed())
+
+					resps := responses(2)
+					Expect(string(resps[0].RequestID[:])).To(Equal("0001"))
+					Expect(resps[1].Type).To(Equal(protocol.RespOk))
+					Expect(string(resps[1].RequestID[:])).To(Equal("0002"))
+				})
+
+				It("bounds requests by the request timeout", func() {
+					start(transport.Options{RequestTimeout: 50 * time.Millisecond})
+
+					_, err := conn.Write([]byte("0001SET foo\n1\n"))
+					Expect(err).To(Succeed())
+
+					var deadline time.Duration
+					Eventually(store.deadlines).Should(Receive(&deadline))
+					Expect(deadline).To(BeNumerically("<=", 50*time.Millisecond))
+				})
+			})
+		}
+	})
+})
@@ -0,0 +1,104 @@
+package transport_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("elections", func() {
+		forEachServer(transport.Options{}, func(f *serverFixture) {
+			elect := func() *client.Election {
+				election, err := client.NewElection(f.ctx, f.connect(), "scheduler", 300*time.Millisecond)
+				Expect(err).To(Succeed())
+
+				return election
+			}
+
+			It("refuses TTLs that are too short to renew the term in", func() {
+				conn := f.connect()
+
+				for _, ttl := range []time.Duration{0, time.Nanosecond, client.MinElectionTTL - 1} {
+					_, err := client.NewElection(f.ctx, conn, "scheduler", ttl)
+					Expect(err).To(MatchError(client.ErrElectionTTL))
+				}
+			})
+
+			It("elects one candidate at a time", func() {
+				first, second := elect(), elect()
+
+				term, err := first.Campaign(f.ctx, "first")
+				Expect(err).To(Succeed())
+				Expect(term.ID).To(Equal("first"))
+
+				elected := make(chan *client.Term, 1)
+				go func() {
+					defer GinkgoRecover()
+
+					term, err := second.Campaign(f.ctx, "second")
+					Expect(err).To(Succeed())
+
+					elected <- term
+				}()
+
+				// The leader keeps renewing its term for longer than the TTL
+				Consistently(elected, time.Second).ShouldNot(Receive())
+				Consistently(term.Done()).ShouldNot(BeClosed())
+
+				Expect(term.Resign(f.ctx)).To(Succeed())
+
+				var next *client.Term
+				Eventually(elected).Should(Receive(&next))
+				Expect(next.ID).To(Equal("second"))
+				Expect(next.Token).To(BeNumerically(">", term.Token))
+			})
+
+			It("lets candidates observe the leader", func() {
+				leader, observer := elect(), elect()
+
+				leaders := observer.Observe(f.ctx)
+				Eventually(leaders).Should(Receive(Equal(client.Leader{})))
+
+				campaignCtx, resign := context.WithCancel(f.ctx)
+				term, err := leader.Campaign(campaignCtx, "leader")
+				Expect(err).To(Succeed())
+
+				Eventually(leaders).Should(Receive(Equal(term.Leader)))
+				Expect(observer.Leader()).To(Equal(term.Leader))
+
+				// Resigns once the campaign's context is done
+				resign()
+
+				Eventually(term.Done()).Should(BeClosed())
+				Eventually(leaders).Should(Receive(Equal(client.Leader{})))
+			})
+
+			It("ends the term when the connection is lost, and campaigns again once it reconnects", func() {
+				election := elect()
+
+				term, err := election.Campaign(f.ctx, "leader")
+				Expect(err).To(Succeed())
+
+				Expect(f.tcp.Close()).To(Succeed())
+				Eventually(term.Done()).Should(BeClosed())
+
+				f.start("")
+
+				campaignCtx, cancelCampaign := context.WithTimeout(f.ctx, 5*time.Second)
+				defer cancelCampaign()
+
+				term, err = election.Campaign(campaignCtx, "leader")
+				Expect(err).To(Succeed())
+				Expect(term.ID).To(Equal("leader"))
+
+				Eventually(election.Leader).Should(Equal(term.Leader))
+			})
+		})
+	})
+})
@@ -0,0 +1,175 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/multierr"
+
+	"github.com/luma/pharos/storage"
+)
+
+// ephemeralKeys are the keys of a namespace that were SET as EPHEMERAL, which
+// are deleted when the connection that owns them closes. It's safe for
+// concurrent use.
+//
+// Every write to the namespace's store is recorded once it has succeeded.
+// Writing to an ephemeral key, or one of its ancestors, without EPHEMERAL takes
+// it out of its owner's hands. Ownership isn't recorded atomically with the
+// write, so that a slow write doesn't hold up the others, which means that when
+// different connections write the same key at the same time either of them may
+// end up owning it.
+type ephemeralKeys struct {
+	// count is how many keys are owned, so that writes don't need the mutex
+	// while there are none
+	count int32
+
+	mu sync.Mutex
+
+	// owners is who owns each ephemeral key, by the top level segment of the
+	// key so that a write only looks at the keys it could affect. owned is the
+	// keys that each connection owns.
+	owners map[string]map[string]session
+	owned  map[session]map[string]struct{}
+}
+
+func newEphemeralKeys() *ephemeralKeys {
+	return &ephemeralKeys{
+		owners: make(map[string]map[string]session),
+		owned:  make(map[session]map[string]struct{}),
+	}
+}
+
+// wrote records that key was written. If owner isn't nil the key becomes owned
+// by it, otherwise key and everything nested beneath it stops being ephemeral.
+func (e *ephemeralKeys) wrote(key []byte, owner session) {
+	if owner == nil && atomic.LoadInt32(&e.count) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.disown(key)
+
+	if owner == nil {
+		return
+	}
+
+	segment := string(topLevelSegment(key))
+
+	owners, ok := e.owners[segment]
+	if !ok {
+		owners = make(map[string]session)
+		e.owners[segment] = owners
+	}
+
+	owners[string(key)] = owner
+
+	keys, ok := e.owned[owner]
+	if !ok {
+		keys = make(map[string]struct{})
+		e.owned[owner] = keys
+	}
+
+	keys[string(key)] = struct{}{}
+	atomic.AddInt32(&e.count, 1)
+}
+
+// disown makes key, and everything nested beneath it, no longer ephemeral. It
+// must be called with the mutex held.
+func (e *ephemeralKeys) disown(key []byte) {
+	// Everything is nested beneath the whole document
+	if len(key) == 0 {
+		for segment := range e.owners {
+			e.disownIn(segment, key)
+		}
+
+		return
+	}
+
+	e.disownIn(string(topLevelSegment(key)), key)
+}
+
+// disownIn makes the keys with the top level segment that are key, or nested
+// beneath it, no longer ephemeral
+func (e *ephemeralKeys) disownIn(segment string, key []byte) {
+	owners := e.owners[segment]
+
+	for owned, owner := range owners {
+		if !storage.HasPathPrefix([]byte(owned), key) {
+			continue
+		}
+
+		delete(owners, owned)
+		delete(e.owned[owner], owned)
+		atomic.AddInt32(&e.count, -1)
+
+		if len(e.owned[owner]) == 0 {
+			delete(e.owned, owner)
+		}
+	}
+
+	if len(owners) == 0 {
+		delete(e.owners, segment)
+	}
+}
+
+// release deletes every key that owner owns from store, subscribers are sent a
+// tombstone for each of them. The keys are deleted once the mutex has been
+// released, so that a slow store doesn't hold up writes to the namespace.
+func (e *ephemeralKeys) release(owner session, store storage.Store) (err error) {
+	e.mu.Lock()
+	keys := e.owned[owner]
+	delete(e.owned, owner)
+
+	for key := range keys {
+		segment := string(topLevelSegment([]byte(key)))
+
+		delete(e.owners[segment], key)
+		if len(e.owners[segment]) == 0 {
+			delete(e.owners, segment)
+		}
+	}
+
+	atomic.AddInt32(&e.count, -int32(len(keys)))
+	e.mu.Unlock()
+
+	for key := range keys {
+		if derr := store.Delete(context.Background(), []byte(key)); derr != nil {
+			err = multierr.Append(err, fmt.Errorf("Failed to delete ephemeral key %s %w", key, derr))
+		}
+	}
+
+	return err
+}
+
+// topLevelSegment returns the first segment of key's path, which is all of it if
+// it isn't nested
+func topLevelSegment(key []byte) []byte {
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '\\':
+			// The next character is escaped, so it's part of the segment
+			i++
+
+		case '.':
+			return key[:i]
+		}
+	}
+
+	return key
+}
+
+// releaseEphemeralKeys deletes the ephemeral keys that s owns in every
+// namespace. It must be called once s has closed, and won't execute any more
+// requests.
+func releaseEphemeralKeys(s session) (err error) {
+	for _, ns := range s.namespace().namespaces.all {
+		err = multierr.Append(err, ns.ephemeral.release(s, ns.store))
+	}
+
+	return err
+}
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// ownerSession is a session that's only used as the owner of ephemeral keys
+type ownerSession struct {
+	session
+}
+
+var _ = Describe("ephemeralKeys (internal)", func() {
+	var (
+		keys  *ephemeralKeys
+		owner *ownerSession
+	)
+
+	BeforeEach(func() {
+		keys = newEphemeralKeys()
+		owner = &ownerSession{}
+	})
+
+	owned := func() []string {
+		var names []string
+		for key := range keys.owned[owner] {
+			names = append(names, key)
+		}
+
+		return names
+	}
+
+	It("only disowns keys that are written or nested beneath the write", func() {
+		keys.wrote([]byte("services.api"), owner)
+		keys.wrote([]byte("services.db"), owner)
+		keys.wrote([]byte("servicesOld"), owner)
+
+		keys.wrote([]byte("services.api"), nil)
+		Expect(owned()).To(ConsistOf("services.db", "servicesOld"))
+
+		keys.wrote([]byte("services"), nil)
+		Expect(owned()).To(ConsistOf("servicesOld"))
+		Expect(keys.owners).To(HaveLen(1))
+	})
+
+	It("treats escaped separators as part of the segment", func() {
+		keys.wrote([]byte(`a\.b.c`), owner)
+
+		keys.wrote([]byte("a"), nil)
+		Expect(owned()).To(ConsistOf(`a\.b.c`))
+
+		keys.wrote([]byte(`a\.b`), nil)
+		Expect(owned()).To(BeEmpty())
+	})
+
+	It("disowns everything when the whole document is written", func() {
+		keys.wrote([]byte("services.api"), owner)
+		keys.wrote([]byte("config"), owner)
+
+		keys.wrote([]byte(""), nil)
+		Expect(owned()).To(BeEmpty())
+		Expect(keys.owners).To(BeEmpty())
+		Expect(keys.count).To(BeZero())
+	})
+})
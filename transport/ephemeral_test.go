@@ -0,0 +1,98 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("ephemeral keys", func() {
+		forEachServer(transport.Options{HeartbeatInterval: 50 * time.Millisecond}, func(f *serverFixture) {
+			get := func(key string) string {
+				value, err := f.tcp.Store().Get(f.ctx, []byte(key))
+				Expect(err).To(Succeed())
+
+				return string(value)
+			}
+
+			It("deletes the key, and sends a tombstone, when its owner disconnects", func() {
+				watcher, err := net.Dial("tcp", testAddr)
+				Expect(err).To(Succeed())
+				defer watcher.Close()
+
+				Expect(watcher.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+				r := bufio.NewReader(watcher)
+
+				owner := f.connect()
+				Expect(owner.SetEphemeral(f.ctx, "services.api", []byte("up"))).To(Succeed())
+				Expect(get("services.api")).To(Equal(`"up"`))
+
+				Expect(owner.Disconnect()).To(Succeed())
+
+				for {
+					_, err := watcher.Write([]byte("0001HEARTBEAT\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+
+					if resp.Type == protocol.RespUpdate && string(resp.Value) == "null" {
+						Expect(resp.Args[0]).To(BeEquivalentTo("services.api"))
+						break
+					}
+				}
+
+				Expect(get("services.api")).To(BeEmpty())
+			})
+
+			It("keeps keys that were set again without EPHEMERAL", func() {
+				owner := f.connect()
+				Expect(owner.SetEphemeral(f.ctx, "services.api", []byte("up"))).To(Succeed())
+				Expect(owner.SetEphemeral(f.ctx, "services.db", []byte("up"))).To(Succeed())
+
+				other := f.connect()
+				defer other.Disconnect()
+
+				Expect(other.Set(f.ctx, "services.api", []byte("pinned"))).To(Succeed())
+
+				Expect(owner.Disconnect()).To(Succeed())
+
+				Eventually(func() string { return get("services.db") }).Should(BeEmpty())
+				Expect(get("services.api")).To(Equal(`"pinned"`))
+			})
+
+			It("deletes the key when its owner stops answering heartbeats", func() {
+				owner, err := net.Dial("tcp", testAddr)
+				Expect(err).To(Succeed())
+				defer owner.Close()
+
+				_, err = owner.Write([]byte("0001SET services.api EPHEMERAL\nup\n"))
+				Expect(err).To(Succeed())
+
+				Eventually(func() string { return get("services.api") }).Should(Equal(`"up"`))
+
+				// The owner never answers a heartbeat, so it's closed once it's idle
+				Eventually(func() string { return get("services.api") }).Should(BeEmpty())
+			})
+
+			It("deletes the key when the server shuts down gracefully", func() {
+				owner := f.connect()
+				Expect(owner.SetEphemeral(f.ctx, "services.api", []byte("up"))).To(Succeed())
+
+				shutdownCtx, cancel := context.WithTimeout(f.ctx, 5*time.Second)
+				defer cancel()
+
+				Expect(f.tcp.Shutdown(shutdownCtx)).To(Succeed())
+				Expect(get("services.api")).To(BeEmpty())
+			})
+		})
+	})
+})
@@ -0,0 +1,1376 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+const (
+	// eventLoopMaxEvents is the most events we'll handle per epoll_wait
+	eventLoopMaxEvents = 256
+
+	// eventLoopBufferSize is the size of the read and write buffers that each
+	// loop shares between all of its connections
+	eventLoopBufferSize = 64 * 1024
+
+	// maxPartialRequestSize bounds how much of an incomplete request we'll buffer
+	// for a connection before giving up on it
+	maxPartialRequestSize = 1024 * 1024
+
+	// maxConnOutput bounds how much output we'll hold for a connection that the
+	// socket isn't ready for, before deciding that the client has stopped
+	// reading and closing it
+	maxConnOutput = 8 * 1024 * 1024
+
+	// maxQueuedRequests is how many requests a connection can have waiting to be
+	// executed before we stop reading from it, until it has caught up
+	maxQueuedRequests = 1024
+
+	// minTickInterval bounds how often a loop wakes up to check for idle
+	// connections and send heartbeats
+	minTickInterval = 10 * time.Millisecond
+)
+
+// EventLoop serves client connections from a single goroutine using epoll,
+// rather than the pair of goroutines per connection that TCPListener uses. An
+// idle connection costs little more than its file descriptor, which allows a
+// loop to hold very large numbers of mostly idle subscribers.
+//
+// Reads are edge triggered. Requests are parsed and admitted on the loop's
+// goroutine, and then executed on a pool of Options.EventLoopWorkers goroutines
+// so that a slow request doesn't hold up the loop. Reads and writes go through
+// buffers that are shared by every connection on the loop, a connection only
+// holds buffers of its own while it has a partial request, or output that the
+// socket wasn't ready for. Clients that stop reading are closed once they have
+// too much output waiting.
+//
+// Writes from other goroutines, such as updates, are queued for the loop and it
+// is woken via the poller's eventfd.
+type EventLoop struct {
+	ctx context.Context
+
+	addr    string
+	options Options
+	handler *requestHandler
+
+	// connLimiter caps how many connections we accept, TCP shares one between
+	// all of its loops
+	connLimiter *connLimiter
+
+	// namespaces are the namespaces that connections can select, TCP shares one
+	// set between all of its loops
+	namespaces *namespaceSet
+
+	// pool executes requests, it's started by Serve
+	pool *workerPool
+
+	poller       *Poller
+	listener     net.Listener
+	listenerFile *os.File
+	listenerFd   int
+
+	// conns and dirty are only used from the loop's goroutine
+	conns map[int]*loopConn
+	dirty []*loopConn
+
+	// unreleased are connections that were closed while they had requests
+	// executing, their ephemeral keys and locks are released once the requests
+	// have finished. It's only used from the loop's goroutine.
+	unreleased map[*loopConn]struct{}
+
+	readBuf  []byte
+	writeBuf []byte
+
+	// now is when the loop last woke up. Connections use it to note when they
+	// were last read from, rather than each read checking the time.
+	now time.Time
+
+	// tickInterval is how often idle connections are checked for and heartbeats
+	// are sent, zero if neither is enabled
+	tickInterval  time.Duration
+	nextTick      time.Time
+	nextHeartbeat time.Time
+
+	// drainStarted is set by the loop's goroutine once it has begun draining,
+	// drained is closed once it has finished
+	drainStarted bool
+	drainOnce    sync.Once
+	drained      chan struct{}
+
+	// pendingMu guards the fields below, which are how other goroutines hand
+	// writes to the loop
+	pendingMu sync.Mutex
+	pending   []pendingWrite
+	spare     []pendingWrite
+	awake     bool
+	stopped   bool
+	draining  bool
+
+	log *zap.Logger
+}
+
+// pendingWrite is a frame waiting to be handed to a connection by the loop. A
+// nil conn means it's an update, or a message, for every connection in
+// namespace. An update with a conn is from one of that connection's watches.
+//
+// If executed is set there's no frame, instead one of conn's requests has
+// finished executing on lane.
+type pendingWrite struct {
+	conn      *loopConn
+	namespace *namespace
+	update    *storage.Update
+	message   *message
+	frame     *Frame
+
+	executed bool
+	lane     int
+}
+
+func NewEventLoop(
+	ctx context.Context,
+	addr string,
+	options Options,
+	connLimiter *connLimiter,
+	namespaces *namespaceSet,
+	log *zap.Logger,
+) *EventLoop {
+	return &EventLoop{
+		ctx:          ctx,
+		addr:         addr,
+		options:      options,
+		handler:      newRequestHandler(options),
+		connLimiter:  connLimiter,
+		namespaces:   namespaces,
+		conns:        make(map[int]*loopConn),
+		unreleased:   make(map[*loopConn]struct{}),
+		readBuf:      make([]byte, eventLoopBufferSize),
+		writeBuf:     make([]byte, 0, eventLoopBufferSize),
+		drained:      make(chan struct{}),
+		tickInterval: tickInterval(options),
+		log:          log,
+	}
+}
+
+// tickInterval returns how often a loop needs to wake up to notice idle
+// connections, and ones that haven't sent their PROXY header, and to send
+// heartbeats on time
+func tickInterval(options Options) time.Duration {
+	timeouts := []time.Duration{options.HeartbeatInterval, options.IdleTimeout}
+	if options.ProxyProtocol != ProxyProtocolDisabled {
+		timeouts = append(timeouts, proxyHeaderTimeout)
+	}
+
+	var interval time.Duration
+	for _, timeout := range timeouts {
+		if timeout > 0 && (interval == 0 || timeout < interval) {
+			interval = timeout
+		}
+	}
+
+	if interval == 0 {
+		return 0
+	}
+
+	interval /= 4
+	if interval < minTickInterval {
+		interval = minTickInterval
+	}
+
+	return interval
+}
+
+// Listen binds the loop and then serves connections until the loop's context
+// is cancelled.
+func (l *EventLoop) Listen() error {
+	if err := l.Bind(); err != nil {
+		return err
+	}
+
+	return l.Serve()
+}
+
+// Bind starts listening on the loop's address, Serve accepts connections from
+// it. Binding is separate so that callers can find out straight away if the
+// address can't be listened on.
+func (l *EventLoop) Bind() error {
+	return l.listen()
+}
+
+// Serve accepts and serves connections until the loop's context is cancelled.
+// If the loop fails then every connection it was serving is closed, and the
+// loop can't be used again.
+func (l *EventLoop) Serve() error {
+	l.pool = newWorkerPool(l.options.EventLoopWorkers)
+	defer l.cleanup()
+
+	go func() {
+		<-l.ctx.Done()
+		l.wake()
+	}()
+
+	// Listen for storage updates, the subscriptions are cancelled when we stop listening
+	for _, ns := range l.namespaces.all {
+		ns := ns
+		updates := ns.store.ListenToUpdates(l.ctx)
+		defer updates.Cancel()
+
+		go func() {
+			for update := range updates.Updates() {
+				l.broadcast(ns, update)
+			}
+		}()
+
+		messages := ns.channels.listen(l.ctx)
+
+		go func() {
+			for msg := range messages {
+				frame := newFrame()
+				frame.buf = protocol.AppendMessage(frame.buf, msg.channel, msg.payload)
+
+				l.enqueue(pendingWrite{namespace: ns, message: msg, frame: frame})
+			}
+		}()
+	}
+
+	events := make([]syscall.EpollEvent, eventLoopMaxEvents)
+
+	l.now = time.Now()
+	l.nextTick = l.now.Add(l.tickInterval)
+	l.nextHeartbeat = l.now.Add(l.options.HeartbeatInterval)
+
+	for {
+		n, _, err := l.poller.Wait(events, l.waitTimeout())
+		if err != nil {
+			return err
+		}
+
+		l.now = time.Now()
+
+		select {
+		case <-l.ctx.Done():
+			l.log.Info("Event loop stopped")
+			return nil
+
+		default:
+		}
+
+		l.pendingMu.Lock()
+		l.awake = true
+		draining := l.draining
+		l.pendingMu.Unlock()
+
+		for _, event := range events[:n] {
+			l.handleEvent(int(event.Fd), event.Events)
+		}
+
+		l.tick()
+		l.drainPending()
+
+		if draining {
+			l.drain()
+		}
+	}
+}
+
+// readProxyHeader parses the PROXY header from the start of data, and returns
+// its length. It returns false if the header is incomplete, in which case data
+// is kept for when we've read more, or if the connection was closed.
+func (l *EventLoop) readProxyHeader(conn *loopConn, data []byte) (int, bool) {
+	n, addr, err := parseProxyHeader(data)
+
+	switch {
+	case errors.Is(err, errProxyHeaderIncomplete):
+		conn.in = append(conn.in[:0], data...)
+		return 0, false
+
+	case errors.Is(err, ErrNoProxyHeader) && l.options.ProxyProtocol == ProxyProtocolOptional:
+		n = 0
+
+	case err != nil:
+		conn.log.Warn("Failed to read PROXY protocol header, closing connection",
+			zap.Stringer("proxyAddr", conn.remoteAddr),
+			zap.Error(err))
+		l.closeConn(conn)
+		return 0, false
+	}
+
+	conn.awaitingProxyHeader = false
+
+	if addr != nil {
+		conn.log = conn.log.With(zap.Stringer("proxyAddr", conn.remoteAddr))
+		conn.remoteAddr = addr
+	}
+
+	conn.log = conn.log.With(zap.Stringer("remoteAddr", conn.remoteAddr))
+
+	if !l.connLimiter.acquire(conn.remoteAddr) {
+		conn.log.Warn("Too many connections, closing new connection")
+		l.closeConn(conn)
+		return 0, false
+	}
+
+	conn.acquired = true
+	return n, true
+}
+
+// waitTimeout returns how many milliseconds the loop can wait for events
+// before it's next due to tick, or -1 to wait indefinitely
+func (l *EventLoop) waitTimeout() int {
+	if l.tickInterval == 0 {
+		return -1
+	}
+
+	wait := time.Until(l.nextTick)
+	if wait <= 0 {
+		return 0
+	}
+
+	// Round up, so that we don't wake up just before the tick is due
+	return int((wait + time.Millisecond - 1) / time.Millisecond)
+}
+
+// tick closes connections that haven't sent us anything within the idle
+// timeout, and queues heartbeats for the rest when they're due
+func (l *EventLoop) tick() {
+	if l.tickInterval == 0 || l.now.Before(l.nextTick) {
+		return
+	}
+
+	l.nextTick = l.now.Add(l.tickInterval)
+
+	var heartbeat *Frame
+	if l.options.HeartbeatInterval > 0 && !l.now.Before(l.nextHeartbeat) {
+		l.nextHeartbeat = l.now.Add(l.options.HeartbeatInterval)
+
+		heartbeat = newHeartbeatFrame()
+		defer heartbeat.Release()
+	}
+
+	for _, conn := range l.conns {
+		if conn.closing {
+			continue
+		}
+
+		if conn.awaitingProxyHeader && l.now.Sub(conn.accepted) >= proxyHeaderTimeout {
+			conn.log.Warn("Timed out waiting for PROXY protocol header, closing connection")
+			l.closeConn(conn)
+			continue
+		}
+
+		if l.options.IdleTimeout > 0 && l.now.Sub(conn.lastRead) >= l.options.IdleTimeout {
+			conn.log.Info("Client idle, closing",
+				zap.Duration("idleTimeout", l.options.IdleTimeout))
+
+			l.closeConn(conn)
+			continue
+		}
+
+		if heartbeat != nil {
+			conn.queue(heartbeat.Retain())
+		}
+	}
+}
+
+// Close stops the loop. The loop's goroutine closes all connections on its
+// way out.
+func (l *EventLoop) Close() error {
+	l.wake()
+	return nil
+}
+
+// Shutdown stops the loop accepting new connections and drains the active ones.
+// Every client is sent a GOAWAY notice and no further requests are read from
+// it, each connection is closed once everything that was queued for it has
+// been written.
+//
+// If ctx is done before every connection has drained then ctx's error is
+// returned, the remaining connections are closed when the loop stops.
+func (l *EventLoop) Shutdown(ctx context.Context) error {
+	l.pendingMu.Lock()
+	l.draining = true
+	l.pendingMu.Unlock()
+
+	l.wake()
+
+	select {
+	case <-l.drained:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriteUpdate writes update to every connection on the loop in the default
+// namespace. The update is encoded once and the resulting frame is shared
+// between all connections.
+func (l *EventLoop) WriteUpdate(update *storage.Update) error {
+	l.broadcast(l.namespaces.defaultNamespace(), update)
+	return nil
+}
+
+func (l *EventLoop) listen() (err error) {
+	l.listener, err = l.options.listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+
+	filer, ok := l.listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		l.listener.Close()
+		return fmt.Errorf("Event loops require a listener with a file descriptor, got %T", l.listener)
+	}
+
+	// Detach the listener from the Go runtime's own poller, we'll accept on it
+	// ourselves.
+	if l.listenerFile, err = filer.File(); err != nil {
+		l.listener.Close()
+		return err
+	}
+
+	l.listenerFd = int(l.listenerFile.Fd())
+
+	if err = syscall.SetNonblock(l.listenerFd, true); err != nil {
+		l.closeListener()
+		return err
+	}
+
+	poller, err := MakePoller()
+	if err != nil {
+		l.closeListener()
+		return err
+	}
+
+	if err = poller.AddRead(l.listenerFd); err != nil {
+		poller.Close()
+		l.closeListener()
+		return err
+	}
+
+	// Other goroutines use the poller to wake us, so it's published under the
+	// lock that they use
+	l.pendingMu.Lock()
+	l.poller = poller
+	draining := l.draining
+	l.pendingMu.Unlock()
+
+	if draining {
+		// Shutdown was called before we were listening
+		l.wake()
+	}
+
+	return nil
+}
+
+func (l *EventLoop) cleanup() {
+	defer l.drainOnce.Do(func() { close(l.drained) })
+
+	l.pendingMu.Lock()
+	l.stopped = true
+	pending := l.pending
+	l.pending = nil
+	l.pendingMu.Unlock()
+
+	for _, write := range pending {
+		if write.frame != nil {
+			write.frame.Release()
+		}
+	}
+
+	for _, conn := range l.conns {
+		l.closeConn(conn)
+	}
+
+	// The connections' contexts are cancelled, so their requests won't be long.
+	// We're no longer told when they finish, so everything is released once
+	// they all have.
+	l.pool.Stop()
+
+	for conn := range l.unreleased {
+		l.release(conn)
+	}
+
+	l.closeListener()
+
+	if err := l.poller.Close(); err != nil {
+		l.log.Warn("Poller did not close cleanly", zap.Error(err))
+	}
+}
+
+func (l *EventLoop) closeListener() {
+	if l.listenerFile != nil {
+		l.listenerFile.Close()
+		l.listenerFile = nil
+	}
+
+	if l.listener == nil {
+		return
+	}
+
+	if err := l.listener.Close(); err != nil {
+		l.log.Warn("Event loop listener did not close cleanly", zap.Error(err))
+	}
+
+	l.listener = nil
+	l.listenerFd = -1
+}
+
+// drain stops accepting connections and starts closing the active ones, once
+// they've all closed drained is closed. It must be called from the loop's
+// goroutine.
+func (l *EventLoop) drain() {
+	if !l.drainStarted {
+		l.drainStarted = true
+
+		if err := l.poller.Remove(l.listenerFd); err != nil {
+			l.log.Warn("Failed to deregister listener", zap.Error(err))
+		}
+
+		l.closeListener()
+
+		goAway := newFrame()
+		goAway.buf = protocol.AppendGoAway(goAway.buf)
+
+		for _, conn := range l.conns {
+			if conn.closing {
+				continue
+			}
+
+			// Anything that's being coalesced is flushed before the GOAWAY
+			conn.coalescer.SetWindow(0)
+			conn.closing = true
+			conn.in = nil
+
+			l.enqueue(pendingWrite{conn: conn, frame: goAway.Retain()})
+		}
+
+		goAway.Release()
+		l.drainPending()
+	}
+
+	if len(l.conns) == 0 {
+		l.drainOnce.Do(func() { close(l.drained) })
+	}
+}
+
+func (l *EventLoop) handleEvent(fd int, events uint32) {
+	if fd == l.listenerFd {
+		l.accept()
+		return
+	}
+
+	conn, ok := l.conns[fd]
+	if !ok {
+		return
+	}
+
+	if events&(syscall.EPOLLIN|syscall.EPOLLRDHUP|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+		l.read(conn)
+	}
+
+	if events&syscall.EPOLLOUT != 0 && len(conn.out) > 0 {
+		l.markDirty(conn)
+	}
+}
+
+func (l *EventLoop) accept() {
+	for {
+		fd, sa, err := syscall.Accept4(l.listenerFd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err != nil {
+			switch err {
+			case syscall.EINTR, syscall.ECONNABORTED:
+				continue
+
+			case syscall.EAGAIN:
+				// Nothing left to accept
+
+			default:
+				l.log.Error("Failed to accept connection", zap.Error(err))
+			}
+
+			return
+		}
+
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1); err != nil {
+			l.log.Warn("Failed to set TCP_NODELAY", zap.Error(err))
+		}
+
+		remoteAddr := sockaddrToTCPAddr(sa)
+		conn := newLoopConn(l, fd, remoteAddr)
+
+		// Connections through a load balancer are limited once we know the
+		// client's address, from their PROXY header
+		if l.options.ProxyProtocol != ProxyProtocolDisabled {
+			conn.awaitingProxyHeader = true
+		} else if !l.connLimiter.acquire(remoteAddr) {
+			l.log.Warn("Too many connections, closing new connection",
+				zap.Stringer("remoteAddr", remoteAddr))
+			syscall.Close(fd)
+			continue
+		} else {
+			conn.acquired = true
+		}
+
+		if err := l.poller.AddConn(fd); err != nil {
+			l.log.Error("Failed to register connection", zap.Error(err))
+			if conn.acquired {
+				l.connLimiter.release(remoteAddr)
+			}
+			syscall.Close(fd)
+			continue
+		}
+
+		l.conns[fd] = conn
+	}
+}
+
+// read reads everything available on conn and dispatches any complete requests.
+// Connections with too many requests waiting aren't read from until they've
+// caught up, at which point executed reads from them again.
+func (l *EventLoop) read(conn *loopConn) {
+	for !conn.closed {
+		if conn.queued >= maxQueuedRequests {
+			conn.throttled = true
+			return
+		}
+
+		n, err := syscall.Read(conn.fd, l.readBuf)
+
+		switch {
+		case err == syscall.EINTR:
+			continue
+
+		case err == syscall.EAGAIN:
+			return
+
+		case err != nil:
+			l.closeConn(conn)
+			return
+
+		case n == 0:
+			// The client has hung up, finish writing anything we owe it
+			conn.closing = true
+			l.markDirty(conn)
+			return
+		}
+
+		conn.lastRead = l.now
+		l.process(conn, l.readBuf[:n])
+	}
+}
+
+// process parses and dispatches the requests in data. Any trailing partial
+// request is kept until more data arrives.
+func (l *EventLoop) process(conn *loopConn, data []byte) {
+	if len(conn.in) > 0 {
+		conn.in = append(conn.in, data...)
+		data = conn.in
+	}
+
+	if conn.awaitingProxyHeader {
+		n, ok := l.readProxyHeader(conn, data)
+		if !ok {
+			return
+		}
+
+		data = data[n:]
+	}
+
+	for len(data) > 0 && !conn.closing {
+		buf := bytes.NewBuffer(data)
+
+		req, err := l.handler.readRequest(buf)
+		if errors.Is(err, io.EOF) {
+			// We don't have a full request yet
+			break
+		}
+
+		data = data[len(data)-buf.Len():]
+
+		if err != nil {
+			conn.log.Warn("Failed to read client request", zap.Error(err))
+			continue
+		}
+
+		conn.requests = append(conn.requests, req)
+		conn.queued++
+
+		if _, ok := req.(*protocol.QuitRequest); ok {
+			// Nothing after a QUIT is read, the connection is closed once
+			// everything before it has been responded to
+			conn.closing = true
+		}
+	}
+
+	l.schedule(conn)
+
+	switch {
+	case len(data) == 0 || conn.closing:
+		conn.in = nil
+
+	case len(data) > maxPartialRequestSize:
+		conn.log.Warn("Client request is too large, closing connection")
+		l.closeConn(conn)
+
+	default:
+		// data may be the loop's shared read buffer, or a suffix of conn.in.
+		// Either way it must be copied before we return.
+		conn.in = append(conn.in[:0], data...)
+	}
+}
+
+// schedule admits conn's requests and hands them to the pool, as far as their
+// order allows, in the same way that a TCPConn does. Requests for a key run in
+// order on the key's lane, at most one from each lane at a time. Nothing is
+// admitted while a request without a key, such as AUTH, is executing, and QUIT
+// and SELECT wait for everything before them to finish first.
+func (l *EventLoop) schedule(conn *loopConn) {
+	for len(conn.requests) > 0 && !conn.exclusive && !conn.closed {
+		req := conn.requests[0]
+
+		key, ok := requestKey(req)
+		if !ok && waitsForOthers(req) && conn.executing > 0 {
+			return
+		}
+
+		conn.requests[0] = nil
+		conn.requests = conn.requests[1:]
+
+		if rejected, err := l.handler.admit(conn, req); rejected {
+			if err != nil {
+				conn.log.Warn("Failed to handle request", zap.Error(err))
+			}
+
+			conn.queued--
+			continue
+		}
+
+		if !ok {
+			conn.exclusive = true
+			l.submit(conn, req, -1)
+			return
+		}
+
+		if conn.lanes == nil {
+			conn.lanes = make([]loopLane, conn.maxLanes)
+		}
+
+		i := keyShard(key, len(conn.lanes))
+		lane := &conn.lanes[i]
+
+		if lane.busy {
+			lane.queued = append(lane.queued, req)
+			continue
+		}
+
+		lane.busy = true
+		l.submit(conn, req, i)
+	}
+
+	if len(conn.requests) == 0 {
+		conn.requests = nil
+	}
+}
+
+// submit executes req on the pool, the loop is told once it has finished
+func (l *EventLoop) submit(conn *loopConn, req protocol.Request, lane int) {
+	conn.executing++
+
+	l.pool.Submit(func() {
+		if err := l.handler.execute(conn, req); err != nil && !errors.Is(err, errQuit) {
+			conn.log.Warn("Failed to handle request",
+				zap.String("command", string(req.GetCommand())),
+				zap.String("requestID", req.GetRequestID().String()),
+				zap.Error(err))
+		}
+
+		// The response was queued before this, so it's flushed first
+		l.enqueue(pendingWrite{conn: conn, executed: true, lane: lane})
+	})
+}
+
+// executed is called once one of conn's requests has finished executing on
+// lane, or -1 if it didn't have a key. It starts the connection's next
+// requests, and reads from it again if it was waiting to catch up.
+func (l *EventLoop) executed(conn *loopConn, lane int) {
+	conn.executing--
+
+	if conn.closed {
+		if conn.executing == 0 {
+			delete(l.unreleased, conn)
+			l.release(conn)
+		}
+
+		return
+	}
+
+	conn.queued--
+
+	if lane < 0 {
+		conn.exclusive = false
+	} else if next := &conn.lanes[lane]; len(next.queued) > 0 {
+		req := next.queued[0]
+		next.queued[0] = nil
+		next.queued = next.queued[1:]
+
+		l.submit(conn, req, lane)
+	} else {
+		next.busy = false
+		next.queued = nil
+	}
+
+	l.schedule(conn)
+
+	// Closing connections are closed by flush once they're idle
+	l.markDirty(conn)
+
+	if conn.throttled && conn.queued < maxQueuedRequests/2 {
+		conn.throttled = false
+		l.read(conn)
+	}
+}
+
+// broadcast queues update for every connection on the loop.
+func (l *EventLoop) broadcast(ns *namespace, update *storage.Update) {
+	frame := newFrame()
+	frame.buf = protocol.AppendUpdate(frame.buf, update.Key, update.Value)
+
+	l.enqueue(pendingWrite{namespace: ns, update: update, frame: frame})
+}
+
+// enqueue hands write to the loop, waking it if necessary. It's safe to call
+// from any goroutine. It takes ownership of write's frame reference.
+func (l *EventLoop) enqueue(write pendingWrite) {
+	l.pendingMu.Lock()
+
+	if l.stopped {
+		l.pendingMu.Unlock()
+
+		if write.frame != nil {
+			write.frame.Release()
+		}
+
+		return
+	}
+
+	l.pending = append(l.pending, write)
+	wake := !l.awake
+	l.awake = true
+
+	// The trigger happens while we hold the lock so that the poller can't be
+	// closed underneath us
+	if wake {
+		if err := l.poller.Trigger(); err != nil {
+			l.log.Warn("Failed to wake event loop", zap.Error(err))
+		}
+	}
+
+	l.pendingMu.Unlock()
+}
+
+func (l *EventLoop) wake() {
+	l.pendingMu.Lock()
+	defer l.pendingMu.Unlock()
+
+	if l.stopped || l.poller == nil {
+		return
+	}
+
+	if err := l.poller.Trigger(); err != nil {
+		l.log.Warn("Failed to wake event loop", zap.Error(err))
+	}
+}
+
+// drainPending hands queued writes to their connections and flushes them. It
+// keeps going until the queue is empty, at which point the loop is marked as
+// asleep so that the next enqueue will wake it.
+func (l *EventLoop) drainPending() {
+	for {
+		l.pendingMu.Lock()
+		pending := l.pending
+
+		if len(pending) == 0 {
+			l.awake = false
+			l.pendingMu.Unlock()
+			break
+		}
+
+		l.pending = l.spare[:0]
+		l.pendingMu.Unlock()
+
+		for n, write := range pending {
+			switch {
+			case write.executed:
+				l.executed(write.conn, write.lane)
+
+			case write.conn == nil && write.message != nil:
+				l.queueMessage(write.namespace, write.message, write.frame)
+
+			case write.conn == nil:
+				l.queueUpdate(write.namespace, write.update, write.frame)
+
+			case write.conn.closed:
+				write.frame.Release()
+
+			case write.update != nil:
+				l.queueWatchedUpdate(write.conn, write.namespace, write.update, write.frame)
+
+			default:
+				write.conn.queue(write.frame)
+			}
+
+			pending[n] = pendingWrite{}
+		}
+
+		l.spare = pending[:0]
+		l.flushDirty()
+	}
+
+	l.flushDirty()
+}
+
+func (l *EventLoop) queueUpdate(ns *namespace, update *storage.Update, frame *Frame) {
+	defer frame.Release()
+
+	fanout := newUpdateFanout(l.options.ACL, update, frame)
+	defer fanout.release()
+
+	for _, conn := range l.conns {
+		// Connections that watch paths are sent their watches' updates instead
+		if conn.closing || conn.namespaceState.current() != ns || conn.watchSet.watching() {
+			continue
+		}
+
+		conn.queueUpdates(fanout)
+	}
+}
+
+// queueWatchedUpdate queues an update from one of conn's watches of ns
+func (l *EventLoop) queueWatchedUpdate(conn *loopConn, ns *namespace, update *storage.Update, frame *Frame) {
+	defer frame.Release()
+
+	if conn.closing || conn.namespaceState.current() != ns {
+		return
+	}
+
+	fanout := newUpdateFanout(l.options.ACL, update, frame)
+	defer fanout.release()
+
+	conn.queueUpdates(fanout)
+}
+
+// queueMessage queues a message published in ns for the connections that have
+// selected it and subscribed to its channel. Messages aren't coalesced.
+func (l *EventLoop) queueMessage(ns *namespace, msg *message, frame *Frame) {
+	defer frame.Release()
+
+	for _, conn := range l.conns {
+		if conn.closing || conn.namespaceState.current() != ns {
+			continue
+		}
+
+		if !receives(l.options.ACL, conn.authState, conn.channelSubscriptions, msg) {
+			continue
+		}
+
+		conn.queue(frame.Retain())
+	}
+}
+
+func (l *EventLoop) markDirty(conn *loopConn) {
+	if conn.dirty {
+		return
+	}
+
+	conn.dirty = true
+	l.dirty = append(l.dirty, conn)
+}
+
+func (l *EventLoop) flushDirty() {
+	for n, conn := range l.dirty {
+		conn.dirty = false
+		l.flush(conn)
+		l.dirty[n] = nil
+	}
+
+	l.dirty = l.dirty[:0]
+}
+
+// flush writes as much of conn's queued output as the socket will take. Output
+// is assembled in the loop's shared write buffer, only what the socket doesn't
+// accept is copied into a buffer of the connection's own.
+func (l *EventLoop) flush(conn *loopConn) {
+	if conn.closed {
+		return
+	}
+
+	var out []byte
+
+	if len(conn.out) > 0 {
+		// There's a backlog, new output has to go after it
+		for _, frame := range conn.frames {
+			conn.out = append(conn.out, frame.Bytes()...)
+		}
+
+		out = conn.out
+	} else {
+		out = l.writeBuf[:0]
+		for _, frame := range conn.frames {
+			out = append(out, frame.Bytes()...)
+		}
+
+		if cap(out) <= eventLoopBufferSize*4 {
+			l.writeBuf = out[:0]
+		}
+	}
+
+	conn.releaseFrames()
+
+	written, err := writeNonblocking(conn.fd, out)
+	if err != nil {
+		l.closeConn(conn)
+		return
+	}
+
+	switch {
+	case written == len(out):
+		conn.out = nil
+
+	case len(conn.out) > 0:
+		conn.out = append(conn.out[:0], out[written:]...)
+
+	default:
+		conn.out = append([]byte(nil), out[written:]...)
+	}
+
+	if len(conn.out) > maxConnOutput {
+		conn.log.Warn("Client isn't reading what we send it, closing connection",
+			zap.Int("pending", len(conn.out)))
+
+		l.closeConn(conn)
+		return
+	}
+
+	if conn.closing && len(conn.out) == 0 && conn.queued == 0 {
+		l.closeConn(conn)
+	}
+}
+
+func (l *EventLoop) closeConn(conn *loopConn) {
+	if conn.closed {
+		return
+	}
+
+	conn.closed = true
+	conn.cancel()
+	conn.coalescer.Stop()
+	conn.releaseFrames()
+	conn.in = nil
+	conn.out = nil
+
+	// Requests that haven't started are never executed
+	conn.requests = nil
+	conn.lanes = nil
+
+	if err := l.poller.Remove(conn.fd); err != nil {
+		conn.log.Warn("Failed to deregister connection", zap.Error(err))
+	}
+
+	if err := syscall.Close(conn.fd); err != nil {
+		conn.log.Warn("Connection did not close cleanly", zap.Error(err))
+	}
+
+	delete(l.conns, conn.fd)
+
+	if conn.executing > 0 {
+		// The requests that are executing could still acquire locks, or set
+		// ephemeral keys
+		l.unreleased[conn] = struct{}{}
+		return
+	}
+
+	l.release(conn)
+}
+
+// release releases what a connection holds once it has closed and its requests
+// have finished, its ephemeral keys, its locks and its place in the connection
+// limits
+func (l *EventLoop) release(conn *loopConn) {
+	if err := releaseEphemeralKeys(conn); err != nil {
+		conn.log.Warn("Failed to delete ephemeral keys", zap.Error(err))
+	}
+
+	releaseLocks(conn)
+
+	if conn.acquired {
+		l.connLimiter.release(conn.remoteAddr)
+	}
+}
+
+// writeNonblocking writes data to fd until it's all written or the socket
+// would block.
+func writeNonblocking(fd int, data []byte) (int, error) {
+	written := 0
+
+	for written < len(data) {
+		n, err := syscall.Write(fd, data[written:])
+
+		switch {
+		case err == syscall.EINTR:
+			continue
+
+		case err == syscall.EAGAIN:
+			// We'll be told when the socket is writable again
+			return written, nil
+
+		case err != nil:
+			return written, err
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+func sockaddrToTCPAddr(sa syscall.Sockaddr) net.Addr {
+	switch addr := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: append(net.IP(nil), addr.Addr[:]...), Port: addr.Port}
+
+	case *syscall.SockaddrInet6:
+		return &net.TCPAddr{IP: append(net.IP(nil), addr.Addr[:]...), Port: addr.Port}
+	}
+
+	return nil
+}
+
+// loopConn is a client connection that is served by an EventLoop. Other than
+// its session methods, it must only be used from the loop's goroutine.
+type loopConn struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	loop       *EventLoop
+	fd         int
+	remoteAddr net.Addr
+
+	// in holds a partial request, out holds output the socket wasn't ready for.
+	// Both are nil for idle connections.
+	in  []byte
+	out []byte
+
+	// frames are waiting to be flushed
+	frames []*Frame
+
+	dirty   bool
+	closing bool
+	closed  bool
+
+	// lastRead is when we last received something from the client
+	lastRead time.Time
+
+	// accepted is when the connection was accepted, awaitingProxyHeader is true
+	// until its PROXY header has been read if the loop expects one
+	accepted            time.Time
+	awaitingProxyHeader bool
+
+	// acquired is true once the connection counts towards the connection limits
+	acquired bool
+
+	// requests have been read but not yet handed to the loop's pool. lanes
+	// hold the requests for each key that are waiting for the request before
+	// them to finish, there are maxLanes of them once the connection has made a
+	// request. exclusive is set while a request without a key is executing.
+	requests  []protocol.Request
+	lanes     []loopLane
+	maxLanes  int
+	exclusive bool
+
+	// executing is how many requests are on the pool, queued is how many have
+	// been read and not yet finished. throttled is set when we've stopped
+	// reading from the connection until it has fewer requests queued.
+	executing int
+	queued    int
+	throttled bool
+
+	// coalescer buffers updates when the client has asked for them to be coalesced
+	coalescer *coalescer
+
+	rateLimiter    *rateLimiter
+	authState      *authState
+	namespaceState *namespaceState
+
+	// channelSubscriptions are the channels that the client has subscribed to
+	channelSubscriptions *channelSubscriptions
+
+	// watchSet is the paths that the client has watched
+	watchSet *watchSet
+
+	// waitCounter counts the client's requests that are waiting
+	waitCounter *waitCounter
+
+	log *zap.Logger
+}
+
+func newLoopConn(loop *EventLoop, fd int, remoteAddr net.Addr) *loopConn {
+	ctx, cancel := context.WithCancel(loop.ctx)
+
+	maxLanes := loop.options.MaxConcurrentRequests
+	if maxLanes < 1 {
+		maxLanes = DefaultMaxConcurrentRequests
+	}
+
+	conn := &loopConn{
+		ctx:            ctx,
+		cancel:         cancel,
+		loop:           loop,
+		fd:             fd,
+		remoteAddr:     remoteAddr,
+		lastRead:       loop.now,
+		accepted:       loop.now,
+		rateLimiter:    newRateLimiter(loop.options),
+		authState:      newAuthState(loop.options),
+		namespaceState: newNamespaceState(loop.namespaces),
+		maxLanes:       maxLanes,
+		log:            loop.log,
+
+		channelSubscriptions: newChannelSubscriptions(),
+		waitCounter:          newWaitCounter(),
+	}
+
+	conn.coalescer = newCoalescer(func(frame *Frame) {
+		// TODO(rolly) deal with WriteFrame error return
+		conn.WriteFrame(frame)
+		frame.Release()
+	})
+
+	conn.watchSet = newWatchSet(ctx, func(ns *namespace, update *storage.Update) {
+		frame := newFrame()
+		frame.buf = protocol.AppendUpdate(frame.buf, update.Key, update.Value)
+
+		loop.enqueue(pendingWrite{conn: conn, namespace: ns, update: update, frame: frame})
+	})
+
+	return conn
+}
+
+// Write queues data to be written to the client. data is copied, so the caller
+// is free to reuse it once Write returns.
+func (c *loopConn) Write(data []byte) (int, error) {
+	frame := newFrameFrom(data)
+	defer frame.Release()
+
+	if err := c.WriteFrame(frame); err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// WriteFrame queues frame to be written to the client. The connection retains
+// its own reference to frame, so the caller still needs to release theirs.
+func (c *loopConn) WriteFrame(frame *Frame) error {
+	select {
+	case <-c.ctx.Done():
+		return ErrConnClosed
+
+	default:
+	}
+
+	c.loop.enqueue(pendingWrite{conn: c, frame: frame.Retain()})
+	return nil
+}
+
+// Context returns a context that is cancelled when the connection is closed.
+func (c *loopConn) Context() context.Context {
+	return c.ctx
+}
+
+// SetCoalesceWindow changes how long updates are buffered for before being
+// written to the client. A zero window writes updates immediately.
+func (c *loopConn) SetCoalesceWindow(window time.Duration) {
+	c.coalescer.SetWindow(window)
+}
+
+// Identity always returns nil, event loops don't support TLS.
+func (c *loopConn) Identity() *Identity {
+	return nil
+}
+
+// RemoteAddr returns the client's address, from its PROXY header if it sent one.
+func (c *loopConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *loopConn) limiter() *rateLimiter {
+	return c.rateLimiter
+}
+
+func (c *loopConn) auth() *authState {
+	return c.authState
+}
+
+func (c *loopConn) namespace() *namespaceState {
+	return c.namespaceState
+}
+
+func (c *loopConn) subscriptions() *channelSubscriptions {
+	return c.channelSubscriptions
+}
+
+func (c *loopConn) watches() *watchSet {
+	return c.watchSet
+}
+
+func (c *loopConn) waits() *waitCounter {
+	return c.waitCounter
+}
+
+// queueUpdates queues the parts of fanout's update that the client can see,
+// unless they're being coalesced
+func (c *loopConn) queueUpdates(fanout *updateFanout) {
+	for _, scoped := range fanout.updatesFor(c.authState) {
+		if c.coalescer.Add(scoped.update) {
+			continue
+		}
+
+		c.queue(scoped.frame.Retain())
+	}
+}
+
+func (c *loopConn) queue(frame *Frame) {
+	c.frames = append(c.frames, frame)
+	c.loop.markDirty(c)
+}
+
+func (c *loopConn) releaseFrames() {
+	for n, frame := range c.frames {
+		frame.Release()
+		c.frames[n] = nil
+	}
+
+	c.frames = nil
+}
+
+// loopLane is where a connection's requests for the keys that share it wait
+// their turn. busy is set while one of them is executing.
+type loopLane struct {
+	busy   bool
+	queued []protocol.Request
+}
+
+var _ session = (*loopConn)(nil)
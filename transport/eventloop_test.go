@@ -0,0 +1,124 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("EventLoop", func() {
+		var (
+			tcp  *transport.TCP
+			conn net.Conn
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			tcp = makeEventLoopServer(`{"foo":"bar"}`)
+
+			conn, err = net.Dial("tcp", "0.0.0.0:6682")
+			Expect(err).To(Succeed())
+		})
+
+		AfterEach(func() {
+			conn.Close()
+			Expect(tcp.Close()).To(Succeed())
+		})
+
+		expectResponse := func(expected string) {
+			response := make([]byte, len(expected))
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			_, err := io.ReadFull(conn, response)
+			Expect(err).To(Succeed())
+			Expect(string(response)).To(Equal(expected))
+		}
+
+		It("responds with PONG when the client sends PING", func() {
+			_, err := conn.Write([]byte("1234PING\n"))
+			Expect(err).To(Succeed())
+
+			expectResponse("1234PONG\r\n")
+		})
+
+		It("returns the current value of a key", func() {
+			_, err := conn.Write([]byte("1234GET foo\n"))
+			Expect(err).To(Succeed())
+
+			expectResponse("1234GET\r\n\"bar\"\r\n")
+		})
+
+		It("handles requests that arrive over several reads", func() {
+			_, err := conn.Write([]byte("1234SET fo"))
+			Expect(err).To(Succeed())
+
+			time.Sleep(20 * time.Millisecond)
+
+			_, err = conn.Write([]byte("o\nbaz\n5678PING\n"))
+			Expect(err).To(Succeed())
+
+			// The update is pushed asynchronously, so it may arrive before or after our responses
+			r := bufio.NewReader(conn)
+			types := make([]protocol.ResponseType, 0, 3)
+			for len(types) < 3 {
+				resp, err := protocol.ReadResponse(r)
+				Expect(err).To(Succeed())
+				types = append(types, resp.Type)
+			}
+
+			Expect(types).To(ConsistOf(protocol.RespOk, protocol.RespPong, protocol.RespUpdate))
+
+			value, err := tcp.Store().Get(context.Background(), []byte("foo"))
+			Expect(err).To(Succeed())
+			Expect(string(value)).To(Equal(`"baz"`))
+		})
+
+		It("sends updates to every connected client", func() {
+			other, err := net.Dial("tcp", "0.0.0.0:6682")
+			Expect(err).To(Succeed())
+			defer other.Close()
+
+			// Make sure the server has accepted the second connection
+			_, err = other.Write([]byte("1234PING\n"))
+			Expect(err).To(Succeed())
+
+			r := bufio.NewReader(other)
+			resp, err := protocol.ReadResponse(r)
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespPong))
+
+			_, err = conn.Write([]byte("1234PING\n"))
+			Expect(err).To(Succeed())
+			expectResponse("1234PONG\r\n")
+
+			Expect(tcp.Store().Set(context.Background(), []byte("foo"), "qux")).To(Succeed())
+
+			expectResponse("*foo\r\n\"qux\"\r\n")
+
+			resp, err = protocol.ReadResponse(r)
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespUpdate))
+			Expect(string(resp.Value)).To(Equal(`"qux"`))
+		})
+
+		It("closes the connection once the client QUITs", func() {
+			_, err := conn.Write([]byte("1234QUIT\n"))
+			Expect(err).To(Succeed())
+
+			expectResponse("1234OK\r\n")
+
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			_, err = conn.Read(make([]byte, 1))
+			Expect(err).To(MatchError(io.EOF))
+		})
+	})
+})
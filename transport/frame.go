@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// initialFrameSize is the capacity of newly allocated frame buffers
+	initialFrameSize = 512
+
+	// maxPooledFrameSize is the largest frame buffer that will be returned to the
+	// pool. Larger buffers are left for the GC so that one huge value doesn't
+	// pin memory forever.
+	maxPooledFrameSize = 64 * 1024
+)
+
+var framePool = sync.Pool{
+	New: func() interface{} {
+		return &Frame{buf: make([]byte, 0, initialFrameSize)}
+	},
+}
+
+// Frame is an encoded protocol frame that is ready to be written to one or
+// more connections.
+//
+// Frames are immutable once they have been handed to a connection, which allows
+// a single encoding of an update to be shared between the write queues of every
+// connection. They're reference counted, when the last reference is released the
+// frame's buffer is returned to a pool to be reused.
+type Frame struct {
+	buf  []byte
+	refs int32
+}
+
+// newFrame returns an empty frame from the pool with a single reference, which
+// belongs to the caller.
+func newFrame() *Frame {
+	frame := framePool.Get().(*Frame)
+	frame.refs = 1
+	return frame
+}
+
+// newFrameFrom returns a frame containing a copy of data.
+func newFrameFrom(data []byte) *Frame {
+	frame := newFrame()
+	frame.buf = append(frame.buf, data...)
+	return frame
+}
+
+// Bytes returns the encoded frame. The result must not be modified.
+func (f *Frame) Bytes() []byte {
+	return f.buf
+}
+
+// Len returns the length of the encoded frame in bytes.
+func (f *Frame) Len() int {
+	return len(f.buf)
+}
+
+// Retain adds a reference to the frame. Every call to Retain must be balanced
+// with a call to Release.
+func (f *Frame) Retain() *Frame {
+	atomic.AddInt32(&f.refs, 1)
+	return f
+}
+
+// Release drops a reference to the frame, once the last reference has been
+// dropped the frame is returned to the pool and must no longer be used.
+func (f *Frame) Release() {
+	refs := atomic.AddInt32(&f.refs, -1)
+
+	switch {
+	case refs > 0:
+		return
+
+	case refs < 0:
+		panic("transport: Frame released more times than it was retained")
+	}
+
+	if cap(f.buf) > maxPooledFrameSize {
+		return
+	}
+
+	f.buf = f.buf[:0]
+	framePool.Put(f)
+}
@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/storage"
+)
+
+// BenchmarkTCPListenerWriteUpdate measures fanning a single update out to
+// many connections. As each update is only encoded once, allocations per
+// update should not grow with the number of connections.
+func BenchmarkTCPListenerWriteUpdate(b *testing.B) {
+	for _, numConns := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("conns=%d", numConns), func(b *testing.B) {
+			benchmarkWriteUpdate(b, numConns)
+		})
+	}
+}
+
+func benchmarkWriteUpdate(b *testing.B, numConns int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	options := Options{MaxCoalesceWindow: DefaultMaxCoalesceWindow}
+	namespaces := newNamespaceSet(options)
+	listener := NewTCPListener(ctx, "", options, newConnLimiter(options), namespaces, zap.NewNop())
+
+	for n := 0; n < numConns; n++ {
+		conn := NewTCPCOnn(ctx, nil, options, namespaces, zap.NewNop())
+		listener.addConn(conn)
+
+		// Stand in for the write loop, without the cost of a real socket
+		go func() {
+			for frame := range conn.writeQueue {
+				frame.Release()
+			}
+		}()
+	}
+
+	update := &storage.Update{
+		Key:   []byte("services.api.port"),
+		Value: []byte("8080"),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		if err := listener.WriteUpdate(update); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
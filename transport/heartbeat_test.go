@@ -0,0 +1,113 @@
+package transport_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("heartbeats", func() {
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var (
+					tcp  *transport.TCP
+					conn net.Conn
+					r    *bufio.Reader
+				)
+
+				start := func(options transport.Options) {
+					options.UseStdlib = useStdlib
+					tcp = makeServer("", options)
+
+					var err error
+					conn, err = net.Dial("tcp", "0.0.0.0:6682")
+					Expect(err).To(Succeed())
+
+					r = bufio.NewReader(conn)
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+				}
+
+				AfterEach(func() {
+					conn.Close()
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				It("sends heartbeats", func() {
+					start(transport.Options{
+						HeartbeatInterval: 50 * time.Millisecond,
+						IdleTimeout:       time.Minute,
+					})
+
+					for i := 0; i < 2; i++ {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+						Expect(resp.Type).To(Equal(protocol.RespHeartbeat))
+					}
+				})
+
+				It("closes connections that don't answer heartbeats", func() {
+					start(transport.Options{HeartbeatInterval: 50 * time.Millisecond})
+
+					var err error
+					for err == nil {
+						var resp *protocol.Response
+						if resp, err = protocol.ReadResponse(r); err == nil {
+							Expect(resp.Type).To(Equal(protocol.RespHeartbeat))
+						}
+					}
+
+					Expect(err).To(MatchError(io.EOF))
+				})
+
+				It("keeps connections that answer heartbeats open", func() {
+					start(transport.Options{HeartbeatInterval: 50 * time.Millisecond})
+
+					// Long enough that we'd be closed several times over if we didn't answer
+					deadline := time.Now().Add(500 * time.Millisecond)
+
+					for time.Now().Before(deadline) {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+						Expect(resp.Type).To(Equal(protocol.RespHeartbeat))
+
+						_, err = conn.Write([]byte("1234HEARTBEAT\n"))
+						Expect(err).To(Succeed())
+					}
+
+					_, err := conn.Write([]byte("1234PING\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					for err == nil && resp.Type == protocol.RespHeartbeat {
+						resp, err = protocol.ReadResponse(r)
+					}
+
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespPong))
+				})
+
+				It("closes idle connections", func() {
+					start(transport.Options{IdleTimeout: 100 * time.Millisecond})
+
+					_, err := r.ReadByte()
+					Expect(err).To(MatchError(io.EOF))
+				})
+			})
+		}
+	})
+})
@@ -0,0 +1,212 @@
+package transport
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/luma/pharos/protocol"
+)
+
+// tokenBucket allows up to burst events at once, and refills at rate events
+// per second. It's not safe for concurrent use, each connection's requests are
+// handled by a single goroutine.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, or nil if rate is zero which allows
+// everything
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// allow takes a token if there is one
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// sharedTokenBucket is a tokenBucket that's safe for concurrent use, for limits
+// that are shared between connections
+type sharedTokenBucket struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+}
+
+// newSharedTokenBucket returns a full bucket, or nil if rate is zero which
+// allows everything
+func newSharedTokenBucket(rate float64, burst int) *sharedTokenBucket {
+	bucket := newTokenBucket(rate, burst)
+	if bucket == nil {
+		return nil
+	}
+
+	return &sharedTokenBucket{bucket: bucket}
+}
+
+// allow takes a token if there is one
+func (b *sharedTokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.bucket.allow(now)
+}
+
+// isWrite returns true for requests that change the store
+func isWrite(req protocol.Request) bool {
+	switch req.GetCommand() {
+	case protocol.SET, protocol.DEL:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// rateLimiter limits how fast a single connection can make requests, and how
+// many of them can be writes.
+type rateLimiter struct {
+	requests *tokenBucket
+	writes   *tokenBucket
+}
+
+func newRateLimiter(options Options) *rateLimiter {
+	return &rateLimiter{
+		requests: newTokenBucket(options.RequestRate, options.RequestBurst),
+		writes:   newTokenBucket(options.WriteRate, options.WriteBurst),
+	}
+}
+
+// allow returns an error message for the client if req exceeds a limit
+func (r *rateLimiter) allow(req protocol.Request) (string, bool) {
+	switch req.GetCommand() {
+	case protocol.HEARTBEAT, protocol.QUIT:
+		// Heartbeats are never limited, rejecting them would get the client closed
+		// for being idle. Neither is leaving.
+		return "", true
+
+	case protocol.SET, protocol.DEL:
+		now := time.Now()
+
+		if !r.requests.allow(now) {
+			return "Too many requests", false
+		}
+
+		if !r.writes.allow(now) {
+			return "Too many writes", false
+		}
+
+		return "", true
+
+	default:
+		if !r.requests.allow(time.Now()) {
+			return "Too many requests", false
+		}
+
+		return "", true
+	}
+}
+
+// connLimiter caps how many connections are open, both in total and from each
+// remote IP. A single limiter is shared by all of a server's listeners.
+type connLimiter struct {
+	maxConns      int
+	maxConnsPerIP int
+
+	mu    sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(options Options) *connLimiter {
+	return &connLimiter{
+		maxConns:      options.MaxConns,
+		maxConnsPerIP: options.MaxConnsPerIP,
+		perIP:         make(map[string]int),
+	}
+}
+
+// acquire reserves a connection for addr, it returns false if that would
+// exceed a limit. Every successful acquire must be followed by a release.
+func (c *connLimiter) acquire(addr net.Addr) bool {
+	ip := remoteIP(addr)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.maxConns > 0 && c.total >= c.maxConns {
+		return false
+	}
+
+	if ip != "" && c.maxConnsPerIP > 0 && c.perIP[ip] >= c.maxConnsPerIP {
+		return false
+	}
+
+	c.total++
+	if ip != "" {
+		c.perIP[ip]++
+	}
+
+	return true
+}
+
+func (c *connLimiter) release(addr net.Addr) {
+	ip := remoteIP(addr)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+	if ip == "" {
+		return
+	}
+
+	if c.perIP[ip]--; c.perIP[ip] <= 0 {
+		delete(c.perIP, ip)
+	}
+}
+
+// remoteIP returns the IP of addr, or "" if it doesn't have one, such as for
+// Unix sockets
+func remoteIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+
+	return ""
+}
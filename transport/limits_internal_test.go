@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Limits (internal)", func() {
+	Describe("tokenBucket", func() {
+		It("allows a burst and then refills at the rate", func() {
+			bucket := newTokenBucket(10, 2)
+			now := time.Now()
+
+			Expect(bucket.allow(now)).To(BeTrue())
+			Expect(bucket.allow(now)).To(BeTrue())
+			Expect(bucket.allow(now)).To(BeFalse())
+
+			// 10 a second is a token every 100ms
+			Expect(bucket.allow(now.Add(50 * time.Millisecond))).To(BeFalse())
+			Expect(bucket.allow(now.Add(100 * time.Millisecond))).To(BeTrue())
+			Expect(bucket.allow(now.Add(100 * time.Millisecond))).To(BeFalse())
+		})
+
+		It("never holds more than the burst", func() {
+			bucket := newTokenBucket(10, 1)
+			now := time.Now()
+
+			Expect(bucket.allow(now)).To(BeTrue())
+
+			later := now.Add(time.Minute)
+			Expect(bucket.allow(later)).To(BeTrue())
+			Expect(bucket.allow(later)).To(BeFalse())
+		})
+
+		It("allows everything if the rate is zero", func() {
+			bucket := newTokenBucket(0, 0)
+
+			for i := 0; i < 100; i++ {
+				Expect(bucket.allow(time.Now())).To(BeTrue())
+			}
+		})
+	})
+
+	Describe("connLimiter", func() {
+		alice := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+		bob := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+
+		It("caps connections from each IP", func() {
+			limiter := newConnLimiter(Options{MaxConnsPerIP: 1})
+
+			Expect(limiter.acquire(alice)).To(BeTrue())
+			Expect(limiter.acquire(alice)).To(BeFalse())
+			Expect(limiter.acquire(bob)).To(BeTrue())
+
+			limiter.release(alice)
+			Expect(limiter.acquire(alice)).To(BeTrue())
+		})
+
+		It("caps the total connections", func() {
+			limiter := newConnLimiter(Options{MaxConns: 2})
+
+			Expect(limiter.acquire(alice)).To(BeTrue())
+			Expect(limiter.acquire(bob)).To(BeTrue())
+			Expect(limiter.acquire(&net.UnixAddr{Name: "@", Net: "unix"})).To(BeFalse())
+
+			limiter.release(bob)
+			Expect(limiter.acquire(&net.UnixAddr{Name: "@", Net: "unix"})).To(BeTrue())
+		})
+	})
+})
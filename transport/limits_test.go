@@ -0,0 +1,132 @@
+package transport_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("limits", func() {
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var tcp *transport.TCP
+
+				AfterEach(func() {
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				dial := func() (net.Conn, *bufio.Reader) {
+					conn, err := net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					return conn, bufio.NewReader(conn)
+				}
+
+				It("closes connections over the per IP limit", func() {
+					tcp = makeServer("", transport.Options{UseStdlib: useStdlib, MaxConnsPerIP: 1})
+
+					first, firstReader := dial()
+					defer first.Close()
+
+					_, err := first.Write([]byte("1234PING\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(firstReader)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespPong))
+
+					second, secondReader := dial()
+					defer second.Close()
+
+					_, err = secondReader.ReadByte()
+					Expect(err).To(MatchError(io.EOF))
+
+					// The limit is freed up when the first connection closes
+					first.Close()
+
+					Eventually(func() error {
+						third, thirdReader := dial()
+						defer third.Close()
+
+						if _, err := third.Write([]byte("1234PING\n")); err != nil {
+							return err
+						}
+
+						_, err := protocol.ReadResponse(thirdReader)
+						return err
+					}, 5*time.Second, 20*time.Millisecond).Should(Succeed())
+				})
+
+				It("rejects requests over the rate limit", func() {
+					tcp = makeServer("", transport.Options{
+						UseStdlib:    useStdlib,
+						RequestRate:  1,
+						RequestBurst: 2,
+					})
+
+					conn, r := dial()
+					defer conn.Close()
+
+					_, err := conn.Write([]byte("0001PING\n0002PING\n0003PING\n"))
+					Expect(err).To(Succeed())
+
+					for _, id := range []string{"0001", "0002"} {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+						Expect(string(resp.RequestID[:])).To(Equal(id))
+						Expect(resp.Type).To(Equal(protocol.RespPong))
+					}
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(string(resp.RequestID[:])).To(Equal("0003"))
+					Expect(resp.ErrorOrNil()).To(MatchError(protocol.ErrRateLimited))
+				})
+
+				It("rejects writes over the write rate limit", func() {
+					tcp = makeServer("", transport.Options{
+						UseStdlib:  useStdlib,
+						WriteRate:  1,
+						WriteBurst: 1,
+					})
+
+					conn, r := dial()
+					defer conn.Close()
+
+					_, err := conn.Write([]byte("0001SET foo\n1\n0002SET foo\n2\n0003PING\n"))
+					Expect(err).To(Succeed())
+
+					responses := map[string]*protocol.Response{}
+					for len(responses) < 3 {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+
+						if resp.Type != protocol.RespUpdate {
+							responses[string(resp.RequestID[:])] = resp
+						}
+					}
+
+					Expect(responses["0001"].Type).To(Equal(protocol.RespOk))
+					Expect(responses["0002"].ErrorOrNil()).To(MatchError(protocol.ErrRateLimited))
+					Expect(responses["0003"].Type).To(Equal(protocol.RespPong))
+				})
+			})
+		}
+	})
+})
@@ -0,0 +1,367 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+var (
+	// errLockHeld is returned when a lock is held by someone else
+	errLockHeld = errors.New("Lock is held")
+
+	// errLockNotHeld is returned when a lock isn't held with the given token
+	errLockNotHeld = errors.New("Lock is not held")
+)
+
+// lockState is how a lock is stored, at protocol.LockKey(name). Token is the
+// last fencing token that the lock was acquired with, it's kept once the lock is
+// released so that tokens keep increasing. Expires and Owner are only set while
+// the lock is held.
+type lockState struct {
+	Token   uint64 `json:"token"`
+	Expires int64  `json:"expires,omitempty"`
+	Owner   string `json:"owner,omitempty"`
+}
+
+// heldLock is a lock that a connection holds
+type heldLock struct {
+	token  uint64
+	holder session
+	owner  string
+	ttl    time.Duration
+
+	// expires is when the lock will be released unless it's renewed, expiry
+	// releases it then
+	expires time.Time
+	expiry  *time.Timer
+
+	// released is closed once the lock is released, to wake any waiters
+	released chan struct{}
+}
+
+// lockManager holds the locks of a namespace. It's safe for concurrent use.
+//
+// The state of each lock is queued to be written to the store while the mutex
+// is held, so that the states are written in the order that they changed and
+// the fencing tokens that are stored always increase, but they're written once
+// it has been released, so that a slow store doesn't hold up every lock in the
+// namespace.
+type lockManager struct {
+	store storage.Store
+
+	mu sync.Mutex
+
+	// held is the locks that are currently held, tokens is the last token that
+	// each lock that's been seen was acquired with
+	held   map[string]*heldLock
+	tokens map[string]uint64
+
+	writer *storeWriter
+}
+
+// lockWrite is the state of a lock that needs writing to the store
+type lockWrite struct {
+	name  string
+	state lockState
+}
+
+func newLockManager(store storage.Store, log *zap.Logger) *lockManager {
+	return &lockManager{
+		store:  store,
+		held:   make(map[string]*heldLock),
+		tokens: make(map[string]uint64),
+		writer: newStoreWriter(store, log),
+	}
+}
+
+// acquire tries to acquire the lock called name for holder, owner is stored
+// with it for anyone watching. If the lock is held it returns errLockHeld,
+// along with a channel that's closed once it's released.
+func (m *lockManager) acquire(name []byte, owner string, holder session, ttl time.Duration) (uint64, <-chan struct{}, error) {
+	var writes []lockWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	if held, ok := m.held[string(name)]; ok {
+		return 0, held.released, errLockHeld
+	}
+
+	// A holder that has closed would never release the lock
+	if err := holder.Context().Err(); err != nil {
+		return 0, nil, err
+	}
+
+	token, err := m.lastToken(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	token++
+
+	key := string(name)
+
+	expires := time.Now().Add(ttl)
+	writes = append(writes, lockWrite{key, lockState{Token: token, Expires: expires.UnixNano(), Owner: owner}})
+
+	m.tokens[key] = token
+	m.held[key] = &heldLock{
+		token:    token,
+		holder:   holder,
+		owner:    owner,
+		ttl:      ttl,
+		expires:  expires,
+		expiry:   time.AfterFunc(ttl, func() { m.expire(key, token) }),
+		released: make(chan struct{}),
+	}
+
+	return token, nil, nil
+}
+
+// wait acquires the lock called name for holder, waiting until ctx is done for
+// it to be released if it's held
+func (m *lockManager) wait(ctx context.Context, name []byte, owner string, holder session, ttl time.Duration) (uint64, error) {
+	for {
+		token, released, err := m.acquire(name, owner, holder, ttl)
+		if !errors.Is(err, errLockHeld) {
+			return token, err
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return 0, errLockHeld
+		}
+	}
+}
+
+// lastToken returns the token that the lock called name was last acquired with.
+// Locks that haven't been seen since the server started are read from the
+// store, which may have been restored from a backup.
+func (m *lockManager) lastToken(name []byte) (uint64, error) {
+	if token, ok := m.tokens[string(name)]; ok {
+		return token, nil
+	}
+
+	value, err := m.store.Get(context.Background(), protocol.LockKey(name))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read lock %w", err)
+	}
+
+	return gjson.GetBytes(value, "token").Uint(), nil
+}
+
+// renew extends the lock called name by its TTL, if it's held with token
+func (m *lockManager) renew(name []byte, token uint64) error {
+	var writes []lockWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	held, ok := m.held[string(name)]
+	if !ok || held.token != token {
+		return errLockNotHeld
+	}
+
+	expires := time.Now().Add(held.ttl)
+	writes = append(writes, lockWrite{string(name), lockState{Token: token, Expires: expires.UnixNano(), Owner: held.owner}})
+
+	held.expires = expires
+	held.expiry.Reset(held.ttl)
+
+	return nil
+}
+
+// unlock releases the lock called name, if it's held with token
+func (m *lockManager) unlock(name []byte, token uint64) error {
+	var writes []lockWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	held, ok := m.held[string(name)]
+	if !ok || held.token != token {
+		return errLockNotHeld
+	}
+
+	writes = append(writes, m.release(string(name), held))
+
+	return nil
+}
+
+// expire releases the lock called name once its TTL has passed, unless it has
+// been released already
+func (m *lockManager) expire(name string, token uint64) {
+	var writes []lockWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	held, ok := m.held[name]
+	if !ok || held.token != token {
+		return
+	}
+
+	// The lock may have been renewed after the timer fired, but before it got
+	// the mutex
+	if time.Now().Before(held.expires) {
+		return
+	}
+
+	writes = append(writes, m.release(name, held))
+}
+
+// releaseAll releases every lock that holder holds
+func (m *lockManager) releaseAll(holder session) {
+	var writes []lockWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	for name, held := range m.held {
+		if held.holder != holder {
+			continue
+		}
+
+		writes = append(writes, m.release(name, held))
+	}
+}
+
+// release releases a lock that's held, and wakes anyone waiting for it. It
+// must be called with the mutex held, and returns the state to write once it
+// has been released.
+func (m *lockManager) release(name string, held *heldLock) lockWrite {
+	held.expiry.Stop()
+	delete(m.held, name)
+	close(held.released)
+
+	return lockWrite{name, lockState{Token: held.token}}
+}
+
+// unlockAndWrite queues the lock states in writes, releases the mutex, and then
+// waits for them to be written. The lock is released even if its state can't be
+// written, subscribers just won't hear about it until its state is next written.
+func (m *lockManager) unlockAndWrite(writes *[]lockWrite) {
+	stored := make([]storeWrite, len(*writes))
+	for i, write := range *writes {
+		stored[i] = storeWrite{key: protocol.LockKey([]byte(write.name)), value: write.state}
+	}
+
+	written := m.writer.queue(stored)
+	m.mu.Unlock()
+
+	<-written
+}
+
+// releaseLocks releases the locks that s holds in every namespace. It must be
+// called once s has closed.
+func releaseLocks(s session) {
+	for _, ns := range s.namespace().namespaces.all {
+		ns.locks.releaseAll(s)
+	}
+}
+
+func (h *requestHandler) handleLock(ctx context.Context, s Session, req protocol.Request) error {
+	lock := req.(*protocol.LockRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, lock.GetKey()); !ok {
+		return err
+	}
+
+	// Locks are held by the connection, rather than any middleware that wraps it
+	holder := ctx.Value(sessionKey{}).(session)
+	locks := namespaceFor(ctx).locks
+
+	owner := string(lock.Owner)
+
+	token, _, err := locks.acquire(lock.Name, owner, holder, lock.TTL)
+	if !errors.Is(err, errLockHeld) || lock.Wait <= 0 {
+		return writeLockResponse(s, req, token, err)
+	}
+
+	if ok, err := acquireWait(s, holder, req); !ok {
+		return err
+	}
+
+	name := retain(lock.Name)
+
+	// The response is written once the lock is acquired or the wait is over
+	waitInBackground(holder, lock.Wait, func(ctx context.Context) error {
+		token, err := locks.wait(ctx, name, owner, holder, lock.TTL)
+		return writeLockResponse(s, req, token, err)
+	})
+
+	return nil
+}
+
+// writeLockResponse responds to a LOCK with the token that it was acquired
+// with, or the reason that it wasn't
+func writeLockResponse(s Session, req protocol.Request, token uint64, err error) error {
+	switch {
+	case err == nil:
+		if err := protocol.WriteLock(s, req.GetRequestID(), token); err != nil {
+			return fmt.Errorf("Failed to respond to LOCK %w", err)
+		}
+
+	case errors.Is(err, errLockHeld):
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeLocked, "Lock is held"); err != nil {
+			return fmt.Errorf("Failed to reject LOCK %w", err)
+		}
+
+	default:
+		return fmt.Errorf("Failed to lock %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleUnlock(ctx context.Context, s Session, req protocol.Request) error {
+	unlock := req.(*protocol.UnlockRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, unlock.GetKey()); !ok {
+		return err
+	}
+
+	err := namespaceFor(ctx).locks.unlock(unlock.Name, unlock.Token)
+	return writeLockTokenResponse(s, req, err)
+}
+
+func (h *requestHandler) handleRenew(ctx context.Context, s Session, req protocol.Request) error {
+	renew := req.(*protocol.RenewRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, renew.GetKey()); !ok {
+		return err
+	}
+
+	err := namespaceFor(ctx).locks.renew(renew.Name, renew.Token)
+	return writeLockTokenResponse(s, req, err)
+}
+
+// writeLockTokenResponse responds to an UNLOCK or RENEW
+func writeLockTokenResponse(s Session, req protocol.Request, err error) error {
+	switch {
+	case err == nil:
+		if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+			return fmt.Errorf("Failed to ack %s %w", req.GetCommand(), err)
+		}
+
+	case errors.Is(err, errLockNotHeld):
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeNotLocked, "Lock is not held with that token"); err != nil {
+			return fmt.Errorf("Failed to reject %s %w", req.GetCommand(), err)
+		}
+
+	default:
+		return fmt.Errorf("Failed to %s %w", req.GetCommand(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("locks", func() {
+		forEachServer(transport.Options{}, func(f *serverFixture) {
+			var first, second *client.Conn
+
+			BeforeEach(func() {
+				first = f.connect()
+				second = f.connect()
+			})
+
+			It("is only held by one connection at a time", func() {
+				lock, err := first.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+				Expect(lock.Token).To(Equal(uint64(1)))
+
+				_, err = second.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(errors.Is(err, protocol.ErrLocked)).To(BeTrue())
+
+				_, err = second.Lock(f.ctx, "weekly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+			})
+
+			It("stores the state of the lock, and who owns it while it's held", func() {
+				lock, err := first.LockAs(f.ctx, "nightly-report", "worker-1", time.Minute, 0)
+				Expect(err).To(Succeed())
+
+				value, err := second.Get(f.ctx, "_locks.nightly-report")
+				Expect(err).To(Succeed())
+				Expect(gjson.GetBytes(value, "token").Uint()).To(Equal(uint64(1)))
+				Expect(gjson.GetBytes(value, "owner").String()).To(Equal("worker-1"))
+
+				Expect(lock.Unlock(f.ctx)).To(Succeed())
+
+				value, err = second.Get(f.ctx, "_locks.nightly-report")
+				Expect(err).To(Succeed())
+				Expect(string(value)).To(Equal(`{"token":1}`))
+			})
+
+			It("refuses writes to the state of locks from clients", func() {
+				_, err := first.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+
+				err = second.Set(f.ctx, "_locks.nightly-report", []byte(`{"token":100}`))
+				Expect(errors.Is(err, protocol.ErrForbidden)).To(BeTrue())
+
+				err = second.Delete(f.ctx, "_locks")
+				Expect(errors.Is(err, protocol.ErrForbidden)).To(BeTrue())
+
+				value, err := second.Get(f.ctx, "_locks.nightly-report")
+				Expect(err).To(Succeed())
+				Expect(gjson.GetBytes(value, "token").Uint()).To(Equal(uint64(1)))
+
+				// Only the path itself is reserved, not every key that starts with it
+				Expect(second.Set(f.ctx, "_lockstep", []byte("1"))).To(Succeed())
+			})
+
+			It("hands the lock to a waiter once it's unlocked, with a greater token", func() {
+				lock, err := first.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+
+				acquired := make(chan *client.Lock, 1)
+				go func() {
+					defer GinkgoRecover()
+
+					lock, err := second.Lock(f.ctx, "nightly-report", time.Minute, 5*time.Second)
+					Expect(err).To(Succeed())
+
+					acquired <- lock
+				}()
+
+				Consistently(acquired, 100*time.Millisecond).ShouldNot(Receive())
+
+				// The connection carries on serving requests while its LOCK waits
+				Expect(second.Ping(f.ctx)).To(Succeed())
+
+				Expect(lock.Unlock(f.ctx)).To(Succeed())
+
+				var next *client.Lock
+				Eventually(acquired).Should(Receive(&next))
+				Expect(next.Token).To(BeNumerically(">", lock.Token))
+			})
+
+			It("limits how many LOCKs each connection can have waiting", func() {
+				_, err := first.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+
+				// Each connection can have 64 requests waiting, the one past that is
+				// refused straight away
+				results := make(chan error, 65)
+				for n := 0; n < 65; n++ {
+					go func() {
+						_, err := second.Lock(f.ctx, "nightly-report", time.Minute, time.Second)
+						results <- err
+					}()
+				}
+
+				Eventually(results).Should(Receive(&err))
+				Expect(errors.Is(err, protocol.ErrTooMany)).To(BeTrue())
+
+				// Other connections can still wait
+				_, err = first.Lock(f.ctx, "nightly-report", time.Minute, 10*time.Millisecond)
+				Expect(errors.Is(err, protocol.ErrLocked)).To(BeTrue())
+
+				for n := 0; n < 64; n++ {
+					Eventually(results, 5*time.Second).Should(Receive(&err))
+					Expect(errors.Is(err, protocol.ErrLocked)).To(BeTrue())
+				}
+
+				// Once the waits are over the connection can wait again
+				_, err = second.Lock(f.ctx, "nightly-report", time.Minute, 10*time.Millisecond)
+				Expect(errors.Is(err, protocol.ErrLocked)).To(BeTrue())
+			})
+
+			It("gives up waiting once the wait has passed", func() {
+				_, err := first.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+
+				_, err = second.Lock(f.ctx, "nightly-report", time.Minute, 50*time.Millisecond)
+				Expect(errors.Is(err, protocol.ErrLocked)).To(BeTrue())
+			})
+
+			It("releases the lock once its TTL passes, unless it's renewed", func() {
+				lock, err := first.Lock(f.ctx, "nightly-report", 200*time.Millisecond, 0)
+				Expect(err).To(Succeed())
+
+				keepAliveCtx, cancel := context.WithTimeout(f.ctx, 500*time.Millisecond)
+				defer cancel()
+
+				Expect(lock.KeepAlive(keepAliveCtx)).To(Succeed())
+
+				_, err = second.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(errors.Is(err, protocol.ErrLocked)).To(BeTrue())
+
+				Eventually(func() error {
+					_, err := second.Lock(f.ctx, "nightly-report", time.Minute, 0)
+					return err
+				}).Should(Succeed())
+
+				Expect(errors.Is(lock.Renew(f.ctx), protocol.ErrNotLocked)).To(BeTrue())
+			})
+
+			It("refuses to unlock with the wrong token", func() {
+				lock, err := first.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+
+				stale := *lock
+				stale.Token--
+
+				Expect(errors.Is(stale.Unlock(f.ctx), protocol.ErrNotLocked)).To(BeTrue())
+				Expect(lock.Unlock(f.ctx)).To(Succeed())
+				Expect(errors.Is(lock.Unlock(f.ctx), protocol.ErrNotLocked)).To(BeTrue())
+			})
+
+			It("releases the lock when its holder disconnects", func() {
+				_, err := first.Lock(f.ctx, "nightly-report", time.Minute, 0)
+				Expect(err).To(Succeed())
+
+				Expect(first.Disconnect()).To(Succeed())
+
+				lock, err := second.Lock(f.ctx, "nightly-report", time.Minute, 5*time.Second)
+				Expect(err).To(Succeed())
+				Expect(lock.Token).To(Equal(uint64(2)))
+			})
+		})
+	})
+})
@@ -0,0 +1,28 @@
+package transport
+
+// Middleware wraps the execution of requests, for concerns that apply to every
+// command such as logging, metrics, or tracing. It's given the next handler in
+// the chain and returns a handler that should call it, unless it's rejecting
+// the request, in which case it should write an error response to the client
+// itself.
+//
+// Each handler sees the request, the client's session, and the error that
+// executing the request returned. Errors from next must be returned unchanged,
+// or wrapped with %w, as the transport recognises some of them. Handlers for a
+// connection may be called concurrently, for requests on different keys.
+//
+// Requests are admitted before they reach the chain: requests over the
+// client's rate limits, writes over its namespace's write limit, and requests
+// from clients that haven't authenticated when the server requires it, are
+// rejected by the transport and never seen by middleware.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// chainMiddleware wraps handler with middleware, so that the first middleware
+// is the first to see each request
+func chainMiddleware(middleware []Middleware, handler HandlerFunc) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
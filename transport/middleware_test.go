@@ -0,0 +1,227 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+// requestLog records what middleware saw
+type requestLog struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (l *requestLog) add(entry string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = append(l.entries, entry)
+}
+
+func (l *requestLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.entries...)
+}
+
+var _ = Describe("transport", func() {
+	Describe("middleware", func() {
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var (
+					tcp  *transport.TCP
+					conn net.Conn
+					r    *bufio.Reader
+				)
+
+				startWith := func(options transport.Options, middleware ...transport.Middleware) {
+					options.UseStdlib = useStdlib
+					options.Middleware = middleware
+					tcp = makeServer("", options)
+
+					var err error
+					conn, err = net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					r = bufio.NewReader(conn)
+				}
+
+				start := func(middleware ...transport.Middleware) {
+					startWith(transport.Options{}, middleware...)
+				}
+
+				// counting returns a middleware that records the request IDs it sees
+				counting := func(log *requestLog) transport.Middleware {
+					return func(next transport.HandlerFunc) transport.HandlerFunc {
+						return func(ctx context.Context, s transport.Session, req protocol.Request) error {
+							id := req.GetRequestID()
+							log.add(string(id[:]))
+
+							return next(ctx, s, req)
+						}
+					}
+				}
+
+				AfterEach(func() {
+					conn.Close()
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				It("runs middleware around every request, the first outermost", func() {
+					log := &requestLog{}
+
+					named := func(name string) transport.Middleware {
+						return func(next transport.HandlerFunc) transport.HandlerFunc {
+							return func(ctx context.Context, s transport.Session, req protocol.Request) error {
+								log.add(name + " before " + string(req.GetCommand()))
+								err := next(ctx, s, req)
+								log.add(name + " after " + string(req.GetCommand()))
+
+								return err
+							}
+						}
+					}
+
+					start(named("outer"), named("inner"))
+
+					_, err := conn.Write([]byte("1234PING\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespPong))
+
+					Eventually(log.get).Should(Equal([]string{
+						"outer before PING",
+						"inner before PING",
+						"inner after PING",
+						"outer after PING",
+					}))
+				})
+
+				It("sees the client's session and the result", func() {
+					var (
+						mu         sync.Mutex
+						remoteAddr net.Addr
+						results    []error
+					)
+
+					start(func(next transport.HandlerFunc) transport.HandlerFunc {
+						return func(ctx context.Context, s transport.Session, req protocol.Request) error {
+							err := next(ctx, s, req)
+
+							mu.Lock()
+							defer mu.Unlock()
+
+							remoteAddr = s.RemoteAddr()
+							results = append(results, err)
+
+							return err
+						}
+					})
+
+					_, err := conn.Write([]byte("1234SET foo\n\"bar\"\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespOk))
+
+					Eventually(func() []error {
+						mu.Lock()
+						defer mu.Unlock()
+
+						return results
+					}).Should(Equal([]error{nil}))
+
+					mu.Lock()
+					defer mu.Unlock()
+					Expect(remoteAddr.String()).To(Equal(conn.LocalAddr().String()))
+				})
+
+				It("can reject requests", func() {
+					start(func(next transport.HandlerFunc) transport.HandlerFunc {
+						return func(ctx context.Context, s transport.Session, req protocol.Request) error {
+							if req.GetCommand() == protocol.SET {
+								return protocol.WriteError(s, req.GetRequestID(), "Read only")
+							}
+
+							return next(ctx, s, req)
+						}
+					})
+
+					_, err := conn.Write([]byte("1234SET foo\n\"bar\"\n1235GET foo\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.ErrorOrNil()).To(MatchError("Read only"))
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespGet))
+					Expect(resp.Value).To(BeEmpty())
+				})
+
+				It("doesn't see requests over the rate limit", func() {
+					log := &requestLog{}
+					startWith(transport.Options{RequestRate: 1, RequestBurst: 1}, counting(log))
+
+					_, err := conn.Write([]byte("0001PING\n0002PING\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespPong))
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.ErrorOrNil()).To(MatchError(protocol.ErrRateLimited))
+
+					Consistently(log.get, 100*time.Millisecond).Should(Equal([]string{"0001"}))
+				})
+
+				It("doesn't see requests from clients that haven't authenticated", func() {
+					tokens := transport.NewTokens()
+					tokens.Add("alice", "s3cret")
+
+					log := &requestLog{}
+					startWith(transport.Options{Auth: tokens}, counting(log))
+
+					_, err := conn.Write([]byte("0001GET foo\n0002AUTH s3cret\n0003PING\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.ErrorOrNil()).To(MatchError(protocol.ErrNoAuth))
+
+					for i := 0; i < 2; i++ {
+						resp, err = protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+						Expect(resp.ErrorOrNil()).To(Succeed())
+					}
+
+					Consistently(log.get, 100*time.Millisecond).Should(Equal([]string{"0002", "0003"}))
+				})
+			})
+		}
+	})
+})
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/storage"
+)
+
+// namespace is a namespace that clients can SELECT. Its limits are shared by
+// every connection that has selected it.
+type namespace struct {
+	name  string
+	store storage.Store
+
+	// writes limits how many writes the namespace's connections can make
+	// between them, nil is unlimited
+	writes *sharedTokenBucket
+
+	// ephemeral is who owns each of the namespace's ephemeral keys
+	ephemeral *ephemeralKeys
+
+	// locks are the namespace's locks
+	locks *lockManager
+
+	// queues are the namespace's queues
+	queues *queueManager
+
+	// channels hands the messages published in the namespace to the listeners
+	channels *channelHub
+}
+
+// namespaceSet is every namespace that the server holds, TCP shares one between
+// all of its listeners so that each namespace's limits apply to the server as a
+// whole.
+type namespaceSet struct {
+	byName map[string]*namespace
+
+	// all is every namespace in the order they were added, the first is the
+	// default
+	all []*namespace
+}
+
+func newNamespaceSet(options Options) *namespaceSet {
+	namespaces := options.Namespaces
+	if namespaces == nil {
+		namespaces = storage.NewNamespaces(options.Store)
+	}
+
+	log := options.Log
+	if log == nil {
+		log = zap.NewNop()
+	}
+
+	set := &namespaceSet{byName: make(map[string]*namespace)}
+
+	for _, name := range namespaces.Names() {
+		store, _ := namespaces.Get(name)
+		nsLog := log.With(zap.String("namespace", name))
+
+		ns := &namespace{
+			name:      name,
+			store:     store,
+			writes:    newSharedTokenBucket(options.NamespaceWriteRate, options.NamespaceWriteBurst),
+			ephemeral: newEphemeralKeys(),
+			locks:     newLockManager(store, nsLog.Named("locks")),
+			queues:    newQueueManager(store, nsLog.Named("queues")),
+			channels:  newChannelHub(),
+		}
+
+		set.byName[name] = ns
+		set.all = append(set.all, ns)
+	}
+
+	return set
+}
+
+// defaultNamespace returns the namespace that connections start in
+func (n *namespaceSet) defaultNamespace() *namespace {
+	return n.byName[storage.DefaultNamespace]
+}
+
+// namespaceState is the namespace that a connection has selected. It's safe
+// for concurrent use, as requests can be executed by workers.
+type namespaceState struct {
+	namespaces *namespaceSet
+
+	// selected holds the current *namespace
+	selected atomic.Value
+}
+
+func newNamespaceState(namespaces *namespaceSet) *namespaceState {
+	state := &namespaceState{namespaces: namespaces}
+	state.selected.Store(namespaces.defaultNamespace())
+
+	return state
+}
+
+// current returns the selected namespace
+func (n *namespaceState) current() *namespace {
+	return n.selected.Load().(*namespace)
+}
+
+// selectNamespace selects the namespace called name, it returns false if there
+// isn't one
+func (n *namespaceState) selectNamespace(name string) bool {
+	ns, ok := n.namespaces.byName[name]
+	if !ok {
+		return false
+	}
+
+	n.selected.Store(ns)
+	return true
+}
+
+// namespaceFor returns the namespace that the client making the request has
+// selected
+func namespaceFor(ctx context.Context) *namespace {
+	return ctx.Value(sessionKey{}).(session).namespace().current()
+}
+
+// Namespace returns the name and store of the namespace that the client making
+// the request has selected, or false if ctx isn't a request's context.
+func Namespace(ctx context.Context) (string, storage.Store, bool) {
+	s, ok := ctx.Value(sessionKey{}).(session)
+	if !ok {
+		return "", nil, false
+	}
+
+	ns := s.namespace().current()
+	return ns.name, ns.store, true
+}
@@ -0,0 +1,181 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("namespaces", func() {
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var (
+					tcp     *transport.TCP
+					staging storage.Store
+				)
+
+				BeforeEach(func() {
+					namespaces := storage.NewNamespaces(storage.NewInmemoryStore())
+
+					var err error
+					staging, err = namespaces.Create("staging")
+					Expect(err).To(Succeed())
+
+					tcp = makeServer("", transport.Options{
+						UseStdlib:          useStdlib,
+						Namespaces:         namespaces,
+						NamespaceWriteRate: 0.01,
+					})
+				})
+
+				AfterEach(func() {
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				dial := func() (net.Conn, *bufio.Reader) {
+					conn, err := net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					return conn, bufio.NewReader(conn)
+				}
+
+				It("keeps each namespace's keys separate", func() {
+					conn, r := dial()
+					defer conn.Close()
+
+					_, err := conn.Write([]byte("0001SET foo\nproduction\n0002SELECT staging\n0003SET foo\nstaging\n0004GET foo\n"))
+					Expect(err).To(Succeed())
+
+					// The connection is sent updates of its own SETs too
+					var types []protocol.ResponseType
+					for len(types) < 4 {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+
+						if resp.Type == protocol.RespUpdate {
+							continue
+						}
+
+						types = append(types, resp.Type)
+
+						if resp.Type == protocol.RespGet {
+							Expect(string(resp.Value)).To(Equal(`"staging"`))
+						}
+					}
+
+					Expect(types).To(Equal([]protocol.ResponseType{protocol.RespOk, protocol.RespOk, protocol.RespOk, protocol.RespGet}))
+
+					Expect(tcp.Store().Get(context.Background(), []byte("foo"))).To(Equal([]byte(`"production"`)))
+					Expect(staging.Get(context.Background(), []byte("foo"))).To(Equal([]byte(`"staging"`)))
+				})
+
+				It("only sends updates of the selected namespace", func() {
+					conn, r := dial()
+					defer conn.Close()
+
+					_, err := conn.Write([]byte("0001SELECT staging\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespOk))
+
+					Expect(tcp.Store().Set(context.Background(), []byte("foo"), "production")).To(Succeed())
+					Expect(staging.Set(context.Background(), []byte("foo"), "staging")).To(Succeed())
+
+					resp, err = protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespUpdate))
+					Expect(string(resp.Value)).To(Equal(`"staging"`))
+				})
+
+				It("refuses to select namespaces that don't exist", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+
+					conn := client.New(zap.NewNop(), client.WithNamespace("missing"))
+					err := conn.Connect(ctx, "127.0.0.1:6682")
+					Expect(errors.Is(err, protocol.ErrNoNamespace)).To(BeTrue())
+				})
+
+				It("limits writes to each namespace separately", func() {
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+
+					first := client.New(zap.NewNop(), client.WithNamespace("staging"))
+					Expect(first.Connect(ctx, "127.0.0.1:6682")).To(Succeed())
+					defer first.Disconnect()
+
+					second := client.New(zap.NewNop(), client.WithNamespace("staging"))
+					Expect(second.Connect(ctx, "127.0.0.1:6682")).To(Succeed())
+					defer second.Disconnect()
+
+					production := client.New(zap.NewNop())
+					Expect(production.Connect(ctx, "127.0.0.1:6682")).To(Succeed())
+					defer production.Disconnect()
+
+					Expect(first.Set(ctx, "foo", []byte("1"))).To(Succeed())
+
+					err := second.Set(ctx, "foo", []byte("2"))
+					Expect(errors.Is(err, protocol.ErrRateLimited)).To(BeTrue())
+
+					Expect(production.Set(ctx, "foo", []byte("3"))).To(Succeed())
+				})
+
+				It("doesn't count writes from clients that haven't authenticated", func() {
+					Expect(tcp.Close()).To(Succeed())
+
+					tokens := transport.NewTokens()
+					tokens.Add("alice", "s3cret")
+
+					tcp = makeServer("", transport.Options{
+						UseStdlib:          useStdlib,
+						Auth:               tokens,
+						NamespaceWriteRate: 0.01,
+					})
+
+					conn, r := dial()
+					defer conn.Close()
+
+					_, err := conn.Write([]byte("0001SET foo\n1\n0002DEL foo\n0003SET foo\n2\n"))
+					Expect(err).To(Succeed())
+
+					for i := 0; i < 3; i++ {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+						Expect(errors.Is(resp.ErrorOrNil(), protocol.ErrNoAuth)).To(BeTrue())
+					}
+
+					_, err = conn.Write([]byte("0004AUTH s3cret\n0005SET foo\n3\n"))
+					Expect(err).To(Succeed())
+
+					for i := 0; i < 2; i++ {
+						resp, err := protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+						Expect(resp.Type).To(Equal(protocol.RespOk))
+					}
+				})
+			})
+		}
+	})
+})
@@ -1,8 +1,13 @@
 package transport
 
 import (
-	"github.com/luma/pharos/storage"
+	"net"
+	"time"
+
+	reuseport "github.com/kavu/go_reuseport"
 	"go.uber.org/zap"
+
+	"github.com/luma/pharos/storage"
 )
 
 type Options struct {
@@ -13,18 +18,140 @@ type Options struct {
 	Port int
 
 	// Reuseport controls setting SO_REUSEPORT
-	// TODO(rolly) this https://blog.cloudflare.com/graceful-upgrades-in-go/
 	// TODO(rolly) Reuseport should default to true
 	Reuseport bool
 
+	// ListenFunc creates each listening socket. It defaults to binding a new
+	// socket with SO_REUSEPORT, it can be replaced to use sockets that were
+	// inherited from another process, see internal/upgrade.
+	ListenFunc func(network, addr string) (net.Listener, error)
+
 	// Trace will dump packets to stdout. This is only useful in local debugging
 	Trace bool
 
+	// UseStdlib serves each connection with a pair of goroutines using the
+	// standard library's net package. When false, connections are multiplexed
+	// onto a few epoll based event loops instead, which scales to many more
+	// idle connections.
 	UseStdlib bool
 
+	// NumListeners is how many listeners (or event loops) accept connections
+	// on the port, using SO_REUSEPORT. Defaults to the number of CPUs.
 	NumListeners int
 
+	// MaxCoalesceWindow is the longest window a client may ask for updates to be
+	// coalesced over. Defaults to DefaultMaxCoalesceWindow.
+	MaxCoalesceWindow time.Duration
+
+	// WriteBatchSize is the most frames a connection will write with a single
+	// syscall. Defaults to DefaultWriteBatchSize.
+	WriteBatchSize int
+
+	// WriteBatchLatency is how long a connection may wait for more frames to be
+	// queued before writing a batch. The default of zero writes as soon as the
+	// write queue is empty.
+	WriteBatchLatency time.Duration
+
+	// IdleTimeout closes connections that we haven't received anything from for
+	// this long. Zero disables idle timeouts, unless HeartbeatInterval is set in
+	// which case it defaults to DefaultHeartbeatMisses heartbeat intervals.
+	IdleTimeout time.Duration
+
+	// HeartbeatInterval is how often clients are sent a HEARTBEAT notice, which
+	// they must answer. Zero disables heartbeats.
+	HeartbeatInterval time.Duration
+
+	// RestartBackoff is how long to wait before restarting a listener that has
+	// failed. It doubles for each consecutive failure, up to MaxRestartBackoff.
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+
+	// MaxConns caps how many client connections can be open at once, and
+	// MaxConnsPerIP how many of them can be from a single remote IP. Connections
+	// over the limit are closed as soon as they're accepted. Zero is unlimited.
+	MaxConns      int
+	MaxConnsPerIP int
+
+	// RequestRate limits how many requests per second each connection can make,
+	// and WriteRate how many of them can be SETs. Requests over the limit are
+	// rejected with a RATELIMITED error. The bursts are how many requests can be
+	// made at once, they default to the rate. Zero rates are unlimited.
+	RequestRate  float64
+	RequestBurst int
+	WriteRate    float64
+	WriteBurst   int
+
+	// ProxyProtocol is whether connections start with a PROXY protocol header,
+	// v1 or v2, from a load balancer. The client address from the header is used
+	// for connection limits and logging.
+	ProxyProtocol ProxyProtocolMode
+
+	// Auth requires clients to AUTH with a token that it accepts before they can
+	// make any other requests, or be sent updates. Nil doesn't require clients
+	// to authenticate.
+	Auth TokenSource
+
+	// ACL limits which paths each authenticated principal can read, write and
+	// be sent updates for. It requires Auth. Nil allows every client to access
+	// the whole document.
+	ACL *ACL
+
+	// Registry holds the commands that clients can use. Defaults to the builtin
+	// commands, custom commands can be added to a registry from NewRegistry.
+	Registry *Registry
+
+	// Middleware wraps the execution of every request, the first is the
+	// outermost. See Middleware.
+	Middleware []Middleware
+
+	// RequestTimeout bounds how long a single request can spend in the store.
+	// Defaults to DefaultRequestTimeout.
+	RequestTimeout time.Duration
+
+	// MaxConcurrentRequests is how many requests each connection can have
+	// executing at once. Requests for the same key are always executed in the
+	// order they were received. Defaults to DefaultMaxConcurrentRequests.
+	MaxConcurrentRequests int
+
+	// EventLoopWorkers is how many goroutines each event loop executes requests
+	// on, so that a slow request doesn't hold up the loop's other connections.
+	// It only applies when UseStdlib is false. Defaults to
+	// DefaultEventLoopWorkers.
+	EventLoopWorkers int
+
+	// TLS enables TLS, and optionally mutual TLS, for client connections. It's
+	// only supported when UseStdlib is true.
+	TLS *TLSOptions
+
+	// UnixSockets are served in addition to the TCP port
+	UnixSockets []UnixSocket
+
 	Store storage.Store
 
+	// Namespaces are the namespaces that clients can SELECT, each is backed by
+	// a store of its own. Defaults to just the default namespace, backed by
+	// Store. Namespaces must all be added before the server is started.
+	Namespaces *storage.Namespaces
+
+	// NamespaceWriteRate limits how many SETs and DELs per second can be made to
+	// each namespace, by all of the connections using it between them. Writes
+	// over the limit are rejected with a RATELIMITED error. NamespaceWriteBurst
+	// is how many can be made at once, it defaults to the rate. Zero is unlimited.
+	NamespaceWriteRate  float64
+	NamespaceWriteBurst int
+
 	Log *zap.Logger
 }
+
+// listen creates a listening socket for addr using ListenFunc
+func (o Options) listen(network, addr string) (net.Listener, error) {
+	if o.ListenFunc != nil {
+		return o.ListenFunc(network, addr)
+	}
+
+	if network == "unix" {
+		return net.Listen(network, addr)
+	}
+
+	return reuseport.Listen(network, addr)
+}
@@ -1,6 +1,20 @@
 package transport
 
-import "syscall"
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+const (
+	// pollReadEvents are the events we are interested in for connections that we
+	// only ever read from, such as listening sockets.
+	pollReadEvents = syscall.EPOLLIN
+
+	// pollConnEvents are the events we are interested in for client connections.
+	// They're edge triggered, so the event loop must read and write until it
+	// receives EAGAIN.
+	pollConnEvents = syscall.EPOLLIN | syscall.EPOLLOUT | syscall.EPOLLRDHUP | (syscall.EPOLLET & 0xffffffff)
+)
 
 type Poller struct {
 	fd     int
@@ -15,32 +29,93 @@ func MakePoller() (*Poller, error) {
 
 	// Open an epoll fd
 	// https://man7.org/linux/man-pages/man2/epoll_create.2.html
-	poller.fd, err = syscall.EpollCreate1(0)
+	poller.fd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
 
 	if err != nil {
 		return nil, err
 	}
 
 	// https://man7.org/linux/man-pages/man2/eventfd.2.html
-	r0, _, e0 := syscall.Syscall(syscall.SYS_EVENTFD2, 0, 0, 0)
+	r0, _, e0 := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
 	if e0 != 0 {
 		syscall.Close(poller.fd)
-		panic(err)
+		return nil, e0
 	}
 	poller.wakeFd = int(r0)
 
-	// Register our interested for read and writes on our wakeFd
+	// Register our interest in reads on our wakeFd. We don't ask for writes, an
+	// eventfd is almost always writable so we'd never stop waking up.
 	// https://man7.org/linux/man-pages/man2/epoll_ctl.2.html
-	event := &syscall.EpollEvent{Fd: int32(poller.wakeFd),
-		Events: syscall.EPOLLIN | syscall.EPOLLOUT,
+	if err = poller.add(poller.wakeFd, pollReadEvents); err != nil {
+		poller.Close()
+		return nil, err
 	}
 
-	err = syscall.EpollCtl(poller.fd, syscall.EPOLL_CTL_ADD, poller.wakeFd, event)
-	if err != nil {
-		panic(err)
+	return &poller, nil
+}
+
+// AddRead registers fd, for which we only care about reads.
+func (p *Poller) AddRead(fd int) error {
+	return p.add(fd, pollReadEvents)
+}
+
+// AddConn registers a client connection fd, for both reads and writes.
+func (p *Poller) AddConn(fd int) error {
+	return p.add(fd, pollConnEvents)
+}
+
+// Remove deregisters fd.
+func (p *Poller) Remove(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+// Wait blocks until there are events, or until Trigger is called. Events for
+// the wake fd are consumed rather than returned, so woken is true if Trigger was
+// called and the remaining events are returned in events[:n].
+func (p *Poller) Wait(events []syscall.EpollEvent, timeoutMs int) (n int, woken bool, err error) {
+	for {
+		n, err = syscall.EpollWait(p.fd, events, timeoutMs)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err != nil {
+			return 0, false, err
+		}
+
+		break
 	}
 
-	return &poller, nil
+	// Consume any wake up events, so the caller only sees events for its fds
+	for i := 0; i < n; i++ {
+		if int(events[i].Fd) != p.wakeFd {
+			continue
+		}
+
+		woken = true
+		p.drainWake()
+
+		n--
+		events[i] = events[n]
+		i--
+	}
+
+	return n, woken, nil
+}
+
+// Trigger wakes up the goroutine that is blocked in Wait. It's safe to call
+// from any goroutine.
+func (p *Poller) Trigger() error {
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+
+	_, err := syscall.Write(p.wakeFd, one[:])
+	if err == syscall.EAGAIN {
+		// The counter is saturated, the poller is going to wake up regardless
+		return nil
+	}
+
+	return err
 }
 
 func (p *Poller) Close() error {
@@ -50,3 +125,22 @@ func (p *Poller) Close() error {
 
 	return syscall.Close(p.fd)
 }
+
+func (p *Poller) add(fd int, events uint32) error {
+	event := &syscall.EpollEvent{
+		Fd:     int32(fd),
+		Events: events,
+	}
+
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, event)
+}
+
+// drainWake resets the wake fd's counter so it stops reporting as readable
+func (p *Poller) drainWake() {
+	var buf [8]byte
+	for {
+		if _, err := syscall.Read(p.wakeFd, buf[:]); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// ProxyProtocolMode is whether connections are expected to start with a PROXY
+// protocol header, which load balancers use to pass on the client's address.
+type ProxyProtocolMode int
+
+const (
+	// ProxyProtocolDisabled doesn't look for PROXY protocol headers
+	ProxyProtocolDisabled ProxyProtocolMode = iota
+
+	// ProxyProtocolOptional uses the client address from the header if the
+	// connection starts with one
+	ProxyProtocolOptional
+
+	// ProxyProtocolStrict closes connections that don't start with a header
+	ProxyProtocolStrict
+)
+
+const (
+	// proxyHeaderTimeout bounds how long a client has to send its PROXY header
+	// once it has connected
+	proxyHeaderTimeout = 5 * time.Second
+
+	// proxyV1MaxSize is the longest a v1 header can be, including the CRLF
+	proxyV1MaxSize = 107
+
+	// maxProxyHeaderSize bounds the size of the v2 headers we'll accept. The
+	// format allows for up to 64KB of extensions, but we don't use them.
+	maxProxyHeaderSize = 4096
+)
+
+var (
+	ErrNoProxyHeader      = errors.New("Connection did not start with a PROXY protocol header")
+	ErrInvalidProxyHeader = errors.New("PROXY protocol header is invalid")
+
+	// errProxyHeaderIncomplete means that we need to read more to parse the header
+	errProxyHeaderIncomplete = errors.New("PROXY protocol header is incomplete")
+
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// parseProxyHeader parses the PROXY protocol header, v1 or v2, at the start of
+// buf. It returns the length of the header and the client address that it
+// carries. The address is nil if the proxy didn't provide one, such as for its
+// own health checks.
+//
+// If buf only holds part of a header errProxyHeaderIncomplete is returned, and
+// if it doesn't start with a header then ErrNoProxyHeader is.
+func parseProxyHeader(buf []byte) (int, net.Addr, error) {
+	switch {
+	case bytes.HasPrefix(buf, proxyV2Signature):
+		return parseProxyV2(buf)
+
+	case bytes.HasPrefix(buf, proxyV1Signature):
+		return parseProxyV1(buf)
+
+	case bytes.HasPrefix(proxyV2Signature, buf) || bytes.HasPrefix(proxyV1Signature, buf):
+		return 0, nil, errProxyHeaderIncomplete
+
+	default:
+		return 0, nil, ErrNoProxyHeader
+	}
+}
+
+// parseProxyV1 parses a human readable header
+//
+//	PROXY TCP4 <src ip> <dst ip> <src port> <dst port>\r\n
+func parseProxyV1(buf []byte) (int, net.Addr, error) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		if len(buf) >= proxyV1MaxSize {
+			return 0, nil, fmt.Errorf("%w, it's too long", ErrInvalidProxyHeader)
+		}
+
+		return 0, nil, errProxyHeaderIncomplete
+	}
+
+	n := end + 2
+	if n > proxyV1MaxSize {
+		return 0, nil, fmt.Errorf("%w, it's too long", ErrInvalidProxyHeader)
+	}
+
+	fields := bytes.Split(buf[:end], []byte(" "))
+
+	if len(fields) >= 2 && string(fields[1]) == "UNKNOWN" {
+		return n, nil, nil
+	}
+
+	if len(fields) != 6 || (string(fields[1]) != "TCP4" && string(fields[1]) != "TCP6") {
+		return 0, nil, fmt.Errorf("%w, '%s'", ErrInvalidProxyHeader, buf[:end])
+	}
+
+	ip := net.ParseIP(string(fields[2]))
+	port, err := strconv.ParseUint(string(fields[4]), 10, 16)
+
+	if ip == nil || err != nil {
+		return 0, nil, fmt.Errorf("%w, '%s'", ErrInvalidProxyHeader, buf[:end])
+	}
+
+	return n, &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 parses a binary header, which is the signature followed by the
+// version and command, the address family, the length of the addresses, and
+// then the addresses themselves.
+func parseProxyV2(buf []byte) (int, net.Addr, error) {
+	if len(buf) < 16 {
+		return 0, nil, errProxyHeaderIncomplete
+	}
+
+	versionCommand := buf[12]
+	family := buf[13]
+	n := 16 + int(binary.BigEndian.Uint16(buf[14:16]))
+
+	if versionCommand>>4 != 2 {
+		return 0, nil, fmt.Errorf("%w, unsupported version %d", ErrInvalidProxyHeader, versionCommand>>4)
+	}
+
+	if n > maxProxyHeaderSize {
+		return 0, nil, fmt.Errorf("%w, it's too long", ErrInvalidProxyHeader)
+	}
+
+	if len(buf) < n {
+		return 0, nil, errProxyHeaderIncomplete
+	}
+
+	addrs := buf[16:n]
+
+	switch versionCommand & 0xf {
+	case 0x0:
+		// LOCAL, the connection is the proxy's own
+		return n, nil, nil
+
+	case 0x1:
+		// PROXY
+
+	default:
+		return 0, nil, fmt.Errorf("%w, unsupported command %d", ErrInvalidProxyHeader, versionCommand&0xf)
+	}
+
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		if len(addrs) < 12 {
+			return 0, nil, fmt.Errorf("%w, IPv4 addresses are truncated", ErrInvalidProxyHeader)
+		}
+
+		return n, &net.TCPAddr{
+			IP:   net.IPv4(addrs[0], addrs[1], addrs[2], addrs[3]),
+			Port: int(binary.BigEndian.Uint16(addrs[8:10])),
+		}, nil
+
+	case 0x21:
+		// TCP over IPv6
+		if len(addrs) < 36 {
+			return 0, nil, fmt.Errorf("%w, IPv6 addresses are truncated", ErrInvalidProxyHeader)
+		}
+
+		return n, &net.TCPAddr{
+			IP:   append(net.IP(nil), addrs[0:16]...),
+			Port: int(binary.BigEndian.Uint16(addrs[32:34])),
+		}, nil
+
+	default:
+		// Anything else isn't a client that we could be serving, so the
+		// connection's own address is kept
+		return n, nil, nil
+	}
+}
+
+// proxyConn is a connection from a load balancer, which reports the address of
+// the client from the PROXY header rather than the load balancer's.
+type proxyConn struct {
+	net.Conn
+
+	// reader holds anything that was read past the header
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+}
+
+// readProxyHeader reads the PROXY header from the start of conn, and returns a
+// connection that reports the client's address. If mode is optional then
+// connections without a header are returned with their own address.
+func readProxyHeader(conn net.Conn, mode ProxyProtocolMode) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(conn, maxProxyHeaderSize)
+
+	var (
+		n    int
+		addr net.Addr
+		err  error
+	)
+
+	for size := 1; ; {
+		buf, peekErr := reader.Peek(size)
+
+		n, addr, err = parseProxyHeader(buf)
+		if !errors.Is(err, errProxyHeaderIncomplete) {
+			break
+		}
+
+		if peekErr != nil {
+			return nil, fmt.Errorf("Failed to read PROXY protocol header %w", peekErr)
+		}
+
+		// Parse everything that's already been read next time, rather than a byte
+		// at a time
+		if size = reader.Buffered(); size <= len(buf) {
+			size = len(buf) + 1
+		}
+	}
+
+	if err != nil && !(errors.Is(err, ErrNoProxyHeader) && mode == ProxyProtocolOptional) {
+		return nil, err
+	}
+
+	if _, err := reader.Discard(n); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+
+	return &proxyConn{Conn: conn, reader: reader, remoteAddr: addr}, nil
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.reader.Buffered() > 0 {
+		return c.reader.Read(b)
+	}
+
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client's address
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+func (c *proxyConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
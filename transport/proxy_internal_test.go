@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// proxyV2Header returns a v2 PROXY header for a TCP over IPv4 connection from
+// src to dst
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, src.IP.To4()...)
+	header = append(header, dst.IP.To4()...)
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+
+	return append(header, ports...)
+}
+
+var _ = Describe("PROXY protocol (internal)", func() {
+	Describe("parseProxyHeader()", func() {
+		src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+		dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 7363}
+
+		It("parses a v1 TCP4 header", func() {
+			header := "PROXY TCP4 192.0.2.1 192.0.2.2 56324 7363\r\n"
+
+			n, addr, err := parseProxyHeader([]byte(header + "1234PING\n"))
+			Expect(err).To(Succeed())
+			Expect(n).To(Equal(len(header)))
+			Expect(addr.String()).To(Equal("192.0.2.1:56324"))
+		})
+
+		It("parses a v1 TCP6 header", func() {
+			_, addr, err := parseProxyHeader([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 7363\r\n"))
+			Expect(err).To(Succeed())
+			Expect(addr.String()).To(Equal("[2001:db8::1]:56324"))
+		})
+
+		It("parses a v1 UNKNOWN header without an address", func() {
+			header := "PROXY UNKNOWN\r\n"
+
+			n, addr, err := parseProxyHeader([]byte(header))
+			Expect(err).To(Succeed())
+			Expect(n).To(Equal(len(header)))
+			Expect(addr).To(BeNil())
+		})
+
+		It("parses a v2 TCP over IPv4 header", func() {
+			header := proxyV2Header(src, dst)
+
+			n, addr, err := parseProxyHeader(append(header, "1234PING\n"...))
+			Expect(err).To(Succeed())
+			Expect(n).To(Equal(len(header)))
+			Expect(addr.String()).To(Equal("192.0.2.1:56324"))
+		})
+
+		It("parses a v2 LOCAL header without an address", func() {
+			header := append([]byte(nil), proxyV2Signature...)
+			header = append(header, 0x20, 0x00, 0, 0)
+
+			n, addr, err := parseProxyHeader(header)
+			Expect(err).To(Succeed())
+			Expect(n).To(Equal(16))
+			Expect(addr).To(BeNil())
+		})
+
+		It("needs more data for a partial header", func() {
+			header := proxyV2Header(src, dst)
+
+			for _, partial := range [][]byte{nil, []byte("PRO"), []byte("PROXY TCP4 192"), header[:10], header[:20]} {
+				_, _, err := parseProxyHeader(partial)
+				Expect(errors.Is(err, errProxyHeaderIncomplete)).To(BeTrue())
+			}
+		})
+
+		It("returns an error if there's no header", func() {
+			_, _, err := parseProxyHeader([]byte("1234PING\n"))
+			Expect(errors.Is(err, ErrNoProxyHeader)).To(BeTrue())
+		})
+
+		It("returns an error if the header is invalid", func() {
+			for _, header := range []string{
+				"PROXY TCP4 nonsense 192.0.2.2 56324 7363\r\n",
+				"PROXY TCP4 192.0.2.1 192.0.2.2 99999 7363\r\n",
+				"PROXY SCTP 192.0.2.1 192.0.2.2 56324 7363\r\n",
+			} {
+				_, _, err := parseProxyHeader([]byte(header))
+				Expect(errors.Is(err, ErrInvalidProxyHeader)).To(BeTrue())
+			}
+		})
+	})
+})
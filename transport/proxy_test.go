@@ -0,0 +1,110 @@
+package transport_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("PROXY protocol", func() {
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var tcp *transport.TCP
+
+				AfterEach(func() {
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				// dial connects, sending header before anything else
+				dial := func(header string) (net.Conn, *bufio.Reader) {
+					conn, err := net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					if header != "" {
+						_, err = conn.Write([]byte(header))
+						Expect(err).To(Succeed())
+					}
+
+					return conn, bufio.NewReader(conn)
+				}
+
+				ping := func(conn net.Conn, r *bufio.Reader) error {
+					if _, err := conn.Write([]byte("1234PING\n")); err != nil {
+						return err
+					}
+
+					_, err := protocol.ReadResponse(r)
+					return err
+				}
+
+				It("limits connections by the client address from the header", func() {
+					tcp = makeServer("", transport.Options{
+						UseStdlib:     useStdlib,
+						ProxyProtocol: transport.ProxyProtocolStrict,
+						MaxConnsPerIP: 1,
+					})
+
+					alice, aliceReader := dial("PROXY TCP4 192.0.2.1 127.0.0.1 50000 6682\r\n")
+					defer alice.Close()
+					Expect(ping(alice, aliceReader)).To(Succeed())
+
+					bob, bobReader := dial("PROXY TCP4 192.0.2.2 127.0.0.1 50000 6682\r\n")
+					defer bob.Close()
+					Expect(ping(bob, bobReader)).To(Succeed())
+
+					// A second connection from alice is over the limit, even though every
+					// connection comes from the same load balancer
+					again, againReader := dial("PROXY TCP4 192.0.2.1 127.0.0.1 50001 6682\r\n")
+					defer again.Close()
+
+					// It may be closed before or after our PING arrives, so this is either
+					// an EOF or a reset
+					Expect(ping(again, againReader)).To(HaveOccurred())
+				})
+
+				It("closes connections without a header in strict mode", func() {
+					tcp = makeServer("", transport.Options{
+						UseStdlib:     useStdlib,
+						ProxyProtocol: transport.ProxyProtocolStrict,
+					})
+
+					conn, r := dial("")
+					defer conn.Close()
+
+					Expect(ping(conn, r)).To(MatchError(io.EOF))
+				})
+
+				It("serves connections without a header in optional mode", func() {
+					tcp = makeServer("", transport.Options{
+						UseStdlib:     useStdlib,
+						ProxyProtocol: transport.ProxyProtocolOptional,
+					})
+
+					conn, r := dial("")
+					defer conn.Close()
+					Expect(ping(conn, r)).To(Succeed())
+
+					proxied, proxiedReader := dial("PROXY TCP4 192.0.2.1 127.0.0.1 50000 6682\r\n")
+					defer proxied.Close()
+					Expect(ping(proxied, proxiedReader)).To(Succeed())
+				})
+			})
+		}
+	})
+})
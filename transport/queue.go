@@ -0,0 +1,447 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+var (
+	// errQueueEmpty is returned when there's nothing in a queue to take
+	errQueueEmpty = errors.New("Queue is empty")
+
+	// errNotPending is returned when an item isn't waiting to be acknowledged
+	errNotPending = errors.New("Item is not pending")
+)
+
+// queueItem is an item in a queue, as it's stored at queueItemKey. Position
+// orders the queue's items, the one with the lowest is at the front. Visible
+// is only set once the item has been taken, it's when the item is returned to
+// the queue unless it's acknowledged before then.
+type queueItem struct {
+	ID       uint64 `json:"-"`
+	Item     string `json:"item"`
+	Position int64  `json:"position"`
+	Visible  int64  `json:"visible,omitempty"`
+}
+
+// queueState is how a queue is stored, at protocol.QueueKey(name). Next is the
+// ID that the next item is given, and Items holds every item that hasn't been
+// acknowledged by its ID. Each item is written on its own so that changing a
+// queue doesn't rewrite all of it.
+type queueState struct {
+	Next  uint64               `json:"next"`
+	Items map[string]queueItem `json:"items"`
+}
+
+// queue is a queue that's been used since the server started
+type queue struct {
+	next  uint64
+	items []queueItem
+
+	// head and tail are the positions of the items that were last added to the
+	// front and the back of the queue
+	head int64
+	tail int64
+
+	// pending is the items that have been taken, by ID, until they're
+	// acknowledged or returned to the queue
+	pending map[uint64]*pendingItem
+
+	// available is closed, and replaced, whenever items are added to the queue
+	// to wake any waiters
+	available chan struct{}
+}
+
+// pendingItem is an item that's been taken from a queue, expiry returns it to
+// the queue once its visibility timeout has passed
+type pendingItem struct {
+	item   queueItem
+	expiry *time.Timer
+}
+
+// queueManager holds the queues of a namespace. It's safe for concurrent use.
+//
+// The contents of each queue are kept in memory, and each change is written to
+// the store so that they're included in backups and can be subscribed to.
+// Changes are queued to be written while the mutex is held, so that they're
+// written in the order that they were made, but written once it has been
+// released. Queues that haven't been used since the server started are read
+// from the store, which may have been restored from a backup.
+type queueManager struct {
+	store storage.Store
+
+	mu     sync.Mutex
+	queues map[string]*queue
+
+	writer *storeWriter
+}
+
+func newQueueManager(store storage.Store, log *zap.Logger) *queueManager {
+	return &queueManager{
+		store:  store,
+		queues: make(map[string]*queue),
+		writer: newStoreWriter(store, log),
+	}
+}
+
+// push adds item to the back of the queue called name, or the front if front is
+// set
+func (m *queueManager) push(name, item []byte, front bool) error {
+	var writes []storeWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	q, err := m.load(name, &writes)
+	if err != nil {
+		return err
+	}
+
+	added := queueItem{ID: q.next, Item: string(item)}
+	q.next++
+
+	if front {
+		q.head--
+		added.Position = q.head
+		q.items = append([]queueItem{added}, q.items...)
+	} else {
+		q.tail++
+		added.Position = q.tail
+		q.items = append(q.items, added)
+	}
+
+	q.wake()
+
+	writes = append(writes, writeQueueItem(name, added), writeQueueNext(name, q))
+
+	return nil
+}
+
+// pop takes the item at the front of the queue called name for holder, it's
+// hidden for visibility. If the queue is empty it returns errQueueEmpty, along
+// with a channel that's closed once something is added to it.
+func (m *queueManager) pop(name []byte, holder session, visibility time.Duration) (queueItem, <-chan struct{}, error) {
+	var writes []storeWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	q, err := m.load(name, &writes)
+	if err != nil {
+		return queueItem{}, nil, err
+	}
+
+	if len(q.items) == 0 {
+		return queueItem{}, q.available, errQueueEmpty
+	}
+
+	// A holder that has closed would never receive the item, leave it for
+	// someone else
+	if err := holder.Context().Err(); err != nil {
+		return queueItem{}, nil, err
+	}
+
+	item := q.items[0]
+	q.items = q.items[1:]
+
+	item.Visible = time.Now().Add(visibility).UnixNano()
+	m.hide(string(name), q, item)
+
+	writes = append(writes, writeQueueItem(name, item))
+
+	return item, nil, nil
+}
+
+// wait takes the item at the front of the queue called name for holder, waiting
+// until ctx is done for one to be added if it's empty
+func (m *queueManager) wait(ctx context.Context, name []byte, holder session, visibility time.Duration) (queueItem, error) {
+	for {
+		item, available, err := m.pop(name, holder, visibility)
+		if !errors.Is(err, errQueueEmpty) {
+			return item, err
+		}
+
+		select {
+		case <-available:
+		case <-ctx.Done():
+			return queueItem{}, errQueueEmpty
+		}
+	}
+}
+
+// ack removes the item with id from the queue called name, if it's pending
+func (m *queueManager) ack(name []byte, id uint64) error {
+	var writes []storeWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	q, err := m.load(name, &writes)
+	if err != nil {
+		return err
+	}
+
+	pending, ok := q.pending[id]
+	if !ok {
+		return errNotPending
+	}
+
+	pending.expiry.Stop()
+	delete(q.pending, id)
+
+	writes = append(writes, storeWrite{key: queueItemKey(name, id)})
+
+	return nil
+}
+
+// expire returns the item with id to the front of the queue called name once
+// its visibility timeout has passed, unless it has been acknowledged already.
+// It's given a new ID so that it can't be acknowledged by whoever took it
+// before.
+func (m *queueManager) expire(name string, id uint64) {
+	var writes []storeWrite
+
+	m.mu.Lock()
+	defer m.unlockAndWrite(&writes)
+
+	q := m.queues[name]
+
+	pending, ok := q.pending[id]
+	if !ok {
+		return
+	}
+
+	delete(q.pending, id)
+
+	q.head--
+	item := queueItem{ID: q.next, Item: pending.item.Item, Position: q.head}
+	q.next++
+
+	q.items = append([]queueItem{item}, q.items...)
+	q.wake()
+
+	writes = append(writes,
+		storeWrite{key: queueItemKey([]byte(name), id)},
+		writeQueueItem([]byte(name), item),
+		writeQueueNext([]byte(name), q),
+	)
+}
+
+// hide marks item as pending until its visibility timeout. It must be called
+// with the mutex held.
+func (m *queueManager) hide(name string, q *queue, item queueItem) {
+	visible := time.Unix(0, item.Visible)
+
+	q.pending[item.ID] = &pendingItem{
+		item:   item,
+		expiry: time.AfterFunc(time.Until(visible), func() { m.expire(name, item.ID) }),
+	}
+}
+
+// load returns the queue called name, reading it from the store if it hasn't
+// been used yet. A queue that isn't in the store is created, by adding its
+// state to writes. It must be called with the mutex held.
+func (m *queueManager) load(name []byte, writes *[]storeWrite) (*queue, error) {
+	if q, ok := m.queues[string(name)]; ok {
+		return q, nil
+	}
+
+	value, err := m.store.Get(context.Background(), protocol.QueueKey(name))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read queue %w", err)
+	}
+
+	state := queueState{Next: 1, Items: map[string]queueItem{}}
+	if len(value) > 0 {
+		if err := json.Unmarshal(value, &state); err != nil {
+			return nil, fmt.Errorf("Failed to parse queue %s %w", name, err)
+		}
+	} else {
+		// Items are stored beneath the queue's items object, which has to exist
+		// first or their numeric IDs would be taken for array indexes
+		*writes = append(*writes, storeWrite{key: protocol.QueueKey(name), value: state})
+	}
+
+	key := string(name)
+
+	q := &queue{
+		next:      state.Next,
+		tail:      -1,
+		pending:   make(map[uint64]*pendingItem),
+		available: make(chan struct{}),
+	}
+
+	for id, item := range state.Items {
+		if item.ID, err = strconv.ParseUint(id, 10, 64); err != nil {
+			return nil, fmt.Errorf("Failed to parse queue %s %w", name, err)
+		}
+
+		if len(q.items) == 0 && len(q.pending) == 0 {
+			q.head, q.tail = item.Position, item.Position
+		}
+
+		if item.Position < q.head {
+			q.head = item.Position
+		}
+
+		if item.Position > q.tail {
+			q.tail = item.Position
+		}
+
+		// Items that were taken before the server restarted can still be
+		// acknowledged until their visibility timeouts pass
+		if item.Visible != 0 {
+			m.hide(key, q, item)
+			continue
+		}
+
+		q.items = append(q.items, item)
+	}
+
+	sort.Slice(q.items, func(i, j int) bool {
+		return q.items[i].Position < q.items[j].Position
+	})
+
+	m.queues[key] = q
+
+	return q, nil
+}
+
+// unlockAndWrite queues the changes in writes, releases the mutex, and then
+// waits for them to be written. The queue is changed even if its changes can't
+// be written, the stored contents just won't include them until the items are
+// next written.
+func (m *queueManager) unlockAndWrite(writes *[]storeWrite) {
+	written := m.writer.queue(*writes)
+	m.mu.Unlock()
+
+	<-written
+}
+
+// queueItemKey returns the key that the item with id in the queue called name
+// is stored at
+func queueItemKey(name []byte, id uint64) []byte {
+	key := append(protocol.QueueKey(name), ".items."...)
+	return strconv.AppendUint(key, id, 10)
+}
+
+func writeQueueItem(name []byte, item queueItem) storeWrite {
+	return storeWrite{key: queueItemKey(name, item.ID), value: item}
+}
+
+func writeQueueNext(name []byte, q *queue) storeWrite {
+	return storeWrite{key: append(protocol.QueueKey(name), ".next"...), value: q.next}
+}
+
+// wake wakes anyone waiting for items to be added to q
+func (q *queue) wake() {
+	close(q.available)
+	q.available = make(chan struct{})
+}
+
+func (h *requestHandler) handlePush(ctx context.Context, s Session, req protocol.Request) error {
+	push := req.(*protocol.PushRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, push.GetKey()); !ok {
+		return err
+	}
+
+	if err := namespaceFor(ctx).queues.push(push.Queue, push.Item, push.Front); err != nil {
+		return fmt.Errorf("Failed to push %w", err)
+	}
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack %s %w", req.GetCommand(), err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handlePop(ctx context.Context, s Session, req protocol.Request) error {
+	pop := req.(*protocol.PopRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, pop.GetKey()); !ok {
+		return err
+	}
+
+	// Items are taken by the connection, rather than any middleware that wraps
+	// it
+	holder := ctx.Value(sessionKey{}).(session)
+	queues := namespaceFor(ctx).queues
+
+	item, _, err := queues.pop(pop.Queue, holder, pop.Visibility)
+	if !errors.Is(err, errQueueEmpty) {
+		return writePopResponse(s, req, item, err)
+	}
+
+	if ok, err := acquireWait(s, holder, req); !ok {
+		return err
+	}
+
+	name := retain(pop.Queue)
+
+	// The response is written once an item is taken or the wait is over
+	waitInBackground(holder, pop.Timeout, func(ctx context.Context) error {
+		item, err := queues.wait(ctx, name, holder, pop.Visibility)
+		return writePopResponse(s, req, item, err)
+	})
+
+	return nil
+}
+
+// writePopResponse responds to a BLPOP with the item that was taken, or the
+// reason that nothing was
+func writePopResponse(s Session, req protocol.Request, item queueItem, err error) error {
+	switch {
+	case err == nil:
+		if err := protocol.WritePop(s, req.GetRequestID(), item.ID, []byte(item.Item)); err != nil {
+			return fmt.Errorf("Failed to respond to BLPOP %w", err)
+		}
+
+	case errors.Is(err, errQueueEmpty):
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeEmpty, "Queue is empty"); err != nil {
+			return fmt.Errorf("Failed to reject BLPOP %w", err)
+		}
+
+	default:
+		return fmt.Errorf("Failed to pop %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleAck(ctx context.Context, s Session, req protocol.Request) error {
+	ack := req.(*protocol.AckRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessWrite, req, ack.GetKey()); !ok {
+		return err
+	}
+
+	switch err := namespaceFor(ctx).queues.ack(ack.Queue, ack.ID); {
+	case err == nil:
+		if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+			return fmt.Errorf("Failed to ack ACK %w", err)
+		}
+
+	case errors.Is(err, errNotPending):
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeNotPending, "Item is not pending"); err != nil {
+			return fmt.Errorf("Failed to reject ACK %w", err)
+		}
+
+	default:
+		return fmt.Errorf("Failed to ACK %w", err)
+	}
+
+	return nil
+}
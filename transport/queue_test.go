@@ -0,0 +1,227 @@
+package transport_test
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("queues", func() {
+		forEachServer(transport.Options{}, func(f *serverFixture) {
+			var producer, first, second *client.Conn
+
+			BeforeEach(func() {
+				producer = f.connect()
+				first = f.connect()
+				second = f.connect()
+			})
+
+			// pop takes an item from queue with conn in the background
+			pop := func(conn *client.Conn, queue string) <-chan *client.Item {
+				items := make(chan *client.Item, 1)
+
+				go func() {
+					defer GinkgoRecover()
+
+					item, err := conn.BLPop(f.ctx, queue, 5*time.Second, 0)
+					Expect(err).To(Succeed())
+
+					items <- item
+				}()
+
+				return items
+			}
+
+			It("takes items from the front of the queue", func() {
+				Expect(producer.RPush(f.ctx, "emails", []byte("a"))).To(Succeed())
+				Expect(producer.RPush(f.ctx, "emails", []byte("b"))).To(Succeed())
+				Expect(producer.LPush(f.ctx, "emails", []byte("c"))).To(Succeed())
+
+				for _, expected := range []string{"c", "a", "b"} {
+					item, err := first.BLPop(f.ctx, "emails", 0, 0)
+					Expect(err).To(Succeed())
+					Expect(string(item.Value)).To(Equal(expected))
+					Expect(item.Ack(f.ctx)).To(Succeed())
+				}
+
+				value, err := producer.Get(f.ctx, "_queues.emails")
+				Expect(err).To(Succeed())
+				Expect(gjson.GetBytes(value, "items").Map()).To(BeEmpty())
+				Expect(gjson.GetBytes(value, "next").Uint()).To(Equal(uint64(4)))
+			})
+
+			It("gives each item to one waiting connection", func() {
+				firstItems, secondItems := pop(first, "emails"), pop(second, "emails")
+
+				// Give both BLPOPs time to start waiting
+				time.Sleep(100 * time.Millisecond)
+
+				Expect(producer.RPush(f.ctx, "emails", []byte("a"))).To(Succeed())
+
+				var item *client.Item
+				Eventually(func() bool {
+					select {
+					case item = <-firstItems:
+						firstItems = nil
+					case item = <-secondItems:
+						secondItems = nil
+					default:
+					}
+
+					return item != nil
+				}).Should(BeTrue())
+
+				Expect(string(item.Value)).To(Equal("a"))
+
+				waiting := firstItems
+				if waiting == nil {
+					waiting = secondItems
+				}
+
+				Consistently(waiting, 200*time.Millisecond).ShouldNot(Receive())
+
+				Expect(producer.RPush(f.ctx, "emails", []byte("b"))).To(Succeed())
+				Eventually(waiting).Should(Receive(&item))
+				Expect(string(item.Value)).To(Equal("b"))
+			})
+
+			It("fails once the timeout passes if the queue stays empty", func() {
+				_, err := first.BLPop(f.ctx, "emails", 100*time.Millisecond, 0)
+				Expect(errors.Is(err, protocol.ErrEmpty)).To(BeTrue())
+			})
+
+			It("returns items that aren't acknowledged in time to the front of the queue", func() {
+				Expect(producer.RPush(f.ctx, "emails", []byte("a"))).To(Succeed())
+				Expect(producer.RPush(f.ctx, "emails", []byte("b"))).To(Succeed())
+
+				taken, err := first.BLPop(f.ctx, "emails", 0, 200*time.Millisecond)
+				Expect(err).To(Succeed())
+				Expect(string(taken.Value)).To(Equal("a"))
+
+				// Hidden until the visibility timeout passes
+				item, err := second.BLPop(f.ctx, "emails", 0, time.Minute)
+				Expect(err).To(Succeed())
+				Expect(string(item.Value)).To(Equal("b"))
+
+				retaken, err := second.BLPop(f.ctx, "emails", time.Second, time.Minute)
+				Expect(err).To(Succeed())
+				Expect(string(retaken.Value)).To(Equal("a"))
+				Expect(retaken.ID).ToNot(Equal(taken.ID))
+
+				// It's stored under its new ID
+				value, err := producer.Get(f.ctx, fmt.Sprintf("_queues.emails.items.%d", taken.ID))
+				Expect(err).To(Succeed())
+				Expect(value).To(BeEmpty())
+
+				value, err = producer.Get(f.ctx, fmt.Sprintf("_queues.emails.items.%d", retaken.ID))
+				Expect(err).To(Succeed())
+				Expect(gjson.GetBytes(value, "item").String()).To(Equal("a"))
+
+				// Whoever took it first can't acknowledge it any more
+				Expect(errors.Is(taken.Ack(f.ctx), protocol.ErrNotPending)).To(BeTrue())
+				Expect(retaken.Ack(f.ctx)).To(Succeed())
+				Expect(errors.Is(retaken.Ack(f.ctx), protocol.ErrNotPending)).To(BeTrue())
+			})
+
+			It("stores each item on its own, ordered by its position", func() {
+				Expect(producer.RPush(f.ctx, "emails", []byte("a"))).To(Succeed())
+				Expect(producer.RPush(f.ctx, "emails", []byte("b"))).To(Succeed())
+				Expect(producer.LPush(f.ctx, "emails", []byte("c"))).To(Succeed())
+
+				value, err := producer.Get(f.ctx, "_queues.emails.items")
+				Expect(err).To(Succeed())
+
+				items := gjson.ParseBytes(value).Map()
+				Expect(items).To(HaveLen(3))
+
+				positions := map[string]int64{}
+				for _, item := range items {
+					positions[item.Get("item").String()] = item.Get("position").Int()
+				}
+
+				Expect(positions["c"]).To(BeNumerically("<", positions["a"]))
+				Expect(positions["a"]).To(BeNumerically("<", positions["b"]))
+			})
+
+			It("refuses writes to the contents of queues from clients", func() {
+				Expect(producer.RPush(f.ctx, "emails", []byte("a"))).To(Succeed())
+
+				err := producer.Set(f.ctx, "_queues.emails.items.1", []byte(`{"item":"b","position":-1}`))
+				Expect(errors.Is(err, protocol.ErrForbidden)).To(BeTrue())
+
+				err = producer.Delete(f.ctx, "_queues")
+				Expect(errors.Is(err, protocol.ErrForbidden)).To(BeTrue())
+
+				item, err := first.BLPop(f.ctx, "emails", 0, 0)
+				Expect(err).To(Succeed())
+				Expect(string(item.Value)).To(Equal("a"))
+			})
+
+			It("limits how many BLPOPs each connection can have waiting", func() {
+				// Each connection can have 64 requests waiting, the one past that is
+				// refused straight away
+				results := make(chan error, 65)
+				for n := 0; n < 65; n++ {
+					go func() {
+						_, err := first.BLPop(f.ctx, "emails", time.Second, 0)
+						results <- err
+					}()
+				}
+
+				var err error
+				Eventually(results).Should(Receive(&err))
+				Expect(errors.Is(err, protocol.ErrTooMany)).To(BeTrue())
+
+				// Other connections can still wait
+				_, err = second.BLPop(f.ctx, "emails", 10*time.Millisecond, 0)
+				Expect(errors.Is(err, protocol.ErrEmpty)).To(BeTrue())
+
+				for n := 0; n < 64; n++ {
+					Eventually(results, 5*time.Second).Should(Receive(&err))
+					Expect(errors.Is(err, protocol.ErrEmpty)).To(BeTrue())
+				}
+			})
+
+			It("includes the queue's contents in backups", func() {
+				Expect(producer.RPush(f.ctx, "emails", []byte("a"))).To(Succeed())
+				Expect(producer.RPush(f.ctx, "emails", []byte("b"))).To(Succeed())
+
+				taken, err := first.BLPop(f.ctx, "emails", 0, time.Minute)
+				Expect(err).To(Succeed())
+
+				backup, err := f.tcp.Store().Backup()
+				Expect(err).To(Succeed())
+
+				f.disconnect()
+				Expect(f.tcp.Close()).To(Succeed())
+
+				f.start(string(backup))
+				producer, first, second = f.connect(), f.connect(), f.connect()
+
+				item, err := second.BLPop(f.ctx, "emails", 0, 0)
+				Expect(err).To(Succeed())
+				Expect(string(item.Value)).To(Equal("b"))
+				Expect(item.ID).To(BeNumerically(">", taken.ID))
+
+				// Items that were taken stay hidden until they're acknowledged, or
+				// their visibility timeouts pass
+				_, err = first.BLPop(f.ctx, "emails", 100*time.Millisecond, 0)
+				Expect(errors.Is(err, protocol.ErrEmpty)).To(BeTrue())
+
+				value, err := producer.Get(f.ctx, fmt.Sprintf("_queues.emails.items.%d", taken.ID))
+				Expect(err).To(Succeed())
+				Expect(gjson.GetBytes(value, "item").String()).To(Equal("a"))
+				Expect(gjson.GetBytes(value, "visible").Int()).To(BeNumerically(">", 0))
+			})
+		})
+	})
+})
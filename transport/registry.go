@@ -0,0 +1,119 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/luma/pharos/protocol"
+)
+
+var (
+	ErrCommandMissingHandler = errors.New("Command must have a Handler")
+
+	// defaultRegistry is used when Options.Registry isn't set
+	defaultRegistry = NewRegistry()
+)
+
+// HandlerFunc executes a request and writes its response to s. ctx is
+// cancelled when the connection closes, or once Options.RequestTimeout has
+// passed.
+//
+// Errors are logged rather than sent to the client, handlers should write an
+// error response for anything that the client needs to know about.
+type HandlerFunc func(ctx context.Context, s Session, req protocol.Request) error
+
+// Command is a command that a server can execute. Its spec describes how it's
+// parsed and documented, and Handler executes it.
+type Command struct {
+	protocol.CommandSpec
+
+	Handler HandlerFunc
+}
+
+// handlerFunc is a handler for a builtin command, which can use the server's
+// store and options through h
+type handlerFunc func(h *requestHandler, ctx context.Context, s Session, req protocol.Request) error
+
+// Registry holds the commands that clients can use, so that servers can be
+// extended with commands of their own. It's safe for concurrent use.
+type Registry struct {
+	commands *protocol.Registry
+
+	mu       sync.RWMutex
+	handlers map[protocol.Command]handlerFunc
+}
+
+// NewRegistry returns a registry that holds the builtin commands.
+func NewRegistry() *Registry {
+	return &Registry{
+		commands: protocol.NewRegistry(),
+		handlers: map[protocol.Command]handlerFunc{
+			protocol.QUIT:      (*requestHandler).handleQuit,
+			protocol.PING:      (*requestHandler).handlePing,
+			protocol.SET:       (*requestHandler).handleSet,
+			protocol.GET:       (*requestHandler).handleGet,
+			protocol.COALESCE:  (*requestHandler).handleCoalesce,
+			protocol.HEARTBEAT: (*requestHandler).handleHeartbeat,
+			protocol.HELP:      (*requestHandler).handleHelp,
+			protocol.AUTH:      (*requestHandler).handleAuth,
+			protocol.DEL:       (*requestHandler).handleDel,
+			protocol.SELECT:    (*requestHandler).handleSelect,
+			protocol.LOCK:      (*requestHandler).handleLock,
+			protocol.UNLOCK:    (*requestHandler).handleUnlock,
+			protocol.RENEW:     (*requestHandler).handleRenew,
+			protocol.PUBLISH:   (*requestHandler).handlePublish,
+			protocol.SUBSCRIBE: (*requestHandler).handleSubscribe,
+			protocol.LPUSH:     (*requestHandler).handlePush,
+			protocol.RPUSH:     (*requestHandler).handlePush,
+			protocol.BLPOP:     (*requestHandler).handlePop,
+			protocol.ACK:       (*requestHandler).handleAck,
+			protocol.WATCH:     (*requestHandler).handleWatch,
+			protocol.UNWATCH:   (*requestHandler).handleUnwatch,
+
+			protocol.UNSUBSCRIBE: (*requestHandler).handleUnsubscribe,
+		},
+	}
+}
+
+// Register adds a command. It fails if a command with the same name has
+// already been registered.
+func (r *Registry) Register(cmd Command) error {
+	if cmd.Handler == nil {
+		return fmt.Errorf("Failed to register '%s': %w", cmd.Name, ErrCommandMissingHandler)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.commands.Register(cmd.CommandSpec); err != nil {
+		return err
+	}
+
+	r.handlers[cmd.Name] = func(_ *requestHandler, ctx context.Context, s Session, req protocol.Request) error {
+		return cmd.Handler(ctx, s, req)
+	}
+
+	return nil
+}
+
+// Commands returns the spec of every command, in the order they were
+// registered.
+func (r *Registry) Commands() []protocol.CommandSpec {
+	return r.commands.Commands()
+}
+
+// Protocol returns the registry for parsing requests and responses, which
+// clients that use custom commands can read responses with.
+func (r *Registry) Protocol() *protocol.Registry {
+	return r.commands
+}
+
+func (r *Registry) handler(name protocol.Command) (handlerFunc, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handler, ok := r.handlers[name]
+	return handler, ok
+}
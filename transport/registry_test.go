@@ -0,0 +1,130 @@
+package transport_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+// upperRequest is a custom command, which is responded to with its key
+// uppercased
+type upperRequest struct {
+	requestID protocol.RequestID
+	key       []byte
+}
+
+func (q *upperRequest) GetRequestID() protocol.RequestID {
+	return q.requestID
+}
+
+func (q *upperRequest) GetCommand() protocol.Command {
+	return "UPPER"
+}
+
+func (q *upperRequest) GetKey() []byte {
+	return q.key
+}
+
+var upperCommand = transport.Command{
+	CommandSpec: protocol.CommandSpec{
+		Name:    "UPPER",
+		Usage:   "UPPER <key>",
+		Summary: "Responds with key in uppercase",
+		Parse: func(requestID protocol.RequestID, args []byte, _ protocol.LineReader) (protocol.Request, error) {
+			return &upperRequest{requestID: requestID, key: args}, nil
+		},
+	},
+	Handler: func(ctx context.Context, s transport.Session, req protocol.Request) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return errors.New("Request has no deadline")
+		}
+
+		upper := req.(*upperRequest)
+		return protocol.WriteString(s, req.GetRequestID(), "OK "+string(bytes.ToUpper(upper.key)))
+	},
+}
+
+var _ = Describe("transport", func() {
+	Describe("command registry", func() {
+		It("rejects commands without a handler", func() {
+			registry := transport.NewRegistry()
+
+			err := registry.Register(transport.Command{CommandSpec: upperCommand.CommandSpec})
+			Expect(errors.Is(err, transport.ErrCommandMissingHandler)).To(BeTrue())
+		})
+
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				var (
+					tcp  *transport.TCP
+					conn net.Conn
+					r    *bufio.Reader
+				)
+
+				BeforeEach(func() {
+					registry := transport.NewRegistry()
+					Expect(registry.Register(upperCommand)).To(Succeed())
+
+					tcp = makeServer("", transport.Options{UseStdlib: useStdlib, Registry: registry})
+
+					var err error
+					conn, err = net.Dial("tcp", "127.0.0.1:6682")
+					Expect(err).To(Succeed())
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					r = bufio.NewReader(conn)
+				})
+
+				AfterEach(func() {
+					conn.Close()
+					Expect(tcp.Close()).To(Succeed())
+				})
+
+				It("executes custom commands", func() {
+					_, err := conn.Write([]byte("1234UPPER foo\n"))
+					Expect(err).To(Succeed())
+
+					line, _, err := r.ReadLine()
+					Expect(err).To(Succeed())
+					Expect(string(line)).To(Equal("1234OK FOO"))
+				})
+
+				It("still executes the builtin commands", func() {
+					_, err := conn.Write([]byte("1234PING\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespPong))
+				})
+
+				It("lists every command in the HELP output", func() {
+					_, err := conn.Write([]byte("1234HELP\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespHelp))
+					Expect(resp.Args).To(ContainElement("GET <key> - Responds with the value of key"))
+					Expect(resp.Args).To(ContainElement("UPPER <key> - Responds with key in uppercase"))
+				})
+			})
+		}
+	})
+})
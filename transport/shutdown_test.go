@@ -0,0 +1,86 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("Shutdown()", func() {
+		servers := map[string]func(restore string) *transport.TCP{
+			"TCPListener": makeTCPServer,
+			"EventLoop":   makeEventLoopServer,
+		}
+
+		for name, makeServer := range servers {
+			makeServer := makeServer
+
+			Describe(name, func() {
+				It("tells clients it's going away and closes their connections once they've drained", func() {
+					tcp := makeServer("")
+
+					conn, err := net.Dial("tcp", "0.0.0.0:6682")
+					Expect(err).To(Succeed())
+					defer conn.Close()
+
+					r := bufio.NewReader(conn)
+
+					_, err = conn.Write([]byte("1234SET foo\nbar\n"))
+					Expect(err).To(Succeed())
+
+					resp, err := protocol.ReadResponse(r)
+					Expect(err).To(Succeed())
+					Expect(resp.Type).To(Equal(protocol.RespOk))
+
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+
+					shutdownErr := make(chan error, 1)
+					go func() {
+						shutdownErr <- tcp.Shutdown(ctx)
+					}()
+
+					Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+					// The update from our SET may arrive before the GOAWAY
+					for {
+						resp, err = protocol.ReadResponse(r)
+						Expect(err).To(Succeed())
+
+						if resp.Type != protocol.RespUpdate {
+							break
+						}
+					}
+
+					Expect(resp.Type).To(Equal(protocol.RespGoAway))
+
+					_, err = r.ReadByte()
+					Expect(err).To(MatchError(io.EOF))
+
+					Eventually(shutdownErr, 5*time.Second).Should(Receive(BeNil()))
+				})
+
+				It("stops accepting new connections", func() {
+					tcp := makeServer("")
+
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+
+					Expect(tcp.Shutdown(ctx)).To(Succeed())
+
+					_, err := net.Dial("tcp", "0.0.0.0:6682")
+					Expect(err).To(HaveOccurred())
+				})
+			})
+		}
+	})
+})
@@ -0,0 +1,203 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultRestartBackoff is the default for Options.RestartBackoff
+	DefaultRestartBackoff = 100 * time.Millisecond
+
+	// DefaultMaxRestartBackoff is the default for Options.MaxRestartBackoff
+	DefaultMaxRestartBackoff = 10 * time.Second
+)
+
+var (
+	errSupervisorStopped = errors.New("Supervisor is stopped")
+)
+
+// server accepts and serves client connections, it's implemented by
+// TCPListener and EventLoop.
+type server interface {
+	Bind() error
+	Serve() error
+	Close() error
+	Shutdown(ctx context.Context) error
+}
+
+// Health is a snapshot of how many of a TCP server's listeners are serving.
+type Health struct {
+	// Required is how many listeners should be serving, Serving is how many are
+	Required int `json:"required"`
+	Serving  int `json:"serving"`
+
+	Listeners []ListenerHealth `json:"listeners"`
+}
+
+// Healthy returns true if every listener is serving.
+func (h Health) Healthy() bool {
+	return h.Required > 0 && h.Serving == h.Required
+}
+
+// ListenerHealth is the state of a single listener or event loop.
+type ListenerHealth struct {
+	Addr    string `json:"addr"`
+	Serving bool   `json:"serving"`
+
+	// Restarts is how many times the listener has been restarted after failing
+	Restarts int `json:"restarts"`
+
+	// LastError is what the listener last failed with, if it ever has
+	LastError string `json:"lastError,omitempty"`
+}
+
+// supervisor keeps a server serving, binding it again with exponential backoff
+// whenever it fails.
+type supervisor struct {
+	addr    string
+	options Options
+
+	// newServer returns the server to bind. TCPListeners return themselves, as
+	// their connections outlive a failure. Event loops close their connections
+	// when they fail, so a fresh loop is made each time.
+	newServer func() server
+
+	// mu guards the fields below
+	mu       sync.Mutex
+	server   server
+	serving  bool
+	stopped  bool
+	restarts int
+	lastErr  error
+
+	log *zap.Logger
+}
+
+func newSupervisor(addr string, options Options, newServer func() server, log *zap.Logger) *supervisor {
+	return &supervisor{
+		addr:      addr,
+		options:   options,
+		newServer: newServer,
+		log:       log,
+	}
+}
+
+// bind binds a server, it fails if the supervisor has been stopped
+func (s *supervisor) bind() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped {
+		return errSupervisorStopped
+	}
+
+	server := s.newServer()
+	if err := server.Bind(); err != nil {
+		s.lastErr = err
+		return err
+	}
+
+	s.server = server
+	s.serving = true
+
+	return nil
+}
+
+// run serves the bound server until it's closed, or ctx is done. Whenever the
+// server fails it's bound again after a backoff, which doubles for every
+// failure up to MaxRestartBackoff. The backoff is reset once a server has been
+// serving for longer than MaxRestartBackoff.
+func (s *supervisor) run(ctx context.Context) {
+	backoff := s.options.RestartBackoff
+
+	for {
+		started := time.Now()
+		err := s.current().Serve()
+
+		s.mu.Lock()
+		s.serving = false
+		if err != nil {
+			s.lastErr = err
+		}
+		s.mu.Unlock()
+
+		if err == nil {
+			return
+		}
+
+		if time.Since(started) > s.options.MaxRestartBackoff {
+			backoff = s.options.RestartBackoff
+		}
+
+		for {
+			s.log.Error("Listener failed, restarting",
+				zap.Error(err),
+				zap.Duration("backoff", backoff))
+
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-time.After(backoff):
+			}
+
+			if backoff *= 2; backoff > s.options.MaxRestartBackoff {
+				backoff = s.options.MaxRestartBackoff
+			}
+
+			if err = s.bind(); err == nil {
+				break
+			}
+
+			if errors.Is(err, errSupervisorStopped) {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		s.restarts++
+		s.mu.Unlock()
+
+		s.log.Info("Listener restarted")
+	}
+}
+
+// current returns the server that's currently bound
+func (s *supervisor) current() server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.server
+}
+
+// stop prevents the server from being restarted, and returns it so that it
+// can be closed or shutdown
+func (s *supervisor) stop() server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	return s.server
+}
+
+func (s *supervisor) health() ListenerHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	health := ListenerHealth{
+		Addr:     s.addr,
+		Serving:  s.serving,
+		Restarts: s.restarts,
+	}
+
+	if s.lastErr != nil {
+		health.LastError = s.lastErr.Error()
+	}
+
+	return health
+}
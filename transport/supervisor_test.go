@@ -0,0 +1,139 @@
+package transport_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/storage"
+	"github.com/luma/pharos/transport"
+)
+
+// failingListener fails an Accept if no listener sharing failed has yet, as if
+// the listening socket broke
+type failingListener struct {
+	net.Listener
+	failed *int32
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if atomic.CompareAndSwapInt32(l.failed, 0, 1) {
+		return nil, errors.New("Listener broke")
+	}
+
+	return l.Listener.Accept()
+}
+
+var _ = Describe("transport", func() {
+	Describe("supervision", func() {
+		newTCP := func(options transport.Options) *transport.TCP {
+			log, err := zap.NewDevelopment()
+			Expect(err).To(Succeed())
+
+			options.Log = log
+			options.Port = 6682
+			options.Reuseport = true
+			options.Store = storage.NewInmemoryStore()
+
+			return transport.NewTCP(options)
+		}
+
+		servers := map[string]bool{
+			"TCPListener": true,
+			"EventLoop":   false,
+		}
+
+		for name, useStdlib := range servers {
+			useStdlib := useStdlib
+
+			Describe(name, func() {
+				It("fails to start if a listener can't bind", func() {
+					bindErr := errors.New("Address unavailable")
+					binds := 0
+
+					tcp := newTCP(transport.Options{
+						UseStdlib:    useStdlib,
+						NumListeners: 2,
+						ListenFunc: func(network, addr string) (net.Listener, error) {
+							if binds++; binds > 1 {
+								return nil, bindErr
+							}
+
+							return net.Listen(network, addr)
+						},
+					})
+
+					err := tcp.Start(context.Background())
+					Expect(errors.Is(err, bindErr)).To(BeTrue())
+
+					// The listener that did bind has been closed again
+					ln, err := net.Listen("tcp", "0.0.0.0:6682")
+					Expect(err).To(Succeed())
+					ln.Close()
+				})
+
+				It("reports every listener as serving once it has started", func() {
+					tcp := newTCP(transport.Options{UseStdlib: useStdlib, NumListeners: 2})
+					Expect(tcp.Start(context.Background())).To(Succeed())
+					defer tcp.Close()
+
+					health := tcp.Health()
+					Expect(health.Healthy()).To(BeTrue())
+					Expect(health.Required).To(Equal(2))
+					Expect(health.Serving).To(Equal(2))
+					Expect(health.Listeners).To(HaveLen(2))
+				})
+			})
+		}
+
+		Describe("TCPListener", func() {
+			It("restarts listeners that fail", func() {
+				var failed int32
+
+				tcp := newTCP(transport.Options{
+					UseStdlib:      true,
+					NumListeners:   1,
+					RestartBackoff: 10 * time.Millisecond,
+					ListenFunc: func(network, addr string) (net.Listener, error) {
+						ln, err := net.Listen(network, addr)
+						if err != nil {
+							return nil, err
+						}
+
+						return &failingListener{Listener: ln, failed: &failed}, nil
+					},
+				})
+
+				Expect(tcp.Start(context.Background())).To(Succeed())
+				defer tcp.Close()
+
+				// The first Accept fails straight away
+				Eventually(func() int {
+					return tcp.Health().Listeners[0].Restarts
+				}, 5*time.Second).Should(Equal(1))
+
+				listener := tcp.Health().Listeners[0]
+				Expect(listener.LastError).To(Equal("Listener broke"))
+
+				Expect(tcp.Health().Healthy()).To(BeTrue())
+
+				conn, err := net.Dial("tcp", "0.0.0.0:6682")
+				Expect(err).To(Succeed())
+				defer conn.Close()
+
+				_, err = conn.Write([]byte("1234PING\n"))
+				Expect(err).To(Succeed())
+
+				line, err := readLine(conn)
+				Expect(err).To(Succeed())
+				Expect(string(line)).To(Equal("1234PONG"))
+			})
+		})
+	})
+})
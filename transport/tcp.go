@@ -1,18 +1,20 @@
 package transport
 
 import (
-	"bytes"
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	reuseport "github.com/kavu/go_reuseport"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
@@ -22,6 +24,21 @@ import (
 
 const (
 	UpdateBufferSize = 255
+
+	// DefaultWriteBatchSize is the default for Options.WriteBatchSize
+	DefaultWriteBatchSize = 64
+
+	// DefaultHeartbeatMisses is how many heartbeats a client can fail to answer
+	// before it's considered idle, when Options.IdleTimeout isn't set
+	DefaultHeartbeatMisses = 3
+)
+
+var (
+	ErrConnClosed = errors.New("Connection is closed")
+
+	// errSlowConsumer is returned when a client isn't reading what's pushed to
+	// it fast enough to keep up
+	errSlowConsumer = errors.New("Client is too slow to keep up")
 )
 
 type Marshaler interface {
@@ -44,13 +61,26 @@ type TCP struct {
 	addr string
 
 	numListeners int
-	listeners    []*TCPListener
 
-	store storage.Store
+	options Options
+
+	// tls is nil unless Options.TLS is set
+	tls *tlsConfig
+
+	// connLimiter is shared by every listener, so that connection limits apply
+	// to the server as a whole
+	connLimiter *connLimiter
+
+	// namespaces are shared by every listener, so that namespace limits apply
+	// to the server as a whole
+	namespaces *namespaceSet
 
 	mu       sync.Mutex
 	doneChan chan struct{}
 
+	// supervisors keep each listener and event loop serving, guarded by mu
+	supervisors []*supervisor
+
 	log   *zap.Logger
 	trace bool
 }
@@ -62,13 +92,34 @@ func NewTCP(options Options) *TCP {
 		numListeners = runtime.NumCPU()
 	}
 
+	if options.MaxCoalesceWindow == 0 {
+		options.MaxCoalesceWindow = DefaultMaxCoalesceWindow
+	}
+
+	if options.WriteBatchSize < 1 {
+		options.WriteBatchSize = DefaultWriteBatchSize
+	}
+
+	if options.RestartBackoff <= 0 {
+		options.RestartBackoff = DefaultRestartBackoff
+	}
+
+	if options.MaxRestartBackoff <= 0 {
+		options.MaxRestartBackoff = DefaultMaxRestartBackoff
+	}
+
+	if options.HeartbeatInterval > 0 && options.IdleTimeout == 0 {
+		options.IdleTimeout = DefaultHeartbeatMisses * options.HeartbeatInterval
+	}
+
 	return &TCP{
 		addr:         net.JoinHostPort(options.Host, strconv.Itoa(options.Port)),
 		numListeners: numListeners,
-		listeners:    make([]*TCPListener, 0, options.NumListeners),
+		connLimiter:  newConnLimiter(options),
+		namespaces:   newNamespaceSet(options),
 		doneChan:     make(chan struct{}),
 		trace:        options.Trace,
-		store:        options.Store,
+		options:      options,
 		log:          options.Log,
 	}
 }
@@ -77,39 +128,163 @@ func (w *TCP) Start(parentCtx context.Context) error {
 	ctx, cancel := context.WithCancel(parentCtx)
 	w.cancel = cancel
 
-	w.log.Info("Starting tcp listeners", zap.Int("count", w.numListeners))
+	if w.options.ACL != nil && w.options.Auth == nil {
+		cancel()
+		return ErrACLRequiresAuth
+	}
+
+	if w.options.TLS != nil {
+		if !w.options.UseStdlib {
+			cancel()
+			return ErrTLSUnsupported
+		}
+
+		tls, err := newTLSConfig(*w.options.TLS)
+		if err != nil {
+			cancel()
+			return err
+		}
 
+		w.tls = tls
+	}
+
+	w.log.Info("Starting tcp listeners",
+		zap.Int("count", w.numListeners),
+		zap.Bool("stdlib", w.options.UseStdlib),
+		zap.Bool("tls", w.tls != nil),
+		zap.Int("unixSockets", len(w.options.UnixSockets)))
+
+	// Every listener is bound before we return, if any of them can't be then the
+	// ones that were are closed again
 	for i := 0; i < w.numListeners; i++ {
-		w.startListener(ctx, w.addr)
+		var err error
+
+		if w.options.UseStdlib {
+			listener := NewTCPListener(ctx, w.addr, w.options, w.connLimiter, w.namespaces, w.listenerLog())
+
+			if w.tls != nil {
+				listener.tlsConfig = w.tls.ServerConfig()
+			}
+
+			err = w.startListener(ctx, w.addr, listener)
+		} else {
+			err = w.startEventLoop(ctx, w.addr)
+		}
+
+		if err != nil {
+			w.Close()
+			return fmt.Errorf("Failed to listen on %s %w", w.addr, err)
+		}
+	}
+
+	for _, socket := range w.options.UnixSockets {
+		listener := NewUnixListener(ctx, socket, w.options, w.connLimiter, w.namespaces, w.listenerLog())
+
+		if err := w.startListener(ctx, socket.Path, listener); err != nil {
+			w.Close()
+			return fmt.Errorf("Failed to listen on %s %w", socket.Path, err)
+		}
 	}
 
 	return nil
 }
 
+// Health reports how many of the listeners, or event loops, are serving. It's
+// unhealthy if any have failed and haven't been restarted yet.
+func (w *TCP) Health() Health {
+	w.mu.Lock()
+	supervisors := w.supervisors
+	w.mu.Unlock()
+
+	health := Health{
+		Required:  w.numListeners + len(w.options.UnixSockets),
+		Listeners: make([]ListenerHealth, 0, len(supervisors)),
+	}
+
+	for _, s := range supervisors {
+		listener := s.health()
+		if listener.Serving {
+			health.Serving++
+		}
+
+		health.Listeners = append(health.Listeners, listener)
+	}
+
+	return health
+}
+
 func (t *TCP) Store() storage.Store {
-	return t.store
+	return t.namespaces.defaultNamespace().store
 }
 
-func (w *TCP) startListener(ctx context.Context, addr string) {
-	w.stopWaiter.Add(1)
-	listener := NewTCPListener(
-		ctx,
-		addr,
-		w.store,
-		w.log.Named("listener").With(zap.Int("listener", len(w.listeners))),
-	)
+// ReloadTLS reloads the TLS certificates from disk, they're used for all new
+// connections. If they fail to load then the current certificates remain in use.
+func (t *TCP) ReloadTLS() error {
+	if t.tls == nil {
+		return errors.New("TLS is not enabled")
+	}
+
+	return t.tls.Reload()
+}
+
+func (w *TCP) listenerLog() *zap.Logger {
+	return w.log.Named("listener").With(zap.Int("listener", w.numSupervisors()))
+}
+
+func (w *TCP) startListener(ctx context.Context, addr string, listener *TCPListener) error {
+	return w.supervise(ctx, addr, w.listenerLog(), func() server {
+		return listener
+	})
+}
+
+func (w *TCP) startEventLoop(ctx context.Context, addr string) error {
+	log := w.log.Named("loop").With(zap.Int("loop", w.numSupervisors()))
+
+	return w.supervise(ctx, addr, log, func() server {
+		return NewEventLoop(ctx, addr, w.options, w.connLimiter, w.namespaces, log)
+	})
+}
+
+// supervise binds a server, and then keeps it serving until ctx is done
+func (w *TCP) supervise(ctx context.Context, addr string, log *zap.Logger, newServer func() server) error {
+	s := newSupervisor(addr, w.options, newServer, log)
+	if err := s.bind(); err != nil {
+		return err
+	}
 
-	w.listeners = append(w.listeners, &listener)
+	w.mu.Lock()
+	w.supervisors = append(w.supervisors, s)
+	w.mu.Unlock()
+
+	w.stopWaiter.Add(1)
 
 	go func() {
 		defer w.stopWaiter.Done()
-
-		if err := listener.Listen(); err != nil {
-			// TODO(rolly) as any of the listeners can fail to listen, but we don't treat this as fatal,
-			//             you can end up with less than the required amount of listeners running
-			w.log.Error("Failed to listen", zap.Error(err))
-		}
+		s.run(ctx)
 	}()
+
+	return nil
+}
+
+func (w *TCP) numSupervisors() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return len(w.supervisors)
+}
+
+// stopSupervisors stops the listeners from being restarted, and returns them
+func (w *TCP) stopSupervisors() []server {
+	w.mu.Lock()
+	supervisors := w.supervisors
+	w.mu.Unlock()
+
+	servers := make([]server, 0, len(supervisors))
+	for _, s := range supervisors {
+		servers = append(servers, s.stop())
+	}
+
+	return servers
 }
 
 // Close immediately closes all active listeners and conenctions.
@@ -120,13 +295,12 @@ func (w *TCP) Close() error {
 	w.cancel()
 
 	// Tell listeners to stop
-	for _, listener := range w.listeners {
-		listener.Close()
+	for _, server := range w.stopSupervisors() {
+		server.Close()
 	}
 
-	w.log.Info("WAITING FOR LISTENERS")
 	w.stopWaiter.Wait()
-	w.log.Info("LISTENERS STOPPED")
+	w.log.Info("TCP server stopped")
 
 	return nil
 }
@@ -143,130 +317,396 @@ func (w *TCP) closeDoneChan() {
 	}
 }
 
+// Shutdown gracefully stops the server. It stops accepting new connections and
+// sends every client a GOAWAY notice. Requests that have already been received
+// are responded to and pending writes are flushed before each connection is
+// closed.
+//
+// If ctx is done before every connection has drained then the remaining
+// connections are closed immediately and ctx's error is returned.
 func (w *TCP) Shutdown(ctx context.Context) error {
-	return nil
+	w.log.Info("Shutting down TCP server")
+
+	var (
+		errMu sync.Mutex
+		err   error
+		wg    sync.WaitGroup
+	)
+
+	drain := func(shutdown func(ctx context.Context) error) {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if serr := shutdown(ctx); serr != nil {
+				errMu.Lock()
+				err = multierr.Append(err, serr)
+				errMu.Unlock()
+			}
+		}()
+	}
+
+	for _, server := range w.stopSupervisors() {
+		drain(server.Shutdown)
+	}
+
+	wg.Wait()
+
+	// Anything that didn't drain in time is closed immediately
+	if cerr := w.Close(); cerr != nil {
+		err = multierr.Append(err, cerr)
+	}
+
+	return err
 }
 
+// TCPListener accepts connections and serves each of them with a pair of
+// goroutines. Despite the name it also serves Unix sockets.
 type TCPListener struct {
 	ctx context.Context
 
 	addr string
 	log  *zap.Logger
 
+	// unixSocket is set if we listen on a Unix socket rather than TCP
+	unixSocket *UnixSocket
+
+	// loopWaiter tracks the goroutines serving each connection
+	loopWaiter sync.WaitGroup
+
+	// startOnce starts the work that lasts for the listener's lifetime, rather
+	// than for each time it's bound
+	startOnce sync.Once
+
+	// mu guards the fields below
 	mu          sync.Mutex
+	listener    net.Listener
 	activeConns map[*TCPConn]struct{}
 
-	writeQueues [](chan []byte)
+	// tlsConfig is used to wrap accepted connections in TLS if it's set
+	tlsConfig *tls.Config
 
-	store storage.Store
+	// connLimiter caps how many connections we accept, TCP shares one between
+	// all of its listeners
+	connLimiter *connLimiter
+
+	// namespaces are the namespaces that connections can select, TCP shares one
+	// set between all of its listeners
+	namespaces *namespaceSet
+
+	options Options
 }
 
+// NewTCPListener returns a listener for addr. connLimiter and namespaces are
+// shared with the server's other listeners.
 func NewTCPListener(
 	ctx context.Context,
 	addr string,
-	store storage.Store,
+	options Options,
+	connLimiter *connLimiter,
+	namespaces *namespaceSet,
 	log *zap.Logger,
-) TCPListener {
-	return TCPListener{
+) *TCPListener {
+	return &TCPListener{
 		ctx:         ctx,
 		activeConns: make(map[*TCPConn]struct{}),
-		writeQueues: make([](chan []byte), 0),
+		connLimiter: connLimiter,
+		namespaces:  namespaces,
 		addr:        addr,
-		store:       store,
+		options:     options,
 		log:         log,
 	}
 }
 
+// NewUnixListener returns a listener for the Unix socket described by socket.
+func NewUnixListener(
+	ctx context.Context,
+	socket UnixSocket,
+	options Options,
+	connLimiter *connLimiter,
+	namespaces *namespaceSet,
+	log *zap.Logger,
+) *TCPListener {
+	listener := NewTCPListener(ctx, socket.Path, options, connLimiter, namespaces, log)
+	listener.unixSocket = &socket
+
+	return listener
+}
+
+// Close immediately closes all active connections.
 func (t *TCPListener) Close() error {
-	// Close active connections
-	// TODO(rolly) We're closing all connections here, not just active
-	for conn := range t.activeConns {
+	t.stopAccepting()
+
+	for _, conn := range t.conns() {
 		conn.Close()
-		delete(t.activeConns, conn)
 	}
 
 	return nil
 }
 
+// Shutdown stops accepting new connections and drains the active ones. Any
+// connections that haven't drained by the time ctx is done are closed
+// immediately, in which case ctx's error is returned.
+func (t *TCPListener) Shutdown(ctx context.Context) error {
+	t.stopAccepting()
+
+	var (
+		errMu sync.Mutex
+		err   error
+		wg    sync.WaitGroup
+	)
+
+	for _, conn := range t.conns() {
+		wg.Add(1)
+
+		go func(conn *TCPConn) {
+			defer wg.Done()
+
+			if derr := conn.Drain(ctx); derr != nil {
+				errMu.Lock()
+				err = multierr.Append(err, derr)
+				errMu.Unlock()
+			}
+		}(conn)
+	}
+
+	wg.Wait()
+
+	return err
+}
+
+// Listen binds the listener and then serves connections until it's closed.
 func (t *TCPListener) Listen() error {
-	listener, err := reuseport.Listen("tcp", t.addr)
+	if err := t.Bind(); err != nil {
+		return err
+	}
+
+	return t.Serve()
+}
+
+// Bind starts listening on the listener's address, Serve accepts connections
+// from it. Binding is separate so that callers can find out straight away if
+// the address can't be listened on.
+func (t *TCPListener) Bind() error {
+	listener, err := t.listen()
 	if err != nil {
 		return err
 	}
 
-	defer listener.Close()
+	t.mu.Lock()
+	t.listener = listener
+	t.mu.Unlock()
 
-	var (
-		loopWaiter sync.WaitGroup
-	)
+	t.startOnce.Do(t.start)
+	return nil
+}
 
+func (t *TCPListener) start() {
 	go func() {
 		<-t.ctx.Done()
+		t.stopAccepting()
+	}()
 
-		t.log.Info("Draining reader/writer loops")
-		loopWaiter.Wait()
+	// Listen for storage updates until our context is cancelled. Connections may
+	// still be draining after we stop accepting, or be waiting for us to be bound
+	// again after we failed, so they continue to receive updates until then.
+	for _, ns := range t.namespaces.all {
+		ns := ns
+		updates := ns.store.ListenToUpdates(t.ctx)
+
+		go func() {
+			for update := range updates.Updates() {
+				// TODO(rolly) deal with writeUpdate error return
+				t.writeUpdate(ns, update)
+			}
+		}()
 
-		t.log.Info("Closing listener")
-		if err := listener.Close(); err != nil {
-			t.log.Warn("TCP Listener did not close cleanly", zap.Error(err))
-		}
-	}()
+		messages := ns.channels.listen(t.ctx)
 
-	// Listen for storage updates
-	go func() {
-		for update := range t.store.ListenToUpdates() {
-			// TODO(rolly) deal with WriteUpdate error return
-			t.WriteUpdate(update)
-		}
-	}()
+		go func() {
+			for msg := range messages {
+				// TODO(rolly) deal with writeMessage error return
+				t.writeMessage(ns, msg)
+			}
+		}()
+	}
+}
+
+// Serve accepts connections until the listener is closed, then waits for the
+// connections to close too. If accepting fails the error is returned straight
+// away and the connections are left running, so that the listener can be bound
+// and served again.
+func (t *TCPListener) Serve() error {
+	t.mu.Lock()
+	listener := t.listener
+	t.mu.Unlock()
+
+	var err error
+	if listener != nil {
+		err = t.accept(listener)
+		t.stopAccepting()
+	}
+
+	if err != nil {
+		t.log.Error("Stopped accepting new connections", zap.Error(err))
+		return err
+	}
+
+	t.log.Info("Stopped accepting new connections, waiting for Read/Write loops to stop")
+	t.loopWaiter.Wait()
 
+	t.log.Info("Listener stopped")
+	return nil
+}
+
+func (t *TCPListener) listen() (net.Listener, error) {
+	if t.unixSocket != nil {
+		return listenUnix(*t.unixSocket, t.options)
+	}
+
+	return t.options.listen("tcp", t.addr)
+}
+
+// accept accepts and starts connections until the listener is closed
+func (t *TCPListener) accept(listener net.Listener) error {
 	for {
-		select {
-		case <-t.ctx.Done():
-			t.log.Info("Stopped accepting new connections")
-			t.log.Info("Waiting for Read/Write loops to stop")
-			loopWaiter.Wait()
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				// The listener was closed while we were waiting for new connections,
+				// that's fine.
+				return nil
+			}
 
-			t.log.Info("Listener stopped")
-			return nil
+			// TODO(rolly) can we recover from some classes of err?
+			return err
+		}
 
-		default:
-			conn, err := listener.Accept()
-			if err != nil {
-				netOpError := new(net.OpError)
+		if t.options.ProxyProtocol == ProxyProtocolDisabled {
+			t.startConn(conn, nil)
+			continue
+		}
 
-				if errors.As(err, &netOpError) && netOpError.Unwrap().Error() == "use of closed network connection" {
-					// The connection was closed while we were waiting for new connections
-					// that's fine.
-					return nil
-				}
+		// The header is read on its own goroutine, so that a slow client can't hold
+		// up accepting everyone else
+		t.loopWaiter.Add(1)
+
+		go func(conn net.Conn) {
+			defer t.loopWaiter.Done()
 
-				// TODO(rolly) can we recover from some classes of err?
-				return err
+			proxied, err := readProxyHeader(conn, t.options.ProxyProtocol)
+			if err != nil {
+				t.log.Warn("Failed to read PROXY protocol header, closing connection",
+					zap.Stringer("proxyAddr", conn.RemoteAddr()),
+					zap.Error(err))
+				conn.Close()
+				return
 			}
 
-			loopWaiter.Add(1)
-			// writeQueue := make(chan []byte, 127)
-			// t.writeQueues = append(t.writeQueues, writeQueue)
-			tcpConn := NewTCPCOnn(t.ctx, conn.(*net.TCPConn), t.store, t.log.Named("conn"))
+			t.startConn(proxied, conn.RemoteAddr())
+		}(conn)
+	}
+}
+
+// startConn starts serving conn, unless that would exceed the connection
+// limits. proxyAddr is the address of the load balancer that the connection
+// came through, if it came through one.
+func (t *TCPListener) startConn(conn net.Conn, proxyAddr net.Addr) {
+	log := t.log.Named("conn").With(zap.Stringer("remoteAddr", conn.RemoteAddr()))
+	if proxyAddr != nil {
+		log = log.With(zap.Stringer("proxyAddr", proxyAddr))
+	}
 
-			t.addConn(tcpConn)
+	if !t.connLimiter.acquire(conn.RemoteAddr()) {
+		log.Warn("Too many connections, closing new connection")
+		conn.Close()
+		return
+	}
 
-			go func() {
-				defer loopWaiter.Done()
-				tcpConn.Start()
-			}()
-		}
+	if t.tlsConfig != nil {
+		conn = tls.Server(conn, t.tlsConfig)
 	}
+
+	tcpConn := NewTCPCOnn(t.ctx, conn, t.options, t.namespaces, log)
+	tcpConn.onClose = t.removeConn
+
+	t.addConn(tcpConn)
+	t.loopWaiter.Add(1)
+
+	go func() {
+		defer t.loopWaiter.Done()
+		tcpConn.Start()
+	}()
 }
 
-func (t *TCPListener) WriteUpdate(update *storage.Update) (err error) {
+// stopAccepting closes the listening socket, active connections are unaffected
+func (t *TCPListener) stopAccepting() {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	for conn := range t.activeConns {
-		if uerr := conn.WriteUpdate(update); uerr != nil {
-			err = multierr.Append(err, uerr)
+	if t.listener == nil {
+		return
+	}
+
+	if err := t.listener.Close(); err != nil {
+		t.log.Warn("TCP Listener did not close cleanly", zap.Error(err))
+	}
+
+	t.listener = nil
+}
+
+// WriteUpdate writes update to every active connection in the default
+// namespace. The update is encoded once and the resulting frame is shared
+// between all connections. With an ACL each connection is only sent the parts
+// of update that it can subscribe to.
+func (t *TCPListener) WriteUpdate(update *storage.Update) error {
+	return t.writeUpdate(t.namespaces.defaultNamespace(), update)
+}
+
+// writeUpdate writes an update of ns to the connections that have selected it
+func (t *TCPListener) writeUpdate(ns *namespace, update *storage.Update) (err error) {
+	frame := newFrame()
+	frame.buf = protocol.AppendUpdate(frame.buf, update.Key, update.Value)
+	defer frame.Release()
+
+	fanout := newUpdateFanout(t.options.ACL, update, frame)
+	defer fanout.release()
+
+	for _, conn := range t.conns() {
+		// Connections that watch paths are sent their watches' updates instead
+		if conn.namespaceState.current() != ns || conn.watchSet.watching() {
+			continue
+		}
+
+		for _, scoped := range fanout.updatesFor(conn.authState) {
+			if uerr := conn.WriteUpdate(scoped.update, scoped.frame); uerr != nil {
+				err = multierr.Append(err, uerr)
+			}
+		}
+	}
+
+	return err
+}
+
+// writeMessage writes a message published in ns to the connections that have
+// selected it and subscribed to its channel. Messages aren't coalesced.
+func (t *TCPListener) writeMessage(ns *namespace, msg *message) (err error) {
+	frame := newFrame()
+	frame.buf = protocol.AppendMessage(frame.buf, msg.channel, msg.payload)
+	defer frame.Release()
+
+	for _, conn := range t.conns() {
+		if conn.namespaceState.current() != ns {
+			continue
+		}
+
+		if !receives(t.options.ACL, conn.authState, conn.channelSubscriptions, msg) {
+			continue
+		}
+
+		if werr := conn.writePush(frame); werr != nil {
+			err = multierr.Append(err, werr)
 		}
 	}
 
@@ -281,65 +721,217 @@ func (t *TCPListener) addConn(conn *TCPConn) {
 }
 
 func (t *TCPListener) removeConn(conn *TCPConn) {
+	t.mu.Lock()
+	delete(t.activeConns, conn)
+	t.mu.Unlock()
+
+	t.connLimiter.release(conn.RemoteAddr())
+}
+
+// conns returns a snapshot of the active connections, so that they can be
+// closed without holding the lock.
+func (t *TCPListener) conns() []*TCPConn {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	delete(t.activeConns, conn)
+	conns := make([]*TCPConn, 0, len(t.activeConns))
+	for conn := range t.activeConns {
+		conns = append(conns, conn)
+	}
+
+	return conns
 }
 
 type TCPConn struct {
 	ctx        context.Context
 	cancel     context.CancelFunc
 	loopWaiter sync.WaitGroup
+	closeOnce  sync.Once
+
+	// readDone is closed when the read loop exits, done is closed once the
+	// connection has been closed
+	readDone chan struct{}
+	done     chan struct{}
+
+	// draining is set to 1 once the connection has been asked to drain
+	draining int32
+
+	// onClose is called once the connection has been closed
+	onClose func(conn *TCPConn)
 
-	conn  *net.TCPConn
-	store storage.Store
+	conn    net.Conn
+	reader  *bufio.Reader
+	handler *requestHandler
+	options Options
 
-	writeQueue chan []byte
+	// identity is the client's verified certificate, if it presented one. It's
+	// set by the TLS handshake before any requests are handled.
+	identity *Identity
+
+	rateLimiter    *rateLimiter
+	authState      *authState
+	namespaceState *namespaceState
+
+	// channelSubscriptions are the channels that the client has subscribed to
+	channelSubscriptions *channelSubscriptions
+
+	// watchSet is the paths that the client has watched
+	watchSet *watchSet
+
+	// waitCounter counts the client's requests that are waiting
+	waitCounter *waitCounter
+
+	// workers execute requests that operate on keys, so that a slow request
+	// doesn't hold up everything after it
+	workers *keyedWorkers
+
+	// writeMu guards writeClosed, and prevents writeQueue from being closed
+	// while frames are being queued
+	writeMu     sync.RWMutex
+	writeClosed bool
+	writeQueue  chan *Frame
+
+	// coalescer buffers updates when the client has asked for them to be coalesced
+	coalescer *coalescer
 
 	log *zap.Logger
 }
 
 func NewTCPCOnn(
 	parentCtx context.Context,
-	conn *net.TCPConn,
-	store storage.Store,
+	conn net.Conn,
+	options Options,
+	namespaces *namespaceSet,
 	log *zap.Logger,
 ) *TCPConn {
 	ctx, cancel := context.WithCancel(parentCtx)
 
-	return &TCPConn{
-		ctx:        ctx,
-		cancel:     cancel,
-		conn:       conn,
-		store:      store,
-		writeQueue: make(chan []byte, 127),
-		log:        log,
+	t := &TCPConn{
+		ctx:            ctx,
+		cancel:         cancel,
+		conn:           conn,
+		reader:         bufio.NewReader(conn),
+		handler:        newRequestHandler(options),
+		options:        options,
+		rateLimiter:    newRateLimiter(options),
+		authState:      newAuthState(options),
+		namespaceState: newNamespaceState(namespaces),
+		workers:        newKeyedWorkers(options.MaxConcurrentRequests),
+		writeQueue:     make(chan *Frame, 127),
+		readDone:       make(chan struct{}),
+		done:           make(chan struct{}),
+		log:            log,
+
+		channelSubscriptions: newChannelSubscriptions(),
+		waitCounter:          newWaitCounter(),
 	}
+
+	t.coalescer = newCoalescer(func(frame *Frame) {
+		// TODO(rolly) deal with writePush error return
+		t.writePush(frame)
+		frame.Release()
+	})
+
+	t.watchSet = newWatchSet(ctx, t.writeWatchedUpdate)
+
+	return t
 }
 
+// Close immediately closes the connection, anything that hasn't been written
+// yet is discarded.
+//
+// For a graceful close, use Drain()
 func (t *TCPConn) Close() error {
-	if !t.isRunning() {
-		// already stopped
-		return nil
-	}
+	t.closeOnce.Do(t.close)
+	return nil
+}
 
+func (t *TCPConn) close() {
 	t.cancel()
+	t.coalescer.Stop()
+
+	// Interrupt any reads or writes that the loops are blocked on
+	if err := t.conn.SetDeadline(time.Now()); err != nil && !errors.Is(err, net.ErrClosed) {
+		t.log.Warn("Failed to interrupt connection", zap.Error(err))
+	}
 
 	// Wait for the read/write loops to exit
 	t.loopWaiter.Wait()
 
 	t.conn.Close()
 
+	// The read loop has finished executing requests, so the connection can't set
+	// any more ephemeral keys
+	if err := releaseEphemeralKeys(t); err != nil {
+		t.log.Warn("Failed to delete ephemeral keys", zap.Error(err))
+	}
+
+	releaseLocks(t)
+
 	// Once close is called, the writeQueue can no longer be used
 	// We need to wait until the read/write loops have exited before
 	// closing this channel.
+	t.writeMu.Lock()
+	t.writeClosed = true
 	close(t.writeQueue)
+	t.writeMu.Unlock()
 
-	return nil
+	// Release anything that was never written
+	for frame := range t.writeQueue {
+		frame.Release()
+	}
+
+	if t.onClose != nil {
+		t.onClose(t)
+	}
+
+	close(t.done)
+}
+
+// Drain gracefully closes the connection. The client is sent a GOAWAY notice
+// and no further requests are read from it. The connection is closed once the
+// responses to requests that have already been read, and anything else that
+// was queued, have been written.
+//
+// If ctx is done before then, the connection is closed immediately and ctx's
+// error is returned.
+func (t *TCPConn) Drain(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&t.draining, 0, 1) {
+		frame := newFrame()
+		frame.buf = protocol.AppendGoAway(frame.buf)
+
+		if err := t.WriteFrame(frame); err != nil {
+			t.log.Debug("Failed to send GOAWAY", zap.Error(err))
+		}
+
+		frame.Release()
+
+		// Interrupt the read loop if it's waiting for a request. A request that
+		// is being handled will finish first.
+		if err := t.conn.SetReadDeadline(time.Now()); err != nil && !errors.Is(err, net.ErrClosed) {
+			t.log.Warn("Failed to interrupt reads", zap.Error(err))
+		}
+	}
+
+	select {
+	case <-t.done:
+		return nil
+
+	case <-ctx.Done():
+		t.Close()
+		return ctx.Err()
+	}
 }
 
+// Start runs the connection's read and write loops, it returns once the
+// connection has closed.
 func (t *TCPConn) Start() {
+	if err := t.handshake(); err != nil {
+		t.log.Warn("TLS handshake failed", zap.Error(err))
+		t.Close()
+		return
+	}
+
 	t.loopWaiter.Add(2)
 
 	go func() {
@@ -353,6 +945,7 @@ func (t *TCPConn) Start() {
 	}()
 
 	t.loopWaiter.Wait()
+	t.Close()
 }
 
 func (t *TCPConn) ReadLoop() {
@@ -361,8 +954,15 @@ func (t *TCPConn) ReadLoop() {
 	defer func() {
 		log.Info("Listener read loop exiting")
 
+		// Finish the requests that we've already received, flush anything that's
+		// being coalesced, and then tell the write loop that there won't be any
+		// more responses
+		t.workers.Stop()
+		t.coalescer.SetWindow(0)
+		close(t.readDone)
+
 		// Stop reading, but allow writes to drain
-		err := t.conn.CloseRead()
+		err := closeRead(t.conn)
 		if err != nil && !strings.Contains(err.Error(), "transport endpoint is not connected") {
 			log.Warn("Failed to close reads on connection cleanly",
 				zap.Error(err))
@@ -378,70 +978,93 @@ func (t *TCPConn) ReadLoop() {
 			return
 
 		default:
-			// TODO(rolly) probably want to SetDeadline on the reads...
-			req, err := protocol.ReadRequest(t.conn)
-			if err != nil {
-				log.Warn("Failed to read client request", zap.Error(err))
-				continue
+			if err := t.setIdleDeadline(); err != nil {
+				log.Warn("Failed to set read deadline", zap.Error(err))
 			}
 
-			switch c := req.(type) {
-			case *protocol.PingRequest:
-				if err = protocol.WriteString(t, req.GetRequestID(), "PONG"); err != nil {
-					log.Warn("Failed to respond to PING",
-						zap.String("requestID", req.GetRequestID().String()))
-					continue
+			// This is checked after the deadline is set, so that we can't replace
+			// the deadline that Drain sets to interrupt us
+			if t.isDraining() {
+				log.Info("Connection draining, exiting...")
+				return
+			}
+
+			req, err := t.handler.readRequest(t.reader)
+			if err != nil {
+				if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+					log.Info("Client disconnected, exiting...")
+					return
 				}
 
-			case *protocol.QuitRequest:
-				if err = protocol.WriteOk(t, req.GetRequestID()); err != nil {
-					log.Warn("Failed to acknowledge QUICK",
-						zap.String("requestID", req.GetRequestID().String()))
+				if isTimeout(err) && !t.isDraining() && t.ctx.Err() == nil {
+					log.Info("Client idle, exiting...",
+						zap.Duration("idleTimeout", t.options.IdleTimeout))
+					return
 				}
 
-				log.Info("Client QUIT, exiting...")
+				if t.isDraining() {
+					// Drain interrupted the read
+					continue
+				}
 
-				return
+				log.Warn("Failed to read client request", zap.Error(err))
+				continue
+			}
 
-			case *protocol.SetRequest:
-				if err = t.dispatchSet(c); err != nil {
-					log.Warn("Failed to dispatch set",
-						zap.String("key", string(c.Key)),
-						zap.String("requestID", req.GetRequestID().String()))
+			if rejected, err := t.handler.admit(t, req); rejected {
+				if err != nil {
+					log.Warn("Failed to handle request", zap.Error(err))
 				}
 
-			case *protocol.GetRequest:
-				setCtx, cancel := context.WithTimeout(t.ctx, 3*time.Second)
-				defer cancel()
+				continue
+			}
 
-				value, err := t.store.Get(setCtx, c.Key)
+			// Requests for a key are executed concurrently with everything else, but
+			// in order with other requests for the same key
+			if key, ok := requestKey(req); ok {
+				t.workers.Submit(key, func() {
+					t.execute(log, req)
+				})
 
-				if err != nil {
-					log.Warn("Failed to get",
-						zap.String("key", string(c.Key)),
-						zap.Error(err))
-					continue
-				}
+				continue
+			}
 
-				if err := protocol.WriteLines(t, req.GetRequestID(), protocol.PrefixGet, value); err != nil {
-					log.Warn("Failed to reply to get",
-						zap.String("key", string(c.Key)),
-						zap.String("value", string(value)),
-						zap.Error(err))
-					continue
-				}
+			if waitsForOthers(req) {
+				t.workers.Wait()
+			}
+
+			if quit := t.execute(log, req); quit {
+				log.Info("Client QUIT, exiting...")
+				return
 			}
 		}
 	}
 }
 
+// execute executes req, it returns true if the client has QUIT
+func (t *TCPConn) execute(log *zap.Logger, req protocol.Request) bool {
+	err := t.handler.execute(t, req)
+	if errors.Is(err, errQuit) {
+		return true
+	}
+
+	if err != nil {
+		log.Warn("Failed to handle request",
+			zap.String("command", string(req.GetCommand())),
+			zap.String("requestID", req.GetRequestID().String()),
+			zap.Error(err))
+	}
+
+	return false
+}
+
 func (t *TCPConn) WriteLoop() {
 	log := t.log.Named("writeLoop")
 
 	defer func() {
 		log.Info("Listener write loop exiting")
 
-		err := t.conn.CloseWrite()
+		err := closeWrite(t.conn)
 		if err != nil && !strings.Contains(err.Error(), "transport endpoint is not connected") {
 			log.Warn("Failed to close writes on connection cleanly",
 				zap.Error(err))
@@ -452,23 +1075,48 @@ func (t *TCPConn) WriteLoop() {
 
 	// TODO(rolly) write the current store state on connect (i.e. now)
 
+	// These are reused between batches so that batching doesn't allocate
+	frames := make([]*Frame, 0, t.options.WriteBatchSize)
+	buffers := make(net.Buffers, 0, t.options.WriteBatchSize)
+
+	var heartbeats <-chan time.Time
+	if t.options.HeartbeatInterval > 0 {
+		ticker := time.NewTicker(t.options.HeartbeatInterval)
+		defer ticker.Stop()
+
+		heartbeats = ticker.C
+	}
+
 	for {
 		select {
 		case <-t.ctx.Done():
 			return
 
+		case <-heartbeats:
+			frames = append(frames[:0], newHeartbeatFrame())
+
+			if err := t.writeBatch(frames, buffers); err != nil {
+				t.log.Warn("Failed to write heartbeat", zap.Error(err))
+			}
+
+		case <-t.readDone:
+			// No more responses are coming, write whatever is left and stop
+			t.flushQueue(frames, buffers)
+			return
+
 		// These are responses from client requests handled by the read loop
-		case data := <-t.writeQueue:
-			t.log.Info("WRITE QUEUE", zap.String("data", string(data)))
-			if data == nil {
+		case frame := <-t.writeQueue:
+			if frame == nil {
 				// Our ready loop has terminated, we should too
 				log.Info("Write loop terminating as write queue has closed")
 				return
 			}
 
-			if _, err := t.conn.Write(data); err != nil {
+			frames = t.collectBatch(append(frames[:0], frame))
+
+			if err := t.writeBatch(frames, buffers); err != nil {
 				t.log.Error("Failed to write from write queue",
-					zap.String("data", string(data)),
+					zap.Int("frames", len(frames)),
 					zap.Error(err))
 				continue
 			}
@@ -476,52 +1124,317 @@ func (t *TCPConn) WriteLoop() {
 	}
 }
 
-// Write writes data into the write for the write loop to write into the connection. Write! Write! Write!
-func (t *TCPConn) Write(data []byte) (int, error) {
-	if t.isRunning() {
-		t.writeQueue <- data
+// flushQueue writes everything that is currently in the write queue
+func (t *TCPConn) flushQueue(frames []*Frame, buffers net.Buffers) {
+	for {
+		select {
+		case frame := <-t.writeQueue:
+			if frame == nil {
+				return
+			}
+
+			frames = t.collectBatch(append(frames[:0], frame))
+
+			if err := t.writeBatch(frames, buffers); err != nil {
+				t.log.Warn("Failed to flush write queue",
+					zap.Int("frames", len(frames)),
+					zap.Error(err))
+				return
+			}
+
+		default:
+			return
+		}
+	}
+}
+
+// collectBatch drains frames from the write queue into frames, so they can be
+// written with a single syscall. It stops once the batch holds
+// Options.WriteBatchSize frames, or once the queue is empty and
+// Options.WriteBatchLatency has passed since the batch was started.
+func (t *TCPConn) collectBatch(frames []*Frame) []*Frame {
+	var deadline <-chan time.Time
+
+	if t.options.WriteBatchLatency > 0 {
+		timer := time.NewTimer(t.options.WriteBatchLatency)
+		defer timer.Stop()
+
+		deadline = timer.C
+	}
+
+	for len(frames) < t.options.WriteBatchSize {
+		// Take anything that is already queued without waiting
+		select {
+		case frame := <-t.writeQueue:
+			if frame == nil {
+				return frames
+			}
+
+			frames = append(frames, frame)
+			continue
+
+		default:
+		}
+
+		if deadline == nil {
+			return frames
+		}
+
+		select {
+		case frame := <-t.writeQueue:
+			if frame == nil {
+				return frames
+			}
+
+			frames = append(frames, frame)
+
+		case <-deadline:
+			return frames
+
+		case <-t.ctx.Done():
+			return frames
+		}
 	}
 
-	return 0, nil
+	return frames
 }
 
-func (t *TCPConn) WriteUpdate(update *storage.Update) error {
-	a := append(protocol.PrefixUpdate, update.Key...)
-	a = append(a, '\n')
+// writeBatch writes frames to the connection using a single vectored write and
+// then releases them. buffers is scratch space for the write.
+func (t *TCPConn) writeBatch(frames []*Frame, buffers net.Buffers) error {
+	for _, frame := range frames {
+		buffers = append(buffers, frame.Bytes())
+	}
 
-	buf := bytes.NewBuffer(a)
+	// net.Buffers uses writev where the connection supports it
+	_, err := buffers.WriteTo(t.conn)
 
-	if _, err := buf.Write(append(update.Value, '\n')); err != nil {
-		return err
+	for n, frame := range frames {
+		frame.Release()
+		frames[n] = nil
 	}
 
-	_, err := t.Write(buf.Bytes())
 	return err
 }
 
-func (t *TCPConn) dispatchSet(req *protocol.SetRequest) error {
-	setCtx, cancel := context.WithTimeout(t.ctx, 3*time.Second)
-	defer cancel()
+// Write writes data into the write for the write loop to write into the connection. Write! Write! Write!
+//
+// data is copied, so the caller is free to reuse it once Write returns.
+func (t *TCPConn) Write(data []byte) (int, error) {
+	frame := newFrameFrom(data)
+	defer frame.Release()
 
-	if err := t.store.Set(setCtx, req.Key, req.Value); err != nil {
-		return fmt.Errorf("Failed to set %w", err)
+	if err := t.WriteFrame(frame); err != nil {
+		return 0, err
 	}
 
-	if err := protocol.WriteOk(t, req.GetRequestID()); err != nil {
-		return fmt.Errorf("Failed to ack set %w", err)
+	return len(data), nil
+}
+
+// WriteFrame queues frame to be written to the connection. The connection
+// retains its own reference to frame, so the caller still needs to release theirs.
+func (t *TCPConn) WriteFrame(frame *Frame) error {
+	t.writeMu.RLock()
+	defer t.writeMu.RUnlock()
+
+	if t.writeClosed {
+		return ErrConnClosed
 	}
 
-	return nil
-}
+	frame.Retain()
 
-// isRunning returns true if Close has not been called
-func (t *TCPConn) isRunning() bool {
 	select {
+	case t.writeQueue <- frame:
+		return nil
+
 	case <-t.ctx.Done():
-		// if we can read on this channel then it's been closed
-		return false
+		frame.Release()
+		return ErrConnClosed
+	}
+}
+
+// WriteUpdate writes update to the connection, frame must be the encoding of
+// update. If the client has asked for updates to be coalesced then the update
+// is buffered and frame is not used.
+//
+// Unlike WriteFrame, WriteUpdate never waits for room in the write queue. A
+// client that has fallen too far behind to queue the update is disconnected.
+func (t *TCPConn) WriteUpdate(update *storage.Update, frame *Frame) error {
+	if !t.authState.allowed() {
+		// Clients can't see the document until they've authenticated
+		return nil
+	}
+
+	if t.coalescer.Add(update) {
+		// The update will be written when the coalescing window ends
+		return nil
+	}
+
+	return t.writePush(frame)
+}
+
+// writePush queues a frame that's being pushed to the client, an update or a
+// message, without waiting for room in the write queue. Pushes are fanned out
+// to every connection, so rather than holding up everyone else a client that
+// can't keep up with them is disconnected.
+func (t *TCPConn) writePush(frame *Frame) error {
+	t.writeMu.RLock()
+	defer t.writeMu.RUnlock()
+
+	if t.writeClosed {
+		return ErrConnClosed
+	}
+
+	frame.Retain()
+
+	select {
+	case t.writeQueue <- frame:
+		return nil
 
 	default:
-		return true
+		frame.Release()
 	}
+
+	t.log.Warn("Client isn't keeping up with updates, closing connection")
+
+	// Closing waits for the connection's requests to finish, which may be
+	// waiting on whoever is pushing to us
+	go t.Close()
+
+	return errSlowConsumer
+}
+
+// Context returns a context that is cancelled when the connection is closed.
+func (t *TCPConn) Context() context.Context {
+	return t.ctx
+}
+
+// Identity returns the identity of the client's verified TLS certificate, or
+// nil if the client didn't present one.
+func (t *TCPConn) Identity() *Identity {
+	return t.identity
+}
+
+// RemoteAddr returns the client's address. For connections that came through a
+// load balancer using the PROXY protocol, it's the address from the header.
+func (t *TCPConn) RemoteAddr() net.Addr {
+	return t.conn.RemoteAddr()
+}
+
+func (t *TCPConn) limiter() *rateLimiter {
+	return t.rateLimiter
+}
+
+func (t *TCPConn) auth() *authState {
+	return t.authState
+}
+
+func (t *TCPConn) namespace() *namespaceState {
+	return t.namespaceState
+}
+
+// writeWatchedUpdate writes an update from one of the client's watches of ns
+func (t *TCPConn) writeWatchedUpdate(ns *namespace, update *storage.Update) {
+	if t.namespaceState.current() != ns {
+		return
+	}
+
+	frame := newFrame()
+	frame.buf = protocol.AppendUpdate(frame.buf, update.Key, update.Value)
+	defer frame.Release()
+
+	fanout := newUpdateFanout(t.options.ACL, update, frame)
+	defer fanout.release()
+
+	for _, scoped := range fanout.updatesFor(t.authState) {
+		if err := t.WriteUpdate(scoped.update, scoped.frame); err != nil {
+			t.log.Debug("Failed to write watched update", zap.Error(err))
+		}
+	}
+}
+
+func (t *TCPConn) watches() *watchSet {
+	return t.watchSet
+}
+
+func (t *TCPConn) waits() *waitCounter {
+	return t.waitCounter
+}
+
+func (t *TCPConn) subscriptions() *channelSubscriptions {
+	return t.channelSubscriptions
+}
+
+// handshake completes the TLS handshake, if the connection uses TLS
+func (t *TCPConn) handshake() error {
+	tlsConn, ok := t.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	if err := tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return err
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	t.identity = identityFromState(tlsConn.ConnectionState())
+
+	return tlsConn.SetDeadline(time.Time{})
+}
+
+// SetCoalesceWindow changes how long updates are buffered for before being
+// written to the client. A zero window writes updates immediately.
+func (t *TCPConn) SetCoalesceWindow(window time.Duration) {
+	t.coalescer.SetWindow(window)
+}
+
+// setIdleDeadline sets the deadline for the client to send us something
+func (t *TCPConn) setIdleDeadline() error {
+	if t.options.IdleTimeout <= 0 {
+		return nil
+	}
+
+	return t.conn.SetReadDeadline(time.Now().Add(t.options.IdleTimeout))
+}
+
+// isDraining returns true once Drain has been called
+func (t *TCPConn) isDraining() bool {
+	return atomic.LoadInt32(&t.draining) == 1
+}
+
+var _ session = (*TCPConn)(nil)
+
+// closeRead shuts down the reading side of conn, if it supports half closes
+func closeRead(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+
+	return nil
+}
+
+// closeWrite shuts down the writing side of conn, if it supports half closes.
+// For TLS connections this sends a close_notify alert.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+
+	return nil
+}
+
+// isTimeout returns true if err is from a read or write deadline passing
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// newHeartbeatFrame returns a frame holding a HEARTBEAT notice
+func newHeartbeatFrame() *Frame {
+	frame := newFrame()
+	frame.buf = protocol.AppendHeartbeat(frame.buf)
+	return frame
 }
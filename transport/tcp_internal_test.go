@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+)
+
+var _ = Describe("TCPConn (internal)", func() {
+	makeConn := func(options Options) *TCPConn {
+		return NewTCPCOnn(context.Background(), nil, options, newNamespaceSet(options), zap.NewNop())
+	}
+
+	queue := func(conn *TCPConn, count int) {
+		for n := 0; n < count; n++ {
+			frame := newFrameFrom([]byte("frame"))
+			Expect(conn.WriteFrame(frame)).To(Succeed())
+			frame.Release()
+		}
+	}
+
+	Describe("collectBatch()", func() {
+		It("drains everything currently queued", func() {
+			conn := makeConn(Options{WriteBatchSize: 16})
+			queue(conn, 5)
+
+			Expect(conn.collectBatch(nil)).To(HaveLen(5))
+		})
+
+		It("does not exceed the maximum batch size", func() {
+			conn := makeConn(Options{WriteBatchSize: 4})
+			queue(conn, 10)
+
+			Expect(conn.collectBatch(nil)).To(HaveLen(4))
+			Expect(conn.writeQueue).To(HaveLen(6))
+		})
+
+		It("waits up to the batch latency for more frames", func() {
+			conn := makeConn(Options{WriteBatchSize: 16, WriteBatchLatency: 200 * time.Millisecond})
+			queue(conn, 1)
+
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				queue(conn, 1)
+			}()
+
+			start := time.Now()
+			Expect(conn.collectBatch(nil)).To(HaveLen(2))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+		})
+	})
+})
@@ -3,10 +3,15 @@ package transport_test
 import (
 	"bufio"
 	"context"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net"
+	"strings"
 	"time"
 
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/protocol"
 	"github.com/luma/pharos/storage"
 	"github.com/luma/pharos/transport"
 	. "github.com/onsi/ginkgo"
@@ -122,6 +127,116 @@ var _ = Describe("transport", func() {
 		// 	})
 		// })
 
+		It("sends updates to every connected client", func() {
+			tcp := makeTCPServer("")
+
+			first, err := net.Dial("tcp", "0.0.0.0:6682")
+			Expect(err).To(Succeed())
+
+			second, err := net.Dial("tcp", "0.0.0.0:6682")
+			Expect(err).To(Succeed())
+
+			defer func() {
+				first.Close()
+				second.Close()
+				Expect(tcp.Close()).To(Succeed())
+			}()
+
+			// Give the server a moment to accept both connections
+			time.Sleep(50 * time.Millisecond)
+
+			Expect(tcp.Store().Set(context.Background(), []byte("foo"), "bar")).To(Succeed())
+
+			for _, conn := range []net.Conn{first, second} {
+				expected := "*foo\r\n\"bar\"\r\n"
+				response := make([]byte, len(expected))
+				_, err = io.ReadFull(conn, response)
+				Expect(err).To(Succeed())
+				Expect(string(response)).To(Equal(expected))
+			}
+		})
+
+		It("responds to pipelined requests", func() {
+			tcp := makeTCPServer("")
+
+			conn, err := net.Dial("tcp", "0.0.0.0:6682")
+			Expect(err).To(Succeed())
+
+			defer func() {
+				conn.Close()
+				Expect(tcp.Close()).To(Succeed())
+			}()
+
+			_, err = conn.Write([]byte("0001PING\n0002PING\n0003PING\n"))
+			Expect(err).To(Succeed())
+
+			expected := "0001PONG\r\n0002PONG\r\n0003PONG\r\n"
+			response := make([]byte, len(expected))
+			_, err = io.ReadFull(conn, response)
+			Expect(err).To(Succeed())
+			Expect(string(response)).To(Equal(expected))
+		})
+
+		Describe("COALESCE command", func() {
+			It("collapses updates within the window into a single batch", func() {
+				tcp := makeTCPServer("")
+
+				conn, err := net.Dial("tcp", "0.0.0.0:6682")
+				Expect(err).To(Succeed())
+
+				defer func() {
+					conn.Close()
+					Expect(tcp.Close()).To(Succeed())
+				}()
+
+				r := bufio.NewReader(conn)
+
+				_, err = conn.Write([]byte("1234COALESCE 200\n"))
+				Expect(err).To(Succeed())
+
+				resp, err := protocol.ReadResponse(r)
+				Expect(err).To(Succeed())
+				Expect(resp.Type).To(Equal(protocol.RespOk))
+
+				ctx := context.Background()
+				Expect(tcp.Store().Set(ctx, []byte("foo"), "one")).To(Succeed())
+				Expect(tcp.Store().Set(ctx, []byte("bar"), "two")).To(Succeed())
+				Expect(tcp.Store().Set(ctx, []byte("foo"), "three")).To(Succeed())
+
+				resp, err = protocol.ReadResponse(r)
+				Expect(err).To(Succeed())
+				Expect(resp.Type).To(Equal(protocol.RespUpdateBatch))
+				Expect(resp.Args).To(HaveLen(2))
+
+				first := resp.Args[0].(*protocol.Response)
+				Expect(first.Args[0]).To(Equal([]byte("foo")))
+				Expect(string(first.Value)).To(Equal(`"three"`))
+
+				second := resp.Args[1].(*protocol.Response)
+				Expect(second.Args[0]).To(Equal([]byte("bar")))
+				Expect(string(second.Value)).To(Equal(`"two"`))
+			})
+
+			It("rejects windows longer than the maximum", func() {
+				tcp := makeTCPServer("")
+
+				conn, err := net.Dial("tcp", "0.0.0.0:6682")
+				Expect(err).To(Succeed())
+
+				defer func() {
+					conn.Close()
+					Expect(tcp.Close()).To(Succeed())
+				}()
+
+				_, err = conn.Write([]byte("1234COALESCE 60000\n"))
+				Expect(err).To(Succeed())
+
+				resp, err := protocol.ReadResponse(bufio.NewReader(conn))
+				Expect(err).To(Succeed())
+				Expect(resp.ErrorOrNil()).To(HaveOccurred())
+			})
+		})
+
 		Describe("GET command", func() {
 			It("returns the current value of a key", func() {
 				tcp := makeTCPServer(`{"foo":"bar"}`)
@@ -137,10 +252,11 @@ var _ = Describe("transport", func() {
 				_, err = conn.Write([]byte("1234GET foo\n"))
 				Expect(err).To(Succeed())
 
-				var response []byte
+				expected := "1234GET\r\n\"bar\"\r\n"
+				response := make([]byte, len(expected))
 				_, err = io.ReadFull(bufio.NewReader(conn), response)
 				Expect(err).To(Succeed())
-				Expect(string(response)).To(Equal("1234GET\r\n\"bar\"\r\n"))
+				Expect(string(response)).To(Equal(expected))
 
 				// response, err := bufio.NewReader(conn).ReadBytes('\n')
 				// Expect(err).To(Succeed())
@@ -153,6 +269,79 @@ var _ = Describe("transport", func() {
 				waitForClose(conn)
 			})
 		})
+
+		Describe("updates", func() {
+			It("stops listening to the store once it's closed", func() {
+				tcp := makeTCPServer("")
+				Expect(tcp.Close()).To(Succeed())
+
+				// A subscription that's still listening would fill up and block
+				// the writes once its buffer is full
+				done := make(chan struct{})
+				go func() {
+					defer GinkgoRecover()
+					defer close(done)
+
+					for i := 0; i < storage.SubscriptionBufferSize*2; i++ {
+						Expect(tcp.Store().Set(context.Background(), []byte("foo"), i)).To(Succeed())
+					}
+				}()
+
+				Eventually(done).Should(BeClosed())
+			})
+
+			servers := map[string]bool{
+				"TCPListener": true,
+				"EventLoop":   false,
+			}
+
+			for name, useStdlib := range servers {
+				useStdlib := useStdlib
+
+				Describe(name, func() {
+					It("disconnects clients that can't keep up, rather than waiting for them", func() {
+						tcp := makeServer("", transport.Options{UseStdlib: useStdlib})
+
+						defer func() {
+							Expect(tcp.Close()).To(Succeed())
+						}()
+
+						// Never reads anything, so the socket's buffers and then the
+						// connection's write queue fill up
+						slow, err := net.Dial("tcp", "127.0.0.1:6682")
+						Expect(err).To(Succeed())
+						defer slow.Close()
+
+						// Make sure the server has accepted the connection
+						_, err = slow.Write([]byte("1234PING\n"))
+						Expect(err).To(Succeed())
+						time.Sleep(100 * time.Millisecond)
+
+						value := strings.Repeat("x", 64*1024)
+
+						done := make(chan struct{})
+						go func() {
+							defer GinkgoRecover()
+							defer close(done)
+
+							for i := 0; i < 1000; i++ {
+								Expect(tcp.Store().Set(context.Background(), []byte("foo"), value)).To(Succeed())
+							}
+						}()
+
+						Eventually(done, 10*time.Second).Should(BeClosed())
+
+						Expect(slow.SetReadDeadline(time.Now().Add(10 * time.Second))).To(Succeed())
+						_, err = io.Copy(ioutil.Discard, slow)
+
+						var netErr net.Error
+						if errors.As(err, &netErr) {
+							Expect(netErr.Timeout()).To(BeFalse())
+						}
+					})
+				})
+			}
+		})
 	})
 })
 
@@ -185,6 +374,14 @@ waitForClose:
 }
 
 func makeTCPServer(restore string) *transport.TCP {
+	return makeServer(restore, transport.Options{UseStdlib: true})
+}
+
+func makeEventLoopServer(restore string) *transport.TCP {
+	return makeServer(restore, transport.Options{UseStdlib: false})
+}
+
+func makeServer(restore string, options transport.Options) *transport.TCP {
 	store := storage.NewInmemoryStore()
 	if restore != "" {
 		Expect(store.Restore([]byte(restore))).To(Succeed())
@@ -193,30 +390,93 @@ func makeTCPServer(restore string) *transport.TCP {
 	log, err := zap.NewDevelopment()
 	Expect(err).To(Succeed())
 
-	tcp := transport.NewTCP(transport.Options{
-		Log:          log,
-		NumListeners: 1,
-		Port:         6682,
+	options.Log = log
+	options.NumListeners = 1
+	options.Port = 6682
 
-		// TODO(rolly) Reuseport should default to true
-		Reuseport: true,
+	// TODO(rolly) Reuseport should default to true
+	options.Reuseport = true
 
-		Store: store,
-	})
+	options.Store = store
 
+	tcp := transport.NewTCP(options)
+
+	// Start doesn't return until the server is listening
 	err = tcp.Start(context.Background())
 	Expect(err).To(Succeed())
 
-	// Wait for the TCP server to be listening.
-	// TODO(rolly) this is stupid, either make sure `tcp.Start()` does not
-	//						 return until the server is listening or provide a test
-	//						 helper that retries until a connection is achieved or a
-	//						 timeout is hit.
-	time.Sleep(100 * time.Millisecond)
-
 	return tcp
 }
 
+// testAddr is the address that makeServer listens on
+const testAddr = "127.0.0.1:6682"
+
+// serverFixture is a server, and the clients that a spec has connected to it
+type serverFixture struct {
+	ctx     context.Context
+	tcp     *transport.TCP
+	options transport.Options
+	conns   []*client.Conn
+}
+
+// start starts the server with the contents of restore
+func (f *serverFixture) start(restore string) {
+	f.tcp = makeServer(restore, f.options)
+}
+
+// connect returns a client that's connected to the server, it's disconnected
+// after the spec
+func (f *serverFixture) connect() *client.Conn {
+	conn := client.New(zap.NewNop())
+	Expect(conn.Connect(f.ctx, testAddr)).To(Succeed())
+
+	f.conns = append(f.conns, conn)
+
+	return conn
+}
+
+// disconnect disconnects every client that connect returned
+func (f *serverFixture) disconnect() {
+	for _, conn := range f.conns {
+		conn.Disconnect()
+	}
+
+	f.conns = nil
+}
+
+// forEachServer describes the specs in body once for a TCPListener server and
+// once for an EventLoop one. A server is started with options before each
+// spec, and it's closed, along with the clients the spec connected, after it.
+func forEachServer(options transport.Options, body func(f *serverFixture)) {
+	servers := map[string]bool{
+		"TCPListener": true,
+		"EventLoop":   false,
+	}
+
+	for name, useStdlib := range servers {
+		f := &serverFixture{options: options}
+		f.options.UseStdlib = useStdlib
+
+		Describe(name, func() {
+			var cancel context.CancelFunc
+
+			BeforeEach(func() {
+				f.ctx, cancel = context.WithCancel(context.Background())
+				f.start("")
+			})
+
+			AfterEach(func() {
+				cancel()
+				f.disconnect()
+
+				Expect(f.tcp.Close()).To(Succeed())
+			})
+
+			body(f)
+		})
+	}
+}
+
 func readLine(conn net.Conn) ([]byte, error) {
 	r := bufio.NewReader(conn)
 	var line []byte
@@ -0,0 +1,131 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// tlsHandshakeTimeout bounds how long a client has to complete the TLS
+	// handshake once it has connected
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrTLSUnsupported = errors.New("TLS is not supported by the event loop transport")
+)
+
+// TLSOptions configures TLS for client connections.
+type TLSOptions struct {
+	// CertFile and KeyFile are the PEM encoded certificate and private key that
+	// the server presents to clients
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is a PEM encoded bundle of certificate authorities. When it's
+	// set clients must present a certificate signed by one of them (mutual TLS),
+	// and the verified certificate is available from the connection's Identity.
+	ClientCAFile string
+}
+
+// Identity is who a client proved it was by presenting a verified certificate.
+type Identity struct {
+	// CommonName is the subject common name of the client's certificate
+	CommonName string
+
+	// DNSNames and URIs are the client certificate's subject alternative names
+	DNSNames []string
+	URIs     []string
+
+	// Certificate is the client's leaf certificate
+	Certificate *x509.Certificate
+}
+
+// identityFromState returns the identity of the verified client certificate
+// in state, or nil if the client did not present one.
+func identityFromState(state tls.ConnectionState) *Identity {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+
+	identity := &Identity{
+		CommonName:  cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		Certificate: cert,
+	}
+
+	for _, uri := range cert.URIs {
+		identity.URIs = append(identity.URIs, uri.String())
+	}
+
+	return identity
+}
+
+// tlsConfig loads the files in TLSOptions, and can reload them while the
+// server is running. Connections that are already established are unaffected
+// by a reload.
+type tlsConfig struct {
+	options TLSOptions
+
+	// current holds the *tls.Config for new connections
+	current atomic.Value
+}
+
+func newTLSConfig(options TLSOptions) (*tlsConfig, error) {
+	c := &tlsConfig{options: options}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the certificates from disk again. If anything fails to load the
+// previous certificates remain in use.
+func (c *tlsConfig) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.options.CertFile, c.options.KeyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS certificate %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.options.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.options.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read client CA file %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in client CA file %s", c.options.ClientCAFile)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	c.current.Store(config)
+	return nil
+}
+
+// ServerConfig returns a config for tls.Server that always uses the most
+// recently loaded certificates.
+func (c *tlsConfig) ServerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.current.Load().(*tls.Config), nil
+		},
+	}
+}
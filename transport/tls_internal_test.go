@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TLS (internal)", func() {
+	Describe("identityFromState()", func() {
+		It("returns nil if the client did not present a certificate", func() {
+			Expect(identityFromState(tls.ConnectionState{})).To(BeNil())
+		})
+
+		It("returns the identity of the verified client certificate", func() {
+			uri, err := url.Parse("spiffe://pharos/alice")
+			Expect(err).To(Succeed())
+
+			cert := &x509.Certificate{
+				Subject:  pkix.Name{CommonName: "alice"},
+				DNSNames: []string{"alice.example.com"},
+				URIs:     []*url.URL{uri},
+			}
+
+			identity := identityFromState(tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			})
+
+			Expect(identity.CommonName).To(Equal("alice"))
+			Expect(identity.DNSNames).To(Equal([]string{"alice.example.com"}))
+			Expect(identity.URIs).To(Equal([]string{"spiffe://pharos/alice"}))
+			Expect(identity.Certificate).To(BeIdenticalTo(cert))
+		})
+	})
+})
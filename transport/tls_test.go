@@ -0,0 +1,259 @@
+package transport_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("TLS", func() {
+		var (
+			dir string
+			ca  *testCA
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			dir, err = ioutil.TempDir("", "pharos-tls")
+			Expect(err).To(Succeed())
+
+			ca = newTestCA()
+			ca.issue("localhost").write(dir, "server")
+			ca.issue("alice").write(dir, "client")
+			ca.write(dir)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		serverTLS := func(clientCA bool) *transport.TLSOptions {
+			options := &transport.TLSOptions{
+				CertFile: filepath.Join(dir, "server.crt"),
+				KeyFile:  filepath.Join(dir, "server.key"),
+			}
+
+			if clientCA {
+				options.ClientCAFile = filepath.Join(dir, "ca.crt")
+			}
+
+			return options
+		}
+
+		clientTLS := func(withCert bool) *tls.Config {
+			config := &tls.Config{
+				RootCAs:    ca.pool(),
+				ServerName: "localhost",
+			}
+
+			if withCert {
+				cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+				Expect(err).To(Succeed())
+				config.Certificates = []tls.Certificate{cert}
+			}
+
+			return config
+		}
+
+		ping := func(conn net.Conn) error {
+			if _, err := conn.Write([]byte("1234PING\n")); err != nil {
+				return err
+			}
+
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+
+			resp, err := protocol.ReadResponse(bufio.NewReader(conn))
+			if err != nil {
+				return err
+			}
+
+			Expect(resp.Type).To(Equal(protocol.RespPong))
+			return nil
+		}
+
+		It("serves clients over TLS", func() {
+			tcp := makeServer("", transport.Options{UseStdlib: true, TLS: serverTLS(false)})
+			defer tcp.Close()
+
+			conn, err := tls.Dial("tcp", "127.0.0.1:6682", clientTLS(false))
+			Expect(err).To(Succeed())
+			defer conn.Close()
+
+			Expect(ping(conn)).To(Succeed())
+		})
+
+		It("requires a client certificate when a client CA is configured", func() {
+			tcp := makeServer("", transport.Options{UseStdlib: true, TLS: serverTLS(true)})
+			defer tcp.Close()
+
+			conn, err := tls.Dial("tcp", "127.0.0.1:6682", clientTLS(false))
+			if err == nil {
+				defer conn.Close()
+
+				// With TLS 1.3 the server rejects our certificate after the client
+				// considers the handshake to be complete
+				err = ping(conn)
+			}
+
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("accepts clients with a certificate signed by the client CA", func() {
+			tcp := makeServer("", transport.Options{UseStdlib: true, TLS: serverTLS(true)})
+			defer tcp.Close()
+
+			conn, err := tls.Dial("tcp", "127.0.0.1:6682", clientTLS(true))
+			Expect(err).To(Succeed())
+			defer conn.Close()
+
+			Expect(ping(conn)).To(Succeed())
+		})
+
+		It("uses reloaded certificates for new connections", func() {
+			tcp := makeServer("", transport.Options{UseStdlib: true, TLS: serverTLS(false)})
+			defer tcp.Close()
+
+			replacement := ca.issue("localhost")
+			replacement.write(dir, "server")
+			Expect(tcp.ReloadTLS()).To(Succeed())
+
+			conn, err := tls.Dial("tcp", "127.0.0.1:6682", clientTLS(false))
+			Expect(err).To(Succeed())
+			defer conn.Close()
+
+			Expect(ping(conn)).To(Succeed())
+
+			peer := conn.ConnectionState().PeerCertificates[0]
+			Expect(peer.SerialNumber).To(Equal(replacement.cert.SerialNumber))
+		})
+
+		It("keeps the current certificates if the reload fails", func() {
+			tcp := makeServer("", transport.Options{UseStdlib: true, TLS: serverTLS(false)})
+			defer tcp.Close()
+
+			Expect(ioutil.WriteFile(filepath.Join(dir, "server.crt"), []byte("nope"), 0600)).To(Succeed())
+			Expect(tcp.ReloadTLS()).NotTo(Succeed())
+
+			conn, err := tls.Dial("tcp", "127.0.0.1:6682", clientTLS(false))
+			Expect(err).To(Succeed())
+			defer conn.Close()
+
+			Expect(ping(conn)).To(Succeed())
+		})
+
+		It("is not supported by event loops", func() {
+			tcp := transport.NewTCP(transport.Options{
+				Port:      6682,
+				UseStdlib: false,
+				TLS:       serverTLS(false),
+			})
+
+			Expect(tcp.Start(context.Background())).To(MatchError(transport.ErrTLSUnsupported))
+		})
+	})
+})
+
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA() *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(Succeed())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pharos test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(Succeed())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(Succeed())
+
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// issue returns a certificate for name that's valid for both servers and clients
+func (ca *testCA) issue(name string) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(Succeed())
+
+	ca.serial++
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).To(Succeed())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(Succeed())
+
+	return &testCert{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *testCA) write(dir string) {
+	writePEM(filepath.Join(dir, "ca.crt"), "CERTIFICATE", ca.cert.Raw)
+}
+
+func (c *testCert) write(dir, name string) *testCert {
+	key, err := x509.MarshalECPrivateKey(c.key)
+	Expect(err).To(Succeed())
+
+	writePEM(filepath.Join(dir, name+".crt"), "CERTIFICATE", c.cert.Raw)
+	writePEM(filepath.Join(dir, name+".key"), "EC PRIVATE KEY", key)
+
+	return c
+}
+
+func writePEM(path, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+}
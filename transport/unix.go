@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultUnixSocketMode is the default for UnixSocket.Mode
+	DefaultUnixSocketMode os.FileMode = 0660
+)
+
+// UnixSocket is a Unix domain socket to serve clients on, alongside TCP. Unix
+// sockets are always served by goroutines, as if UseStdlib were set, and they
+// don't use TLS. Access is controlled by the socket file's permissions instead.
+type UnixSocket struct {
+	// Path of the socket file
+	Path string
+
+	// Mode is the socket file's permissions. Defaults to DefaultUnixSocketMode.
+	Mode os.FileMode
+
+	// User and Group own the socket file, either can be a name or a numeric ID.
+	// The owner is left alone if they're empty.
+	User  string
+	Group string
+}
+
+// listenUnix binds socket and sets its permissions. If the path is taken by a
+// socket that nothing is listening on anymore, left behind by a process that
+// didn't exit cleanly, it's replaced.
+func listenUnix(socket UnixSocket, options Options) (net.Listener, error) {
+	ln, err := options.listen("unix", socket.Path)
+
+	if errors.Is(err, syscall.EADDRINUSE) {
+		var removed bool
+		if removed, err = removeStaleUnixSocket(socket.Path); removed {
+			ln, err = options.listen("unix", socket.Path)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := socket.applyPermissions(); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+func (s UnixSocket) applyPermissions() error {
+	mode := s.Mode
+	if mode == 0 {
+		mode = DefaultUnixSocketMode
+	}
+
+	if err := os.Chmod(s.Path, mode); err != nil {
+		return fmt.Errorf("Failed to set unix socket mode %w", err)
+	}
+
+	if s.User == "" && s.Group == "" {
+		return nil
+	}
+
+	uid, err := lookupID(s.User, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+
+		return u.Uid, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to find unix socket user %w", err)
+	}
+
+	gid, err := lookupID(s.Group, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+
+		return g.Gid, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to find unix socket group %w", err)
+	}
+
+	if err := os.Chown(s.Path, uid, gid); err != nil {
+		return fmt.Errorf("Failed to set unix socket owner %w", err)
+	}
+
+	return nil
+}
+
+// lookupID resolves a user or group name to its ID using lookup. Numeric names
+// are used as they are, and an empty name resolves to -1 which os.Chown
+// treats as unchanged.
+func lookupID(name string, lookup func(name string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(id)
+}
+
+// removeStaleUnixSocket removes the socket at path if nothing is listening on
+// it. It returns false if the socket is in use.
+func removeStaleUnixSocket(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return false, fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return false, fmt.Errorf("%s is already in use", path)
+	}
+
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return false, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Unix sockets (internal)", func() {
+	var (
+		dir  string
+		path string
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		dir, err = ioutil.TempDir("", "pharos-unix")
+		Expect(err).To(Succeed())
+
+		path = filepath.Join(dir, "pharos.sock")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("listenUnix()", func() {
+		It("does not replace a socket that is in use", func() {
+			ln, err := net.Listen("unix", path)
+			Expect(err).To(Succeed())
+			defer ln.Close()
+
+			_, err = listenUnix(UnixSocket{Path: path}, Options{})
+			Expect(err).To(MatchError(ContainSubstring("already in use")))
+		})
+
+		It("does not replace files that aren't sockets", func() {
+			Expect(ioutil.WriteFile(path, []byte("important"), 0600)).To(Succeed())
+
+			_, err := listenUnix(UnixSocket{Path: path}, Options{})
+			Expect(err).To(MatchError(ContainSubstring("not a socket")))
+
+			data, err := ioutil.ReadFile(path)
+			Expect(err).To(Succeed())
+			Expect(string(data)).To(Equal("important"))
+		})
+	})
+
+	Describe("lookupID()", func() {
+		It("uses numeric IDs as they are", func() {
+			Expect(lookupID("1234", nil)).To(Equal(1234))
+		})
+
+		It("leaves the owner unchanged for empty names", func() {
+			Expect(lookupID("", nil)).To(Equal(-1))
+		})
+
+		It("looks up names", func() {
+			id, err := lookupID("pharos", func(name string) (string, error) {
+				Expect(name).To(Equal("pharos"))
+				return "42", nil
+			})
+
+			Expect(err).To(Succeed())
+			Expect(id).To(Equal(42))
+		})
+	})
+})
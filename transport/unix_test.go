@@ -0,0 +1,115 @@
+package transport_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("Unix sockets", func() {
+		var (
+			dir  string
+			path string
+		)
+
+		BeforeEach(func() {
+			var err error
+
+			dir, err = ioutil.TempDir("", "pharos-unix")
+			Expect(err).To(Succeed())
+
+			path = filepath.Join(dir, "pharos.sock")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		expectPong := func() {
+			conn, err := net.Dial("unix", path)
+			Expect(err).To(Succeed())
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("1234PING\n"))
+			Expect(err).To(Succeed())
+
+			Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			resp, err := protocol.ReadResponse(bufio.NewReader(conn))
+			Expect(err).To(Succeed())
+			Expect(resp.Type).To(Equal(protocol.RespPong))
+		}
+
+		It("serves clients on unix sockets alongside TCP", func() {
+			tcp := makeServer("", transport.Options{
+				UseStdlib:   true,
+				UnixSockets: []transport.UnixSocket{{Path: path}},
+			})
+			defer tcp.Close()
+
+			expectPong()
+
+			conn, err := net.Dial("tcp", "0.0.0.0:6682")
+			Expect(err).To(Succeed())
+			conn.Close()
+		})
+
+		It("serves unix sockets when TCP is served by event loops", func() {
+			tcp := makeServer("", transport.Options{
+				UseStdlib:   false,
+				UnixSockets: []transport.UnixSocket{{Path: path}},
+			})
+			defer tcp.Close()
+
+			expectPong()
+		})
+
+		It("sets the mode of the socket file", func() {
+			tcp := makeServer("", transport.Options{
+				UseStdlib:   true,
+				UnixSockets: []transport.UnixSocket{{Path: path, Mode: 0600}},
+			})
+			defer tcp.Close()
+
+			info, err := os.Stat(path)
+			Expect(err).To(Succeed())
+			Expect(info.Mode() & os.ModePerm).To(Equal(os.FileMode(0600)))
+		})
+
+		It("replaces a socket that was left behind by a previous process", func() {
+			ln, err := net.Listen("unix", path)
+			Expect(err).To(Succeed())
+			ln.(*net.UnixListener).SetUnlinkOnClose(false)
+			Expect(ln.Close()).To(Succeed())
+
+			tcp := makeServer("", transport.Options{
+				UseStdlib:   true,
+				UnixSockets: []transport.UnixSocket{{Path: path}},
+			})
+			defer tcp.Close()
+
+			expectPong()
+		})
+
+		It("removes the socket file when it's closed", func() {
+			tcp := makeServer("", transport.Options{
+				UseStdlib:   true,
+				UnixSockets: []transport.UnixSocket{{Path: path}},
+			})
+
+			Expect(tcp.Close()).To(Succeed())
+
+			_, err := os.Stat(path)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/luma/pharos/protocol"
+)
+
+// maxWaits is how many requests, like a LOCK with a WAIT or a BLPOP, each
+// connection can have waiting at once. Each waits on a goroutine of its own.
+const maxWaits = 64
+
+// waitCounter counts the requests that a connection has waiting. It's safe for
+// concurrent use.
+type waitCounter struct {
+	count int32
+}
+
+func newWaitCounter() *waitCounter {
+	return &waitCounter{}
+}
+
+// acquire reserves a wait, it returns false if the connection already has
+// maxWaits requests waiting. Every successful acquire must be followed by a
+// release.
+func (w *waitCounter) acquire() bool {
+	if atomic.AddInt32(&w.count, 1) > maxWaits {
+		atomic.AddInt32(&w.count, -1)
+		return false
+	}
+
+	return true
+}
+
+func (w *waitCounter) release() {
+	atomic.AddInt32(&w.count, -1)
+}
+
+// acquireWait reserves a wait on holder for req. If holder already has as many
+// requests waiting as it's allowed it rejects req, and returns false.
+func acquireWait(s Session, holder session, req protocol.Request) (bool, error) {
+	if holder.waits().acquire() {
+		return true, nil
+	}
+
+	if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeTooMany, "Too many waiting requests"); err != nil {
+		return false, fmt.Errorf("Failed to reject %s %w", req.GetCommand(), err)
+	}
+
+	return false, nil
+}
+
+// waitInBackground calls wait on a goroutine of its own, so that waiting doesn't
+// hold up the connection's other requests, or the event loop, and releases the
+// wait that was acquired on holder once it returns. The request's context ends
+// when its handler returns, so wait is given one that's bound to the
+// connection's instead, which also ends after timeout if it's set.
+//
+// wait's error is dropped, it's from responding and the connection may have
+// closed, in which case there's no one to tell.
+func waitInBackground(holder session, timeout time.Duration, wait func(ctx context.Context) error) {
+	go func() {
+		defer holder.waits().release()
+
+		ctx := holder.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		_ = wait(ctx)
+	}()
+}
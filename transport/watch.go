@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/luma/pharos/protocol"
+	"github.com/luma/pharos/storage"
+)
+
+// maxWatches is how many paths a connection can watch at once, each watch is a
+// subscription to the store of its own
+const maxWatches = 64
+
+// errTooManyWatches is returned when a connection already watches maxWatches
+// paths
+var errTooManyWatches = errors.New("Too many watches")
+
+// watchSet is the paths that a connection watches. While it watches anything
+// the connection is only sent the updates of its watches, which are
+// subscriptions to the store filtered to each path, rather than every update
+// in its namespace. It's safe for concurrent use.
+type watchSet struct {
+	ctx context.Context
+
+	// deliver sends an update from a watch of ns to the connection
+	deliver func(ns *namespace, update *storage.Update)
+
+	mu      sync.Mutex
+	watches map[string]*storage.Subscription
+
+	// count is len(watches), it's read without the mutex by the listeners as
+	// they fan updates out
+	count int32
+}
+
+func newWatchSet(ctx context.Context, deliver func(ns *namespace, update *storage.Update)) *watchSet {
+	return &watchSet{
+		ctx:     ctx,
+		deliver: deliver,
+		watches: make(map[string]*storage.Subscription),
+	}
+}
+
+// watch subscribes to the updates of path in ns. Watching a path that's
+// already watched does nothing.
+func (w *watchSet) watch(ns *namespace, path []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.watches[string(path)]; ok {
+		return nil
+	}
+
+	if len(w.watches) >= maxWatches {
+		return errTooManyWatches
+	}
+
+	filter := retain(path)
+
+	sub := ns.store.ListenToUpdates(w.ctx, filter)
+	w.watches[string(filter)] = sub
+	atomic.StoreInt32(&w.count, int32(len(w.watches)))
+
+	go func() {
+		for update := range sub.Updates() {
+			w.deliver(ns, update)
+		}
+	}()
+
+	return nil
+}
+
+// unwatch stops watching path
+func (w *watchSet) unwatch(path []byte) {
+	w.mu.Lock()
+	sub, ok := w.watches[string(path)]
+	delete(w.watches, string(path))
+	atomic.StoreInt32(&w.count, int32(len(w.watches)))
+	w.mu.Unlock()
+
+	// Cancelling waits for the store, which may be waiting for a listener that
+	// wants to know whether we're watching anything, so the mutex isn't held
+	if ok {
+		sub.Cancel()
+	}
+}
+
+// clear stops watching everything
+func (w *watchSet) clear() {
+	w.mu.Lock()
+	watches := w.watches
+	w.watches = make(map[string]*storage.Subscription)
+	atomic.StoreInt32(&w.count, 0)
+	w.mu.Unlock()
+
+	for _, sub := range watches {
+		sub.Cancel()
+	}
+}
+
+// watching returns true if anything is watched
+func (w *watchSet) watching() bool {
+	return atomic.LoadInt32(&w.count) > 0
+}
+
+func (h *requestHandler) handleWatch(ctx context.Context, s Session, req protocol.Request) error {
+	watch := req.(*protocol.WatchRequest)
+
+	if ok, err := h.checkAccess(ctx, s, AccessSubscribe, req, watch.GetKey()); !ok {
+		return err
+	}
+
+	switch err := ctx.Value(sessionKey{}).(session).watches().watch(namespaceFor(ctx), watch.Path); {
+	case err == nil:
+		if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+			return fmt.Errorf("Failed to ack WATCH %w", err)
+		}
+
+	case errors.Is(err, errTooManyWatches):
+		if err := protocol.WriteCodedError(s, req.GetRequestID(), protocol.CodeTooMany, "Too many watches"); err != nil {
+			return fmt.Errorf("Failed to reject WATCH %w", err)
+		}
+
+	default:
+		return fmt.Errorf("Failed to watch %w", err)
+	}
+
+	return nil
+}
+
+func (h *requestHandler) handleUnwatch(ctx context.Context, s Session, req protocol.Request) error {
+	unwatch := req.(*protocol.UnwatchRequest)
+
+	ctx.Value(sessionKey{}).(session).watches().unwatch(unwatch.Path)
+
+	if err := protocol.WriteOk(s, req.GetRequestID()); err != nil {
+		return fmt.Errorf("Failed to ack UNWATCH %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package transport_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+
+	"github.com/luma/pharos/client"
+	"github.com/luma/pharos/transport"
+)
+
+var _ = Describe("transport", func() {
+	Describe("watches", func() {
+		forEachServer(transport.Options{}, func(f *serverFixture) {
+			var writer, watcher *client.Conn
+
+			BeforeEach(func() {
+				writer = f.connect()
+				watcher = f.connect()
+			})
+
+			It("sends changes beneath a watched path as updates of that path", func() {
+				Expect(watcher.Watch(f.ctx, "services")).To(Succeed())
+
+				Expect(writer.Set(f.ctx, "services.api.port", []byte("8080"))).To(Succeed())
+
+				var update *client.Update
+				Eventually(watcher.UpdateChan()).Should(Receive(&update))
+				Expect(update.Key).To(Equal("services"))
+				Expect(gjson.GetBytes(update.Value, "api.port").Int()).To(Equal(int64(8080)))
+			})
+
+			It("only sends the updates of watched paths until they're unwatched", func() {
+				Expect(watcher.Watch(f.ctx, "services")).To(Succeed())
+
+				Expect(writer.Set(f.ctx, "users.rolly", []byte(`"admin"`))).To(Succeed())
+				Consistently(watcher.UpdateChan(), 100*time.Millisecond).ShouldNot(Receive())
+
+				Expect(watcher.Unwatch(f.ctx, "services")).To(Succeed())
+
+				Expect(writer.Set(f.ctx, "users.rolly", []byte(`"owner"`))).To(Succeed())
+
+				var update *client.Update
+				Eventually(watcher.UpdateChan()).Should(Receive(&update))
+				Expect(update.Key).To(Equal("users.rolly"))
+			})
+
+			It("still sends every update to connections that don't watch anything", func() {
+				Expect(watcher.Watch(f.ctx, "services")).To(Succeed())
+
+				Expect(writer.Set(f.ctx, "users.rolly", []byte(`"admin"`))).To(Succeed())
+
+				var update *client.Update
+				Eventually(writer.UpdateChan()).Should(Receive(&update))
+				Expect(update.Key).To(Equal("users.rolly"))
+			})
+		})
+	})
+})
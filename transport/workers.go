@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"bytes"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	// DefaultMaxConcurrentRequests is the default for Options.MaxConcurrentRequests
+	DefaultMaxConcurrentRequests = 8
+
+	// DefaultEventLoopWorkers is the default for Options.EventLoopWorkers
+	DefaultEventLoopWorkers = 64
+
+	// workerQueueSize is how many requests can be waiting for each worker before
+	// submitting more blocks
+	workerQueueSize = 16
+)
+
+// keyedWorkers runs functions concurrently on a fixed number of workers. All
+// functions for the same key run on the same worker, so they run one at a time
+// and in the order they were submitted.
+//
+// Workers are started the first time they're needed, so connections that don't
+// make any requests don't cost any goroutines. Submit, Wait, and Stop must all
+// be called from the same goroutine.
+type keyedWorkers struct {
+	queues []chan func()
+
+	// workers tracks the running workers, pending tracks the submitted functions
+	// that haven't finished running yet
+	workers sync.WaitGroup
+	pending sync.WaitGroup
+}
+
+func newKeyedWorkers(size int) *keyedWorkers {
+	if size < 1 {
+		size = DefaultMaxConcurrentRequests
+	}
+
+	return &keyedWorkers{
+		queues: make([]chan func(), size),
+	}
+}
+
+// Submit queues fn to be run on the worker for key. It blocks if that worker
+// already has a full queue.
+func (w *keyedWorkers) Submit(key []byte, fn func()) {
+	i := w.worker(key)
+
+	if w.queues[i] == nil {
+		w.queues[i] = make(chan func(), workerQueueSize)
+		w.workers.Add(1)
+
+		go w.work(w.queues[i])
+	}
+
+	w.pending.Add(1)
+	w.queues[i] <- fn
+}
+
+// Wait blocks until every function that has been submitted has finished.
+func (w *keyedWorkers) Wait() {
+	w.pending.Wait()
+}
+
+// Stop waits for every function that has been submitted to finish, and then
+// stops the workers.
+func (w *keyedWorkers) Stop() {
+	for i, queue := range w.queues {
+		if queue != nil {
+			close(queue)
+			w.queues[i] = nil
+		}
+	}
+
+	w.workers.Wait()
+}
+
+// worker returns the index of the worker that runs functions for key
+func (w *keyedWorkers) worker(key []byte) int {
+	return keyShard(key, len(w.queues))
+}
+
+// keyShard returns which of n shards the requests for key belong to. Keys are
+// sharded by their top level path segment, so that requests for paths that
+// overlap, like `services` and `services.api`, share a shard and run in order.
+func keyShard(key []byte, n int) int {
+	if i := bytes.IndexByte(key, '.'); i >= 0 {
+		key = key[:i]
+	}
+
+	hash := fnv.New32a()
+	hash.Write(key)
+
+	return int(hash.Sum32() % uint32(n))
+}
+
+func (w *keyedWorkers) work(queue <-chan func()) {
+	defer w.workers.Done()
+
+	for fn := range queue {
+		fn()
+		w.pending.Done()
+	}
+}
+
+// workerPool runs functions on a fixed number of goroutines. Unlike
+// keyedWorkers submitting never blocks, functions wait in the pool's queue until
+// a goroutine is free, so it's safe to submit from an event loop. It doesn't
+// order functions, that's up to whoever submits them. It's safe for concurrent
+// use.
+type workerPool struct {
+	mu      sync.Mutex
+	ready   *sync.Cond
+	queue   []func()
+	stopped bool
+
+	workers sync.WaitGroup
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = DefaultEventLoopWorkers
+	}
+
+	p := &workerPool{}
+	p.ready = sync.NewCond(&p.mu)
+
+	p.workers.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+
+	return p
+}
+
+// Submit queues fn to be run on the next free goroutine
+func (p *workerPool) Submit(fn func()) {
+	p.mu.Lock()
+	p.queue = append(p.queue, fn)
+	p.mu.Unlock()
+
+	p.ready.Signal()
+}
+
+// Stop waits for every function that has been submitted to finish, and then
+// stops the pool's goroutines.
+func (p *workerPool) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+
+	p.ready.Broadcast()
+	p.workers.Wait()
+}
+
+func (p *workerPool) work() {
+	defer p.workers.Done()
+
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 && !p.stopped {
+			p.ready.Wait()
+		}
+
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		fn := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		fn()
+	}
+}
@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("keyedWorkers (internal)", func() {
+	It("runs functions for the same key in order", func() {
+		workers := newKeyedWorkers(4)
+		defer workers.Stop()
+
+		var (
+			mu  sync.Mutex
+			ran []int
+		)
+
+		for i := 0; i < 100; i++ {
+			i := i
+
+			workers.Submit([]byte("foo"), func() {
+				mu.Lock()
+				ran = append(ran, i)
+				mu.Unlock()
+			})
+		}
+
+		workers.Wait()
+
+		Expect(ran).To(HaveLen(100))
+		for i, n := range ran {
+			Expect(n).To(Equal(i))
+		}
+	})
+
+	It("runs functions for overlapping paths on the same worker", func() {
+		workers := newKeyedWorkers(64)
+		defer workers.Stop()
+
+		for _, key := range []string{"services.api", "services.api.port", "services.db"} {
+			Expect(workers.worker([]byte(key))).To(Equal(workers.worker([]byte("services"))))
+		}
+	})
+
+	It("runs functions for different keys concurrently", func() {
+		workers := newKeyedWorkers(64)
+		defer workers.Stop()
+
+		// Find a key that isn't on the same worker as "foo"
+		other := []byte("bar")
+		for n := 0; workers.worker(other) == workers.worker([]byte("foo")); n++ {
+			other = []byte{byte(n)}
+		}
+
+		unblock := make(chan struct{})
+		workers.Submit([]byte("foo"), func() {
+			<-unblock
+		})
+
+		ran := make(chan struct{})
+		workers.Submit(other, func() {
+			close(ran)
+		})
+
+		Eventually(ran, time.Second).Should(BeClosed())
+		close(unblock)
+	})
+
+	It("waits for the submitted functions when it's stopped", func() {
+		workers := newKeyedWorkers(4)
+
+		done := false
+		workers.Submit([]byte("foo"), func() {
+			time.Sleep(20 * time.Millisecond)
+			done = true
+		})
+
+		workers.Stop()
+		Expect(done).To(BeTrue())
+	})
+})
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/storage"
+)
+
+// storeWrite is a change that needs writing to the store, key is deleted if
+// value is nil
+type storeWrite struct {
+	key   []byte
+	value interface{}
+}
+
+// storeBatch is a set of writes, done is closed once they've been written
+type storeBatch struct {
+	writes []storeWrite
+	done   chan struct{}
+}
+
+// storeWriter writes changes to a store in the order that they were queued, on
+// a goroutine of its own. Queueing never waits for the store, so it can be done
+// while holding a mutex that orders the changes without a slow store holding up
+// everyone else that needs it. It's safe for concurrent use.
+//
+// The goroutine is started when writes are queued and exits once there are none
+// left, so an idle writer doesn't cost anything.
+type storeWriter struct {
+	store storage.Store
+	log   *zap.Logger
+
+	mu      sync.Mutex
+	pending []storeBatch
+	writing bool
+}
+
+func newStoreWriter(store storage.Store, log *zap.Logger) *storeWriter {
+	return &storeWriter{
+		store: store,
+		log:   log,
+	}
+}
+
+// queue queues writes to be written after everything that's been queued before
+// them. It returns a channel that's closed once they've been written, or have
+// failed to be, errors are logged rather than returned as the change has
+// already been made in memory.
+func (w *storeWriter) queue(writes []storeWrite) <-chan struct{} {
+	done := make(chan struct{})
+
+	if len(writes) == 0 {
+		close(done)
+		return done
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, storeBatch{writes, done})
+
+	if !w.writing {
+		w.writing = true
+		go w.write()
+	}
+
+	return done
+}
+
+// write writes the pending batches until there are none left
+func (w *storeWriter) write() {
+	for {
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.writing = false
+			w.mu.Unlock()
+			return
+		}
+
+		batch := w.pending[0]
+		w.pending[0] = storeBatch{}
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+
+		for _, write := range batch.writes {
+			var err error
+			if write.value == nil {
+				err = w.store.Delete(context.Background(), write.key)
+			} else {
+				err = w.store.Set(context.Background(), write.key, write.value)
+			}
+
+			if err != nil {
+				w.log.Error("Failed to write", zap.ByteString("key", write.key), zap.Error(err))
+			}
+		}
+
+		close(batch.done)
+	}
+}
@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/luma/pharos/storage"
+)
+
+// blockingStore is a store whose Sets wait until unblock is closed
+type blockingStore struct {
+	storage.Store
+	unblock chan struct{}
+}
+
+func (s *blockingStore) Set(ctx context.Context, key []byte, value interface{}) error {
+	<-s.unblock
+	return s.Store.Set(ctx, key, value)
+}
+
+var _ = Describe("storeWriter (internal)", func() {
+	It("writes in the order that writes were queued", func() {
+		store := storage.NewInmemoryStore()
+		defer store.Close()
+
+		writer := newStoreWriter(store, zap.NewNop())
+
+		var written <-chan struct{}
+		for i := 0; i < 100; i++ {
+			written = writer.queue([]storeWrite{{key: []byte("foo"), value: i}})
+		}
+
+		Eventually(written).Should(BeClosed())
+		Expect(store.Get(context.Background(), []byte("foo"))).To(Equal([]byte("99")))
+	})
+
+	It("doesn't wait for the store to queue writes", func() {
+		store := &blockingStore{storage.NewInmemoryStore(), make(chan struct{})}
+		defer store.Close()
+
+		writer := newStoreWriter(store, zap.NewNop())
+
+		first := writer.queue([]storeWrite{{key: []byte("foo"), value: 1}})
+		second := writer.queue([]storeWrite{{key: []byte("foo"), value: 2}})
+
+		Consistently(first).ShouldNot(BeClosed())
+
+		close(store.unblock)
+
+		Eventually(second).Should(BeClosed())
+		Expect(first).To(BeClosed())
+		Expect(store.Get(context.Background(), []byte("foo"))).To(Equal([]byte("2")))
+	})
+})